@@ -0,0 +1,87 @@
+package cluster
+
+import (
+	"godis-learn/config"
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 5 * time.Second
+)
+
+// circuitBreaker 记录发往某个节点的请求连续失败的次数，熔断期间直接拒绝请求，
+// 冷却时间过后只放行一个试探请求，试探成功后恢复正常
+type circuitBreaker struct {
+	mutex     sync.Mutex
+	state     string
+	failures  int
+	threshold int
+	cooldown  time.Duration
+	openedAt  time.Time
+	trips     int64
+}
+
+func newCircuitBreaker() *circuitBreaker {
+	b := &circuitBreaker{
+		state:     breakerClosed,
+		threshold: defaultBreakerThreshold,
+		cooldown:  defaultBreakerCooldown,
+	}
+	if config.Properties.ClusterBreakerThreshold > 0 {
+		b.threshold = config.Properties.ClusterBreakerThreshold
+	}
+	if config.Properties.ClusterBreakerCooldown > 0 {
+		b.cooldown = time.Duration(config.Properties.ClusterBreakerCooldown) * time.Millisecond
+	}
+	return b
+}
+
+// allow 判断当前是否可以发送请求
+func (b *circuitBreaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// 试探请求还没有结果
+		return false
+	}
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.state = breakerClosed
+	b.failures = 0
+}
+
+func (b *circuitBreaker) failure() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerOpen {
+			b.trips++
+		}
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *circuitBreaker) status() (state string, trips int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state, b.trips
+}
@@ -1,29 +1,276 @@
 package cluster
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	pool "github.com/jolestar/go-commons-pool/v2"
 	"godis-learn/config"
+	"godis-learn/interface/redis"
 	"godis-learn/lib/utils"
 	"godis-learn/redis/client"
+	"godis-learn/redis/protocol"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	defaultPoolMaxActive     = 16
+	defaultPoolMaxIdle       = 8
+	defaultPoolBorrowTimeout = time.Second
+	defaultPoolIdleTimeout   = time.Minute
+
+	// validateIdleTime 连接空闲超过这段时间后，借出前才需要用 PING 检查
+	validateIdleTime = time.Second
+
+	// defaultRelayTimeout 是等待普通命令回复的最长时间，migrateSlotsTimeout 是等待迁移槽位的最长时间
+	defaultRelayTimeout = 3 * time.Second
+	migrateSlotsTimeout = 5 * time.Minute
+
+	// sharedConnCount 是每个节点上以流水线方式共享的连接数
+	sharedConnCount = 2
+
+	borrowErrPrefix = "ERR borrow connection failed: "
+)
+
+// peerPool 是发往某个节点的连接，包括流水线共享的连接和供长时间占用连接的命令借出的连接池，
+// 同时记录该节点的熔断状态和统计数据
+type peerPool struct {
+	peer          string
+	sharedMutex   sync.Mutex
+	shared        [sharedConnCount]*client.Client
+	next          uint32
+	pool          *pool.ObjectPool
+	breaker       *circuitBreaker
+	borrowTimeout time.Duration
+	requests      int64
+	failures      int64
+	rejected      int64
+	timeouts      int64
+	inflight      int64
+}
+
+func newPeerPool(peer string) *peerPool {
+	poolConfig := pool.NewDefaultPoolConfig()
+	poolConfig.MaxTotal = defaultPoolMaxActive
+	poolConfig.MaxIdle = defaultPoolMaxIdle
+	if config.Properties.ClusterPoolMaxActive > 0 {
+		poolConfig.MaxTotal = config.Properties.ClusterPoolMaxActive
+	}
+	if config.Properties.ClusterPoolMaxIdle > 0 {
+		poolConfig.MaxIdle = config.Properties.ClusterPoolMaxIdle
+	}
+	idleTimeout := defaultPoolIdleTimeout
+	if config.Properties.ClusterPoolIdleTimeout > 0 {
+		idleTimeout = time.Duration(config.Properties.ClusterPoolIdleTimeout) * time.Millisecond
+	}
+	// 借出前用 PING 检查连接，空闲连接定期检查并在空闲过久后关闭
+	poolConfig.TestOnBorrow = true
+	poolConfig.TestWhileIdle = true
+	poolConfig.MinEvictableIdleTime = idleTimeout
+	poolConfig.TimeBetweenEvictionRuns = idleTimeout / 2
+	poolConfig.NumTestsPerEvictionRun = poolConfig.MaxIdle
+	p := &peerPool{
+		peer:          peer,
+		pool:          pool.NewObjectPool(context.Background(), &connectionFactory{peer: peer}, poolConfig),
+		breaker:       newCircuitBreaker(),
+		borrowTimeout: defaultPoolBorrowTimeout,
+	}
+	if config.Properties.ClusterPoolBorrowTimeout > 0 {
+		p.borrowTimeout = time.Duration(config.Properties.ClusterPoolBorrowTimeout) * time.Millisecond
+	}
+	return p
+}
+
+// send 在指定的数据库上执行命令。普通命令通过共享的连接以流水线方式发送，
+// 可能长时间占用连接的命令借出一个独占的连接，收到回复之后才归还，避免阻塞流水线上的其它请求
+func (p *peerPool) send(dbIndex int, line redis.Line) redis.Reply {
+	atomic.AddInt64(&p.requests, 1)
+	if !p.breaker.allow() {
+		atomic.AddInt64(&p.rejected, 1)
+		return protocol.NewErrorReply([]byte("ERR peer " + p.peer + " is unavailable, circuit breaker is open"))
+	}
+	atomic.AddInt64(&p.inflight, 1)
+	defer atomic.AddInt64(&p.inflight, -1)
+	var reply redis.Reply
+	if exclusiveCommand(line) {
+		reply = p.sendExclusive(dbIndex, line)
+	} else {
+		reply = p.sendShared(dbIndex, line)
+	}
+	if client.IsConnectionError(reply) || isBorrowError(reply) {
+		p.fail()
+	} else {
+		p.breaker.success()
+	}
+	return reply
+}
+
+// sendShared 通过共享的连接发送命令，出错的连接会被关闭并在下次使用时重新建立
+func (p *peerPool) sendShared(dbIndex int, line redis.Line) redis.Reply {
+	var reply redis.Reply
+	// 共享的连接可能已经被对端关闭，此时换一个连接重试一次
+	for i := 0; i < 2; i++ {
+		slot, cli, errReply := p.sharedClient()
+		if errReply != nil {
+			return errReply
+		}
+		reply = cli.SendToDBWithTimeout(dbIndex, line, defaultRelayTimeout)
+		if !client.IsConnectionError(reply) {
+			return reply
+		}
+		p.dropShared(slot, cli)
+		if reply.(redis.ErrorReply).Error() != "client closed" {
+			break
+		}
+	}
+	return reply
+}
+
+// sharedClient 轮流返回一个共享的连接，连接不存在时建立新的连接
+func (p *peerPool) sharedClient() (int, *client.Client, redis.Reply) {
+	slot := int(atomic.AddUint32(&p.next, 1) % sharedConnCount)
+	p.sharedMutex.Lock()
+	defer p.sharedMutex.Unlock()
+	if cli := p.shared[slot]; cli != nil {
+		return slot, cli, nil
+	}
+	cli, err := dialPeer(p.peer)
+	if err != nil {
+		return 0, nil, protocol.NewErrorReply([]byte(borrowErrPrefix + err.Error()))
+	}
+	p.shared[slot] = cli
+	return slot, cli, nil
+}
+
+// dropShared 关闭出错的共享连接，其它协程可能已经替换了这个连接
+func (p *peerPool) dropShared(slot int, cli *client.Client) {
+	p.sharedMutex.Lock()
+	if p.shared[slot] == cli {
+		p.shared[slot] = nil
+	}
+	p.sharedMutex.Unlock()
+	// Close 会等待这个连接上其它请求结束
+	go cli.Close()
+}
+
+// sendExclusive 借出一个连接执行命令，连接在收到回复之后才归还，出错的连接会被销毁
+func (p *peerPool) sendExclusive(dbIndex int, line redis.Line) redis.Reply {
+	timeout := relayTimeout(line)
+	var reply redis.Reply
+	// 空闲的连接可能已经被对端关闭，此时换一个连接重试一次
+	for i := 0; i < 2; i++ {
+		cli, errReply := p.borrow()
+		if errReply != nil {
+			return errReply
+		}
+		reply = cli.SendToDBWithTimeout(dbIndex, line, timeout)
+		if !client.IsConnectionError(reply) {
+			_ = p.pool.ReturnObject(context.Background(), cli)
+			return reply
+		}
+		_ = p.pool.InvalidateObject(context.Background(), cli)
+		if reply.(redis.ErrorReply).Error() != "client closed" {
+			break
+		}
+	}
+	return reply
+}
+
+// exclusiveCommand 判断命令是否可能长时间占用连接：需要等待其它节点完成工作的管理命令，
+// 以及需要等待 key 锁的 TCC prepare
+func exclusiveCommand(line redis.Line) bool {
+	return relayTimeout(line) > defaultRelayTimeout || strings.EqualFold(string(line[0]), "prepare")
+}
+
+func isBorrowError(reply redis.Reply) bool {
+	return protocol.CheckErrorReply(reply) && strings.HasPrefix(reply.(redis.ErrorReply).Error(), borrowErrPrefix)
+}
+
+// relayTimeout 返回等待回复的最长时间，需要等待其它节点完成工作的管理命令期限更长
+func relayTimeout(line redis.Line) time.Duration {
+	switch strings.ToLower(string(line[0])) {
+	case "cluster":
+		if len(line) > 1 && strings.EqualFold(string(line[1]), "migrateslots") {
+			return migrateSlotsTimeout
+		}
+	}
+	return defaultRelayTimeout
+}
+
+// borrow 借出一个连接，调用者需要在收到回复后归还或者销毁
+func (p *peerPool) borrow() (*client.Client, redis.Reply) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.borrowTimeout)
+	defer cancel()
+	obj, err := p.pool.BorrowObject(ctx)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			atomic.AddInt64(&p.timeouts, 1)
+		}
+		return nil, protocol.NewErrorReply([]byte(borrowErrPrefix + err.Error()))
+	}
+	return obj.(*client.Client), nil
+}
+
+func (p *peerPool) fail() {
+	atomic.AddInt64(&p.failures, 1)
+	p.breaker.failure()
+}
+
+func (p *peerPool) close() {
+	p.sharedMutex.Lock()
+	for i, cli := range p.shared {
+		if cli != nil {
+			cli.Close()
+			p.shared[i] = nil
+		}
+	}
+	p.sharedMutex.Unlock()
+	p.pool.Close(context.Background())
+}
+
+// sharedCount 返回已经建立的共享连接数
+func (p *peerPool) sharedCount() int {
+	p.sharedMutex.Lock()
+	defer p.sharedMutex.Unlock()
+	n := 0
+	for _, cli := range p.shared {
+		if cli != nil {
+			n++
+		}
+	}
+	return n
+}
+
 type connectionFactory struct {
 	peer string
 }
 
 func (f *connectionFactory) MakeObject(_ context.Context) (*pool.PooledObject, error) {
-	cli, err := client.NewClient(f.peer)
+	cli, err := dialPeer(f.peer)
+	if err != nil {
+		return nil, err
+	}
+	return pool.NewPooledObject(cli), nil
+}
+
+// dialPeer 建立到节点的连接，配置了密码时先进行认证
+func dialPeer(peer string) (*client.Client, error) {
+	cli, err := client.NewClient(peer)
 	if err != nil {
 		return nil, err
 	}
 	cli.Start()
 	password := config.Properties.RequirePass
 	if password != "" {
-		cli.Send(utils.StringsToLine("AUTH", password))
+		if reply := cli.Send(utils.StringsToLine("AUTH", password)); protocol.CheckErrorReply(reply) {
+			cli.Close()
+			return nil, errors.New(reply.(redis.ErrorReply).Error())
+		}
 	}
-	return pool.NewPooledObject(cli), nil
+	return cli, nil
 }
 
 func (f *connectionFactory) DestroyObject(_ context.Context, obj *pool.PooledObject) error {
@@ -35,8 +282,17 @@ func (f *connectionFactory) DestroyObject(_ context.Context, obj *pool.PooledObj
 	return nil
 }
 
-func (f *connectionFactory) ValidateObject(_ context.Context, _ *pool.PooledObject) bool {
-	return true
+func (f *connectionFactory) ValidateObject(_ context.Context, obj *pool.PooledObject) bool {
+	cli, ok := obj.Object.(*client.Client)
+	if !ok {
+		return false
+	}
+	// 刚刚使用过的连接不需要再次检查
+	if obj.GetIdleTime() < validateIdleTime {
+		return true
+	}
+	reply := cli.Send(utils.StringsToLine("PING"))
+	return bytes.Equal(reply.GetBytes(), protocol.PongReply().GetBytes())
 }
 
 func (f *connectionFactory) ActivateObject(_ context.Context, _ *pool.PooledObject) error {
@@ -1,9 +1,7 @@
 package cluster
 
 import (
-	"context"
 	"fmt"
-	"github.com/jolestar/go-commons-pool/v2"
 	"godis-learn/config"
 	"godis-learn/database"
 	"godis-learn/datastruct/dict"
@@ -14,6 +12,8 @@ import (
 	"godis-learn/lib/snow"
 	"godis-learn/redis/protocol"
 	"runtime/debug"
+	"sync"
+	"time"
 )
 
 type PeerPicker interface {
@@ -24,35 +24,59 @@ type PeerPicker interface {
 type CommandFunc func(cluster *Cluster, conn redis.Connection, line redis.Line) redis.Reply
 
 type Cluster struct {
-	self        string
-	nodes       []string
-	picker      PeerPicker
-	connPoolMap map[string]*pool.ObjectPool
-	db          dbinterface.EmbedDB
-	txMap       dict.HashMap
-	idGenerator *snow.IDGenerator
+	self         string
+	nodes        []string
+	picker       PeerPicker
+	slots        *slotStates
+	redirectMode bool
+	rebalance    *rebalancer
+	bus          *clusterBus
+	poolMutex    sync.RWMutex
+	connPoolMap  map[string]*peerPool
+	db           dbinterface.EmbedDB
+	txMap        dict.HashMap
+	// coordinators 保存本节点发起的事务，供参与者查询事务的结果
+	coordinators dict.HashMap
+	idGenerator  *snow.IDGenerator
+	// writeMutex 保护 pausedUntil，写命令执行期间持有读锁，手动故障转移时 master 在 pausedUntil 之前暂停写命令
+	writeMutex  sync.RWMutex
+	pausedUntil time.Time
 	relayFunc   func(cluster *Cluster, node string, conn redis.Connection, line redis.Line) redis.Reply
 }
 
 const (
 	replicaCount = 4
+	txMapSize    = 1 << 6
 	allowFastTx  = true
 )
 
 var (
-	router = newRouter()
+	router map[string]CommandFunc
 )
 
+func init() {
+	router = newRouter()
+}
+
 func NewCluster() *Cluster {
+	cluster := newCluster()
+	cluster.StartBus()
+	return cluster
+}
+
+func newCluster() *Cluster {
 	self := config.Properties.Self
 	cluster := &Cluster{
-		self:        self,
-		picker:      consistenthash.NewPicker(replicaCount, nil),
-		connPoolMap: make(map[string]*pool.ObjectPool),
-		db:          database.NewStandaloneServer(),
-		txMap:       dict.NewSimpleHashMap(),
-		idGenerator: snow.NewIDGenerator(self),
-		relayFunc:   defaultRelayFunc,
+		self:         self,
+		picker:       newPeerPicker(),
+		slots:        newSlotStates(),
+		rebalance:    &rebalancer{state: rebalanceIdle},
+		connPoolMap:  make(map[string]*peerPool),
+		db:           database.NewStandaloneServer(),
+		txMap:        dict.NewConcurrentHashMap(txMapSize),
+		coordinators: dict.NewConcurrentHashMap(txMapSize),
+		idGenerator:  snow.NewIDGenerator(self),
+		relayFunc:    defaultRelayFunc,
 	}
 	contains := make(map[string]struct{})
 	peers := config.Properties.Peers
@@ -65,15 +89,28 @@ func NewCluster() *Cluster {
 	}
 	nodes = append(nodes, self)
 	cluster.picker.AddNodes(nodes...)
-	ctx := context.Background()
 	for _, peer := range peers {
-		cluster.connPoolMap[peer] = pool.NewObjectPoolWithDefaultConfig(ctx, &connectionFactory{
-			peer: peer,
-		})
+		cluster.addPeer(peer)
 	}
 	cluster.nodes = nodes
+	cluster.bus = newClusterBus(self, peers)
+	if config.Properties.ClusterRedirect {
+		if _, ok := cluster.picker.(*consistenthash.SlotPicker); ok {
+			cluster.redirectMode = true
+		} else {
+			logger.Warn("cluster-redirect requires hash slots, falling back to relaying")
+		}
+	}
 	return cluster
 }
+
+func newPeerPicker() PeerPicker {
+	if config.Properties.ClusterPicker == "consistent" {
+		return consistenthash.NewPicker(replicaCount, nil)
+	}
+	return consistenthash.NewSlotPicker()
+}
+
 func (c *Cluster) Execute(conn redis.Connection, line redis.Line) redis.Reply {
 	var res redis.Reply
 	defer func() {
@@ -88,6 +125,11 @@ func (c *Cluster) Execute(conn redis.Connection, line redis.Line) redis.Reply {
 		return database.Auth(conn, line.CommandContent())
 	} else if config.Properties.RequirePass != "" && conn.GetPassword() != config.Properties.RequirePass {
 		return protocol.NewErrorReply([]byte("NOAUTH Authentication required"))
+	} else if errReply := database.CheckSubscriberMode(conn, cmdName); errReply != nil {
+		return errReply
+	} else if cmdName == "reset" {
+		conn.SetAsking(false)
+		return c.db.Execute(conn, line)
 	} else if cmdName == "multi" {
 		if len(line) != 1 {
 			return argumentCountErrorReply
@@ -109,7 +151,21 @@ func (c *Cluster) Execute(conn redis.Connection, line redis.Line) redis.Reply {
 		}
 		return execSelect(conn, line)
 	}
-	if conn != nil && conn.CheckMultiMode() {
+	if database.IsWriteCommand(cmdName) {
+		c.waitWritesResumed()
+		defer c.writeMutex.RUnlock()
+	}
+	inMulti := conn != nil && conn.CheckMultiMode()
+	if cmdName != "asking" && (c.redirectMode || !inMulti) {
+		reply, local := c.route(conn, line)
+		if reply != nil {
+			return reply
+		}
+		if local && !inMulti {
+			return c.db.Execute(conn, line)
+		}
+	}
+	if inMulti {
 		return database.ConnectionEnqueue(conn, line)
 	}
 	commandFunc, ok := router[cmdName]
@@ -125,6 +181,7 @@ func (c *Cluster) AfterClientClose(conn redis.Connection) {
 }
 
 func (c *Cluster) Close() {
+	c.stopBus()
 	c.db.Close()
 }
 
@@ -0,0 +1,937 @@
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"godis-learn/config"
+	"godis-learn/interface/redis"
+	"godis-learn/lib/consistenthash"
+	"godis-learn/lib/utils"
+	"godis-learn/redis/connection"
+	"godis-learn/redis/parse"
+	"godis-learn/redis/protocol"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testNetwork 在进程内连接多个节点，down 中的节点既收不到也发不出消息
+type testNetwork struct {
+	mutex sync.RWMutex
+	nodes map[string]*Cluster
+	down  map[string]bool
+	// conns 是 serve 为各个节点接受的 TCP 连接
+	conns map[string][]net.Conn
+}
+
+func (n *testNetwork) relay(cluster *Cluster, node string, conn redis.Connection, line redis.Line) redis.Reply {
+	if node == cluster.self {
+		return cluster.db.Execute(conn, line)
+	}
+	n.mutex.RLock()
+	peer, ok := n.nodes[node]
+	down := n.down[node] || n.down[cluster.self]
+	n.mutex.RUnlock()
+	if !ok || down {
+		return protocol.NewErrorReply([]byte("ERR connection refused"))
+	}
+	relayConn := connection.NewClientConn(nil)
+	relayConn.SelectDB(conn.GetDBIndex())
+	return peer.Execute(relayConn, line)
+}
+
+func (n *testNetwork) addNode(self string, peers ...string) *Cluster {
+	defer func() {
+		config.Properties.Self = ""
+		config.Properties.Peers = nil
+	}()
+	config.Properties.Self = self
+	config.Properties.Peers = peers
+	node := newCluster()
+	node.relayFunc = n.relay
+	n.mutex.Lock()
+	n.nodes[self] = node
+	n.mutex.Unlock()
+	return node
+}
+
+func (n *testNetwork) setDown(node string, down bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.down[node] = down
+	if down {
+		for _, conn := range n.conns[node] {
+			_ = conn.Close()
+		}
+		delete(n.conns, node)
+	}
+}
+
+// serve 在节点的地址上接受 TCP 连接，副本通过 TCP 连接 master 进行复制，节点 down 时不接受连接
+func (n *testNetwork) serve(t *testing.T, node *Cluster) {
+	listener, err := net.Listen("tcp", node.self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		for _, conn := range n.conns[node.self] {
+			_ = conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			n.mutex.Lock()
+			if n.down[node.self] {
+				n.mutex.Unlock()
+				_ = conn.Close()
+				continue
+			}
+			n.conns[node.self] = append(n.conns[node.self], conn)
+			n.mutex.Unlock()
+			go func(conn net.Conn) {
+				client := connection.NewClientConn(conn)
+				for payload := range parse.StartParseStream(conn) {
+					if payload.Err != nil {
+						break
+					}
+					args, _ := protocol.FetchArrayArgs(payload.Data)
+					if err := client.Write(node.Execute(client, args).GetBytes()); err != nil {
+						break
+					}
+				}
+				node.AfterClientClose(client)
+				_ = client.Close()
+			}(conn)
+		}
+	}()
+}
+
+// makeTestNetwork 创建三个节点，测试结束时关闭全部节点，释放数据库的后台任务
+func makeTestNetwork(t *testing.T) *testNetwork {
+	n := &testNetwork{
+		nodes: make(map[string]*Cluster),
+		down:  make(map[string]bool),
+		conns: make(map[string][]net.Conn),
+	}
+	t.Cleanup(func() {
+		n.mutex.RLock()
+		defer n.mutex.RUnlock()
+		for _, node := range n.nodes {
+			node.Close()
+		}
+	})
+	addrs := []string{"127.0.0.1:16399", "127.0.0.1:16400", "127.0.0.1:16401"}
+	for i, addr := range addrs {
+		peers := make([]string, 0, len(addrs)-1)
+		for j, peer := range addrs {
+			if i != j {
+				peers = append(peers, peer)
+			}
+		}
+		n.addNode(addr, peers...)
+	}
+	return n
+}
+
+func makeTestCluster(t *testing.T) *Cluster {
+	return makeTestNetwork(t).nodes["127.0.0.1:16399"]
+}
+
+func TestMSetMGet(t *testing.T) {
+	cluster := makeTestCluster(t)
+	conn := connection.NewClientConn(nil)
+	line := utils.StringsToLine("MSET")
+	keys := make([]string, 0, 20)
+	for i := 0; i < 20; i++ {
+		key := "key" + strconv.Itoa(i)
+		keys = append(keys, key)
+		line = append(line, []byte(key), []byte(strconv.Itoa(i)))
+	}
+	if len(groupBy(cluster, keys)) < 2 {
+		t.Fatal("keys are expected to span several nodes")
+	}
+	if reply := cluster.Execute(conn, line); !protocol.CheckOKReply(reply) {
+		t.Fatalf("mset failed: %s", reply.GetBytes())
+	}
+	mget := utils.StringsWithNameToLine("MGET", utils.StringsToLine(append(keys, "missing")...))
+	replies, ok := protocol.FetchReplies(cluster.Execute(conn, mget))
+	if !ok || len(replies) != len(keys)+1 {
+		t.Fatal("unexpected mget reply")
+	}
+	for i := range keys {
+		if value, _ := protocol.FetchBulkString(replies[i]); string(value) != strconv.Itoa(i) {
+			t.Errorf("expected %d, got %s", i, replies[i].GetBytes())
+		}
+	}
+	if string(replies[len(keys)].GetBytes()) != "$-1\r\n" {
+		t.Errorf("expected null bulk string, got %s", replies[len(keys)].GetBytes())
+	}
+	exists := utils.StringsWithNameToLine("EXISTS", utils.StringsToLine(append(keys, "missing")...))
+	if code, _ := protocol.FetchCode(cluster.Execute(conn, exists)); code != int64(len(keys)) {
+		t.Errorf("expected %d existing keys, got %d", len(keys), code)
+	}
+	del := utils.StringsWithNameToLine("DEL", utils.StringsToLine(keys[:10]...))
+	if code, _ := protocol.FetchCode(cluster.Execute(conn, del)); code != 10 {
+		t.Errorf("expected 10 deleted keys, got %d", code)
+	}
+}
+
+func TestRenameAcrossNodes(t *testing.T) {
+	cluster := makeTestCluster(t)
+	conn := connection.NewClientConn(nil)
+	src, dst := "src", ""
+	for i := 0; dst == ""; i++ {
+		key := "dst" + strconv.Itoa(i)
+		if cluster.picker.PickNode(key) != cluster.picker.PickNode(src) {
+			dst = key
+		}
+	}
+	cluster.Execute(conn, utils.StringsToLine("SET", src, "value", "EX", "100"))
+	if reply := cluster.Execute(conn, utils.StringsToLine("RENAME", src, dst)); !protocol.CheckOKReply(reply) {
+		t.Fatalf("rename failed: %s", reply.GetBytes())
+	}
+	if value, _ := protocol.FetchBulkString(cluster.Execute(conn, utils.StringsToLine("GET", dst))); string(value) != "value" {
+		t.Errorf("expected value, got %s", value)
+	}
+	if code, _ := protocol.FetchCode(cluster.Execute(conn, utils.StringsToLine("TTL", dst))); code <= 0 {
+		t.Errorf("expected ttl to be kept, got %d", code)
+	}
+	if code, _ := protocol.FetchCode(cluster.Execute(conn, utils.StringsToLine("EXISTS", src))); code != 0 {
+		t.Error("expected source key to be removed")
+	}
+	cluster.Execute(conn, utils.StringsToLine("SET", src, "another"))
+	if code, _ := protocol.FetchCode(cluster.Execute(conn, utils.StringsToLine("RENAMENX", src, dst))); code != 0 {
+		t.Error("expected renamenx to refuse existing key")
+	}
+	if value, _ := protocol.FetchBulkString(cluster.Execute(conn, utils.StringsToLine("GET", src))); string(value) != "another" {
+		t.Errorf("expected source key to be rolled back, got %s", value)
+	}
+}
+
+func TestMultiAcrossNodes(t *testing.T) {
+	cluster := makeTestCluster(t)
+	conn := connection.NewClientConn(nil)
+	cluster.Execute(conn, utils.StringsToLine("MULTI"))
+	keys := make([]string, 10)
+	for i := range keys {
+		keys[i] = "tx" + strconv.Itoa(i)
+		cluster.Execute(conn, utils.StringsToLine("SET", keys[i], strconv.Itoa(i)))
+	}
+	cluster.Execute(conn, utils.StringsToLine("GET", keys[0]))
+	replies, ok := protocol.FetchReplies(cluster.Execute(conn, utils.StringsToLine("EXEC")))
+	if !ok || len(replies) != len(keys)+1 {
+		t.Fatal("unexpected exec reply")
+	}
+	if value, _ := protocol.FetchBulkString(replies[len(keys)]); string(value) != "0" {
+		t.Errorf("expected 0, got %s", replies[len(keys)].GetBytes())
+	}
+	mget := utils.StringsWithNameToLine("MGET", utils.StringsToLine(keys...))
+	values, _ := protocol.FetchReplies(cluster.Execute(conn, mget))
+	for i, value := range values {
+		if bs, _ := protocol.FetchBulkString(value); string(bs) != strconv.Itoa(i) {
+			t.Errorf("expected %d, got %s", i, value.GetBytes())
+		}
+	}
+}
+
+func TestMultiRuntimeErrorAcrossNodes(t *testing.T) {
+	cluster := makeTestCluster(t)
+	conn := connection.NewClientConn(nil)
+	cluster.Execute(conn, utils.StringsToLine("MULTI"))
+	keys := make([]string, 10)
+	for i := range keys {
+		keys[i] = "tx" + strconv.Itoa(i)
+		cluster.Execute(conn, utils.StringsToLine("SET", keys[i], strconv.Itoa(i)))
+	}
+	cluster.Execute(conn, utils.StringsToLine("EXPIRE", keys[0], "abc"))
+	replies, ok := protocol.FetchReplies(cluster.Execute(conn, utils.StringsToLine("EXEC")))
+	if !ok || len(replies) != len(keys)+1 {
+		t.Fatal("unexpected exec reply")
+	}
+	if !protocol.CheckErrorReply(replies[len(keys)]) {
+		t.Errorf("expected error for expire, got %s", replies[len(keys)].GetBytes())
+	}
+	// 与 EXEC 一致，运行时错误不影响其它命令
+	for i, key := range keys {
+		if value, _ := protocol.FetchBulkString(cluster.Execute(conn, utils.StringsToLine("GET", key))); string(value) != strconv.Itoa(i) {
+			t.Errorf("expected %d, got %s", i, value)
+		}
+	}
+}
+
+func TestCommitParticipantFailure(t *testing.T) {
+	network := makeTestNetwork(t)
+	cluster := network.nodes["127.0.0.1:16399"]
+	peer := network.nodes["127.0.0.1:16400"]
+	conn := connection.NewClientConn(nil)
+	co := newCoordinator(cluster, conn)
+	errReply := co.prepareAll(map[string]redis.Line{
+		cluster.self: utils.StringsToLine("SET", "a", "1"),
+		peer.self:    utils.StringsToLine("SET", "b", "2"),
+	})
+	if errReply != nil {
+		t.Fatalf("prepare failed: %s", errReply.GetBytes())
+	}
+	network.setDown(peer.self, true)
+	if _, errReply := co.commit(); errReply == nil {
+		t.Fatal("expected commit to fail")
+	}
+	network.setDown(peer.self, false)
+	// 提交失败时已经提交的参与者也要回滚
+	if reply := cluster.db.Execute(conn, utils.StringsToLine("GET", "a")); !bytes.Equal(reply.GetBytes(), protocol.NullBulkStringReply().GetBytes()) {
+		t.Errorf("expected committed participant to be rolled back, got %s", reply.GetBytes())
+	}
+
+	// 没有收到 commit 和 rollback 的参与者超时之后向协调者查询，得知事务已经放弃后回滚并释放锁
+	raw, ok := peer.txMap.Get(co.txID)
+	if !ok {
+		t.Fatal("expected transaction on peer")
+	}
+	tx := raw.(*Transaction)
+	start := time.Now()
+	waitFor(t, "transaction rollback", func() bool {
+		tx.mutex.Lock()
+		defer tx.mutex.Unlock()
+		return tx.status == rolledBackStatus && !tx.keysLocked
+	})
+	if elapsed := time.Since(start); elapsed < maxLockTime-time.Second {
+		t.Errorf("expected rollback after about %s, got %s", maxLockTime, elapsed)
+	}
+	if reply := peer.db.Execute(conn, utils.StringsToLine("SET", "b", "3")); !protocol.CheckOKReply(reply) {
+		t.Errorf("expected keys to be unlocked, got %s", reply.GetBytes())
+	}
+}
+
+func TestCommitAfterParticipantTimeout(t *testing.T) {
+	network := makeTestNetwork(t)
+	cluster := network.nodes["127.0.0.1:16399"]
+	peer := network.nodes["127.0.0.1:16400"]
+	// commit 在参与者超时之后才到达
+	cluster.relayFunc = func(c *Cluster, node string, conn redis.Connection, line redis.Line) redis.Reply {
+		if strings.EqualFold(string(line.CommandName()), "commit") {
+			time.Sleep(maxLockTime + time.Second)
+		}
+		return network.relay(c, node, conn, line)
+	}
+	conn := connection.NewClientConn(nil)
+	co := newCoordinator(cluster, conn)
+	errReply := co.prepareAll(map[string]redis.Line{
+		cluster.self: utils.StringsToLine("SET", "a", "1"),
+		peer.self:    utils.StringsToLine("SET", "b", "2"),
+	})
+	if errReply != nil {
+		t.Fatalf("prepare failed: %s", errReply.GetBytes())
+	}
+	if _, errReply := co.commit(); errReply != nil {
+		t.Fatalf("expected commit to succeed, got %s", errReply.GetBytes())
+	}
+	if value, _ := protocol.FetchBulkString(cluster.db.Execute(conn, utils.StringsToLine("GET", "a"))); string(value) != "1" {
+		t.Errorf("expected 1, got %s", value)
+	}
+	if value, _ := protocol.FetchBulkString(peer.db.Execute(conn, utils.StringsToLine("GET", "b"))); string(value) != "2" {
+		t.Errorf("expected 2, got %s", value)
+	}
+	raw, _ := peer.txMap.Get(co.txID)
+	tx := raw.(*Transaction)
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	if tx.status != releasedStatus || tx.keysLocked {
+		t.Errorf("expected transaction to be released, got status %d", tx.status)
+	}
+}
+
+func TestClusterSlots(t *testing.T) {
+	cluster := makeTestCluster(t)
+	conn := connection.NewClientConn(nil)
+	if code, _ := protocol.FetchCode(cluster.Execute(conn, utils.StringsToLine("CLUSTER", "KEYSLOT", "foo"))); code != 12182 {
+		t.Errorf("expected slot 12182, got %d", code)
+	}
+	replies, _ := protocol.FetchReplies(cluster.Execute(conn, utils.StringsToLine("CLUSTER", "SLOTS")))
+	if len(replies) != 3 {
+		t.Errorf("expected 3 slot ranges, got %d", len(replies))
+	}
+	nodes, _ := protocol.FetchBulkString(cluster.Execute(conn, utils.StringsToLine("CLUSTER", "NODES")))
+	if lines := strings.Split(strings.TrimSpace(string(nodes)), "\n"); len(lines) != 3 {
+		t.Errorf("expected 3 nodes, got %s", nodes)
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	cluster := makeTestCluster(t)
+	cluster.redirectMode = true
+	conn := connection.NewClientConn(nil)
+	picker := cluster.picker.(*consistenthash.SlotPicker)
+	var local, foreign string
+	for i := 0; local == "" || foreign == ""; i++ {
+		key := "key" + strconv.Itoa(i)
+		if picker.PickNode(key) == cluster.self {
+			local = key
+		} else {
+			foreign = key
+		}
+	}
+	slot := consistenthash.KeySlot(foreign)
+	expected := fmt.Sprintf("-MOVED %d %s\r\n", slot, picker.NodeOfSlot(slot))
+	if reply := cluster.Execute(conn, utils.StringsToLine("GET", foreign)); string(reply.GetBytes()) != expected {
+		t.Errorf("expected %s, got %s", expected, reply.GetBytes())
+	}
+	if reply := cluster.Execute(conn, utils.StringsToLine("MGET", local, foreign)); !strings.HasPrefix(string(reply.GetBytes()), "-CROSSSLOT") {
+		t.Errorf("expected CROSSSLOT, got %s", reply.GetBytes())
+	}
+	slot = consistenthash.KeySlot(local)
+	target := picker.NodeOfSlot(consistenthash.KeySlot(foreign))
+	cluster.Execute(conn, utils.StringsToLine("CLUSTER", "SETSLOT", strconv.Itoa(slot), "MIGRATING", nodeID(target)))
+	expected = fmt.Sprintf("-ASK %d %s\r\n", slot, target)
+	if reply := cluster.Execute(conn, utils.StringsToLine("GET", local)); string(reply.GetBytes()) != expected {
+		t.Errorf("expected %s, got %s", expected, reply.GetBytes())
+	}
+	cluster.Execute(conn, utils.StringsToLine("CLUSTER", "SETSLOT", strconv.Itoa(slot), "STABLE"))
+	if reply := cluster.Execute(conn, utils.StringsToLine("GET", local)); string(reply.GetBytes()) != "$-1\r\n" {
+		t.Errorf("expected null bulk string, got %s", reply.GetBytes())
+	}
+}
+
+func TestRebalanceDrain(t *testing.T) {
+	cluster := makeTestCluster(t)
+	conn := connection.NewClientConn(nil)
+	drained := "127.0.0.1:16401"
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		cluster.Execute(conn, utils.StringsToLine("SET", key, strconv.Itoa(i)))
+	}
+	cluster.Execute(conn, utils.StringsToLine("EXPIRE", "key0", "100"))
+	reply := cluster.Execute(conn, utils.StringsToLine("CLUSTER", "REBALANCE", "START", "DRAIN", drained))
+	if code, ok := protocol.FetchCode(reply); !ok || code == 0 {
+		t.Fatalf("rebalance failed to start: %s", reply.GetBytes())
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		replies, _ := protocol.FetchReplies(cluster.Execute(conn, utils.StringsToLine("CLUSTER", "REBALANCE", "STATUS")))
+		state, _ := protocol.FetchBulkString(replies[1])
+		if string(state) == rebalanceDone {
+			break
+		} else if string(state) != rebalanceRunning || time.Now().After(deadline) {
+			lastError, _ := protocol.FetchBulkString(replies[11])
+			t.Fatalf("rebalance ended with state %s: %s", state, lastError)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if counts := cluster.picker.(*consistenthash.SlotPicker).SlotCounts(); counts[drained] != 0 {
+		t.Fatalf("expected %s to be drained, %d slots left", drained, counts[drained])
+	}
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		value, _ := protocol.FetchBulkString(cluster.Execute(conn, utils.StringsToLine("GET", key)))
+		if string(value) != strconv.Itoa(i) {
+			t.Fatalf("expected %d, got %s", i, value)
+		}
+	}
+	if ttl, _ := protocol.FetchCode(cluster.Execute(conn, utils.StringsToLine("TTL", "key0"))); ttl <= 0 {
+		t.Errorf("expected ttl to survive migration, got %d", ttl)
+	}
+	if reply := cluster.Execute(conn, utils.StringsToLine("CLUSTER", "DELNODE", drained)); !protocol.CheckOKReply(reply) {
+		t.Fatalf("delnode failed: %s", reply.GetBytes())
+	}
+	if nodes := cluster.picker.(*consistenthash.SlotPicker).Nodes(); len(nodes) != 2 {
+		t.Errorf("expected 2 nodes, got %v", nodes)
+	}
+}
+
+func TestMigrateKeyModifiedDuringRelay(t *testing.T) {
+	network := makeTestNetwork(t)
+	source := network.nodes["127.0.0.1:16399"]
+	target := network.nodes["127.0.0.1:16400"]
+	conn := connection.NewClientConn(nil)
+	key := ""
+	for i := 0; key == ""; i++ {
+		if candidate := "key" + strconv.Itoa(i); source.picker.PickNode(candidate) == source.self {
+			key = candidate
+		}
+	}
+	slot := strconv.Itoa(consistenthash.KeySlot(key))
+	source.Execute(conn, utils.StringsToLine("SET", key, "old"))
+	target.Execute(conn, utils.StringsToLine("CLUSTER", "SETSLOT", slot, "IMPORTING", nodeID(source.self)))
+	source.Execute(conn, utils.StringsToLine("CLUSTER", "SETSLOT", slot, "MIGRATING", nodeID(target.self)))
+	restores := 0
+	source.relayFunc = func(cluster *Cluster, node string, c redis.Connection, line redis.Line) redis.Reply {
+		if len(line) > 1 && strings.EqualFold(string(line[1]), "restore") {
+			restores++
+			client := connection.NewClientConn(nil)
+			if restores == 1 {
+				// 发送 RESTORE 期间删除并重新写入 key，客户端不应该被转向目标节点
+				source.Execute(client, utils.StringsToLine("DEL", key))
+				if reply := source.Execute(client, utils.StringsToLine("SET", key, "new")); !protocol.CheckOKReply(reply) {
+					t.Errorf("write during migration failed: %s", reply.GetBytes())
+				}
+			} else {
+				// 重新发送 RESTORE 时不应该持有 key 的锁
+				done := make(chan struct{})
+				go func() {
+					source.Execute(client, utils.StringsToLine("GET", key))
+					close(done)
+				}()
+				select {
+				case <-done:
+				case <-time.After(time.Second):
+					t.Error("key is locked while RESTORE is relayed again")
+				}
+			}
+		}
+		return network.relay(cluster, node, c, line)
+	}
+	reply := source.Execute(conn, utils.StringsToLine("CLUSTER", "MIGRATESLOTS", nodeID(target.self), slot))
+	if code, _ := protocol.FetchCode(reply); code != 1 {
+		t.Fatalf("expected 1 key to be migrated, got %s", reply.GetBytes())
+	}
+	if restores != 2 {
+		t.Errorf("expected RESTORE to be relayed twice, got %d", restores)
+	}
+	if value, _ := protocol.FetchBulkString(target.db.Execute(conn, utils.StringsToLine("GET", key))); string(value) != "new" {
+		t.Errorf("expected the value written during migration, got %q", value)
+	}
+	if n, _ := protocol.FetchCode(source.db.Execute(conn, utils.StringsToLine("EXISTS", key))); n != 0 {
+		t.Error("expected key to be removed from the source")
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// executeWhenUp 执行命令，cluster_state 为 fail 时重试。节点超时很短，拓扑变化之后集群状态可能短暂地变为 fail
+func executeWhenUp(t *testing.T, cluster *Cluster, args ...string) redis.Reply {
+	var reply redis.Reply
+	waitFor(t, "cluster to be up", func() bool {
+		reply = cluster.Execute(connection.NewClientConn(nil), utils.StringsToLine(args...))
+		return !strings.HasPrefix(string(reply.GetBytes()), "-CLUSTERDOWN")
+	})
+	return reply
+}
+
+func clusterInfoField(cluster *Cluster, field string) string {
+	info, _ := protocol.FetchBulkString(cluster.Execute(connection.NewClientConn(nil), utils.StringsToLine("CLUSTER", "INFO")))
+	for _, line := range strings.Split(string(info), "\r\n") {
+		if strings.HasPrefix(line, field+":") {
+			return strings.TrimPrefix(line, field+":")
+		}
+	}
+	return ""
+}
+
+func TestGossipFailureDetection(t *testing.T) {
+	config.Properties.ClusterNodeTimeout = 200
+	defer func() {
+		config.Properties.ClusterNodeTimeout = 0
+	}()
+	network := makeTestNetwork(t)
+	for _, node := range network.nodes {
+		node.StartBus()
+		defer node.stopBus()
+	}
+	self := network.nodes["127.0.0.1:16399"]
+	failed := "127.0.0.1:16401"
+	network.setDown(failed, true)
+	waitFor(t, "node to be marked as failed", func() bool {
+		return clusterInfoField(self, "cluster_state") == clusterStateFail
+	})
+	nodes, _ := protocol.FetchBulkString(self.Execute(connection.NewClientConn(nil), utils.StringsToLine("CLUSTER", "NODES")))
+	if !strings.Contains(string(nodes), "master,fail") {
+		t.Errorf("expected failed node in cluster nodes, got %s", nodes)
+	}
+	reply := self.Execute(connection.NewClientConn(nil), utils.StringsToLine("GET", "foo"))
+	if !strings.HasPrefix(string(reply.GetBytes()), "-CLUSTERDOWN") {
+		t.Errorf("expected CLUSTERDOWN, got %s", reply.GetBytes())
+	}
+	network.setDown(failed, false)
+	waitFor(t, "cluster to recover", func() bool {
+		return clusterInfoField(self, "cluster_state") == clusterStateOK
+	})
+}
+
+func TestClusterMeetAndForget(t *testing.T) {
+	config.Properties.ClusterNodeTimeout = 200
+	defer func() {
+		config.Properties.ClusterNodeTimeout = 0
+	}()
+	network := makeTestNetwork(t)
+	joined := network.addNode("127.0.0.1:16402")
+	for _, node := range network.nodes {
+		node.StartBus()
+		defer node.stopBus()
+	}
+	self := network.nodes["127.0.0.1:16399"]
+	conn := connection.NewClientConn(nil)
+	if reply := self.Execute(conn, utils.StringsToLine("CLUSTER", "MEET", "127.0.0.1", "16402")); !protocol.CheckOKReply(reply) {
+		t.Fatalf("meet failed: %s", reply.GetBytes())
+	}
+	waitFor(t, "topology to converge", func() bool {
+		for _, node := range network.nodes {
+			if clusterInfoField(node, "cluster_known_nodes") != "4" {
+				return false
+			}
+		}
+		return true
+	})
+	if counts := joined.picker.(*consistenthash.SlotPicker).SlotCounts(); counts[joined.self] != 0 {
+		t.Errorf("expected joined node to own no slots, got %d", counts[joined.self])
+	}
+	if owner := joined.picker.PickNode("foo"); owner != self.picker.PickNode("foo") {
+		t.Errorf("expected joined node to learn slot owners, got %s", owner)
+	}
+	if reply := self.Execute(conn, utils.StringsToLine("CLUSTER", "FORGET", nodeID(joined.self))); !protocol.CheckOKReply(reply) {
+		t.Fatalf("forget failed: %s", reply.GetBytes())
+	}
+	network.setDown(joined.self, true)
+	waitFor(t, "node to be forgotten", func() bool {
+		for addr, node := range network.nodes {
+			if addr != joined.self && clusterInfoField(node, "cluster_known_nodes") != "3" {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestFailover(t *testing.T) {
+	config.Properties.ClusterNodeTimeout = 200
+	defer func() {
+		config.Properties.ClusterNodeTimeout = 0
+	}()
+	network := makeTestNetwork(t)
+	replica := network.addNode("127.0.0.1:16402")
+	for _, node := range network.nodes {
+		network.serve(t, node)
+		node.StartBus()
+		defer node.stopBus()
+	}
+	self := network.nodes["127.0.0.1:16399"]
+	primary := network.nodes["127.0.0.1:16401"]
+	conn := connection.NewClientConn(nil)
+	self.Execute(conn, utils.StringsToLine("CLUSTER", "MEET", "127.0.0.1", "16402"))
+	waitFor(t, "replica to join", func() bool {
+		return clusterInfoField(primary, "cluster_known_nodes") == "4"
+	})
+	if reply := replica.Execute(conn, utils.StringsToLine("CLUSTER", "REPLICATE", nodeID(primary.self))); !protocol.CheckOKReply(reply) {
+		t.Fatalf("replicate failed: %s", reply.GetBytes())
+	}
+	keys := make([]string, 0)
+	for i := 0; len(keys) < 10; i++ {
+		key := "key" + strconv.Itoa(i)
+		if self.picker.PickNode(key) == primary.self {
+			keys = append(keys, key)
+			self.Execute(conn, utils.StringsToLine("SET", key, key))
+		}
+	}
+	waitFor(t, "replica to sync", func() bool {
+		value, _ := protocol.FetchBulkString(replica.db.Execute(conn, utils.StringsToLine("GET", keys[len(keys)-1])))
+		return string(value) == keys[len(keys)-1]
+	})
+	waitFor(t, "replica to be reported in the primary's shard", func() bool {
+		nodes := shardNodes(self, primary.self)
+		return len(nodes) == 2 && nodes[1]["role"] == "replica" && nodes[1]["health"] == "online" && nodes[1]["replication-offset"] != "0"
+	})
+
+	network.setDown(primary.self, true)
+	waitFor(t, "replica to be promoted", func() bool {
+		return self.picker.PickNode(keys[0]) == replica.self && clusterInfoField(self, "cluster_state") == clusterStateOK
+	})
+	for _, key := range keys {
+		if value, _ := protocol.FetchBulkString(executeWhenUp(t, self, "GET", key)); string(value) != key {
+			t.Errorf("expected %s, got %s", key, value)
+		}
+	}
+	// 提升之后副本不再是只读的
+	if reply := executeWhenUp(t, self, "SET", keys[0], "updated"); !protocol.CheckOKReply(reply) {
+		t.Fatalf("write to the promoted replica failed: %s", reply.GetBytes())
+	}
+
+	network.setDown(primary.self, false)
+	waitFor(t, "old primary to become a replica", func() bool {
+		_, synced := primary.db.ReplicationOffset()
+		return primary.masterOf(primary.self) == replica.self && synced
+	})
+	if value, _ := protocol.FetchBulkString(primary.db.Execute(conn, utils.StringsToLine("GET", keys[0]))); string(value) != "updated" {
+		t.Errorf("expected old primary to sync from the new master, got %s", value)
+	}
+	// _mfstart 之后写入 master 的命令应该被暂停，直到 master 成为副本之后转发给新的 master
+	paused := make(chan redis.Reply, 1)
+	primary.relayFunc = func(cluster *Cluster, node string, c redis.Connection, line redis.Line) redis.Reply {
+		reply := network.relay(cluster, node, c, line)
+		if strings.EqualFold(string(line[0]), mfStartStr) {
+			go func() {
+				paused <- replica.Execute(connection.NewClientConn(nil), utils.StringsToLine("SET", keys[2], "paused"))
+			}()
+		}
+		return reply
+	}
+	if reply := primary.Execute(conn, utils.StringsToLine("CLUSTER", "FAILOVER")); !protocol.CheckOKReply(reply) {
+		t.Fatalf("manual failover failed: %s", reply.GetBytes())
+	}
+	waitFor(t, "manual failover to propagate", func() bool {
+		return self.picker.PickNode(keys[0]) == primary.self && replica.masterOf(replica.self) == primary.self
+	})
+	if reply := <-paused; !protocol.CheckOKReply(reply) {
+		t.Errorf("write paused during manual failover failed: %s", reply.GetBytes())
+	}
+	if value, _ := protocol.FetchBulkString(primary.db.Execute(conn, utils.StringsToLine("GET", keys[2]))); string(value) != "paused" {
+		t.Errorf("expected the paused write to reach the new master, got %s", value)
+	}
+	if value, _ := protocol.FetchBulkString(executeWhenUp(t, self, "GET", keys[0])); string(value) != "updated" {
+		t.Errorf("expected updated, got %s", value)
+	}
+	if reply := executeWhenUp(t, self, "SET", keys[1], "updated"); !protocol.CheckOKReply(reply) {
+		t.Errorf("write after manual failover failed: %s", reply.GetBytes())
+	}
+}
+
+// shardNodes 返回 CLUSTER SHARDS 中以 master 开头的分片的节点信息
+func shardNodes(cluster *Cluster, master string) []map[string]string {
+	shards, _ := protocol.FetchReplies(cluster.Execute(connection.NewClientConn(nil), utils.StringsToLine("CLUSTER", "SHARDS")))
+	for _, shard := range shards {
+		fields, _ := protocol.FetchReplies(shard)
+		nodeReplies, _ := protocol.FetchReplies(fields[3])
+		var nodes []map[string]string
+		for _, nodeReply := range nodeReplies {
+			info, _ := protocol.FetchReplies(nodeReply)
+			node := make(map[string]string)
+			for i := 0; i+1 < len(info); i += 2 {
+				name, _ := protocol.FetchBulkString(info[i])
+				if value, ok := protocol.FetchBulkString(info[i+1]); ok {
+					node[string(name)] = string(value)
+				} else if code, ok := protocol.FetchCode(info[i+1]); ok {
+					node[string(name)] = strconv.FormatInt(code, 10)
+				}
+			}
+			nodes = append(nodes, node)
+		}
+		if len(nodes) > 0 && nodes[0]["id"] == nodeID(master) {
+			return nodes
+		}
+	}
+	return nil
+}
+
+func TestPeerPickerConfig(t *testing.T) {
+	defer func() {
+		config.Properties.ClusterPicker = ""
+	}()
+	if _, ok := newPeerPicker().(*consistenthash.SlotPicker); !ok {
+		t.Error("expected hash slots by default")
+	}
+	config.Properties.ClusterPicker = "consistent"
+	if _, ok := newPeerPicker().(*consistenthash.ConsistentPicker); !ok {
+		t.Error("expected consistent hashing with cluster-picker consistent")
+	}
+}
+
+func TestPeerCircuitBreaker(t *testing.T) {
+	config.Properties.ClusterBreakerThreshold = 2
+	config.Properties.ClusterBreakerCooldown = 100
+	defer func() {
+		config.Properties.ClusterBreakerThreshold = 0
+		config.Properties.ClusterBreakerCooldown = 0
+	}()
+	// 没有监听的端口，建立连接会立即失败
+	peer := newPeerPool("127.0.0.1:1")
+	defer peer.close()
+	line := utils.StringsToLine("GET", "key")
+	for i := 0; i < 2; i++ {
+		reply := peer.send(0, line)
+		if !protocol.CheckErrorReply(reply) || strings.Contains(reply.(redis.ErrorReply).Error(), "circuit breaker") {
+			t.Fatalf("expected borrow failure, got %s", reply.GetBytes())
+		}
+	}
+	reply := peer.send(0, line)
+	if !protocol.CheckErrorReply(reply) || !strings.Contains(reply.(redis.ErrorReply).Error(), "circuit breaker is open") {
+		t.Fatalf("expected circuit breaker to be open, got %s", reply.GetBytes())
+	}
+	time.Sleep(150 * time.Millisecond)
+	// 冷却后放行的试探请求失败，熔断器重新打开
+	if reply := peer.send(0, line); strings.Contains(string(reply.GetBytes()), "circuit breaker") {
+		t.Fatalf("expected a probe request after cooldown, got %s", reply.GetBytes())
+	}
+	if state, trips := peer.breaker.status(); state != breakerOpen || trips != 2 {
+		t.Errorf("expected breaker to be open after 2 trips, got %s after %d trips", state, trips)
+	}
+	if rejected := atomic.LoadInt64(&peer.rejected); rejected != 1 {
+		t.Errorf("expected 1 rejected request, got %d", rejected)
+	}
+}
+
+// serveTestPeer 在本地端口上用 handler 处理收到的命令
+func serveTestPeer(t *testing.T, handler func(args redis.Line) redis.Reply) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer func() {
+					_ = conn.Close()
+				}()
+				for payload := range parse.StartParseStream(conn) {
+					if payload.Err != nil {
+						return
+					}
+					args, _ := protocol.FetchArrayArgs(payload.Data)
+					if _, err := conn.Write(handler(args).GetBytes()); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestPeerPoolConcurrentRequests(t *testing.T) {
+	release := make(chan struct{})
+	addr := serveTestPeer(t, func(args redis.Line) redis.Reply {
+		if strings.EqualFold(string(args[0]), "prepare") {
+			<-release
+		}
+		return protocol.OkReply()
+	})
+	peer := newPeerPool(addr)
+	defer peer.close()
+	done := make(chan redis.Reply)
+	go func() {
+		done <- peer.send(0, utils.StringsToLine("Prepare", "1", "node", "SET", "key", "value"))
+	}()
+	for deadline := time.Now().Add(time.Second); peer.pool.GetNumActive() != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the blocked request to hold a connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 被阻塞的 prepare 独占一个连接，普通命令通过共享的连接发送，不需要等待
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if reply := peer.send(0, utils.StringsToLine("GET", "key")); !protocol.CheckOKReply(reply) {
+				t.Errorf("expected OK, got %s", reply.GetBytes())
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("requests waited %v behind a blocked request", elapsed)
+	}
+	if shared := peer.sharedCount(); shared == 0 || shared > sharedConnCount {
+		t.Errorf("expected at most %d shared connections, got %d", sharedConnCount, shared)
+	}
+	if active := peer.pool.GetNumActive(); active != 1 {
+		t.Errorf("expected only the blocked request to borrow a connection, %d are active", active)
+	}
+	close(release)
+	if reply := <-done; !protocol.CheckOKReply(reply) {
+		t.Errorf("expected OK, got %s", reply.GetBytes())
+	}
+	if active := peer.pool.GetNumActive(); active != 0 {
+		t.Errorf("expected all connections to be returned, %d are active", active)
+	}
+}
+
+func TestRelayTimeout(t *testing.T) {
+	if timeout := relayTimeout(utils.StringsToLine("GET", "key")); timeout != defaultRelayTimeout {
+		t.Errorf("expected default timeout, got %v", timeout)
+	}
+	if timeout := relayTimeout(utils.StringsToLine("CLUSTER", "MIGRATESLOTS", "node", "1")); timeout != migrateSlotsTimeout {
+		t.Errorf("expected migrate slots timeout, got %v", timeout)
+	}
+}
+
+// recordConn 记录推送给订阅者的消息
+type recordConn struct {
+	*connection.ClientConn
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func newRecordConn() *recordConn {
+	return &recordConn{ClientConn: connection.NewClientConn(nil)}
+}
+
+func (c *recordConn) Write(b []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.buf.Write(b)
+	return nil
+}
+
+func (c *recordConn) received(message redis.Line) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return bytes.Contains(c.buf.Bytes(), protocol.ArrayReply(message).GetBytes())
+}
+
+func TestPublishAcrossNodes(t *testing.T) {
+	// 发布订阅用不到多个数据库，减少测试节点占用的内存
+	databaseCount := config.Properties.DatabaseCount
+	config.Properties.DatabaseCount = 1
+	defer func() {
+		config.Properties.DatabaseCount = databaseCount
+	}()
+	network := makeTestNetwork(t)
+	a := network.nodes["127.0.0.1:16399"]
+	b := network.nodes["127.0.0.1:16400"]
+	c := network.nodes["127.0.0.1:16401"]
+	subB, subC := newRecordConn(), newRecordConn()
+	b.Execute(subB, utils.StringsToLine("SUBSCRIBE", "news"))
+	c.Execute(subC, utils.StringsToLine("SUBSCRIBE", "news"))
+	publisher := connection.NewClientConn(nil)
+	if code, _ := protocol.FetchCode(a.Execute(publisher, utils.StringsToLine("PUBLISH", "news", "hello"))); code != 2 {
+		t.Errorf("expected 2 receivers, got %d", code)
+	}
+	message := utils.StringsToLine("message", "news", "hello")
+	if !subB.received(message) || !subC.received(message) {
+		t.Errorf("expected message on every node, got %q and %q", subB.buf.String(), subC.buf.String())
+	}
+
+	// 在不负责该频道的节点上订阅分片频道，消息经负责节点转发
+	channel := ""
+	for i := 0; channel == ""; i++ {
+		name := "shard" + strconv.Itoa(i)
+		if a.picker.PickNode(name) == c.self {
+			channel = name
+		}
+	}
+	b.Execute(subB, utils.StringsToLine("SSUBSCRIBE", channel))
+	if code, _ := protocol.FetchCode(a.Execute(publisher, utils.StringsToLine("SPUBLISH", channel, "hi"))); code != 1 {
+		t.Errorf("expected 1 receiver, got %d", code)
+	}
+	if !subB.received(utils.StringsToLine("smessage", channel, "hi")) {
+		t.Errorf("expected smessage, got %q", subB.buf.String())
+	}
+	if reply := b.Execute(subB, utils.StringsToLine("GET", "key")); !protocol.CheckErrorReply(reply) {
+		t.Errorf("expected subscriber mode error, got %s", reply.GetBytes())
+	}
+}
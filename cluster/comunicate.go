@@ -1,33 +1,56 @@
 package cluster
 
 import (
-	"context"
 	"godis-learn/interface/redis"
-	"godis-learn/lib/utils"
-	"godis-learn/redis/client"
 	"godis-learn/redis/protocol"
-	"strconv"
 )
 
 var defaultRelayFunc = func(cluster *Cluster, node string, conn redis.Connection, line redis.Line) redis.Reply {
 	if node == cluster.self {
 		return cluster.db.Execute(conn, line)
 	}
-	factory, ok := cluster.connPoolMap[node]
+	peer, ok := cluster.getPool(node)
 	if !ok {
 		return protocol.NewErrorReply([]byte("connection factory not found"))
 	}
-	borrowedObj, err := factory.BorrowObject(context.Background())
-	if err != nil {
-		return protocol.NewErrorReply([]byte("connection factory borrow failed"))
+	return peer.send(conn.GetDBIndex(), line)
+}
+
+func (c *Cluster) getPool(node string) (*peerPool, bool) {
+	c.poolMutex.RLock()
+	defer c.poolMutex.RUnlock()
+	peer, ok := c.connPoolMap[node]
+	return peer, ok
+}
+
+// addPeer 为新加入的节点创建连接池，节点已存在时返回 false
+func (c *Cluster) addPeer(node string) bool {
+	if node == c.self {
+		return false
+	}
+	c.poolMutex.Lock()
+	defer c.poolMutex.Unlock()
+	if _, ok := c.connPoolMap[node]; ok {
+		return false
+	}
+	c.connPoolMap[node] = newPeerPool(node)
+	return true
+}
+
+func (c *Cluster) removePeer(node string) {
+	c.poolMutex.Lock()
+	peer, ok := c.connPoolMap[node]
+	delete(c.connPoolMap, node)
+	c.poolMutex.Unlock()
+	if ok {
+		peer.close()
+	}
+}
+
+// send 向指定节点发送命令，发往自身的命令直接交由 Execute 处理
+func (c *Cluster) send(node string, conn redis.Connection, line redis.Line) redis.Reply {
+	if node == c.self {
+		return c.Execute(conn, line)
 	}
-	borrowedConn := borrowedObj.(*client.Client)
-	defer func(cluster *Cluster) {
-		factory, ok := cluster.connPoolMap[node]
-		if ok {
-			_ = factory.ReturnObject(context.Background(), borrowedConn)
-		}
-	}(cluster)
-	_ = borrowedConn.Send(utils.StringsToLine("SELECT", strconv.Itoa(conn.GetDBIndex())))
-	return borrowedConn.Send(line)
+	return c.relayFunc(c, node, conn, line)
 }
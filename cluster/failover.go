@@ -0,0 +1,303 @@
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"godis-learn/interface/redis"
+	"godis-learn/lib/consistenthash"
+	"godis-learn/lib/logger"
+	"godis-learn/lib/utils"
+	"godis-learn/redis/protocol"
+	"time"
+)
+
+const (
+	mfStartStr = "_mfstart"
+
+	// manualFailoverTimeout 手动故障转移时副本等待追上 master 的最长时间
+	manualFailoverTimeout = 5 * time.Second
+)
+
+// execMFStart 在 master 上执行，返回当前的复制偏移量，发起手动故障转移的副本追上这个偏移量之后再发起选举
+func execMFStart(cluster *Cluster, _ redis.Connection, line redis.Line) redis.Reply {
+	if len(line) != 1 {
+		return protocol.ArgumentCountErrorReply([]byte(mfStartStr))
+	}
+	if cluster.masterOf(cluster.self) != "" {
+		return protocol.NewErrorReply([]byte("ERR I'm a replica"))
+	}
+	// 先暂停写命令并等待正在执行的写命令结束，返回的偏移量之后不会再有新的写入
+	cluster.writeMutex.Lock()
+	cluster.pausedUntil = time.Now().Add(2 * manualFailoverTimeout)
+	cluster.writeMutex.Unlock()
+	offset, _ := cluster.db.ReplicationOffset()
+	return protocol.IntReply(offset)
+}
+
+// waitWritesResumed 等待手动故障转移引起的写暂停结束，返回时持有 writeMutex 的读锁
+func (c *Cluster) waitWritesResumed() {
+	for {
+		c.writeMutex.RLock()
+		if !time.Now().Before(c.pausedUntil) {
+			return
+		}
+		c.writeMutex.RUnlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// resumeWrites 结束写暂停，被暂停的写命令重新路由，此时 slot 通常已经属于新的 master
+func (c *Cluster) resumeWrites() {
+	c.writeMutex.Lock()
+	c.pausedUntil = time.Time{}
+	c.writeMutex.Unlock()
+}
+
+func (c *Cluster) masterOf(addr string) string {
+	c.bus.mutex.Lock()
+	defer c.bus.mutex.Unlock()
+	if m, ok := c.bus.members[addr]; ok {
+		return m.master
+	}
+	return ""
+}
+
+// becomeReplica 成为 master 的副本，由数据库的复制功能连接 master 并进行全量同步
+func (c *Cluster) becomeReplica(master string) {
+	c.bus.mutex.Lock()
+	c.bus.members[c.self].master = master
+	c.bus.nextElection = time.Time{}
+	c.bus.mutex.Unlock()
+	host, port := splitAddr(master)
+	c.db.SlaveOf(host, port)
+	c.resumeWrites()
+	logger.Info(fmt.Sprintf("become replica of %s", master))
+}
+
+// replicaCron 在 master 故障时安排选举，复制偏移量越大的副本越早发起选举
+func (c *Cluster) replicaCron() {
+	bus := c.bus
+	now := time.Now()
+	// 没有完成过全量同步的副本没有可用的数据，不能参与选举
+	offset, synced := c.db.ReplicationOffset()
+	bus.mutex.Lock()
+	self := bus.members[c.self]
+	master, ok := bus.members[self.master]
+	if self.master == "" || !ok {
+		bus.mutex.Unlock()
+		return
+	}
+	startElection := false
+	if master.flag == flagFail && !bus.electing && synced {
+		if bus.nextElection.IsZero() {
+			rank := 0
+			for _, m := range bus.members {
+				if m.master == self.master && m.addr != c.self && m.flag == "" && m.offset > offset {
+					rank++
+				}
+			}
+			bus.nextElection = now.Add(bus.nodeTimeout/2 + time.Duration(rank)*bus.nodeTimeout)
+		} else if now.After(bus.nextElection) {
+			bus.electing = true
+			startElection = true
+		}
+	} else if master.flag == "" {
+		bus.nextElection = time.Time{}
+	}
+	bus.mutex.Unlock()
+	if startElection {
+		go c.runElection(false)
+	}
+}
+
+// runElection 递增 epoch 并向所有 master 请求投票，得到多数 master 的同意后接管原 master 的 slot
+func (c *Cluster) runElection(manual bool) bool {
+	bus := c.bus
+	bus.mutex.Lock()
+	master := bus.members[c.self].master
+	bus.currentEpoch++
+	epoch := bus.currentEpoch
+	bus.mutex.Unlock()
+	defer func() {
+		bus.mutex.Lock()
+		bus.electing = false
+		bus.nextElection = time.Now().Add(2 * bus.nodeTimeout)
+		bus.mutex.Unlock()
+	}()
+	if master == "" {
+		return false
+	}
+	masters := c.masters()
+	line := c.encodeGossip(&gossipMsg{
+		Type:         gossipAuthRequest,
+		Target:       master,
+		CurrentEpoch: epoch,
+		Manual:       manual,
+	})
+	votes := 0
+	for node := range masters {
+		if node == master {
+			continue
+		}
+		if protocol.CheckOKReply(c.relayFunc(c, node, c.busConn(), line)) {
+			votes++
+		}
+	}
+	if votes < len(masters)/2+1 {
+		logger.Info(fmt.Sprintf("failover election for epoch %d lost with %d votes", epoch, votes))
+		return false
+	}
+	c.promote(master, epoch)
+	return true
+}
+
+// promote 使当前节点成为 master，并以新的 config epoch 接管原 master 的全部 slot
+func (c *Cluster) promote(master string, epoch uint64) {
+	picker := c.picker.(*consistenthash.SlotPicker)
+	c.bus.mutex.Lock()
+	self := c.bus.members[c.self]
+	self.master = ""
+	self.epoch = epoch
+	if c.bus.currentEpoch < epoch {
+		c.bus.currentEpoch = epoch
+	}
+	c.bus.mutex.Unlock()
+	// 停止复制并开始接受写命令，已经同步的数据被保留
+	if reply := c.db.Execute(c.busConn(), utils.StringsToLine("SLAVEOF", "NO", "ONE")); !protocol.CheckOKReply(reply) {
+		logger.Warn(fmt.Sprintf("SLAVEOF NO ONE failed: %s", reply.GetBytes()))
+	}
+	for slot := 0; slot < consistenthash.SlotCount; slot++ {
+		if picker.NodeOfSlot(slot) == master {
+			picker.SetSlotOwner(slot, c.self)
+			c.slots.setStable(slot)
+		}
+	}
+	logger.Info(fmt.Sprintf("promoted to master in place of %s with epoch %d", master, epoch))
+	for _, node := range picker.Nodes() {
+		if node != c.self {
+			go c.sendPing(node, gossipPong)
+		}
+	}
+}
+
+// handleAuthRequest 决定是否为发起选举的副本投票，每个 epoch 只投一票，
+// 并且同一个 master 的副本在 2 倍 nodeTimeout 内只能得到一次投票
+func (c *Cluster) handleAuthRequest(msg *gossipMsg) redis.Reply {
+	bus := c.bus
+	if !c.ownsSlots() {
+		return protocol.NewErrorReply([]byte("ERR only masters can vote"))
+	}
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	now := time.Now()
+	master, ok := bus.members[msg.Target]
+	if !ok || msg.Master != msg.Target {
+		return protocol.NewErrorReply([]byte("ERR requester is not a replica of the failed node"))
+	}
+	if msg.CurrentEpoch <= bus.lastVoteEpoch || msg.CurrentEpoch < bus.currentEpoch {
+		return protocol.NewErrorReply([]byte("ERR stale epoch"))
+	}
+	if master.flag != flagFail && !msg.Manual {
+		return protocol.NewErrorReply([]byte("ERR master is not failing"))
+	}
+	if t, voted := bus.votedFor[msg.Target]; voted && now.Sub(t) < 2*bus.nodeTimeout {
+		return protocol.NewErrorReply([]byte("ERR already voted for this master"))
+	}
+	bus.lastVoteEpoch = msg.CurrentEpoch
+	bus.votedFor[msg.Target] = now
+	logger.Info(fmt.Sprintf("vote for %s to replace %s in epoch %d", msg.Sender, msg.Target, msg.CurrentEpoch))
+	return protocol.OkReply()
+}
+
+func clusterReplicate(cluster *Cluster, picker *consistenthash.SlotPicker, args redis.Line) redis.Reply {
+	if len(args) != 1 {
+		return protocol.ArgumentCountErrorReply([]byte("cluster|replicate"))
+	}
+	master, ok := resolveNode(picker, string(args[0]))
+	if !ok {
+		return protocol.NewErrorReply([]byte(fmt.Sprintf("ERR Unknown node %s", args[0])))
+	}
+	if master == cluster.self {
+		return protocol.NewErrorReply([]byte("ERR Can't replicate myself"))
+	}
+	if cluster.masterOf(master) != "" {
+		return protocol.NewErrorReply([]byte("ERR I can only replicate a master, not a replica."))
+	}
+	if cluster.ownsSlots() {
+		return protocol.NewErrorReply([]byte("ERR To set a master the node must be empty and without assigned slots."))
+	}
+	cluster.becomeReplica(master)
+	return protocol.OkReply()
+}
+
+func clusterReplicas(cluster *Cluster, picker *consistenthash.SlotPicker, args redis.Line) redis.Reply {
+	if len(args) != 1 {
+		return protocol.ArgumentCountErrorReply([]byte("cluster|replicas"))
+	}
+	master, ok := resolveNode(picker, string(args[0]))
+	if !ok {
+		return protocol.NewErrorReply([]byte(fmt.Sprintf("ERR Unknown node %s", args[0])))
+	}
+	res := make([][]byte, 0)
+	for _, line := range clusterNodeLines(cluster, picker) {
+		if bytes.Contains(line, []byte(" "+nodeID(master)+" ")) && bytes.Contains(line, []byte("slave")) {
+			res = append(res, line)
+		}
+	}
+	return protocol.ArrayReply(res)
+}
+
+// clusterFailover 在副本上执行手动故障转移：默认等待副本追上 master 后发起选举，
+// FORCE 不等待 master，TAKEOVER 不经过选举直接接管
+func clusterFailover(cluster *Cluster, args redis.Line) redis.Reply {
+	option := ""
+	if len(args) > 1 {
+		return protocol.ArgumentCountErrorReply([]byte("cluster|failover"))
+	} else if len(args) == 1 {
+		option = string(bytes.ToLower(args[0]))
+		if option != "force" && option != "takeover" {
+			return protocol.SyntaxErrorReply()
+		}
+	}
+	master := cluster.masterOf(cluster.self)
+	if master == "" {
+		return protocol.NewErrorReply([]byte("ERR You should send CLUSTER FAILOVER to a replica"))
+	}
+	switch option {
+	case "takeover":
+		cluster.bus.mutex.Lock()
+		cluster.bus.currentEpoch++
+		epoch := cluster.bus.currentEpoch
+		cluster.bus.mutex.Unlock()
+		cluster.promote(master, epoch)
+		return protocol.OkReply()
+	case "":
+		// master 收到 _mfstart 之后暂停写命令，直到成为新 master 的副本或者超时
+		reply := cluster.relayFunc(cluster, master, cluster.busConn(), utils.StringsToLine(mfStartStr))
+		masterOffset, ok := protocol.FetchCode(reply)
+		if !ok {
+			return reply
+		}
+		deadline := time.Now().Add(manualFailoverTimeout)
+		for {
+			if offset, synced := cluster.db.ReplicationOffset(); synced && offset >= masterOffset {
+				break
+			}
+			if time.Now().After(deadline) {
+				return protocol.NewErrorReply([]byte("ERR timeout waiting for replica to catch up"))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	cluster.bus.mutex.Lock()
+	if cluster.bus.electing {
+		cluster.bus.mutex.Unlock()
+		return protocol.NewErrorReply([]byte("ERR an election is already in progress"))
+	}
+	cluster.bus.electing = true
+	cluster.bus.mutex.Unlock()
+	if !cluster.runElection(true) {
+		return protocol.NewErrorReply([]byte("ERR failover election failed"))
+	}
+	return protocol.OkReply()
+}
@@ -0,0 +1,619 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"godis-learn/config"
+	"godis-learn/interface/redis"
+	"godis-learn/lib/consistenthash"
+	"godis-learn/lib/logger"
+	"godis-learn/lib/utils"
+	"godis-learn/redis/connection"
+	"godis-learn/redis/protocol"
+	"sync"
+	"time"
+)
+
+const (
+	gossipStr = "_gossip"
+
+	gossipPing   = "ping"
+	gossipPong   = "pong"
+	gossipMeet   = "meet"
+	gossipFail   = "fail"
+	gossipForget = "forget"
+	// gossipAuthRequest 由发起选举的副本发送给各个 master 请求投票
+	gossipAuthRequest = "auth-request"
+
+	flagPFail = "pfail"
+	flagFail  = "fail"
+
+	clusterStateOK   = "ok"
+	clusterStateFail = "fail"
+
+	defaultNodeTimeout = 15 * time.Second
+	// forgetBlacklistTime 被 FORGET 的节点在这段时间内不会因为 gossip 被重新加入
+	forgetBlacklistTime = time.Minute
+)
+
+// member 是当前节点对集群中某个节点的认识
+type member struct {
+	addr  string
+	epoch uint64
+	flag  string
+	// master 不为空表示该节点是 master 的副本
+	master string
+	offset int64
+	// pingSent 为最早一个尚未收到回复的 ping 的发送时间，收到 pong 后清零
+	pingSent     time.Time
+	lastPing     time.Time
+	pongReceived time.Time
+	inflight     bool
+	failReports  map[string]time.Time
+}
+
+// clusterBus 负责节点之间的心跳、故障检测以及拓扑信息的传播，消息通过 _gossip 命令在节点间传递
+type clusterBus struct {
+	mutex        sync.Mutex
+	members      map[string]*member
+	currentEpoch uint64
+	blacklist    map[string]time.Time
+	state        string
+	nodeTimeout  time.Duration
+	running      bool
+	stop         chan struct{}
+	// 以下字段用于副本的故障转移
+	lastVoteEpoch uint64
+	votedFor      map[string]time.Time
+	nextElection  time.Time
+	electing      bool
+}
+
+type gossipNode struct {
+	Addr   string `json:"addr"`
+	Epoch  uint64 `json:"epoch"`
+	Flag   string `json:"flag,omitempty"`
+	Master string `json:"master,omitempty"`
+}
+
+type gossipMsg struct {
+	Type         string       `json:"type"`
+	Sender       string       `json:"sender"`
+	CurrentEpoch uint64       `json:"currentEpoch"`
+	ConfigEpoch  uint64       `json:"configEpoch"`
+	Slots        [][2]int     `json:"slots"`
+	Nodes        []gossipNode `json:"nodes,omitempty"`
+	Target       string       `json:"target,omitempty"`
+	Master       string       `json:"master,omitempty"`
+	Offset       int64        `json:"offset,omitempty"`
+	Manual       bool         `json:"manual,omitempty"`
+}
+
+func newClusterBus(self string, nodes []string) *clusterBus {
+	timeout := defaultNodeTimeout
+	if config.Properties.ClusterNodeTimeout > 0 {
+		timeout = time.Duration(config.Properties.ClusterNodeTimeout) * time.Millisecond
+	}
+	bus := &clusterBus{
+		members:     make(map[string]*member),
+		blacklist:   make(map[string]time.Time),
+		votedFor:    make(map[string]time.Time),
+		state:       clusterStateOK,
+		nodeTimeout: timeout,
+		stop:        make(chan struct{}),
+	}
+	for _, node := range append(nodes, self) {
+		bus.members[node] = &member{addr: node, failReports: make(map[string]time.Time)}
+	}
+	return bus
+}
+
+// StartBus 开始与其它节点交换心跳，只有使用 hash slot 时才能启用
+func (c *Cluster) StartBus() {
+	if _, ok := c.picker.(*consistenthash.SlotPicker); !ok {
+		logger.Warn("cluster bus requires hash slots, membership stays static")
+		return
+	}
+	c.bus.mutex.Lock()
+	defer c.bus.mutex.Unlock()
+	if c.bus.running {
+		return
+	}
+	c.bus.running = true
+	go func() {
+		interval := c.bus.nodeTimeout / 10
+		if interval > 100*time.Millisecond {
+			interval = 100 * time.Millisecond
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.busCron()
+			case <-c.bus.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (c *Cluster) stopBus() {
+	c.bus.mutex.Lock()
+	defer c.bus.mutex.Unlock()
+	if c.bus.running {
+		c.bus.running = false
+		close(c.bus.stop)
+	}
+}
+
+// busCron 定期向其它节点发送 ping，超过 nodeTimeout 没有回复的节点被标记为 PFAIL
+func (c *Cluster) busCron() {
+	bus := c.bus
+	now := time.Now()
+	pings := make([]string, 0)
+	suspects := make([]string, 0)
+	bus.mutex.Lock()
+	for addr, m := range bus.members {
+		if addr == c.self {
+			continue
+		}
+		if !m.inflight && now.Sub(m.lastPing) >= bus.nodeTimeout/5 {
+			m.inflight = true
+			m.lastPing = now
+			if m.pingSent.IsZero() {
+				m.pingSent = now
+			}
+			pings = append(pings, addr)
+		}
+		if !m.pingSent.IsZero() && now.Sub(m.pingSent) > bus.nodeTimeout && m.flag == "" {
+			m.flag = flagPFail
+			logger.Info(fmt.Sprintf("node %s is possibly failing", addr))
+		}
+		if m.flag == flagPFail {
+			suspects = append(suspects, addr)
+		}
+	}
+	bus.mutex.Unlock()
+	for _, addr := range pings {
+		go c.sendPing(addr, gossipPing)
+	}
+	for _, addr := range suspects {
+		c.checkFailure(addr)
+	}
+	c.updateState()
+	c.replicaCron()
+}
+
+func (c *Cluster) sendPing(addr string, msgType string) redis.Reply {
+	defer func() {
+		c.bus.mutex.Lock()
+		if m, ok := c.bus.members[addr]; ok {
+			m.inflight = false
+		}
+		c.bus.mutex.Unlock()
+	}()
+	reply := c.relayFunc(c, addr, c.busConn(), c.gossipLine(msgType, ""))
+	payload, ok := protocol.FetchBulkString(reply)
+	if !ok {
+		return reply
+	}
+	msg := &gossipMsg{}
+	if err := json.Unmarshal(payload, msg); err != nil {
+		return protocol.NewErrorReply([]byte("ERR invalid gossip message: " + err.Error()))
+	}
+	c.handleGossip(msg)
+	return protocol.OkReply()
+}
+
+func (c *Cluster) busConn() redis.Connection {
+	conn := connection.NewClientConn(nil)
+	conn.SetPassword(config.Properties.RequirePass)
+	return conn
+}
+
+// broadcastGossip 异步地向其它所有节点发送消息
+func (c *Cluster) broadcastGossip(msgType string, target string) {
+	line := c.gossipLine(msgType, target)
+	for _, addr := range c.picker.(*consistenthash.SlotPicker).Nodes() {
+		if addr != c.self {
+			go c.relayFunc(c, addr, c.busConn(), line)
+		}
+	}
+}
+
+func (c *Cluster) gossipLine(msgType string, target string) redis.Line {
+	return c.encodeGossip(&gossipMsg{Type: msgType, Target: target})
+}
+
+func (c *Cluster) encodeGossip(msg *gossipMsg) redis.Line {
+	picker := c.picker.(*consistenthash.SlotPicker)
+	msg.Sender = c.self
+	msg.Slots = make([][2]int, 0)
+	msg.Offset, _ = c.db.ReplicationOffset()
+	for _, r := range picker.SlotRanges() {
+		if r.Node == c.self {
+			msg.Slots = append(msg.Slots, [2]int{r.Start, r.End})
+		}
+	}
+	c.bus.mutex.Lock()
+	if msg.CurrentEpoch == 0 {
+		msg.CurrentEpoch = c.bus.currentEpoch
+	}
+	for addr, m := range c.bus.members {
+		if addr == c.self {
+			msg.ConfigEpoch = m.epoch
+			msg.Master = m.master
+		}
+		msg.Nodes = append(msg.Nodes, gossipNode{Addr: addr, Epoch: m.epoch, Flag: m.flag, Master: m.master})
+	}
+	c.bus.mutex.Unlock()
+	payload, _ := json.Marshal(msg)
+	return utils.StringsToLine(gossipStr, string(payload))
+}
+
+func execGossip(cluster *Cluster, _ redis.Connection, line redis.Line) redis.Reply {
+	if len(line) != 2 {
+		return protocol.ArgumentCountErrorReply([]byte(gossipStr))
+	}
+	if _, ok := cluster.picker.(*consistenthash.SlotPicker); !ok {
+		return protocol.NewErrorReply([]byte("ERR hash slots are disabled, set cluster-picker to slot"))
+	}
+	msg := &gossipMsg{}
+	if err := json.Unmarshal(line[1], msg); err != nil {
+		return protocol.NewErrorReply([]byte("ERR invalid gossip message: " + err.Error()))
+	}
+	if msg.Type == gossipMeet {
+		cluster.acceptMeet()
+	}
+	if !cluster.handleGossip(msg) {
+		return protocol.NewErrorReply([]byte("ERR node is forgotten"))
+	}
+	if msg.Type == gossipAuthRequest {
+		return cluster.handleAuthRequest(msg)
+	}
+	if msg.Type == gossipPing || msg.Type == gossipMeet {
+		return protocol.BulkStringReply(cluster.gossipLine(gossipPong, "")[1])
+	}
+	return protocol.OkReply()
+}
+
+// acceptMeet 被 MEET 的节点如果还没有加入任何集群，就放弃自己持有的 slot，由所在集群通过 rebalance 分配
+func (c *Cluster) acceptMeet() {
+	picker := c.picker.(*consistenthash.SlotPicker)
+	if len(picker.Nodes()) > 1 {
+		return
+	}
+	for slot := 0; slot < consistenthash.SlotCount; slot++ {
+		if picker.NodeOfSlot(slot) == c.self {
+			picker.SetSlotOwner(slot, "")
+		}
+	}
+}
+
+// handleGossip 处理其它节点发来的消息，返回 false 表示发送者已经被当前节点遗忘
+func (c *Cluster) handleGossip(msg *gossipMsg) bool {
+	bus := c.bus
+	picker := c.picker.(*consistenthash.SlotPicker)
+	now := time.Now()
+	bus.mutex.Lock()
+	if until, ok := bus.blacklist[msg.Sender]; ok && now.Before(until) {
+		bus.mutex.Unlock()
+		return false
+	}
+	if msg.CurrentEpoch > bus.currentEpoch {
+		bus.currentEpoch = msg.CurrentEpoch
+	}
+	unknown := make([]string, 0)
+	if _, ok := bus.members[msg.Sender]; !ok {
+		unknown = append(unknown, msg.Sender)
+	}
+	for _, node := range msg.Nodes {
+		if _, ok := bus.members[node.Addr]; ok || node.Addr == c.self {
+			continue
+		}
+		if until, ok := bus.blacklist[node.Addr]; ok && now.Before(until) {
+			continue
+		}
+		unknown = append(unknown, node.Addr)
+	}
+	bus.mutex.Unlock()
+	for _, addr := range unknown {
+		c.joinNode(addr)
+	}
+
+	bus.mutex.Lock()
+	sender := bus.members[msg.Sender]
+	if sender == nil {
+		bus.mutex.Unlock()
+		return true
+	}
+	sender.epoch = msg.ConfigEpoch
+	sender.master = msg.Master
+	sender.offset = msg.Offset
+	if msg.Type == gossipPong {
+		sender.pingSent = time.Time{}
+		sender.pongReceived = now
+		if sender.flag != "" {
+			logger.Info(fmt.Sprintf("node %s is reachable again", msg.Sender))
+		}
+		sender.flag = ""
+	}
+	for _, node := range msg.Nodes {
+		m, ok := bus.members[node.Addr]
+		if !ok || node.Addr == c.self || node.Addr == msg.Sender {
+			continue
+		}
+		if m.epoch < node.Epoch {
+			m.epoch = node.Epoch
+		}
+		if m.flag != flagFail {
+			m.master = node.Master
+		}
+		if node.Flag != "" && len(msg.Slots) > 0 {
+			m.failReports[msg.Sender] = now
+		} else {
+			delete(m.failReports, msg.Sender)
+		}
+	}
+	self := bus.members[c.self]
+	// 两个持有 slot 的节点 config epoch 相同时，ID 较大的一方递增自己的 epoch，保证 epoch 互不相同
+	if len(msg.Slots) > 0 && msg.ConfigEpoch == self.epoch && nodeID(msg.Sender) < nodeID(c.self) && c.ownsSlots() {
+		bus.currentEpoch++
+		self.epoch = bus.currentEpoch
+	}
+	if msg.Type == gossipFail {
+		if m, ok := bus.members[msg.Target]; ok && msg.Target != c.self && m.flag != flagFail {
+			m.flag = flagFail
+			logger.Info(fmt.Sprintf("node %s is marked as failed by %s", msg.Target, msg.Sender))
+		}
+	}
+	bus.mutex.Unlock()
+
+	c.updateSlots(picker, msg)
+	if msg.Type == gossipForget && msg.Target != c.self {
+		c.forgetNode(msg.Target)
+	}
+	for _, node := range msg.Nodes {
+		if node.Flag != "" {
+			c.checkFailure(node.Addr)
+		}
+	}
+	return true
+}
+
+// updateSlots 发送者声明的 slot 在其 config epoch 更大时覆盖当前节点记录的归属，
+// 当前节点或者当前节点的 master 因此失去全部 slot 时，当前节点成为发送者的副本
+func (c *Cluster) updateSlots(picker *consistenthash.SlotPicker, msg *gossipMsg) {
+	losers := make(map[string]bool)
+	epochs := c.memberEpochs()
+	for _, r := range msg.Slots {
+		for slot := r[0]; slot <= r[1] && slot < consistenthash.SlotCount; slot++ {
+			owner := picker.NodeOfSlot(slot)
+			if owner == msg.Sender {
+				continue
+			}
+			if owner == "" || msg.ConfigEpoch > epochs[owner] {
+				picker.SetSlotOwner(slot, msg.Sender)
+				c.slots.setStable(slot)
+				losers[owner] = true
+			}
+		}
+	}
+	if len(losers) == 0 || msg.Master != "" {
+		return
+	}
+	counts := picker.SlotCounts()
+	if losers[c.self] && counts[c.self] == 0 {
+		logger.Info(fmt.Sprintf("all slots are taken over by %s", msg.Sender))
+		c.becomeReplica(msg.Sender)
+	} else if master := c.masterOf(c.self); master != "" && losers[master] && counts[master] == 0 {
+		c.becomeReplica(msg.Sender)
+	}
+}
+
+// memberEpochs 在一次加锁中读取全部成员的 config epoch，避免逐个 slot 加锁，未知的成员视为 0
+func (c *Cluster) memberEpochs() map[string]uint64 {
+	c.bus.mutex.Lock()
+	defer c.bus.mutex.Unlock()
+	epochs := make(map[string]uint64, len(c.bus.members))
+	for addr, m := range c.bus.members {
+		epochs[addr] = m.epoch
+	}
+	return epochs
+}
+
+// bumpEpoch 在当前节点获得新的 slot 时调用，使新的归属在 gossip 中优先于旧的归属
+func (c *Cluster) bumpEpoch() {
+	c.bus.mutex.Lock()
+	defer c.bus.mutex.Unlock()
+	c.bus.currentEpoch++
+	c.bus.members[c.self].epoch = c.bus.currentEpoch
+}
+
+func (c *Cluster) ownsSlots() bool {
+	for _, r := range c.picker.(*consistenthash.SlotPicker).SlotRanges() {
+		if r.Node == c.self {
+			return true
+		}
+	}
+	return false
+}
+
+// masters 返回持有 slot 的节点，只有它们的故障报告会被计入
+func (c *Cluster) masters() map[string]bool {
+	res := make(map[string]bool)
+	for _, r := range c.picker.(*consistenthash.SlotPicker).SlotRanges() {
+		res[r.Node] = true
+	}
+	return res
+}
+
+// checkFailure 当前节点认为处于 PFAIL 的节点，在多数 master 都报告其故障后被标记为 FAIL 并广播
+func (c *Cluster) checkFailure(addr string) {
+	masters := c.masters()
+	bus := c.bus
+	bus.mutex.Lock()
+	m, ok := bus.members[addr]
+	if !ok || addr == c.self || m.flag != flagPFail {
+		bus.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	reports := 0
+	if masters[c.self] {
+		reports++
+	}
+	for reporter, t := range m.failReports {
+		if now.Sub(t) > 2*bus.nodeTimeout {
+			delete(m.failReports, reporter)
+		} else if masters[reporter] {
+			reports++
+		}
+	}
+	if reports < len(masters)/2+1 {
+		bus.mutex.Unlock()
+		return
+	}
+	m.flag = flagFail
+	bus.mutex.Unlock()
+	logger.Info(fmt.Sprintf("node %s is marked as failed", addr))
+	c.broadcastGossip(gossipFail, addr)
+}
+
+// updateState 存在未分配或者归属于故障节点的 slot，或者当前节点无法联系多数 master 时，集群状态为 fail
+func (c *Cluster) updateState() {
+	picker := c.picker.(*consistenthash.SlotPicker)
+	masters := c.masters()
+	state := clusterStateOK
+	bus := c.bus
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	unreachable := 0
+	for addr := range masters {
+		if m, ok := bus.members[addr]; ok && m.flag != "" {
+			unreachable++
+			if m.flag == flagFail {
+				state = clusterStateFail
+			}
+		}
+	}
+	if unreachable > len(masters)/2 {
+		state = clusterStateFail
+	}
+	for slot := 0; slot < consistenthash.SlotCount && state == clusterStateOK; slot++ {
+		if picker.NodeOfSlot(slot) == "" {
+			state = clusterStateFail
+		}
+	}
+	if state != bus.state {
+		logger.Info(fmt.Sprintf("cluster state changed: %s", state))
+		bus.state = state
+	}
+}
+
+func (c *Cluster) clusterDown() bool {
+	c.bus.mutex.Lock()
+	defer c.bus.mutex.Unlock()
+	return c.bus.running && c.bus.state == clusterStateFail
+}
+
+// joinNode 把新节点加入 PeerPicker、连接池和成员表，新节点不持有 slot
+func (c *Cluster) joinNode(addr string) bool {
+	picker, ok := c.picker.(*consistenthash.SlotPicker)
+	if !ok || !picker.JoinNode(addr) {
+		return false
+	}
+	c.addPeer(addr)
+	c.bus.mutex.Lock()
+	defer c.bus.mutex.Unlock()
+	delete(c.bus.blacklist, addr)
+	if _, exists := c.bus.members[addr]; !exists {
+		c.bus.members[addr] = &member{addr: addr, failReports: make(map[string]time.Time)}
+	}
+	logger.Info(fmt.Sprintf("node %s joined the cluster", addr))
+	return true
+}
+
+// forgetNode 把节点从集群中移除，仍持有 slot 的节点不能被移除
+func (c *Cluster) forgetNode(addr string) bool {
+	picker := c.picker.(*consistenthash.SlotPicker)
+	if !picker.RemoveNode(addr) {
+		return false
+	}
+	c.removePeer(addr)
+	c.bus.mutex.Lock()
+	defer c.bus.mutex.Unlock()
+	delete(c.bus.members, addr)
+	for _, m := range c.bus.members {
+		delete(m.failReports, addr)
+	}
+	c.bus.blacklist[addr] = time.Now().Add(forgetBlacklistTime)
+	return true
+}
+
+func clusterMeet(cluster *Cluster, args redis.Line) redis.Reply {
+	if len(args) != 2 && len(args) != 3 {
+		return protocol.ArgumentCountErrorReply([]byte("cluster|meet"))
+	}
+	addr := fmt.Sprintf("%s:%s", args[0], args[1])
+	if _, port := splitAddr(addr); port == 0 {
+		return protocol.NewErrorReply([]byte(fmt.Sprintf("ERR Invalid node address specified: %s", addr)))
+	}
+	if addr == cluster.self {
+		return protocol.OkReply()
+	}
+	cluster.joinNode(addr)
+	if reply := cluster.sendPing(addr, gossipMeet); protocol.CheckErrorReply(reply) {
+		return reply
+	}
+	return protocol.OkReply()
+}
+
+func clusterForget(cluster *Cluster, picker *consistenthash.SlotPicker, args redis.Line) redis.Reply {
+	if len(args) != 1 {
+		return protocol.ArgumentCountErrorReply([]byte("cluster|forget"))
+	}
+	node, ok := resolveNode(picker, string(args[0]))
+	if !ok {
+		return protocol.NewErrorReply([]byte(fmt.Sprintf("ERR Unknown node %s", args[0])))
+	}
+	if node == cluster.self {
+		return protocol.NewErrorReply([]byte("ERR I tried hard but I can't forget myself..."))
+	}
+	if !cluster.forgetNode(node) {
+		return protocol.NewErrorReply([]byte(fmt.Sprintf("ERR node %s still serves slots, drain it first", node)))
+	}
+	cluster.broadcastGossip(gossipForget, node)
+	return protocol.OkReply()
+}
+
+func clusterInfo(cluster *Cluster, picker *consistenthash.SlotPicker) string {
+	bus := cluster.bus
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	assigned, pfail, fail := 0, 0, 0
+	for slot := 0; slot < consistenthash.SlotCount; slot++ {
+		owner := picker.NodeOfSlot(slot)
+		if owner == "" {
+			continue
+		}
+		assigned++
+		if m, ok := bus.members[owner]; ok && m.flag == flagPFail {
+			pfail++
+		} else if ok && m.flag == flagFail {
+			fail++
+		}
+	}
+	return fmt.Sprintf("cluster_state:%s\r\n"+
+		"cluster_slots_assigned:%d\r\n"+
+		"cluster_slots_ok:%d\r\n"+
+		"cluster_slots_pfail:%d\r\n"+
+		"cluster_slots_fail:%d\r\n"+
+		"cluster_known_nodes:%d\r\n"+
+		"cluster_size:%d\r\n"+
+		"cluster_current_epoch:%d\r\n"+
+		"cluster_my_epoch:%d\r\n",
+		bus.state, assigned, assigned-pfail-fail, pfail, fail, len(bus.members),
+		len(cluster.masters()), bus.currentEpoch, bus.members[cluster.self].epoch)
+}
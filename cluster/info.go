@@ -0,0 +1,48 @@
+package cluster
+
+import (
+	"fmt"
+	"godis-learn/interface/redis"
+	"godis-learn/redis/protocol"
+	"strings"
+	"sync/atomic"
+)
+
+// execInfo 在单机 INFO 的基础上追加节点间连接池的状态
+func execInfo(cluster *Cluster, conn redis.Connection, line redis.Line) redis.Reply {
+	section := "all"
+	if len(line) == 2 {
+		section = strings.ToLower(string(line[1]))
+	}
+	if section == "peers" {
+		return protocol.BulkStringReply([]byte("# Peers\r\n" + cluster.peersInfo()))
+	}
+	reply := cluster.db.Execute(conn, line)
+	if section != "all" && section != "everything" && section != "default" {
+		return reply
+	}
+	info, ok := protocol.FetchBulkString(reply)
+	if !ok {
+		return reply
+	}
+	return protocol.BulkStringReply([]byte(string(info) + "\r\n# Peers\r\n" + cluster.peersInfo()))
+}
+
+func (c *Cluster) peersInfo() string {
+	peers := c.peers()
+	builder := strings.Builder{}
+	builder.WriteString(fmt.Sprintf("connected_peers:%d\r\n", len(peers)))
+	for i, peer := range peers {
+		p, ok := c.getPool(peer)
+		if !ok {
+			continue
+		}
+		state, trips := p.breaker.status()
+		builder.WriteString(fmt.Sprintf("peer%d:addr=%s,shared=%d,active=%d,idle=%d,inflight=%d,requests=%d,failures=%d,rejected=%d,"+
+			"borrow_timeouts=%d,validation_failures=%d,breaker=%s,breaker_trips=%d\r\n",
+			i, peer, p.sharedCount(), p.pool.GetNumActive(), p.pool.GetNumIdle(), atomic.LoadInt64(&p.inflight),
+			atomic.LoadInt64(&p.requests), atomic.LoadInt64(&p.failures), atomic.LoadInt64(&p.rejected),
+			atomic.LoadInt64(&p.timeouts), p.pool.GetDestroyedByBorrowValidationCount(), state, trips))
+	}
+	return builder.String()
+}
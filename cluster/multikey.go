@@ -0,0 +1,181 @@
+package cluster
+
+import (
+	"fmt"
+	"godis-learn/interface/redis"
+	"godis-learn/lib/utils"
+	"godis-learn/redis/protocol"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type lineMaker func(peer string, keys []string) redis.Line
+
+func execDel(cluster *Cluster, conn redis.Connection, line redis.Line) redis.Reply {
+	return sumIntReplies(cluster, conn, line)
+}
+
+func execExists(cluster *Cluster, conn redis.Connection, line redis.Line) redis.Reply {
+	return sumIntReplies(cluster, conn, line)
+}
+
+func execMGet(cluster *Cluster, conn redis.Connection, line redis.Line) redis.Reply {
+	if len(line) < 2 {
+		return protocol.ArgumentCountErrorReply([]byte("mget"))
+	}
+	keys := lineToKeys(line.CommandContent())
+	groupMap := groupBy(cluster, keys)
+	if len(groupMap) == 1 {
+		for peer := range groupMap {
+			return cluster.relayFunc(cluster, peer, conn, line)
+		}
+	}
+	replies, errReply := scatter(cluster, conn, groupMap, func(_ string, keys []string) redis.Line {
+		return utils.StringsWithNameToLine("MGET", utils.StringsToLine(keys...))
+	})
+	if errReply != nil {
+		return errReply
+	}
+	valueMap := make(map[string]redis.Reply, len(keys))
+	for peer, reply := range replies {
+		values, ok := fetchElements(reply)
+		group := groupMap[peer]
+		if !ok || len(values) != len(group) {
+			return protocol.NewErrorReply([]byte(fmt.Sprintf("ERR unexpected MGET reply from node %s", peer)))
+		}
+		for i, key := range group {
+			valueMap[key] = values[i]
+		}
+	}
+	res := make([]redis.Reply, len(keys))
+	for i, key := range keys {
+		res[i] = valueMap[key]
+	}
+	return protocol.ContainingReply(res)
+}
+
+func execMSet(cluster *Cluster, conn redis.Connection, line redis.Line) redis.Reply {
+	content := line.CommandContent()
+	if len(content) == 0 || len(content)&1 == 1 {
+		return protocol.ArgumentCountErrorReply([]byte("mset"))
+	}
+	valueMap := make(map[string][]byte, len(content)>>1)
+	keys := make([]string, 0, len(content)>>1)
+	for i := 0; i < len(content); i += 2 {
+		key := string(content[i])
+		if _, ok := valueMap[key]; !ok {
+			keys = append(keys, key)
+		}
+		valueMap[key] = content[i+1]
+	}
+	groupMap := groupBy(cluster, keys)
+	if len(groupMap) == 1 {
+		for peer := range groupMap {
+			return cluster.relayFunc(cluster, peer, conn, line)
+		}
+	}
+	lineMap := make(map[string]redis.Line, len(groupMap))
+	for peer, group := range groupMap {
+		subLine := utils.StringsToLine("MSET")
+		for _, key := range group {
+			subLine = append(subLine, []byte(key), valueMap[key])
+		}
+		lineMap[peer] = subLine
+	}
+	co := newCoordinator(cluster, conn)
+	if errReply := co.prepareAll(lineMap); errReply != nil {
+		return errReply
+	}
+	if _, errReply := co.commit(); errReply != nil {
+		return errReply
+	}
+	return protocol.OkReply()
+}
+
+func sumIntReplies(cluster *Cluster, conn redis.Connection, line redis.Line) redis.Reply {
+	cmdName := line.CommandName()
+	if len(line) < 2 {
+		return protocol.ArgumentCountErrorReply(cmdName)
+	}
+	groupMap := groupBy(cluster, lineToKeys(line.CommandContent()))
+	if len(groupMap) == 1 {
+		for peer := range groupMap {
+			return cluster.relayFunc(cluster, peer, conn, line)
+		}
+	}
+	replies, errReply := scatter(cluster, conn, groupMap, func(_ string, keys []string) redis.Line {
+		return utils.StringsWithNameToLine(string(cmdName), utils.StringsToLine(keys...))
+	})
+	if errReply != nil {
+		return errReply
+	}
+	var sum int64
+	for peer, reply := range replies {
+		code, ok := protocol.FetchCode(reply)
+		if !ok {
+			return protocol.NewErrorReply([]byte(fmt.Sprintf("ERR unexpected %s reply from node %s", cmdName, peer)))
+		}
+		sum += code
+	}
+	return protocol.IntReply(sum)
+}
+
+func scatter(cluster *Cluster, conn redis.Connection, groupMap map[string][]string, maker lineMaker) (map[string]redis.Reply, redis.Reply) {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	replies := make(map[string]redis.Reply, len(groupMap))
+	for peer, keys := range groupMap {
+		wg.Add(1)
+		go func(peer string, subLine redis.Line) {
+			defer wg.Done()
+			reply := cluster.relayFunc(cluster, peer, conn, subLine)
+			mutex.Lock()
+			replies[peer] = reply
+			mutex.Unlock()
+		}(peer, maker(peer, keys))
+	}
+	wg.Wait()
+	var failed []string
+	for peer, reply := range replies {
+		if protocol.CheckErrorReply(reply) {
+			failed = append(failed, fmt.Sprintf("%s (%s)", peer, strings.TrimSpace(string(reply.GetBytes()[1:]))))
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		info := fmt.Sprintf("ERR %d of %d nodes failed: %s", len(failed), len(groupMap), strings.Join(failed, ", "))
+		return replies, protocol.NewErrorReply([]byte(info))
+	}
+	return replies, nil
+}
+
+func fetchElements(reply redis.Reply) ([]redis.Reply, bool) {
+	if replies, ok := protocol.FetchReplies(reply); ok {
+		return replies, true
+	}
+	if protocol.CheckEmptyArrayReply(reply) {
+		return nil, true
+	}
+	args, ok := protocol.FetchArrayArgs(reply)
+	if !ok {
+		return nil, false
+	}
+	res := make([]redis.Reply, len(args))
+	for i, arg := range args {
+		if arg == nil {
+			res[i] = protocol.NullBulkStringReply()
+		} else {
+			res[i] = protocol.BulkStringReply(arg)
+		}
+	}
+	return res, true
+}
+
+func lineToKeys(args [][]byte) []string {
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i] = string(arg)
+	}
+	return keys
+}
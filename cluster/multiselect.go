@@ -3,6 +3,7 @@ package cluster
 import (
 	"bytes"
 	"encoding/base64"
+	"fmt"
 	"godis-learn/config"
 	"godis-learn/database"
 	"godis-learn/interface/redis"
@@ -39,7 +40,10 @@ func execMulti(cluster *Cluster, conn redis.Connection) redis.Reply {
 	}
 	groupMap := groupBy(cluster, keys)
 	if len(groupMap) > 1 {
-		return protocol.NewErrorReply([]byte("ERR MULTI commands transaction must within one slot in cluster mode"))
+		if len(watching) > 0 {
+			return protocol.NewErrorReply([]byte("ERR WATCH keys of a transaction spanning several nodes are not supported in cluster mode"))
+		}
+		return execMultiAcrossNodes(cluster, conn, lines)
 	}
 	peer := ""
 	for p := range groupMap {
@@ -96,6 +100,56 @@ func execMultiOnAnotherNode(cluster *Cluster, conn redis.Connection, peer string
 	return decoded
 }
 
+func execMultiAcrossNodes(cluster *Cluster, conn redis.Connection, lines []redis.Line) redis.Reply {
+	peerLines := make(map[string][]redis.Line)
+	peerIndexes := make(map[string][]int)
+	for i, line := range lines {
+		rKeys, wKeys := database.RelatedKeys(line)
+		lineGroup := groupBy(cluster, append(rKeys, wKeys...))
+		if len(lineGroup) > 1 {
+			return protocol.NewErrorReply([]byte(fmt.Sprintf("ERR keys of command '%s' must within one node in cluster mode", line.CommandName())))
+		}
+		peer := cluster.self
+		for p := range lineGroup {
+			peer = p
+		}
+		peerLines[peer] = append(peerLines[peer], line)
+		peerIndexes[peer] = append(peerIndexes[peer], i)
+	}
+	lineMap := make(map[string]redis.Line, len(peerLines))
+	for peer, pLines := range peerLines {
+		lineMap[peer] = append(utils.StringsToLine(batchStr), encodeCmdLines(pLines)...)
+	}
+	co := newCoordinator(cluster, conn)
+	if errReply := co.prepareAll(lineMap); errReply != nil {
+		return errReply
+	}
+	commitReplies, errReply := co.commit()
+	if errReply != nil {
+		return errReply
+	}
+	res := make([]redis.Reply, len(lines))
+	for peer, reply := range commitReplies {
+		args, ok := protocol.FetchArrayArgs(reply)
+		if !ok {
+			return protocol.NewErrorReply([]byte("ERR unexpected commit reply from " + peer))
+		}
+		decoded, err := decodeToContaining(args)
+		if err != nil {
+			return protocol.NewErrorReply([]byte(err.Error()))
+		}
+		replies, _ := protocol.FetchReplies(decoded)
+		indexes := peerIndexes[peer]
+		if len(replies) != len(indexes) {
+			return protocol.NewErrorReply([]byte("ERR unexpected commit reply from " + peer))
+		}
+		for i, index := range indexes {
+			res[index] = replies[i]
+		}
+	}
+	return protocol.ContainingReply(res)
+}
+
 func execRelayedMulti(cluster *Cluster, conn redis.Connection, line redis.Line) redis.Reply {
 	if len(line) < 2 {
 		return protocol.ArgumentCountErrorReply([]byte("_exec"))
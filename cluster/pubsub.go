@@ -0,0 +1,120 @@
+package cluster
+
+import (
+	"godis-learn/interface/redis"
+	"godis-learn/lib/consistenthash"
+	"godis-learn/lib/utils"
+	"godis-learn/redis/protocol"
+	"sort"
+	"sync"
+)
+
+const (
+	publishStr  = "_publish"
+	spublishStr = "_spublish"
+)
+
+// execPublish 先投递给本节点的订阅者，再通过节点间连接广播给其他节点，返回全部节点的接收者数量
+func execPublish(cluster *Cluster, conn redis.Connection, line redis.Line) redis.Reply {
+	if len(line) != 3 {
+		return protocol.ArgumentCountErrorReply([]byte("publish"))
+	}
+	reply := cluster.db.Execute(conn, line)
+	receivers, ok := protocol.FetchCode(reply)
+	if !ok {
+		return reply
+	}
+	receivers += cluster.broadcast(conn, utils.StringsWithNameToLine(publishStr, line.CommandContent()))
+	return protocol.IntReply(receivers)
+}
+
+// execRelayedPublish 处理其他节点广播过来的消息，只投递给本节点的订阅者
+func execRelayedPublish(cluster *Cluster, conn redis.Connection, line redis.Line) redis.Reply {
+	if len(line) != 3 {
+		return protocol.ArgumentCountErrorReply([]byte(publishStr))
+	}
+	return cluster.db.Execute(conn, utils.StringsWithNameToLine("PUBLISH", line.CommandContent()))
+}
+
+// execSSubscribe 订阅分片频道，重定向模式下频道必须由当前节点负责，
+// 代理模式下可以在任意节点订阅，消息由负责该频道的节点转发过来
+func execSSubscribe(cluster *Cluster, conn redis.Connection, line redis.Line) redis.Reply {
+	if len(line) < 2 {
+		return protocol.ArgumentCountErrorReply([]byte("ssubscribe"))
+	}
+	if picker, ok := cluster.picker.(*consistenthash.SlotPicker); ok {
+		slot := consistenthash.KeySlot(string(line[1]))
+		for _, channel := range line[2:] {
+			if consistenthash.KeySlot(string(channel)) != slot {
+				return protocol.NewErrorReply([]byte("CROSSSLOT Keys in request don't hash to the same slot"))
+			}
+		}
+		if owner := picker.NodeOfSlot(slot); cluster.redirectMode && owner != cluster.self {
+			return movedReply(slot, owner)
+		}
+	}
+	return cluster.db.Execute(conn, line)
+}
+
+// execSPublish 把分片消息交给 PeerPicker 选出的节点发布，由该节点投递并转发给其他节点的订阅者，
+// 同一个分片频道的消息因此只经过一个节点，保持发布顺序
+func execSPublish(cluster *Cluster, conn redis.Connection, line redis.Line) redis.Reply {
+	if len(line) != 3 {
+		return protocol.ArgumentCountErrorReply([]byte("spublish"))
+	}
+	channel := string(line[1])
+	owner := cluster.picker.PickNode(channel)
+	if owner != cluster.self {
+		if cluster.redirectMode {
+			return movedReply(consistenthash.KeySlot(channel), owner)
+		}
+		return cluster.relayFunc(cluster, owner, conn, line)
+	}
+	reply := cluster.db.Execute(conn, line)
+	receivers, ok := protocol.FetchCode(reply)
+	if !ok || cluster.redirectMode {
+		// 重定向模式下订阅者都连接在负责该频道的节点上
+		return reply
+	}
+	receivers += cluster.broadcast(conn, utils.StringsWithNameToLine(spublishStr, line.CommandContent()))
+	return protocol.IntReply(receivers)
+}
+
+func execRelayedSPublish(cluster *Cluster, conn redis.Connection, line redis.Line) redis.Reply {
+	if len(line) != 3 {
+		return protocol.ArgumentCountErrorReply([]byte(spublishStr))
+	}
+	return cluster.db.Execute(conn, utils.StringsWithNameToLine("SPUBLISH", line.CommandContent()))
+}
+
+// broadcast 并发地把命令发送给所有其他节点，返回各节点回复的整数之和，无法连接的节点会被忽略
+func (c *Cluster) broadcast(conn redis.Connection, line redis.Line) int64 {
+	var total int64
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range c.peers() {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			if code, ok := protocol.FetchCode(c.relayFunc(c, peer, conn, line)); ok {
+				mutex.Lock()
+				total += code
+				mutex.Unlock()
+			}
+		}(peer)
+	}
+	wg.Wait()
+	return total
+}
+
+// peers 返回当前已知的其他节点
+func (c *Cluster) peers() []string {
+	c.poolMutex.RLock()
+	peers := make([]string, 0, len(c.connPoolMap))
+	for peer := range c.connPoolMap {
+		peers = append(peers, peer)
+	}
+	c.poolMutex.RUnlock()
+	sort.Strings(peers)
+	return peers
+}
@@ -0,0 +1,528 @@
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"godis-learn/config"
+	"godis-learn/interface/dbinterface"
+	"godis-learn/interface/redis"
+	"godis-learn/lib/consistenthash"
+	"godis-learn/lib/logger"
+	"godis-learn/lib/utils"
+	"godis-learn/redis/connection"
+	"godis-learn/redis/protocol"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	rebalanceIdle    = "idle"
+	rebalanceRunning = "running"
+	rebalanceDone    = "done"
+	rebalanceAborted = "aborted"
+	rebalanceFailed  = "failed"
+
+	// migrateBatchSize 每批迁移的 slot 数量，同一批 slot 的来源节点和目标节点相同
+	migrateBatchSize = 128
+	// maxMigrateRetries 迁移单个 key 期间 key 被反复修改时重新发送的最大次数
+	maxMigrateRetries = 16
+)
+
+// rebalancer 记录当前节点发起的重新分片任务的进度
+type rebalancer struct {
+	mutex     sync.Mutex
+	state     string
+	aborting  bool
+	total     int
+	moved     int
+	keys      int64
+	current   string
+	lastError string
+	startTime time.Time
+}
+
+type slotMove struct {
+	slot int
+	src  string
+	dst  string
+}
+
+func clusterAddNode(cluster *Cluster, picker *consistenthash.SlotPicker, conn redis.Connection, args redis.Line) redis.Reply {
+	if len(args) != 1 && !(len(args) == 2 && string(bytes.ToLower(args[1])) == "local") {
+		return protocol.ArgumentCountErrorReply([]byte("cluster|addnode"))
+	}
+	node := string(args[0])
+	if _, port := splitAddr(node); port == 0 {
+		return protocol.NewErrorReply([]byte(fmt.Sprintf("ERR Invalid node address %s", node)))
+	}
+	others := picker.Nodes()
+	if !cluster.joinNode(node) {
+		if len(args) == 2 {
+			return protocol.OkReply()
+		}
+		return protocol.NewErrorReply([]byte(fmt.Sprintf("ERR node %s is already in the cluster", node)))
+	}
+	if len(args) == 2 {
+		return protocol.OkReply()
+	}
+	// 通知其它节点，并让新节点得知现有节点和 slot 分配情况
+	for _, peer := range others {
+		if peer == cluster.self {
+			continue
+		}
+		reply := cluster.send(peer, conn, utils.StringsToLine("CLUSTER", "ADDNODE", node, "LOCAL"))
+		if protocol.CheckErrorReply(reply) {
+			return reply
+		}
+	}
+	for _, peer := range others {
+		reply := cluster.send(node, conn, utils.StringsToLine("CLUSTER", "ADDNODE", peer, "LOCAL"))
+		if protocol.CheckErrorReply(reply) {
+			return reply
+		}
+	}
+	for _, r := range picker.SlotRanges() {
+		reply := cluster.send(node, conn, utils.StringsToLine("CLUSTER", "SETSLOTRANGE",
+			strconv.Itoa(r.Start), strconv.Itoa(r.End), r.Node))
+		if protocol.CheckErrorReply(reply) {
+			return reply
+		}
+	}
+	return protocol.OkReply()
+}
+
+func clusterDelNode(cluster *Cluster, picker *consistenthash.SlotPicker, conn redis.Connection, args redis.Line) redis.Reply {
+	if len(args) != 1 && !(len(args) == 2 && string(bytes.ToLower(args[1])) == "local") {
+		return protocol.ArgumentCountErrorReply([]byte("cluster|delnode"))
+	}
+	node, ok := resolveNode(picker, string(args[0]))
+	if !ok {
+		if len(args) == 2 {
+			return protocol.OkReply()
+		}
+		return protocol.NewErrorReply([]byte(fmt.Sprintf("ERR I don't know about node %s", args[0])))
+	}
+	if node == cluster.self && len(args) == 1 {
+		return protocol.NewErrorReply([]byte("ERR I tried hard but I can't forget myself..."))
+	}
+	if !cluster.forgetNode(node) {
+		return protocol.NewErrorReply([]byte(fmt.Sprintf("ERR node %s still serves slots, drain it first", node)))
+	}
+	if len(args) == 2 {
+		return protocol.OkReply()
+	}
+	for _, peer := range picker.Nodes() {
+		if peer == cluster.self {
+			continue
+		}
+		reply := cluster.send(peer, conn, utils.StringsToLine("CLUSTER", "DELNODE", node, "LOCAL"))
+		if protocol.CheckErrorReply(reply) {
+			return reply
+		}
+	}
+	return protocol.OkReply()
+}
+
+func clusterSetSlotRange(picker *consistenthash.SlotPicker, args redis.Line) redis.Reply {
+	if len(args) != 3 {
+		return protocol.ArgumentCountErrorReply([]byte("cluster|setslotrange"))
+	}
+	start, err1 := strconv.Atoi(string(args[0]))
+	end, err2 := strconv.Atoi(string(args[1]))
+	if err1 != nil || err2 != nil || start < 0 || end >= consistenthash.SlotCount || start > end {
+		return protocol.NewErrorReply([]byte("ERR Invalid or out of range slot"))
+	}
+	node, ok := resolveNode(picker, string(args[2]))
+	if !ok {
+		return protocol.NewErrorReply([]byte(fmt.Sprintf("ERR I don't know about node %s", args[2])))
+	}
+	for slot := start; slot <= end; slot++ {
+		picker.SetSlotOwner(slot, node)
+	}
+	return protocol.OkReply()
+}
+
+func parseSlot(arg []byte) (int, bool) {
+	slot, err := strconv.Atoi(string(arg))
+	if err != nil || slot < 0 || slot >= consistenthash.SlotCount {
+		return 0, false
+	}
+	return slot, true
+}
+
+func clusterGetKeysInSlot(cluster *Cluster, conn redis.Connection, args redis.Line) redis.Reply {
+	if len(args) != 2 {
+		return protocol.ArgumentCountErrorReply([]byte("cluster|getkeysinslot"))
+	}
+	slot, ok := parseSlot(args[0])
+	if !ok {
+		return protocol.NewErrorReply([]byte("ERR Invalid or out of range slot"))
+	}
+	count, err := strconv.Atoi(string(args[1]))
+	if err != nil || count < 0 {
+		return protocol.NewErrorReply([]byte("ERR Invalid number of keys"))
+	}
+	keys := make([][]byte, 0)
+	cluster.db.ForEach(conn.GetDBIndex(), func(key string, _ *dbinterface.EntryValue, _ *time.Time) bool {
+		if len(keys) >= count {
+			return false
+		}
+		if consistenthash.KeySlot(key) == slot {
+			keys = append(keys, []byte(key))
+		}
+		return true
+	})
+	return protocol.ArrayReply(keys)
+}
+
+func clusterCountKeysInSlot(cluster *Cluster, conn redis.Connection, args redis.Line) redis.Reply {
+	if len(args) != 1 {
+		return protocol.ArgumentCountErrorReply([]byte("cluster|countkeysinslot"))
+	}
+	slot, ok := parseSlot(args[0])
+	if !ok {
+		return protocol.NewErrorReply([]byte("ERR Invalid or out of range slot"))
+	}
+	count := 0
+	cluster.db.ForEach(conn.GetDBIndex(), func(key string, _ *dbinterface.EntryValue, _ *time.Time) bool {
+		if consistenthash.KeySlot(key) == slot {
+			count++
+		}
+		return true
+	})
+	return protocol.IntReply(int64(count))
+}
+
+// clusterMigrateSlots 在迁移源节点上执行，把给定 slot 中所有数据库的 key 逐个 DUMP 后 RESTORE 到目标节点
+func clusterMigrateSlots(cluster *Cluster, picker *consistenthash.SlotPicker, args redis.Line) redis.Reply {
+	if len(args) < 2 {
+		return protocol.ArgumentCountErrorReply([]byte("cluster|migrateslots"))
+	}
+	target, ok := resolveNode(picker, string(args[0]))
+	if !ok {
+		return protocol.NewErrorReply([]byte(fmt.Sprintf("ERR I don't know about node %s", args[0])))
+	}
+	slotSet := make(map[int]struct{}, len(args)-1)
+	for _, arg := range args[1:] {
+		slot, valid := parseSlot(arg)
+		if !valid {
+			return protocol.NewErrorReply([]byte("ERR Invalid or out of range slot"))
+		}
+		if dst, migrating := cluster.slots.migratingTo(slot); !migrating || dst != target {
+			return protocol.NewErrorReply([]byte(fmt.Sprintf("ERR slot %d is not migrating to %s", slot, target)))
+		}
+		slotSet[slot] = struct{}{}
+	}
+	moved := int64(0)
+	for dbIndex := 0; dbIndex < config.Properties.DatabaseCount; dbIndex++ {
+		keys := make([]string, 0)
+		cluster.db.ForEach(dbIndex, func(key string, _ *dbinterface.EntryValue, _ *time.Time) bool {
+			if _, ok := slotSet[consistenthash.KeySlot(key)]; ok {
+				keys = append(keys, key)
+			}
+			return true
+		})
+		conn := connection.NewClientConn(nil)
+		conn.SelectDB(dbIndex)
+		for _, key := range keys {
+			migrated, errReply := cluster.migrateKey(conn, target, key)
+			if errReply != nil {
+				return errReply
+			}
+			if migrated {
+				moved++
+			}
+		}
+	}
+	return protocol.IntReply(moved)
+}
+
+// migrateKey 在 key 的读锁内生成 DUMP 并用 WATCH 记录版本，释放锁之后再向目标节点发送 RESTORE，迁移期间 key 仍然可以读写。
+// 之后持有写锁检查版本，key 没有被修改时删除本地的 key，被修改时在锁内重新生成 DUMP，释放锁发送之后再次检查，
+// 最多重试 maxMigrateRetries 次。迁移结束之前 key 一直由当前节点负责，即使在此期间被删除，客户端也不会被转向目标节点
+func (c *Cluster) migrateKey(conn redis.Connection, target string, key string) (bool, redis.Reply) {
+	dbIndex := conn.GetDBIndex()
+	keys := []string{key}
+	watchConn := connection.NewClientConn(nil)
+	watchConn.SelectDB(dbIndex)
+	c.db.RWLockKeys(dbIndex, keys, nil)
+	restoreLine, errReply := c.dumpKey(conn, key)
+	if restoreLine == nil {
+		c.db.RWUnlockKeys(dbIndex, keys, nil)
+		return false, errReply
+	}
+	c.slots.setMoving(dbIndex, key, true)
+	defer c.slots.setMoving(dbIndex, key, false)
+	c.db.Execute(watchConn, utils.StringsToLine("WATCH", key))
+	version := watchConn.GetWatching()[key]
+	c.db.RWUnlockKeys(dbIndex, keys, nil)
+
+	migrated := true
+	for i := 0; i <= maxMigrateRetries; i++ {
+		if reply := c.relayFunc(c, target, conn, restoreLine); protocol.CheckErrorReply(reply) {
+			return false, reply
+		}
+		c.db.RWLockKeys(dbIndex, nil, keys)
+		c.db.Execute(watchConn, utils.StringsToLine("WATCH", key))
+		if watchConn.GetWatching()[key] == version {
+			c.db.ExecWithLock(conn, utils.StringsToLine("DEL", key))
+			c.db.RWUnlockKeys(dbIndex, nil, keys)
+			return migrated, nil
+		}
+		// 发送 RESTORE 期间 key 被修改了，目标节点上的值已经过时
+		version = watchConn.GetWatching()[key]
+		restoreLine, errReply = c.dumpKey(conn, key)
+		c.db.RWUnlockKeys(dbIndex, nil, keys)
+		if errReply != nil {
+			return false, errReply
+		}
+		migrated = restoreLine != nil
+		if !migrated {
+			// key 在此期间被删除，没有客户端被转向目标节点，可以直接删除目标节点上的值
+			restoreLine = utils.StringsToLine(askStr, "DEL", key)
+		}
+	}
+	return false, protocol.NewErrorReply([]byte(fmt.Sprintf("TRYAGAIN key %s kept changing during migration", key)))
+}
+
+// dumpKey 生成把 key 写入目标节点的 RESTORE 命令，key 不存在时返回 nil，调用者需要持有 key 的锁
+func (c *Cluster) dumpKey(conn redis.Connection, key string) (redis.Line, redis.Reply) {
+	dumped := c.db.ExecWithLock(conn, utils.StringsToLine("DUMP", key))
+	if protocol.CheckErrorReply(dumped) {
+		return nil, dumped
+	}
+	payload, ok := protocol.FetchBulkString(dumped)
+	if !ok {
+		return nil, nil
+	}
+	ttl, _ := protocol.FetchCode(c.db.ExecWithLock(conn, utils.StringsToLine("PTTL", key)))
+	if ttl == -2 {
+		return nil, nil
+	} else if ttl < 0 {
+		ttl = 0
+	}
+	restoreLine := utils.StringsToLine(askStr, "RESTORE", key, strconv.FormatInt(ttl, 10), "", "REPLACE")
+	restoreLine[4] = payload
+	return restoreLine, nil
+}
+
+func clusterRebalance(cluster *Cluster, picker *consistenthash.SlotPicker, args redis.Line) redis.Reply {
+	if len(args) == 0 {
+		return protocol.ArgumentCountErrorReply([]byte("cluster|rebalance"))
+	}
+	r := cluster.rebalance
+	switch string(bytes.ToLower(args[0])) {
+	case "start":
+		drain := make(map[string]bool)
+		if len(args) > 1 {
+			if string(bytes.ToLower(args[1])) != "drain" || len(args) == 2 {
+				return protocol.SyntaxErrorReply()
+			}
+			for _, arg := range args[2:] {
+				node, ok := resolveNode(picker, string(arg))
+				if !ok {
+					return protocol.NewErrorReply([]byte(fmt.Sprintf("ERR I don't know about node %s", arg)))
+				}
+				drain[node] = true
+			}
+		}
+		moves, err := planRebalance(picker, drain)
+		if err != nil {
+			return protocol.NewErrorReply([]byte("ERR " + err.Error()))
+		}
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if r.state == rebalanceRunning {
+			return protocol.NewErrorReply([]byte("ERR a rebalance is already in progress"))
+		}
+		r.state = rebalanceRunning
+		r.aborting = false
+		r.total = len(moves)
+		r.moved = 0
+		r.keys = 0
+		r.current = ""
+		r.lastError = ""
+		r.startTime = time.Now()
+		go cluster.runRebalance(moves)
+		return protocol.IntReply(int64(len(moves)))
+	case "status":
+		return r.status()
+	case "abort":
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if r.state != rebalanceRunning {
+			return protocol.NewErrorReply([]byte("ERR no rebalance is in progress"))
+		}
+		r.aborting = true
+		return protocol.OkReply()
+	}
+	return protocol.SyntaxErrorReply()
+}
+
+// planRebalance 计算每个节点应持有的 slot 数量，把多出的 slot 移给不足的节点，
+// drain 中的节点应持有的 slot 数量为 0
+func planRebalance(picker *consistenthash.SlotPicker, drain map[string]bool) ([]slotMove, error) {
+	counts := picker.SlotCounts()
+	active := make([]string, 0, len(counts))
+	for node := range counts {
+		if !drain[node] {
+			active = append(active, node)
+		}
+	}
+	if len(active) == 0 {
+		return nil, errors.New("no node left to receive slots")
+	}
+	sort.Strings(active)
+	want := make(map[string]int, len(counts))
+	for i, node := range active {
+		want[node] = consistenthash.SlotCount / len(active)
+		if i < consistenthash.SlotCount%len(active) {
+			want[node]++
+		}
+	}
+	excess := make(map[string]int, len(counts))
+	for node, count := range counts {
+		excess[node] = count - want[node]
+	}
+	moves := make([]slotMove, 0)
+	receiver := 0
+	for slot := 0; slot < consistenthash.SlotCount; slot++ {
+		owner := picker.NodeOfSlot(slot)
+		if owner != "" && excess[owner] <= 0 {
+			continue
+		}
+		for receiver < len(active) && excess[active[receiver]] >= 0 {
+			receiver++
+		}
+		if receiver == len(active) {
+			break
+		}
+		dst := active[receiver]
+		moves = append(moves, slotMove{slot: slot, src: owner, dst: dst})
+		excess[owner]--
+		excess[dst]++
+	}
+	// 同一对节点之间的迁移放在一起，便于分批执行
+	sort.SliceStable(moves, func(i, j int) bool {
+		if moves[i].src != moves[j].src {
+			return moves[i].src < moves[j].src
+		}
+		return moves[i].dst < moves[j].dst
+	})
+	return moves, nil
+}
+
+func (c *Cluster) runRebalance(moves []slotMove) {
+	r := c.rebalance
+	conn := connection.NewClientConn(nil)
+	conn.SetPassword(config.Properties.RequirePass)
+	for start := 0; start < len(moves); {
+		end := start + 1
+		for end < len(moves) && end-start < migrateBatchSize &&
+			moves[end].src == moves[start].src && moves[end].dst == moves[start].dst {
+			end++
+		}
+		batch := moves[start:end]
+		r.mutex.Lock()
+		aborting := r.aborting
+		r.current = fmt.Sprintf("%s -> %s, slot %d-%d", batch[0].src, batch[0].dst, batch[0].slot, batch[len(batch)-1].slot)
+		r.mutex.Unlock()
+		if aborting {
+			r.finish(rebalanceAborted, "")
+			return
+		}
+		keys, err := c.migrateBatch(conn, batch)
+		r.mutex.Lock()
+		r.keys += keys
+		if err == nil {
+			r.moved += len(batch)
+		}
+		r.mutex.Unlock()
+		if err != nil {
+			logger.Error(fmt.Sprintf("rebalance failed: %v", err))
+			r.finish(rebalanceFailed, err.Error())
+			return
+		}
+		start = end
+	}
+	r.finish(rebalanceDone, "")
+}
+
+// migrateBatch 依次设置 importing 和 migrating 状态、迁移数据，最后通知所有节点 slot 的新归属，
+// 迁移失败时保留 slot 的迁移状态，已经迁走的 key 仍可以通过 ASK 在目标节点访问，重新发起 rebalance 即可继续
+func (c *Cluster) migrateBatch(conn redis.Connection, batch []slotMove) (int64, error) {
+	src, dst := batch[0].src, batch[0].dst
+	slots := make([]string, 0, len(batch))
+	for _, move := range batch {
+		slots = append(slots, strconv.Itoa(move.slot))
+	}
+	keys := int64(0)
+	if src != "" {
+		for _, slot := range slots {
+			if err := c.sendAndCheck(dst, conn, utils.StringsToLine("CLUSTER", "SETSLOT", slot, "IMPORTING", src)); err != nil {
+				return 0, err
+			}
+			if err := c.sendAndCheck(src, conn, utils.StringsToLine("CLUSTER", "SETSLOT", slot, "MIGRATING", dst)); err != nil {
+				return 0, err
+			}
+		}
+		reply := c.send(src, conn, utils.StringsWithNameToLine("CLUSTER", utils.StringsToLine(append([]string{"MIGRATESLOTS", dst}, slots...)...)))
+		if protocol.CheckErrorReply(reply) {
+			return 0, fmt.Errorf("migrate from %s to %s: %s", src, dst, reply.(redis.ErrorReply).Error())
+		}
+		keys, _ = protocol.FetchCode(reply)
+	}
+	picker := c.picker.(*consistenthash.SlotPicker)
+	for _, node := range picker.Nodes() {
+		for _, slot := range slots {
+			if err := c.sendAndCheck(node, conn, utils.StringsToLine("CLUSTER", "SETSLOT", slot, "NODE", dst)); err != nil {
+				return keys, err
+			}
+		}
+	}
+	return keys, nil
+}
+
+func (c *Cluster) sendAndCheck(node string, conn redis.Connection, line redis.Line) error {
+	reply := c.send(node, conn, line)
+	if protocol.CheckErrorReply(reply) {
+		return fmt.Errorf("%s on %s: %s", bytes.Join(line, []byte(" ")), node, reply.(redis.ErrorReply).Error())
+	}
+	return nil
+}
+
+func (r *rebalancer) finish(state string, lastError string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.state = state
+	r.current = ""
+	r.lastError = lastError
+}
+
+func (r *rebalancer) status() redis.Reply {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	elapsed := int64(0)
+	if !r.startTime.IsZero() {
+		elapsed = time.Since(r.startTime).Milliseconds()
+	}
+	return protocol.ContainingReply([]redis.Reply{
+		protocol.BulkStringReply([]byte("state")),
+		protocol.BulkStringReply([]byte(r.state)),
+		protocol.BulkStringReply([]byte("slots-total")),
+		protocol.IntReply(int64(r.total)),
+		protocol.BulkStringReply([]byte("slots-moved")),
+		protocol.IntReply(int64(r.moved)),
+		protocol.BulkStringReply([]byte("keys-moved")),
+		protocol.IntReply(r.keys),
+		protocol.BulkStringReply([]byte("current")),
+		protocol.BulkStringReply([]byte(r.current)),
+		protocol.BulkStringReply([]byte("last-error")),
+		protocol.BulkStringReply([]byte(r.lastError)),
+		protocol.BulkStringReply([]byte("elapsed-ms")),
+		protocol.IntReply(elapsed),
+	})
+}
@@ -0,0 +1,260 @@
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"godis-learn/database"
+	"godis-learn/interface/redis"
+	"godis-learn/lib/consistenthash"
+	"godis-learn/lib/utils"
+	"godis-learn/redis/protocol"
+	"strconv"
+	"sync"
+)
+
+const askStr = "_ask"
+
+// slotStates 记录迁移过程中处于 migrating 或 importing 状态的 slot
+type slotStates struct {
+	mutex     sync.RWMutex
+	migrating map[int]string
+	importing map[int]string
+	// moving 是正在发送到目标节点的 key，在迁移完成之前它们由当前节点负责，即使已经被删除也不会转向目标节点
+	moving map[string]struct{}
+}
+
+func newSlotStates() *slotStates {
+	return &slotStates{
+		migrating: make(map[int]string),
+		importing: make(map[int]string),
+		moving:    make(map[string]struct{}),
+	}
+}
+
+func movingKey(dbIndex int, key string) string {
+	return strconv.Itoa(dbIndex) + " " + key
+}
+
+func (s *slotStates) isMoving(dbIndex int, key string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, ok := s.moving[movingKey(dbIndex, key)]
+	return ok
+}
+
+func (s *slotStates) setMoving(dbIndex int, key string, moving bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if moving {
+		s.moving[movingKey(dbIndex, key)] = struct{}{}
+	} else {
+		delete(s.moving, movingKey(dbIndex, key))
+	}
+}
+
+func (s *slotStates) migratingTo(slot int) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	node, ok := s.migrating[slot]
+	return node, ok
+}
+
+func (s *slotStates) importingFrom(slot int) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	node, ok := s.importing[slot]
+	return node, ok
+}
+
+func (s *slotStates) setMigrating(slot int, node string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.importing, slot)
+	s.migrating[slot] = node
+}
+
+func (s *slotStates) setImporting(slot int, node string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.migrating, slot)
+	s.importing[slot] = node
+}
+
+func (s *slotStates) setStable(slot int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.migrating, slot)
+	delete(s.importing, slot)
+}
+
+// route 根据命令涉及的 slot 决定命令的去向，reply 非空时直接返回给客户端，
+// local 表示命令涉及的 key 都由当前节点负责，可以直接交给本地数据库执行
+func (c *Cluster) route(conn redis.Connection, line redis.Line) (reply redis.Reply, local bool) {
+	asking := conn != nil && conn.CheckAsking()
+	if conn != nil {
+		conn.SetAsking(false)
+	}
+	picker, ok := c.picker.(*consistenthash.SlotPicker)
+	if !ok {
+		return nil, false
+	}
+	keys := distinctKeys(line)
+	if len(keys) == 0 {
+		return nil, false
+	}
+	if c.clusterDown() {
+		return protocol.NewErrorReply([]byte("CLUSTERDOWN The cluster is down")), false
+	}
+	slot := consistenthash.KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if consistenthash.KeySlot(key) != slot {
+			if c.redirectMode {
+				return protocol.NewErrorReply([]byte("CROSSSLOT Keys in request don't hash to the same slot")), false
+			}
+			return nil, false
+		}
+	}
+	owner := picker.NodeOfSlot(slot)
+	if owner == c.self {
+		target, migrating := c.slots.migratingTo(slot)
+		if !migrating {
+			return nil, true
+		}
+		reply, local, relay := c.execMigrating(conn, line, keys)
+		if !relay {
+			return reply, local
+		}
+		// key 已不在本节点，此时已释放 key 锁，转发期间不会阻塞本地对这些 key 的访问
+		if c.redirectMode {
+			return askReply(slot, target), false
+		}
+		return c.relayFunc(c, target, conn, utils.StringsWithNameToLine(askStr, line)), false
+	}
+	if _, importing := c.slots.importingFrom(slot); importing && asking {
+		return nil, true
+	}
+	if !c.redirectMode {
+		return nil, false
+	}
+	if owner == "" {
+		return protocol.NewErrorReply([]byte("CLUSTERDOWN Hash slot not served")), false
+	}
+	return movedReply(slot, owner), false
+}
+
+// execMigrating 锁住 key 再检查是否存在，避免 key 在检查之后被迁走。
+// key 全部存在或正在迁移时在锁内执行，否则返回 relay 为 true，由调用方在释放锁后转发到迁移目标
+func (c *Cluster) execMigrating(conn redis.Connection, line redis.Line, keys []string) (reply redis.Reply, local bool, relay bool) {
+	dbIndex := conn.GetDBIndex()
+	rKeys, wKeys := database.RelatedKeys(line)
+	c.db.RWLockKeys(dbIndex, rKeys, wKeys)
+	defer c.db.RWUnlockKeys(dbIndex, rKeys, wKeys)
+	existing := c.countExisting(conn, keys)
+	moving := len(keys) == 1 && c.slots.isMoving(dbIndex, keys[0])
+	if existing == len(keys) || moving {
+		if conn.CheckMultiMode() {
+			return nil, true, false
+		}
+		return c.db.ExecWithLock(conn, line), false, false
+	} else if existing > 0 {
+		return protocol.NewErrorReply([]byte("TRYAGAIN Multiple keys request during rehashing of slot")), false, false
+	}
+	return nil, false, true
+}
+
+func distinctKeys(line redis.Line) []string {
+	rKeys, wKeys := database.RelatedKeys(line)
+	keys := make([]string, 0, len(rKeys)+len(wKeys))
+	contains := make(map[string]struct{})
+	for _, key := range append(rKeys, wKeys...) {
+		if _, ok := contains[key]; !ok {
+			contains[key] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (c *Cluster) countExisting(conn redis.Connection, keys []string) int {
+	reply := c.db.ExecWithLock(conn, utils.StringsWithNameToLine("EXISTS", utils.StringsToLine(keys...)))
+	code, _ := protocol.FetchCode(reply)
+	return int(code)
+}
+
+func execAsking(_ *Cluster, conn redis.Connection, line redis.Line) redis.Reply {
+	if len(line) != 1 {
+		return protocol.ArgumentCountErrorReply([]byte("asking"))
+	}
+	conn.SetAsking(true)
+	return protocol.OkReply()
+}
+
+// execAsk 由迁移源节点转发而来，相当于带着 ASKING 标记执行命令
+func execAsk(cluster *Cluster, conn redis.Connection, line redis.Line) redis.Reply {
+	if len(line) < 2 {
+		return protocol.ArgumentCountErrorReply([]byte(askStr))
+	}
+	conn.SetAsking(true)
+	return cluster.Execute(conn, line[1:])
+}
+
+func clusterSetSlot(cluster *Cluster, picker *consistenthash.SlotPicker, args redis.Line) redis.Reply {
+	if len(args) < 2 {
+		return protocol.ArgumentCountErrorReply([]byte("cluster|setslot"))
+	}
+	slot, err := strconv.Atoi(string(args[0]))
+	if err != nil || slot < 0 || slot >= consistenthash.SlotCount {
+		return protocol.NewErrorReply([]byte("ERR Invalid or out of range slot"))
+	}
+	action := string(bytes.ToLower(args[1]))
+	if action == "stable" {
+		cluster.slots.setStable(slot)
+		return protocol.OkReply()
+	}
+	if len(args) != 3 {
+		return protocol.ArgumentCountErrorReply([]byte("cluster|setslot"))
+	}
+	node, ok := resolveNode(picker, string(args[2]))
+	if !ok {
+		return protocol.NewErrorReply([]byte(fmt.Sprintf("ERR I don't know about node %s", args[2])))
+	}
+	switch action {
+	case "migrating":
+		if picker.NodeOfSlot(slot) != cluster.self {
+			return protocol.NewErrorReply([]byte(fmt.Sprintf("ERR I'm not the owner of hash slot %d", slot)))
+		}
+		cluster.slots.setMigrating(slot, node)
+	case "importing":
+		if picker.NodeOfSlot(slot) == cluster.self {
+			return protocol.NewErrorReply([]byte(fmt.Sprintf("ERR I'm already the owner of hash slot %d", slot)))
+		}
+		cluster.slots.setImporting(slot, node)
+	case "node":
+		if node == cluster.self && picker.NodeOfSlot(slot) != cluster.self {
+			cluster.bumpEpoch()
+		}
+		picker.SetSlotOwner(slot, node)
+		cluster.slots.setStable(slot)
+	default:
+		return protocol.SyntaxErrorReply()
+	}
+	return protocol.OkReply()
+}
+
+// resolveNode 允许使用节点 ID 或者节点地址来指定节点
+func resolveNode(picker *consistenthash.SlotPicker, arg string) (string, bool) {
+	for _, node := range picker.Nodes() {
+		if node == arg || nodeID(node) == arg {
+			return node, true
+		}
+	}
+	return "", false
+}
+
+func movedReply(slot int, node string) redis.Reply {
+	return protocol.NewErrorReply([]byte(fmt.Sprintf("MOVED %d %s", slot, node)))
+}
+
+func askReply(slot int, node string) redis.Reply {
+	return protocol.NewErrorReply([]byte(fmt.Sprintf("ASK %d %s", slot, node)))
+}
@@ -0,0 +1,85 @@
+package cluster
+
+import (
+	"godis-learn/interface/redis"
+	"godis-learn/lib/utils"
+	"godis-learn/redis/protocol"
+)
+
+func execRename(cluster *Cluster, conn redis.Connection, line redis.Line) redis.Reply {
+	if len(line) != 3 {
+		return protocol.ArgumentCountErrorReply([]byte("rename"))
+	}
+	reply := renameAcrossNodes(cluster, conn, line, false)
+	if protocol.CheckErrorReply(reply) {
+		return reply
+	}
+	return protocol.OkReply()
+}
+
+func execRenameNX(cluster *Cluster, conn redis.Connection, line redis.Line) redis.Reply {
+	if len(line) != 3 {
+		return protocol.ArgumentCountErrorReply([]byte("renamenx"))
+	}
+	reply := renameAcrossNodes(cluster, conn, line, true)
+	if protocol.CheckErrorReply(reply) {
+		if reply.(redis.ErrorReply).Error() == keyExistsInfo {
+			return protocol.IntReply(0)
+		}
+		return reply
+	}
+	return protocol.IntReply(1)
+}
+
+func renameAcrossNodes(cluster *Cluster, conn redis.Connection, line redis.Line, nx bool) redis.Reply {
+	src, dst := string(line[1]), string(line[2])
+	srcPeer, dstPeer := cluster.picker.PickNode(src), cluster.picker.PickNode(dst)
+	if srcPeer == dstPeer {
+		reply := cluster.relayFunc(cluster, srcPeer, conn, line)
+		if code, ok := protocol.FetchCode(reply); ok && code == 0 {
+			return protocol.NewErrorReply([]byte(keyExistsInfo))
+		}
+		return reply
+	}
+	co := newCoordinator(cluster, conn)
+	reply := co.prepare(srcPeer, utils.StringsToLine(renameFromStr, src))
+	if protocol.CheckErrorReply(reply) {
+		co.rollback()
+		return reply
+	}
+	encoded, ok := protocol.FetchArrayArgs(reply)
+	if !ok {
+		co.rollback()
+		return protocol.NewErrorReply([]byte("ERR unexpected dump reply"))
+	}
+	decoded, err := decodeToContaining(encoded)
+	if err != nil {
+		co.rollback()
+		return protocol.NewErrorReply([]byte(err.Error()))
+	}
+	replies, _ := protocol.FetchReplies(decoded)
+	dumped := make([]redis.Line, 0, len(replies))
+	for _, r := range replies {
+		dumpedLine, ok := protocol.FetchArrayArgs(r)
+		if !ok || len(dumpedLine) < 2 {
+			co.rollback()
+			return protocol.NewErrorReply([]byte("ERR unexpected dump reply"))
+		}
+		dumpedLine[1] = []byte(dst)
+		dumped = append(dumped, dumpedLine)
+	}
+	mode := "replace"
+	if nx {
+		mode = "nx"
+	}
+	renameToLine := utils.StringsToLine(renameToStr, dst, mode)
+	renameToLine = append(renameToLine, encodeCmdLines(dumped)...)
+	if reply = co.prepare(dstPeer, renameToLine); protocol.CheckErrorReply(reply) {
+		co.rollback()
+		return reply
+	}
+	if _, errReply := co.commit(); errReply != nil {
+		return errReply
+	}
+	return protocol.OkReply()
+}
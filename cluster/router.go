@@ -1,5 +1,79 @@
 package cluster
 
+import (
+	"godis-learn/interface/redis"
+	"godis-learn/redis/protocol"
+)
+
 func newRouter() map[string]CommandFunc {
-	return nil
+	routerMap := make(map[string]CommandFunc)
+	routerMap["ping"] = ping
+	routerMap["quit"] = ping
+	routerMap["cluster"] = execCluster
+	routerMap["info"] = execInfo
+	routerMap["asking"] = execAsking
+	routerMap[askStr] = execAsk
+	routerMap[gossipStr] = execGossip
+	routerMap[mfStartStr] = execMFStart
+	routerMap["watch"] = execWatch
+	routerMap[relayStr] = execRelayedMulti
+	routerMap["prepare"] = execPrepare
+	routerMap["commit"] = execCommit
+	routerMap["rollback"] = execRollback
+	routerMap["release"] = execRelease
+	routerMap[txStatusStr] = execTxStatus
+
+	// 订阅关系保存在客户端所连接的节点上
+	routerMap["subscribe"] = localFunc
+	routerMap["unsubscribe"] = localFunc
+	routerMap["psubscribe"] = localFunc
+	routerMap["punsubscribe"] = localFunc
+	routerMap["sunsubscribe"] = localFunc
+	routerMap["pubsub"] = localFunc
+	// 副本连接 master 进行复制
+	routerMap["psync"] = localFunc
+	routerMap["replconf"] = localFunc
+	routerMap["ssubscribe"] = execSSubscribe
+	routerMap["publish"] = execPublish
+	routerMap["spublish"] = execSPublish
+	routerMap[publishStr] = execRelayedPublish
+	routerMap[spublishStr] = execRelayedSPublish
+
+	routerMap["get"] = defaultFunc
+	routerMap["set"] = defaultFunc
+	routerMap["setnx"] = defaultFunc
+	routerMap["expire"] = defaultFunc
+	routerMap["pexpire"] = defaultFunc
+	routerMap["pexpireat"] = defaultFunc
+	routerMap["ttl"] = defaultFunc
+	routerMap["pttl"] = defaultFunc
+	routerMap["persist"] = defaultFunc
+	routerMap["type"] = defaultFunc
+	routerMap["dump"] = defaultFunc
+	routerMap["restore"] = defaultFunc
+
+	routerMap["del"] = execDel
+	routerMap["exists"] = execExists
+	routerMap["mget"] = execMGet
+	routerMap["mset"] = execMSet
+	routerMap["rename"] = execRename
+	routerMap["renamenx"] = execRenameNX
+	return routerMap
+}
+
+func defaultFunc(cluster *Cluster, conn redis.Connection, line redis.Line) redis.Reply {
+	if len(line) < 2 {
+		return protocol.ArgumentCountErrorReply(line.CommandName())
+	}
+	peer := cluster.picker.PickNode(string(line[1]))
+	return cluster.relayFunc(cluster, peer, conn, line)
+}
+
+// localFunc 直接交给本节点执行
+func localFunc(cluster *Cluster, conn redis.Connection, line redis.Line) redis.Reply {
+	return cluster.db.Execute(conn, line)
+}
+
+func ping(cluster *Cluster, conn redis.Connection, line redis.Line) redis.Reply {
+	return cluster.db.Execute(conn, line)
 }
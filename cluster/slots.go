@@ -0,0 +1,245 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"godis-learn/interface/redis"
+	"godis-learn/lib/consistenthash"
+	"godis-learn/redis/protocol"
+	"net"
+	"strconv"
+)
+
+const clusterBusPortOffset = 10000
+
+func execCluster(cluster *Cluster, conn redis.Connection, line redis.Line) redis.Reply {
+	if len(line) < 2 {
+		return protocol.ArgumentCountErrorReply([]byte("cluster"))
+	}
+	subCmd := string(bytes.ToLower(line[1]))
+	args := line[2:]
+	if subCmd == "keyslot" {
+		if len(args) != 1 {
+			return protocol.ArgumentCountErrorReply([]byte("cluster|keyslot"))
+		}
+		return protocol.IntReply(int64(consistenthash.KeySlot(string(args[0]))))
+	}
+	picker, ok := cluster.picker.(*consistenthash.SlotPicker)
+	if !ok {
+		return protocol.NewErrorReply([]byte("ERR hash slots are disabled, set cluster-picker to slot"))
+	}
+	switch subCmd {
+	case "myid":
+		return protocol.BulkStringReply([]byte(nodeID(cluster.self)))
+	case "slots":
+		return clusterSlots(picker)
+	case "shards":
+		return clusterShards(cluster, picker)
+	case "nodes":
+		return protocol.BulkStringReply([]byte(clusterNodes(cluster, picker)))
+	case "info":
+		return protocol.BulkStringReply([]byte(clusterInfo(cluster, picker)))
+	case "meet":
+		return clusterMeet(cluster, args)
+	case "forget":
+		return clusterForget(cluster, picker, args)
+	case "replicate":
+		return clusterReplicate(cluster, picker, args)
+	case "replicas", "slaves":
+		return clusterReplicas(cluster, picker, args)
+	case "failover":
+		return clusterFailover(cluster, args)
+	case "setslot":
+		return clusterSetSlot(cluster, picker, args)
+	case "setslotrange":
+		return clusterSetSlotRange(picker, args)
+	case "addnode":
+		return clusterAddNode(cluster, picker, conn, args)
+	case "delnode":
+		return clusterDelNode(cluster, picker, conn, args)
+	case "getkeysinslot":
+		return clusterGetKeysInSlot(cluster, conn, args)
+	case "countkeysinslot":
+		return clusterCountKeysInSlot(cluster, conn, args)
+	case "migrateslots":
+		return clusterMigrateSlots(cluster, picker, args)
+	case "rebalance":
+		return clusterRebalance(cluster, picker, args)
+	}
+	return protocol.NewErrorReply([]byte(fmt.Sprintf("ERR unknown subcommand '%s'", line[1])))
+}
+
+func clusterSlots(picker *consistenthash.SlotPicker) redis.Reply {
+	ranges := picker.SlotRanges()
+	res := make([]redis.Reply, 0, len(ranges))
+	for _, r := range ranges {
+		host, port := splitAddr(r.Node)
+		res = append(res, protocol.ContainingReply([]redis.Reply{
+			protocol.IntReply(int64(r.Start)),
+			protocol.IntReply(int64(r.End)),
+			protocol.ContainingReply([]redis.Reply{
+				protocol.BulkStringReply([]byte(host)),
+				protocol.IntReply(int64(port)),
+				protocol.BulkStringReply([]byte(nodeID(r.Node))),
+			}),
+		}))
+	}
+	return protocol.ContainingReply(res)
+}
+
+// clusterShards 按 master 分组，每个分片包含 master 的 slot 以及 master 和它的副本，
+// 角色、复制偏移量和健康状态来自集群总线，本节点的偏移量直接从数据库读取
+func clusterShards(cluster *Cluster, picker *consistenthash.SlotPicker) redis.Reply {
+	slotMap := make(map[string][]redis.Reply)
+	for _, r := range picker.SlotRanges() {
+		slotMap[r.Node] = append(slotMap[r.Node], protocol.IntReply(int64(r.Start)), protocol.IntReply(int64(r.End)))
+	}
+	selfOffset, _ := cluster.db.ReplicationOffset()
+	bus := cluster.bus
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	nodes := picker.Nodes()
+	known := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		known[node] = true
+	}
+	var masters []string
+	shardMap := make(map[string][]redis.Reply)
+	for _, node := range nodes {
+		role, shard, health := "master", node, "online"
+		var offset int64
+		if node == cluster.self {
+			offset = selfOffset
+		}
+		if m, ok := bus.members[node]; ok {
+			if m.master != "" {
+				role = "replica"
+				if known[m.master] {
+					shard = m.master
+				}
+			}
+			if m.flag != "" {
+				health = "failed"
+			}
+			if node != cluster.self {
+				offset = m.offset
+			}
+		}
+		if _, ok := shardMap[shard]; !ok {
+			masters = append(masters, shard)
+		}
+		host, port := splitAddr(node)
+		nodeInfo := protocol.ContainingReply([]redis.Reply{
+			protocol.BulkStringReply([]byte("id")),
+			protocol.BulkStringReply([]byte(nodeID(node))),
+			protocol.BulkStringReply([]byte("port")),
+			protocol.IntReply(int64(port)),
+			protocol.BulkStringReply([]byte("ip")),
+			protocol.BulkStringReply([]byte(host)),
+			protocol.BulkStringReply([]byte("endpoint")),
+			protocol.BulkStringReply([]byte(host)),
+			protocol.BulkStringReply([]byte("role")),
+			protocol.BulkStringReply([]byte(role)),
+			protocol.BulkStringReply([]byte("replication-offset")),
+			protocol.IntReply(offset),
+			protocol.BulkStringReply([]byte("health")),
+			protocol.BulkStringReply([]byte(health)),
+		})
+		// master 排在分片的第一个
+		if role == "master" {
+			shardMap[shard] = append([]redis.Reply{nodeInfo}, shardMap[shard]...)
+		} else {
+			shardMap[shard] = append(shardMap[shard], nodeInfo)
+		}
+	}
+	res := make([]redis.Reply, 0, len(masters))
+	for _, master := range masters {
+		res = append(res, protocol.ContainingReply([]redis.Reply{
+			protocol.BulkStringReply([]byte("slots")),
+			protocol.ContainingReply(slotMap[master]),
+			protocol.BulkStringReply([]byte("nodes")),
+			protocol.ContainingReply(shardMap[master]),
+		}))
+	}
+	return protocol.ContainingReply(res)
+}
+
+func clusterNodes(cluster *Cluster, picker *consistenthash.SlotPicker) string {
+	var buf bytes.Buffer
+	for _, line := range clusterNodeLines(cluster, picker) {
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+func clusterNodeLines(cluster *Cluster, picker *consistenthash.SlotPicker) [][]byte {
+	slotMap := make(map[string][]string)
+	for _, r := range picker.SlotRanges() {
+		if r.Start == r.End {
+			slotMap[r.Node] = append(slotMap[r.Node], strconv.Itoa(r.Start))
+		} else {
+			slotMap[r.Node] = append(slotMap[r.Node], fmt.Sprintf("%d-%d", r.Start, r.End))
+		}
+	}
+	bus := cluster.bus
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	nodes := picker.Nodes()
+	res := make([][]byte, 0, len(nodes))
+	for _, node := range nodes {
+		host, port := splitAddr(node)
+		role, master := "master", "-"
+		var epoch uint64
+		var pingSent, pongReceived int64
+		link, flags := "connected", ""
+		if m, ok := bus.members[node]; ok {
+			epoch = m.epoch
+			if m.master != "" {
+				role, master = "slave", nodeID(m.master)
+			}
+			if !m.pingSent.IsZero() {
+				pingSent = m.pingSent.UnixMilli()
+			}
+			if !m.pongReceived.IsZero() {
+				pongReceived = m.pongReceived.UnixMilli()
+			}
+			if m.flag == flagPFail {
+				flags = ",fail?"
+			} else if m.flag == flagFail {
+				flags = ",fail"
+			}
+			if m.flag != "" {
+				link = "disconnected"
+			}
+		}
+		flags = role + flags
+		if node == cluster.self {
+			flags = "myself," + flags
+		}
+		line := fmt.Sprintf("%s %s:%d@%d %s %s %d %d %d %s", nodeID(node), host, port, port+clusterBusPortOffset,
+			flags, master, pingSent, pongReceived, epoch, link)
+		for _, slots := range slotMap[node] {
+			line += " " + slots
+		}
+		res = append(res, []byte(line))
+	}
+	return res
+}
+
+// nodeID 由节点地址计算出 40 位的十六进制 ID，各节点无需通信即可得到一致的结果
+func nodeID(addr string) string {
+	sum := sha1.Sum([]byte(addr))
+	return hex.EncodeToString(sum[:])
+}
+
+func splitAddr(addr string) (string, int) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
@@ -0,0 +1,531 @@
+package cluster
+
+import (
+	"fmt"
+	"godis-learn/database"
+	"godis-learn/interface/redis"
+	"godis-learn/lib/logger"
+	"godis-learn/lib/timewheel"
+	"godis-learn/lib/utils"
+	"godis-learn/redis/connection"
+	"godis-learn/redis/protocol"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	createdStatus = iota
+	preparedStatus
+	// committedStatus 表示已经执行，但仍然持有锁和 undo log，等待协调者确认全部参与者都已提交
+	committedStatus
+	releasedStatus
+	rolledBackStatus
+)
+
+// 协调者对事务的决定，参与者超时后通过 _txstatus 查询
+const (
+	// pendingDecision 表示还在 prepare 阶段，参与者超时的时候协调者会放弃事务
+	pendingDecision = "pending"
+	// committingDecision 表示已经开始发送 commit，参与者必须等待最终的决定
+	committingDecision = "committing"
+	committedDecision  = "committed"
+	abortedDecision    = "aborted"
+)
+
+const (
+	maxLockTime       = 3 * time.Second
+	waitBeforeCleanTx = 2 * maxLockTime
+
+	batchStr      = "_batch"
+	txStatusStr   = "_txstatus"
+	renameFromStr = "renamefrom"
+	renameToStr   = "renameto"
+	keyExistsInfo = "ERR target key already exists"
+)
+
+// Transaction 是参与者一侧的 TCC 事务，prepare 时锁定相关的 key，commit 时执行并记录 undo log，
+// 直到协调者发送 release 或 rollback 才释放锁
+type Transaction struct {
+	id string
+	// coordinator 是协调者的地址，超时之后向它查询事务的结果
+	coordinator string
+	line        redis.Line
+	lines       []redis.Line
+	cluster     *Cluster
+	conn        redis.Connection
+	dbIndex     int
+	rKeys       []string
+	wKeys       []string
+	keysLocked  bool
+	undoLogs    [][]redis.Line
+	status      int8
+	mutex       *sync.Mutex
+}
+
+func NewTransaction(cluster *Cluster, conn redis.Connection, id, coordinator string, line redis.Line) *Transaction {
+	txConn := connection.NewClientConn(nil)
+	txConn.SelectDB(conn.GetDBIndex())
+	return &Transaction{
+		id:          id,
+		coordinator: coordinator,
+		line:        line,
+		cluster:     cluster,
+		conn:        txConn,
+		dbIndex:     conn.GetDBIndex(),
+		status:      createdStatus,
+		mutex:       &sync.Mutex{},
+	}
+}
+
+func (tx *Transaction) prepare() redis.Reply {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	reply := tx.resolveLines()
+	if reply != nil && protocol.CheckErrorReply(reply) {
+		return reply
+	}
+	tx.lockKeys()
+	switch string(tx.line.CommandName()) {
+	case renameFromStr:
+		dumped := tx.cluster.db.GetUndoLogs(tx.dbIndex, tx.lines[0])
+		if len(dumped) < 2 {
+			tx.unlockKeys()
+			return protocol.NewErrorReply([]byte("ERR no such key"))
+		}
+		reply = protocol.ArrayReply(encodeCmdLines(dumped[1:]))
+	case renameToStr:
+		if string(tx.line[2]) == "nx" {
+			existsLine := utils.StringsToLine("EXISTS", string(tx.line[1]))
+			if code, _ := protocol.FetchCode(tx.cluster.db.ExecWithLock(tx.conn, existsLine)); code > 0 {
+				tx.unlockKeys()
+				return protocol.NewErrorReply([]byte(keyExistsInfo))
+			}
+		}
+	}
+	tx.status = preparedStatus
+	tx.scheduleCheck()
+	if reply == nil {
+		reply = protocol.OkReply()
+	}
+	return reply
+}
+
+func (tx *Transaction) resolveLines() redis.Reply {
+	cmdName := string(tx.line.CommandName())
+	args := tx.line.CommandContent()
+	switch cmdName {
+	case batchStr:
+		decoded, err := decodeToContaining(args)
+		if err != nil {
+			return protocol.NewErrorReply([]byte(err.Error()))
+		}
+		replies, _ := protocol.FetchReplies(decoded)
+		for _, r := range replies {
+			line, ok := protocol.FetchArrayArgs(r)
+			if !ok {
+				return protocol.NewErrorReply([]byte("ERR illegal batch line"))
+			}
+			tx.lines = append(tx.lines, line)
+		}
+	case renameFromStr:
+		if len(args) != 1 {
+			return protocol.ArgumentCountErrorReply(tx.line.CommandName())
+		}
+		tx.lines = []redis.Line{utils.StringsWithNameToLine("DEL", args)}
+	case renameToStr:
+		if len(args) < 3 {
+			return protocol.ArgumentCountErrorReply(tx.line.CommandName())
+		}
+		decoded, err := decodeToContaining(args[2:])
+		if err != nil {
+			return protocol.NewErrorReply([]byte(err.Error()))
+		}
+		tx.lines = []redis.Line{utils.StringsToLine("DEL", string(args[0]))}
+		replies, _ := protocol.FetchReplies(decoded)
+		for _, r := range replies {
+			line, ok := protocol.FetchArrayArgs(r)
+			if !ok {
+				return protocol.NewErrorReply([]byte("ERR illegal dumped line"))
+			}
+			tx.lines = append(tx.lines, line)
+		}
+	default:
+		tx.lines = []redis.Line{tx.line}
+	}
+	for _, line := range tx.lines {
+		rKeys, wKeys := database.RelatedKeys(line)
+		tx.rKeys = append(tx.rKeys, rKeys...)
+		tx.wKeys = append(tx.wKeys, wKeys...)
+	}
+	return nil
+}
+
+func (tx *Transaction) commit() (redis.Reply, bool) {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	if tx.status != preparedStatus {
+		return protocol.NewErrorReply([]byte("ERR transaction is not prepared: " + tx.id)), false
+	}
+	timewheel.Cancel(tx.timeoutTaskKey())
+	replies := make([]redis.Reply, 0, len(tx.lines))
+	for _, line := range tx.lines {
+		tx.undoLogs = append(tx.undoLogs, tx.cluster.db.GetUndoLogs(tx.dbIndex, line))
+		reply := tx.cluster.db.ExecWithLock(tx.conn, line)
+		// 与 EXEC 一致，批量执行时单条命令的错误只作为它自己的回复，不回滚整个事务
+		if protocol.CheckErrorReply(reply) && !tx.isBatch() {
+			tx.rollbackWithLock()
+			return reply, false
+		}
+		replies = append(replies, reply)
+	}
+	// 其它参与者可能提交失败，需要保留锁和 undo log 直到协调者做出最终决定
+	tx.status = committedStatus
+	tx.scheduleCheck()
+	switch {
+	case tx.isBatch():
+		return encodeContaining(protocol.ContainingReply(replies)), true
+	case len(replies) == 1:
+		return replies[0], true
+	}
+	return protocol.OkReply(), true
+}
+
+func (tx *Transaction) isBatch() bool {
+	return string(tx.line.CommandName()) == batchStr
+}
+
+// rollbackWithLock 撤销事务的修改。已经 release 的事务释放了锁，其它命令可能已经修改了这些 key，不能再回滚
+func (tx *Transaction) rollbackWithLock() bool {
+	if tx.status == rolledBackStatus || tx.status == releasedStatus {
+		return false
+	}
+	timewheel.Cancel(tx.timeoutTaskKey())
+	tx.lockKeys()
+	for i := len(tx.undoLogs) - 1; i >= 0; i-- {
+		for _, line := range tx.undoLogs[i] {
+			tx.cluster.db.ExecWithLock(tx.conn, line)
+		}
+	}
+	tx.undoLogs = nil
+	tx.unlockKeys()
+	tx.status = rolledBackStatus
+	tx.scheduleClean()
+	return true
+}
+
+// releaseWithLock 在协调者确认全部参与者都已提交之后释放锁并丢弃 undo log
+func (tx *Transaction) releaseWithLock() bool {
+	if tx.status != committedStatus {
+		return false
+	}
+	timewheel.Cancel(tx.timeoutTaskKey())
+	tx.unlockKeys()
+	tx.undoLogs = nil
+	tx.status = releasedStatus
+	tx.scheduleClean()
+	return true
+}
+
+// scheduleCheck 在 maxLockTime 之后向协调者查询事务的结果。参与者不能自行回滚已经 prepare 的事务，
+// 否则协调者随后发送的 commit 会使事务只在部分节点生效
+func (tx *Transaction) scheduleCheck() {
+	timewheel.JobWithDelay(tx.checkDecision, tx.timeoutTaskKey(), maxLockTime)
+}
+
+// checkDecision 按照协调者的决定回滚或者释放事务。协调者还没有做出决定或者无法联系时继续持有锁，稍后再次查询
+func (tx *Transaction) checkDecision() {
+	tx.mutex.Lock()
+	status := tx.status
+	tx.mutex.Unlock()
+	if status != preparedStatus && status != committedStatus {
+		return
+	}
+	decision := tx.queryDecision()
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	if tx.status != status {
+		// 查询期间收到了协调者的命令
+		return
+	}
+	switch {
+	case decision == abortedDecision:
+		logger.Info("abort transaction: " + tx.id)
+		tx.rollbackWithLock()
+	case decision == committedDecision && status == committedStatus:
+		tx.releaseWithLock()
+	default:
+		tx.scheduleCheck()
+	}
+}
+
+func (tx *Transaction) queryDecision() string {
+	line := utils.StringsToLine(txStatusStr, tx.id)
+	var reply redis.Reply
+	if tx.coordinator == tx.cluster.self {
+		reply = execTxStatus(tx.cluster, tx.conn, line)
+	} else {
+		reply = tx.cluster.relayFunc(tx.cluster, tx.coordinator, tx.conn, line)
+	}
+	decision, ok := protocol.FetchStatus(reply)
+	if !ok {
+		logger.Warn(fmt.Sprintf("query transaction %s from %s failed: %s", tx.id, tx.coordinator, reply.GetBytes()))
+	}
+	return string(decision)
+}
+
+func (tx *Transaction) lockKeys() {
+	if !tx.keysLocked {
+		tx.cluster.db.RWLockKeys(tx.dbIndex, tx.rKeys, tx.wKeys)
+		tx.keysLocked = true
+	}
+}
+
+func (tx *Transaction) unlockKeys() {
+	if tx.keysLocked {
+		tx.cluster.db.RWUnlockKeys(tx.dbIndex, tx.rKeys, tx.wKeys)
+		tx.keysLocked = false
+	}
+}
+
+func (tx *Transaction) scheduleClean() {
+	timewheel.JobWithDelay(func() {
+		tx.cluster.txMap.Delete(tx.id)
+	}, "tx-clean:"+tx.cluster.self+":"+tx.id, waitBeforeCleanTx)
+}
+
+// timeoutTaskKey 带上节点地址，同一进程中的多个节点参与同一事务时不会互相取消定时任务
+func (tx *Transaction) timeoutTaskKey() string {
+	return "tx:" + tx.cluster.self + ":" + tx.id
+}
+
+// execPrepare 处理 prepare txID coordinator command args...
+func execPrepare(cluster *Cluster, conn redis.Connection, line redis.Line) redis.Reply {
+	if len(line) < 4 {
+		return protocol.ArgumentCountErrorReply([]byte("prepare"))
+	}
+	txID := string(line[1])
+	tx := NewTransaction(cluster, conn, txID, string(line[2]), line[3:])
+	if !cluster.txMap.PutIfAbsent(txID, tx) {
+		return protocol.NewErrorReply([]byte("ERR duplicated transaction: " + txID))
+	}
+	reply := tx.prepare()
+	if protocol.CheckErrorReply(reply) {
+		cluster.txMap.Delete(txID)
+	}
+	return reply
+}
+
+func execCommit(cluster *Cluster, _ redis.Connection, line redis.Line) redis.Reply {
+	if len(line) != 2 {
+		return protocol.ArgumentCountErrorReply([]byte("commit"))
+	}
+	txID := string(line[1])
+	raw, ok := cluster.txMap.Get(txID)
+	if !ok {
+		return protocol.NewErrorReply([]byte("ERR transaction not found: " + txID))
+	}
+	reply, _ := raw.(*Transaction).commit()
+	return reply
+}
+
+func execRollback(cluster *Cluster, _ redis.Connection, line redis.Line) redis.Reply {
+	if len(line) != 2 {
+		return protocol.ArgumentCountErrorReply([]byte("rollback"))
+	}
+	raw, ok := cluster.txMap.Get(string(line[1]))
+	if !ok {
+		return protocol.IntReply(0)
+	}
+	tx := raw.(*Transaction)
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	if !tx.rollbackWithLock() {
+		return protocol.IntReply(0)
+	}
+	return protocol.IntReply(1)
+}
+
+func execRelease(cluster *Cluster, _ redis.Connection, line redis.Line) redis.Reply {
+	if len(line) != 2 {
+		return protocol.ArgumentCountErrorReply([]byte("release"))
+	}
+	raw, ok := cluster.txMap.Get(string(line[1]))
+	if !ok {
+		return protocol.IntReply(0)
+	}
+	tx := raw.(*Transaction)
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	if !tx.releaseWithLock() {
+		return protocol.IntReply(0)
+	}
+	return protocol.IntReply(1)
+}
+
+// execTxStatus 回复参与者对事务结果的查询。协调者不知道的事务没有进入 commit 阶段，或者早已结束，视为放弃
+func execTxStatus(cluster *Cluster, _ redis.Connection, line redis.Line) redis.Reply {
+	if len(line) != 2 {
+		return protocol.ArgumentCountErrorReply([]byte(txStatusStr))
+	}
+	raw, ok := cluster.coordinators.Get(string(line[1]))
+	if !ok {
+		return protocol.StatusReply([]byte(abortedDecision))
+	}
+	return protocol.StatusReply([]byte(raw.(*coordinator).participantTimeout()))
+}
+
+// coordinator 是 TCC 事务的发起者，负责向各个参与者发送 prepare、commit、release 和 rollback，
+// 并记录事务的决定，供超时的参与者查询
+type coordinator struct {
+	cluster      *Cluster
+	conn         redis.Connection
+	txID         string
+	mutex        sync.Mutex
+	participants []string
+	decision     string
+}
+
+// newCoordinator 创建协调者并登记到 coordinators 中，每个协调者最终都要调用 commit 或者 rollback
+func newCoordinator(cluster *Cluster, conn redis.Connection) *coordinator {
+	co := &coordinator{
+		cluster:  cluster,
+		conn:     conn,
+		txID:     strconv.FormatInt(cluster.idGenerator.NextID(), 10),
+		decision: pendingDecision,
+	}
+	cluster.coordinators.Put(co.txID, co)
+	return co
+}
+
+func (co *coordinator) send(peer string, line redis.Line) redis.Reply {
+	if peer == co.cluster.self {
+		return router[string(line.CommandName())](co.cluster, co.conn, line)
+	}
+	return co.cluster.relayFunc(co.cluster, peer, co.conn, line)
+}
+
+// decide 在当前决定为 from 时改为 to
+func (co *coordinator) decide(from, to string) bool {
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+	if co.decision != from {
+		return false
+	}
+	co.decision = to
+	return true
+}
+
+// finish 记录最终的决定，保留一段时间供没有收到 release 或 rollback 的参与者查询
+func (co *coordinator) finish(decision string) {
+	co.mutex.Lock()
+	co.decision = decision
+	co.mutex.Unlock()
+	timewheel.JobWithDelay(func() {
+		co.cluster.coordinators.Delete(co.txID)
+	}, "co-clean:"+co.cluster.self+":"+co.txID, waitBeforeCleanTx)
+}
+
+// participantTimeout 处理超时参与者的查询，prepare 阶段的事务直接放弃，之后的 commit 会失败并回滚全部参与者
+func (co *coordinator) participantTimeout() string {
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+	if co.decision == pendingDecision {
+		co.decision = abortedDecision
+	}
+	return co.decision
+}
+
+func (co *coordinator) prepare(peer string, line redis.Line) redis.Reply {
+	prepareLine := utils.StringsToLine("Prepare", co.txID, co.cluster.self)
+	prepareLine = append(prepareLine, line...)
+	reply := co.send(peer, prepareLine)
+	if !protocol.CheckErrorReply(reply) {
+		co.mutex.Lock()
+		co.participants = append(co.participants, peer)
+		co.mutex.Unlock()
+	}
+	return reply
+}
+
+func (co *coordinator) prepareAll(lineMap map[string]redis.Line) redis.Reply {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var failed []string
+	for peer, line := range lineMap {
+		wg.Add(1)
+		go func(peer string, line redis.Line) {
+			defer wg.Done()
+			if reply := co.prepare(peer, line); protocol.CheckErrorReply(reply) {
+				mutex.Lock()
+				failed = append(failed, fmt.Sprintf("%s (%s)", peer, strings.TrimSpace(string(reply.GetBytes()[1:]))))
+				mutex.Unlock()
+			}
+		}(peer, line)
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		co.rollback()
+		return protocol.NewErrorReply([]byte("ERR prepare failed on " + strings.Join(failed, ", ")))
+	}
+	return nil
+}
+
+// commit 向所有参与者发送 commit。参与者执行之后仍然持有锁和 undo log，全部成功之后才发送 release，
+// 任何一个参与者失败都回滚全部参与者，事务要么在所有节点生效，要么全部撤销
+func (co *coordinator) commit() (map[string]redis.Reply, redis.Reply) {
+	if !co.decide(pendingDecision, committingDecision) {
+		// 有参与者等待超时，已经放弃了事务
+		co.rollback()
+		return nil, protocol.NewErrorReply([]byte("ERR transaction timed out: " + co.txID))
+	}
+	replies := co.broadcast("Commit")
+	var failedInfo []string
+	for _, peer := range co.participants {
+		if reply := replies[peer]; protocol.CheckErrorReply(reply) {
+			failedInfo = append(failedInfo, fmt.Sprintf("%s (%s)", peer, strings.TrimSpace(string(reply.GetBytes()[1:]))))
+		}
+	}
+	if len(failedInfo) > 0 {
+		co.rollback()
+		return nil, protocol.NewErrorReply([]byte("ERR commit failed on " + strings.Join(failedInfo, ", ")))
+	}
+	co.finish(committedDecision)
+	// release 失败的参与者会在超时之后查询到 committed 并自行释放
+	for peer, reply := range co.broadcast("Release") {
+		if protocol.CheckErrorReply(reply) {
+			logger.Error(fmt.Sprintf("release transaction %s on %s failed: %s", co.txID, peer, reply.GetBytes()))
+		}
+	}
+	return replies, nil
+}
+
+// rollback 放弃事务并回滚全部参与者，包括已经执行了 commit 的参与者，没有收到 rollback 的参与者在超时之后自行回滚
+func (co *coordinator) rollback() {
+	co.finish(abortedDecision)
+	for peer, reply := range co.broadcast("Rollback") {
+		if protocol.CheckErrorReply(reply) {
+			logger.Error(fmt.Sprintf("rollback transaction %s on %s failed: %s", co.txID, peer, reply.GetBytes()))
+		}
+	}
+}
+
+// broadcast 并发地向全部参与者发送 cmd txID，返回各个参与者的回复
+func (co *coordinator) broadcast(cmd string) map[string]redis.Reply {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	replies := make(map[string]redis.Reply, len(co.participants))
+	for _, peer := range co.participants {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			reply := co.send(peer, utils.StringsToLine(cmd, co.txID))
+			mutex.Lock()
+			replies[peer] = reply
+			mutex.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+	return replies
+}
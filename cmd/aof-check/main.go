@@ -0,0 +1,102 @@
+// aof-check 逐条检查 AOF 文件中的命令，报告第一个损坏的位置，使用 --fix 时把文件截断到该位置。
+// 文件以 RDB 前导部分开头时先检查 RDB 部分，再检查之后的命令。
+// 参数为清单文件时按顺序检查清单中的全部文件，只有最后一个文件可以截断，之前的文件损坏时截断会丢失之后的全部写入
+//
+//	aof-check [--fix] <file|manifest>
+package main
+
+import (
+	"flag"
+	"fmt"
+	"godis-learn/persistent"
+	"io"
+	"os"
+)
+
+// checkFile 检查一个文件并把结果输出到 out，返回检查结果与文件大小
+func checkFile(out io.Writer, filename string) (*persistent.CheckResult, int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(file)
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	res := persistent.CheckAOF(file)
+	if res.Preamble {
+		if res.Valid == 0 && res.Err != nil {
+			_, _ = fmt.Fprintf(out, "%s: RDB preamble is corrupted, use rdb-check for details: %v\n", filename, res.Err)
+			return res, info.Size(), nil
+		}
+		_, _ = fmt.Fprintf(out, "%s: RDB preamble is valid\n", filename)
+	}
+	_, _ = fmt.Fprintf(out, "%s: %d commands, %d of %d bytes are valid\n", filename, res.Commands, res.Valid, info.Size())
+	if res.Err == nil {
+		_, _ = fmt.Fprintf(out, "%s: AOF is valid\n", filename)
+	} else {
+		_, _ = fmt.Fprintf(out, "%s: bad format at offset %d: %v\n", filename, res.Valid, res.Err)
+	}
+	return res, info.Size(), nil
+}
+
+// run 解析命令行参数并检查文件，返回进程的退出码：0 表示文件完整或者已经修复，1 表示文件损坏或者出错，2 表示参数错误
+func run(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("aof-check", flag.ContinueOnError)
+	flags.SetOutput(out)
+	fix := flags.Bool("fix", false, "truncate the file to the last valid command")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintln(out, "usage: aof-check [--fix] <file|manifest>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	files := []string{flags.Arg(0)}
+	if persistent.IsManifest(flags.Arg(0)) {
+		var err error
+		files, err = persistent.ManifestFiles(flags.Arg(0))
+		if err != nil {
+			_, _ = fmt.Fprintln(out, err)
+			return 1
+		}
+	}
+	for i, filename := range files {
+		res, size, err := checkFile(out, filename)
+		if err != nil {
+			_, _ = fmt.Fprintln(out, err)
+			return 1
+		}
+		if res.Err == nil {
+			continue
+		}
+		if res.Preamble && res.Valid == 0 {
+			return 1
+		}
+		if i != len(files)-1 {
+			_, _ = fmt.Fprintf(out, "%s is not the last file in the manifest and cannot be fixed by truncation\n", filename)
+			return 1
+		}
+		if !*fix {
+			_, _ = fmt.Fprintln(out, "run with --fix to truncate the file to offset", res.Valid)
+			return 1
+		}
+		if err := os.Truncate(filename, res.Valid); err != nil {
+			_, _ = fmt.Fprintln(out, err)
+			return 1
+		}
+		_, _ = fmt.Fprintf(out, "truncated %s to %d bytes, %d bytes removed\n", filename, res.Valid, size-res.Valid)
+	}
+	return 0
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout))
+}
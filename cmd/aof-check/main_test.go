@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"godis-learn/lib/utils"
+	"godis-learn/redis/protocol"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, filename string, data []byte) {
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	valid := protocol.ArrayReply(utils.StringsToLine("SET", "key", "value")).GetBytes()
+	torn := append(append([]byte{}, valid...), "*3\r\n$3\r\nSET"...)
+	base := filepath.Join(dir, "appendonly.aof.1.base.aof")
+	incr := filepath.Join(dir, "appendonly.aof.2.incr.aof")
+	manifest := filepath.Join(dir, "appendonly.aof.manifest")
+	writeFile(t, base, valid)
+	writeFile(t, incr, torn)
+	writeFile(t, manifest, []byte("file appendonly.aof.1.base.aof seq 1 type b\nfile appendonly.aof.2.incr.aof seq 2 type i\n"))
+
+	var out bytes.Buffer
+	if code := run(nil, &out); code != 2 || !strings.Contains(out.String(), "usage") {
+		t.Errorf("expected usage with exit code 2, got %d: %s", code, out.String())
+	}
+	out.Reset()
+	if code := run([]string{manifest}, &out); code != 1 || !strings.Contains(out.String(), "run with --fix") {
+		t.Errorf("expected exit code 1 without --fix, got %d: %s", code, out.String())
+	}
+	out.Reset()
+	if code := run([]string{"--fix", manifest}, &out); code != 0 || !strings.Contains(out.String(), "truncated") {
+		t.Errorf("expected the last file to be fixed, got %d: %s", code, out.String())
+	}
+	if data, _ := os.ReadFile(incr); !bytes.Equal(data, valid) {
+		t.Errorf("expected %s to be truncated to %d bytes, got %d", incr, len(valid), len(data))
+	}
+	out.Reset()
+	if code := run([]string{manifest}, &out); code != 0 {
+		t.Errorf("expected a valid manifest after fixing, got %d: %s", code, out.String())
+	}
+
+	// 只有最后一个文件可以截断
+	writeFile(t, base, torn)
+	out.Reset()
+	if code := run([]string{"--fix", manifest}, &out); code != 1 || !strings.Contains(out.String(), "not the last file") {
+		t.Errorf("expected a corrupted base file to be rejected, got %d: %s", code, out.String())
+	}
+	if data, _ := os.ReadFile(base); !bytes.Equal(data, torn) {
+		t.Error("expected the base file to be left untouched")
+	}
+}
@@ -0,0 +1,152 @@
+// rdb-check 使用 RDB 解码器遍历文件，按类型和数据库统计 key 的数量、设置了过期时间的 key 以及最大的 key
+//
+//	rdb-check [--top n] <file>
+package main
+
+import (
+	"flag"
+	"fmt"
+	rdb "github.com/hdt3213/rdb/parser"
+	"io"
+	"os"
+	"sort"
+)
+
+type keyInfo struct {
+	db    int
+	key   string
+	typ   string
+	size  int
+	elems int
+}
+
+type dbStats struct {
+	keys    int
+	expires int
+}
+
+type rdbStats struct {
+	keys    int
+	expires int
+	types   map[string]int
+	dbs     map[int]*dbStats
+	top     int
+	// largest 按大小降序保存最大的 top 个 key
+	largest []*keyInfo
+}
+
+func newRDBStats(top int) *rdbStats {
+	return &rdbStats{
+		types: make(map[string]int),
+		dbs:   make(map[int]*dbStats),
+		top:   top,
+	}
+}
+
+func (s *rdbStats) add(obj rdb.RedisObject) {
+	switch obj.GetType() {
+	case rdb.StringType, rdb.ListType, rdb.SetType, rdb.HashType, rdb.ZSetType:
+	default:
+		return
+	}
+	db := s.dbs[obj.GetDBIndex()]
+	if db == nil {
+		db = &dbStats{}
+		s.dbs[obj.GetDBIndex()] = db
+	}
+	s.keys++
+	db.keys++
+	s.types[obj.GetType()]++
+	if obj.GetExpiration() != nil {
+		s.expires++
+		db.expires++
+	}
+	s.addLargest(&keyInfo{
+		db:    obj.GetDBIndex(),
+		key:   obj.GetKey(),
+		typ:   obj.GetType(),
+		size:  obj.GetSize(),
+		elems: obj.GetElemCount(),
+	})
+}
+
+func (s *rdbStats) addLargest(info *keyInfo) {
+	if s.top <= 0 || (len(s.largest) == s.top && info.size <= s.largest[s.top-1].size) {
+		return
+	}
+	i := sort.Search(len(s.largest), func(i int) bool {
+		return s.largest[i].size < info.size
+	})
+	s.largest = append(s.largest, nil)
+	copy(s.largest[i+1:], s.largest[i:])
+	s.largest[i] = info
+	if len(s.largest) > s.top {
+		s.largest = s.largest[:s.top]
+	}
+}
+
+func checkRDB(reader io.Reader, top int) (*rdbStats, error) {
+	stats := newRDBStats(top)
+	err := rdb.NewDecoder(reader).Parse(func(obj rdb.RedisObject) bool {
+		stats.add(obj)
+		return true
+	})
+	return stats, err
+}
+
+func (s *rdbStats) print() {
+	fmt.Printf("keys: %d, expiring: %d\n", s.keys, s.expires)
+	var indexes []int
+	for index := range s.dbs {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		fmt.Printf("db %d: %d keys, %d expiring\n", index, s.dbs[index].keys, s.dbs[index].expires)
+	}
+	for _, typ := range []string{rdb.StringType, rdb.ListType, rdb.SetType, rdb.HashType, rdb.ZSetType} {
+		if s.types[typ] > 0 {
+			fmt.Printf("%s: %d keys\n", typ, s.types[typ])
+		}
+	}
+	if len(s.largest) == 0 {
+		return
+	}
+	fmt.Println("largest keys:")
+	for _, info := range s.largest {
+		fmt.Printf("  db %d %s %q %d bytes", info.db, info.typ, info.key, info.size)
+		if info.typ != rdb.StringType {
+			fmt.Printf(" %d elements", info.elems)
+		}
+		fmt.Println()
+	}
+}
+
+func main() {
+	top := flag.Int("top", 10, "number of largest keys to print")
+	flag.Usage = func() {
+		_, _ = fmt.Fprintln(os.Stderr, "usage: rdb-check [--top n] <file>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	file, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	stats, err := checkRDB(file, *top)
+	stats.print()
+	if err != nil {
+		fmt.Printf("RDB is corrupted after %d keys: %v\n", stats.keys, err)
+		_ = file.Close()
+		os.Exit(1)
+	}
+	fmt.Println("RDB is valid")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"github.com/hdt3213/rdb/core"
+	rdb "github.com/hdt3213/rdb/parser"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckRDB(t *testing.T) {
+	var buf bytes.Buffer
+	encoder := core.NewEncoder(&buf)
+	expireAt := uint64(time.Now().Add(time.Hour).UnixNano() / 1_000_000)
+	steps := []func() error{
+		encoder.WriteHeader,
+		func() error { return encoder.WriteDBHeader(0, 2, 1) },
+		func() error { return encoder.WriteStringObject("small", []byte("v"), core.WithTTL(expireAt)) },
+		func() error { return encoder.WriteStringObject("large", []byte(strings.Repeat("v", 100))) },
+		func() error { return encoder.WriteDBHeader(3, 1, 0) },
+		func() error { return encoder.WriteListObject("list", [][]byte{[]byte("a"), []byte("b")}) },
+		encoder.WriteEnd,
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := checkRDB(bytes.NewReader(buf.Bytes()), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.keys != 3 || stats.expires != 1 || stats.dbs[0].keys != 2 || stats.dbs[3].keys != 1 {
+		t.Errorf("unexpected key counts %+v", stats)
+	}
+	if stats.types[rdb.StringType] != 2 || stats.types[rdb.ListType] != 1 {
+		t.Errorf("unexpected type counts %v", stats.types)
+	}
+	if len(stats.largest) != 2 || stats.largest[0].key != "large" {
+		t.Errorf("expected large to be the largest key, got %+v", stats.largest)
+	}
+
+	if _, err = checkRDB(bytes.NewReader(buf.Bytes()[:buf.Len()-20]), 2); err == nil {
+		t.Error("expected error for truncated RDB")
+	}
+}
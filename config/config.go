@@ -15,6 +15,10 @@ type ServerProperties struct {
 	Port              int      `cfg:"port"`
 	AppendOnly        bool     `cfg:"appendonly"`
 	AppendFilename    string   `cfg:"appendfilename"`
+	AppendFsync       string   `cfg:"appendfsync"`
+	AppendDirname     string   `cfg:"appenddirname"`
+	AOFUseRDBPreamble bool     `cfg:"aof-use-rdb-preamble"`
+	AOFLoadTruncated  bool     `cfg:"aof-load-truncated"`
 	MaxClients        int      `cfg:"maxclients"`
 	RequirePass       string   `cfg:"requirepass"`
 	DatabaseCount     int      `cfg:"databasecount"`
@@ -25,6 +29,36 @@ type ServerProperties struct {
 	ReplTimeout       int      `cfg:"repl-timeout"`
 	Peers             []string `cfg:"peers"`
 	Self              string   `cfg:"self"`
+	// ClusterPicker 默认为 slot，使用与 Redis Cluster 兼容的 16384 个哈希槽；
+	// 使用原来的一致性哈希需要设置为 consistent，两者对同一个 key 选择的节点不同，切换前需要迁移数据
+	ClusterPicker   string `cfg:"cluster-picker"`
+	ClusterRedirect bool   `cfg:"cluster-redirect"`
+	// ClusterNodeTimeout 单位为毫秒，节点超过这段时间没有回复心跳就被认为可能故障
+	ClusterNodeTimeout int `cfg:"cluster-node-timeout"`
+	// 以下为节点之间转发命令使用的连接池配置，时间单位均为毫秒
+	ClusterPoolMaxActive     int `cfg:"cluster-pool-max-active"`
+	ClusterPoolMaxIdle       int `cfg:"cluster-pool-max-idle"`
+	ClusterPoolBorrowTimeout int `cfg:"cluster-pool-borrow-timeout"`
+	ClusterPoolIdleTimeout   int `cfg:"cluster-pool-idle-timeout"`
+	// 连续失败 ClusterBreakerThreshold 次后熔断，ClusterBreakerCooldown 毫秒后放行一次试探请求
+	ClusterBreakerThreshold int `cfg:"cluster-breaker-threshold"`
+	ClusterBreakerCooldown  int `cfg:"cluster-breaker-cooldown"`
+	// ClientMaxSubscriptions 限制每个连接订阅的频道和模式总数，0 表示不限制
+	ClientMaxSubscriptions int `cfg:"client-max-subscriptions"`
+	// ClientOutputBufferLimit 形如 "normal 0 0 0 pubsub 32mb 8mb 60"，每个类别依次为硬限制、软限制和软限制持续的秒数，
+	// 与 Redis 一样可以每行配置一个类别，未指定的类别使用 Redis 的默认值
+	ClientOutputBufferLimit string `cfg:"client-output-buffer-limit,multi"`
+	// NotifyKeyspaceEvents 与 Redis 的 notify-keyspace-events 相同，为空时不发送键空间通知
+	NotifyKeyspaceEvents string `cfg:"notify-keyspace-events"`
+	// AOF 比上次重写后增长了 AutoAOFRewritePercentage 百分比，且不小于 AutoAOFRewriteMinSize 时自动重写，
+	// 百分比为 0 表示关闭自动重写，最小大小可以带 kb、mb 等单位，默认为 64mb
+	AutoAOFRewritePercentage int    `cfg:"auto-aof-rewrite-percentage"`
+	AutoAOFRewriteMinSize    string `cfg:"auto-aof-rewrite-min-size"`
+	// Save 形如 "900 1 300 10"，每两个数字为一条规则，表示距离上次保存 seconds 秒并且至少有 changes 次写入时在后台保存 RDB。
+	// 与 Redis 一样可以每行写一条规则，save "" 清空之前的规则，为空时不自动保存
+	Save string `cfg:"save,multi"`
+	// StopWritesOnBGSaveError 为 yes 时，如果配置了 save 规则并且最近一次保存失败就拒绝写命令，默认为 yes
+	StopWritesOnBGSaveError string `cfg:"stop-writes-on-bgsave-error"`
 }
 
 var Properties *ServerProperties
@@ -50,7 +84,8 @@ func init() {
 
 func parse(reader io.Reader) *ServerProperties {
 	res := &ServerProperties{}
-	m := make(map[string]string)
+	// 同一个配置项可能出现多次，按出现的顺序保存全部的值
+	m := make(map[string][]string)
 	scanner := bufio.NewScanner(reader)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -61,7 +96,8 @@ func parse(reader io.Reader) *ServerProperties {
 		if pivot > 0 && pivot < len(line)-1 {
 			key := line[0:pivot]
 			val := strings.Trim(line[pivot+1:], " ")
-			m[strings.ToLower(key)] = val
+			key = strings.ToLower(key)
+			m[key] = append(m[key], val)
 		}
 	}
 	if err := scanner.Err(); err != nil {
@@ -71,7 +107,21 @@ func parse(reader io.Reader) *ServerProperties {
 	return res
 }
 
-func fillProperties(p *ServerProperties, m map[string]string) {
+// joinValues 合并标记为 multi 的配置项的多行值，值为 "" 时清空之前的值
+func joinValues(values []string) string {
+	var res []string
+	for _, val := range values {
+		if val == `""` {
+			res = res[:0]
+			continue
+		}
+		res = append(res, val)
+	}
+	return strings.Join(res, " ")
+}
+
+// fillProperties 填充配置项，除标记为 multi 的配置项外，重复出现时以最后一次为准
+func fillProperties(p *ServerProperties, m map[string][]string) {
 	fields := reflect.TypeOf(p).Elem()
 	values := reflect.ValueOf(p).Elem()
 	n := fields.NumField()
@@ -82,10 +132,15 @@ func fillProperties(p *ServerProperties, m map[string]string) {
 		if !ok {
 			key = field.Name
 		}
-		val, ok := m[strings.ToLower(key)]
+		key, option, _ := strings.Cut(key, ",")
+		values, ok := m[strings.ToLower(key)]
 		if !ok {
 			continue
 		}
+		val := values[len(values)-1]
+		if option == "multi" {
+			val = joinValues(values)
+		}
 		switch field.Type.Kind() {
 		case reflect.String:
 			fieldVal.SetString(val)
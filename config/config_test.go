@@ -0,0 +1,49 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	p := parse(strings.NewReader(`bind 0.0.0.0
+port 6380
+# save 60 1
+save 900 1
+save 300 10
+save 60 10000
+port 6381
+appendonly yes
+`))
+	if p.Bind != "0.0.0.0" || !p.AppendOnly {
+		t.Errorf("unexpected properties %+v", p)
+	}
+	if p.Port != 6381 {
+		t.Errorf("expected the last port, got %d", p.Port)
+	}
+	if p.Save != "900 1 300 10 60 10000" {
+		t.Errorf("expected all save rules, got %q", p.Save)
+	}
+}
+
+func TestParseOutputBufferLimitLines(t *testing.T) {
+	p := parse(strings.NewReader(`client-output-buffer-limit normal 0 0 0
+client-output-buffer-limit replica 256mb 64mb 60
+client-output-buffer-limit pubsub 32mb 8mb 60
+`))
+	if expected := "normal 0 0 0 replica 256mb 64mb 60 pubsub 32mb 8mb 60"; p.ClientOutputBufferLimit != expected {
+		t.Errorf("expected limits of all classes, got %q", p.ClientOutputBufferLimit)
+	}
+}
+
+func TestParseSaveDisabled(t *testing.T) {
+	for _, raw := range []string{"save \"\"\n", "save 900 1\nsave \"\"\n"} {
+		if p := parse(strings.NewReader(raw)); p.Save != "" {
+			t.Errorf("expected save to be disabled by %q, got %q", raw, p.Save)
+		}
+	}
+	p := parse(strings.NewReader("save \"\"\nsave 300 10\n"))
+	if p.Save != "300 10" {
+		t.Errorf("expected rules after save \"\", got %q", p.Save)
+	}
+}
@@ -0,0 +1,275 @@
+package database
+
+import (
+	"bytes"
+	"github.com/hdt3213/rdb/encoder"
+	"godis-learn/config"
+	"godis-learn/lib/utils"
+	"godis-learn/redis/connection"
+	"godis-learn/redis/protocol"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAutoAOFRewrite(t *testing.T) {
+	defer func() {
+		config.Properties.AppendOnly = false
+		config.Properties.AppendFilename = ""
+		config.Properties.AutoAOFRewritePercentage = 0
+		config.Properties.AutoAOFRewriteMinSize = ""
+	}()
+	config.Properties.AppendOnly = true
+	config.Properties.AppendFilename = filepath.Join(t.TempDir(), "appendonly.aof")
+	config.Properties.AutoAOFRewritePercentage = 100
+	config.Properties.AutoAOFRewriteMinSize = "4kb"
+	db := NewStandaloneServer()
+	conn := connection.NewClientConn(nil)
+	// 反复覆盖同一个 key，重写之后只剩一条命令
+	for i := 0; i < 200; i++ {
+		db.Execute(conn, utils.StringsToLine("SET", "key", strconv.Itoa(i)))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		// 文件一开始为空，重写完成后才会以新的文件大小作为基准
+		status := db.aofHandler.RewriteStatus()
+		if !status.InProgress && status.BaseSize > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected AOF to be rewritten automatically, got %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	db.Close()
+
+	config.Properties.AutoAOFRewritePercentage = 0
+	reloaded := NewStandaloneServer()
+	defer reloaded.Close()
+	if value, _ := protocol.FetchBulkString(reloaded.Execute(conn, utils.StringsToLine("GET", "key"))); string(value) != "199" {
+		t.Errorf("expected 199 after reloading rewritten AOF, got %q", value)
+	}
+}
+
+func TestRewriteDuringWrites(t *testing.T) {
+	defer func() {
+		config.Properties.AppendOnly = false
+		config.Properties.AppendFilename = ""
+	}()
+	config.Properties.AppendOnly = true
+	config.Properties.AppendFilename = filepath.Join(t.TempDir(), "appendonly.aof")
+	db := NewStandaloneServer()
+	conn := connection.NewClientConn(nil)
+	for i := 0; i < 100; i++ {
+		db.Execute(conn, utils.StringsToLine("SET", "key"+strconv.Itoa(i), "old"))
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		writer := connection.NewClientConn(nil)
+		for i := 0; i < 500; i++ {
+			db.Execute(writer, utils.StringsToLine("SET", "key"+strconv.Itoa(i), strconv.Itoa(i)))
+		}
+	}()
+	if err := db.aofHandler.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	db.Close()
+
+	reloaded := NewStandaloneServer()
+	defer reloaded.Close()
+	for i := 0; i < 500; i++ {
+		key := "key" + strconv.Itoa(i)
+		if value, _ := protocol.FetchBulkString(reloaded.Execute(conn, utils.StringsToLine("GET", key))); string(value) != strconv.Itoa(i) {
+			t.Fatalf("expected %s to be %d after reloading, got %q", key, i, value)
+		}
+	}
+}
+
+func TestRewriteInterrupted(t *testing.T) {
+	defer func() {
+		config.Properties.AppendOnly = false
+		config.Properties.AppendFilename = ""
+	}()
+	config.Properties.AppendOnly = true
+	config.Properties.AppendFilename = filepath.Join(t.TempDir(), "appendonly.aof")
+	db := NewStandaloneServer()
+	conn := connection.NewClientConn(nil)
+	db.Execute(conn, utils.StringsToLine("SET", "before", "1"))
+	ctx, err := db.aofHandler.StartRewrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.aofHandler.DoRewrite(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db.Execute(conn, utils.StringsToLine("SET", "before", "2"))
+	db.Execute(conn, utils.StringsToLine("SET", "after", "1"))
+	// 在 FinishRewrite 之前退出，相当于重写过程中崩溃
+	db.Close()
+
+	reloaded := NewStandaloneServer()
+	defer reloaded.Close()
+	for key, expected := range map[string]string{"before": "2", "after": "1"} {
+		if value, _ := protocol.FetchBulkString(reloaded.Execute(conn, utils.StringsToLine("GET", key))); string(value) != expected {
+			t.Errorf("expected %s to be %s after reloading, got %q", key, expected, value)
+		}
+	}
+	if files := aofDirFiles(t); len(files) != 3 {
+		// 清单、原有的增量文件和切换出的增量文件都需要保留，临时文件被删除
+		t.Errorf("unexpected files after reloading: %v", files)
+	}
+}
+
+func TestRewriteWithRDBBase(t *testing.T) {
+	defer func() {
+		config.Properties.AppendOnly = false
+		config.Properties.AppendFilename = ""
+		config.Properties.AOFUseRDBPreamble = false
+	}()
+	config.Properties.AppendOnly = true
+	config.Properties.AppendFilename = filepath.Join(t.TempDir(), "appendonly.aof")
+	config.Properties.AOFUseRDBPreamble = true
+	db := NewStandaloneServer()
+	conn := connection.NewClientConn(nil)
+	db.Execute(conn, utils.StringsToLine("SELECT", "1"))
+	db.Execute(conn, utils.StringsToLine("SET", "key", "1"))
+	if err := db.aofHandler.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	db.Execute(conn, utils.StringsToLine("SET", "key", "2"))
+	db.Close()
+	files := aofDirFiles(t)
+	if len(files) != 3 || !strings.HasSuffix(files[0], ".base.rdb") {
+		t.Fatalf("expected rdb base file, incr file and manifest, got %v", files)
+	}
+
+	reloaded := NewStandaloneServer()
+	defer reloaded.Close()
+	reader := connection.NewClientConn(nil)
+	reloaded.Execute(reader, utils.StringsToLine("SELECT", "1"))
+	if value, _ := protocol.FetchBulkString(reloaded.Execute(reader, utils.StringsToLine("GET", "key"))); string(value) != "2" {
+		t.Errorf("expected 2 after reloading, got %q", value)
+	}
+}
+
+func TestUpgradeSingleFileAOF(t *testing.T) {
+	defer func() {
+		config.Properties.AppendOnly = false
+		config.Properties.AppendFilename = ""
+	}()
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	legacy := protocol.ArrayReply(utils.StringsToLine("SET", "key", "legacy")).GetBytes()
+	if err := os.WriteFile(filename, legacy, 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.Properties.AppendOnly = true
+	config.Properties.AppendFilename = filename
+	db := NewStandaloneServer()
+	defer db.Close()
+	conn := connection.NewClientConn(nil)
+	if value, _ := protocol.FetchBulkString(db.Execute(conn, utils.StringsToLine("GET", "key"))); string(value) != "legacy" {
+		t.Errorf("expected legacy AOF to be loaded, got %q", value)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("expected legacy AOF to be moved into the AOF directory, got %v", err)
+	}
+}
+
+func TestLoadAOFWithRDBPreamble(t *testing.T) {
+	defer func() {
+		config.Properties.AppendOnly = false
+		config.Properties.AppendFilename = ""
+	}()
+	data := &bytes.Buffer{}
+	enc := encoder.NewEncoder(data)
+	if err := enc.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteDBHeader(1, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteStringObject("preamble", []byte("rdb")); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteEnd(); err != nil {
+		t.Fatal(err)
+	}
+	data.Write(protocol.ArrayReply(utils.StringsToLine("SELECT", "1")).GetBytes())
+	data.Write(protocol.ArrayReply(utils.StringsToLine("SET", "tail", "aof")).GetBytes())
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	if err := os.WriteFile(filename, data.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.Properties.AppendOnly = true
+	config.Properties.AppendFilename = filename
+	db := NewStandaloneServer()
+	defer db.Close()
+	conn := connection.NewClientConn(nil)
+	db.Execute(conn, utils.StringsToLine("SELECT", "1"))
+	for key, expected := range map[string]string{"preamble": "rdb", "tail": "aof"} {
+		if value, _ := protocol.FetchBulkString(db.Execute(conn, utils.StringsToLine("GET", key))); string(value) != expected {
+			t.Errorf("expected %s to be %q, got %q", key, expected, value)
+		}
+	}
+}
+
+// aofDirFiles 按文件名顺序返回 AOF 目录中的文件
+func aofDirFiles(t *testing.T) []string {
+	entries, err := os.ReadDir(filepath.Join(filepath.Dir(config.Properties.AppendFilename), "appendonlydir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, entry := range entries {
+		files = append(files, entry.Name())
+	}
+	return files
+}
+
+func TestLoadTruncatedAOF(t *testing.T) {
+	defer func() {
+		config.Properties.AppendOnly = false
+		config.Properties.AppendFilename = ""
+		config.Properties.AOFLoadTruncated = false
+	}()
+	config.Properties.AppendOnly = true
+	config.Properties.AppendFilename = filepath.Join(t.TempDir(), "appendonly.aof")
+	db := NewStandaloneServer()
+	conn := connection.NewClientConn(nil)
+	db.Execute(conn, utils.StringsToLine("SET", "key", "1"))
+	db.Close()
+	// 模拟断电时最后一次写入只完成了一部分
+	incr := filepath.Join(filepath.Dir(config.Properties.AppendFilename), "appendonlydir", aofDirFiles(t)[0])
+	complete, err := os.ReadFile(incr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torn := protocol.ArrayReply(utils.StringsToLine("SET", "key", "2")).GetBytes()
+	if err = os.WriteFile(incr, append(append([]byte{}, complete...), torn[:len(torn)-3]...), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	func() {
+		defer func() {
+			if err := recover(); err == nil {
+				t.Error("expected truncated AOF to be refused")
+			}
+		}()
+		NewStandaloneServer()
+	}()
+
+	config.Properties.AOFLoadTruncated = true
+	reloaded := NewStandaloneServer()
+	defer reloaded.Close()
+	if value, _ := protocol.FetchBulkString(reloaded.Execute(conn, utils.StringsToLine("GET", "key"))); string(value) != "1" {
+		t.Errorf("expected 1 after repairing, got %q", value)
+	}
+	if repaired, _ := os.ReadFile(incr); !bytes.Equal(repaired, complete) {
+		t.Errorf("expected AOF to be truncated to %d bytes, got %d", len(complete), len(repaired))
+	}
+}
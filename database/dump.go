@@ -0,0 +1,263 @@
+package database
+
+import (
+	"godis-learn/interface/dbinterface"
+	"godis-learn/interface/redis"
+	"godis-learn/lib/utils"
+	"godis-learn/persistent"
+	"godis-learn/redis/client"
+	"godis-learn/redis/protocol"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func execDump(db *DB, line redis.Line) redis.Reply {
+	val, ok := db.Get(string(line[0]))
+	if !ok {
+		return protocol.NullBulkStringReply()
+	}
+	payload, err := persistent.DumpValue(val)
+	if err != nil {
+		return protocol.NewErrorReply([]byte("ERR " + err.Error()))
+	}
+	return protocol.BulkStringReply(payload)
+}
+
+// execRestore 实现 RESTORE key ttl payload [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]。
+// 没有记录访问时间和访问频率，IDLETIME 与 FREQ 只检查参数
+func execRestore(db *DB, line redis.Line) redis.Reply {
+	key := string(line[0])
+	ttl, err := strconv.ParseInt(string(line[1]), 10, 64)
+	if err != nil || ttl < 0 {
+		return protocol.NewErrorReply([]byte("ERR Invalid TTL value, must be >= 0"))
+	}
+	replace, absTTL := false, false
+	idleTime, freq := int64(-1), int64(-1)
+	for i := 3; i < len(line); i++ {
+		switch strings.ToLower(string(line[i])) {
+		case "replace":
+			replace = true
+		case "absttl":
+			absTTL = true
+		case "idletime":
+			if i+1 >= len(line) || freq >= 0 {
+				return protocol.SyntaxErrorReply()
+			}
+			i++
+			idleTime, err = strconv.ParseInt(string(line[i]), 10, 64)
+			if err != nil || idleTime < 0 {
+				return protocol.NewErrorReply([]byte("ERR Invalid IDLETIME value, must be >= 0"))
+			}
+		case "freq":
+			if i+1 >= len(line) || idleTime >= 0 {
+				return protocol.SyntaxErrorReply()
+			}
+			i++
+			freq, err = strconv.ParseInt(string(line[i]), 10, 64)
+			if err != nil || freq < 0 || freq > 255 {
+				return protocol.NewErrorReply([]byte("ERR Invalid FREQ value, must be >= 0 and <= 255"))
+			}
+		default:
+			return protocol.SyntaxErrorReply()
+		}
+	}
+	if _, exists := db.Get(key); exists && !replace {
+		return protocol.NewErrorReply([]byte("BUSYKEY Target key name already exists."))
+	}
+	val, restoreErr := persistent.RestoreValue(line[2])
+	if restoreErr != nil {
+		return protocol.NewErrorReply([]byte("ERR " + restoreErr.Error()))
+	}
+	deleted := db.Delete(key)
+	var expireTime time.Time
+	if ttl > 0 {
+		if absTTL {
+			expireTime = time.UnixMilli(ttl)
+		} else {
+			expireTime = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+		if !expireTime.After(time.Now()) {
+			// 已经过期的 key 不需要写入，只需要删除被替换的旧值
+			if deleted {
+				err := db.addAOF(utils.StringsToLine("DEL", key))
+				db.notifyEvent(notifyGeneric, "del", key)
+				if err != nil {
+					return aofErrorReply(err)
+				}
+			}
+			return protocol.OkReply()
+		}
+	}
+	db.Put(key, val)
+	lines := []redis.Line{utils.StringsToLine("DEL", key), persistent.ValueToLine(key, val)}
+	if ttl > 0 {
+		db.Expire(key, expireTime)
+		lines = append(lines, persistent.ExpireToLine(key, expireTime))
+	}
+	db.notifyEvent(notifyGeneric, "restore", key)
+	for _, aofLine := range lines {
+		if err := db.addAOF(aofLine); err != nil {
+			return aofErrorReply(err)
+		}
+	}
+	return protocol.OkReply()
+}
+
+// cloneValue 通过 DUMP 格式深拷贝一个值，拷贝与原值不共享任何可变的数据
+func cloneValue(val *dbinterface.EntryValue) (*dbinterface.EntryValue, error) {
+	payload, err := persistent.DumpValue(val)
+	if err != nil {
+		return nil, err
+	}
+	return persistent.RestoreValue(payload)
+}
+
+// migrateArgs 是 MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [KEYS key ...] 解析后的参数
+type migrateArgs struct {
+	addr    string
+	dbIndex int
+	timeout time.Duration
+	copy    bool
+	replace bool
+	keys    []string
+}
+
+func parseMigrateArgs(line redis.Line) (*migrateArgs, redis.Reply) {
+	args := &migrateArgs{
+		addr: net.JoinHostPort(string(line[0]), string(line[1])),
+	}
+	dbIndex, err := strconv.Atoi(string(line[3]))
+	if err != nil || dbIndex < 0 {
+		return nil, protocol.NewErrorReply([]byte("ERR value is not an integer or out of range"))
+	}
+	args.dbIndex = dbIndex
+	timeout, err := strconv.ParseInt(string(line[4]), 10, 64)
+	if err != nil {
+		return nil, protocol.NewErrorReply([]byte("ERR value is not an integer or out of range"))
+	}
+	if timeout <= 0 {
+		// 与 Redis 一致，不是正数的超时时间按 1 秒处理
+		timeout = 1000
+	}
+	args.timeout = time.Duration(timeout) * time.Millisecond
+	if len(line[2]) > 0 {
+		args.keys = []string{string(line[2])}
+	}
+	for i := 5; i < len(line); i++ {
+		switch strings.ToLower(string(line[i])) {
+		case "copy":
+			args.copy = true
+		case "replace":
+			args.replace = true
+		case "keys":
+			if len(line[2]) > 0 {
+				return nil, protocol.NewErrorReply([]byte("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string"))
+			}
+			for _, key := range line[i+1:] {
+				args.keys = append(args.keys, string(key))
+			}
+			i = len(line)
+		default:
+			return nil, protocol.SyntaxErrorReply()
+		}
+	}
+	return args, nil
+}
+
+// prepareMigrate 在没有 COPY 时需要删除本地的 key，因此加写锁
+func prepareMigrate(line redis.Line) (rKeys, wKeys []string) {
+	args, errReply := parseMigrateArgs(line)
+	if errReply != nil {
+		return nil, nil
+	}
+	if args.copy {
+		return args.keys, nil
+	}
+	return nil, args.keys
+}
+
+func rollbackMigrate(db *DB, line redis.Line) []redis.Line {
+	_, keys := prepareMigrate(line)
+	return rollbackGivenKeys(db, keys...)
+}
+
+// execMigrate 通过 DUMP 和 RESTORE 把 key 复制到目标实例，没有 COPY 时删除目标实例已经接收的 key。
+// 执行期间一直持有这些 key 的锁，迁移过程中不会被其它命令修改
+func execMigrate(db *DB, line redis.Line) redis.Reply {
+	args, errReply := parseMigrateArgs(line)
+	if errReply != nil {
+		return errReply
+	}
+	var keys []string
+	var restoreLines []redis.Line
+	for _, key := range args.keys {
+		val, ok := db.Get(key)
+		if !ok {
+			continue
+		}
+		payload, err := persistent.DumpValue(val)
+		if err != nil {
+			return protocol.NewErrorReply([]byte("ERR " + err.Error()))
+		}
+		ttl := int64(0)
+		if expireTime, ok := db.ttlMap.Get(key); ok {
+			// RESTORE 的 TTL 为 0 时表示永不过期，剩余时间不足 1 毫秒时按 1 毫秒处理
+			ttl = time.Until(expireTime.(time.Time)).Milliseconds()
+			if ttl < 1 {
+				ttl = 1
+			}
+		}
+		restoreLine := redis.Line{[]byte("RESTORE"), []byte(key), []byte(strconv.FormatInt(ttl, 10)), payload}
+		if args.replace {
+			restoreLine = append(restoreLine, []byte("REPLACE"))
+		}
+		keys = append(keys, key)
+		restoreLines = append(restoreLines, restoreLine)
+	}
+	if len(keys) == 0 {
+		return protocol.StatusReply([]byte("NOKEY"))
+	}
+	cli, err := client.NewClientWithTimeout(args.addr, args.timeout)
+	if err != nil {
+		return protocol.NewErrorReply([]byte("IOERR error or timeout connecting to the client"))
+	}
+	cli.Start()
+	defer cli.Close()
+	var migrated []string
+	var targetErr redis.Reply
+	for i, restoreLine := range restoreLines {
+		reply := cli.SendToDB(args.dbIndex, restoreLine)
+		if client.IsConnectionError(reply) {
+			// 无法确定目标实例是否已经写入，保留本地的全部 key
+			return protocol.NewErrorReply([]byte("IOERR error or timeout reading to target instance"))
+		}
+		if protocol.CheckErrorReply(reply) {
+			if targetErr == nil {
+				targetErr = protocol.NewErrorReply([]byte("ERR Target instance replied with error: " + reply.(redis.ErrorReply).Error()))
+			}
+			continue
+		}
+		migrated = append(migrated, keys[i])
+	}
+	if !args.copy && len(migrated) > 0 {
+		for _, key := range migrated {
+			db.Delete(key)
+			db.notifyEvent(notifyGeneric, "del", key)
+		}
+		if err := db.addAOF(utils.StringsToLine(append([]string{"DEL"}, migrated...)...)); err != nil {
+			return aofErrorReply(err)
+		}
+	}
+	if targetErr != nil {
+		return targetErr
+	}
+	return protocol.OkReply()
+}
+
+func init() {
+	RegisterCommand("dump", execDump, readFirstKey, nil, 2, readOnlyFlag)
+	RegisterCommand("restore", execRestore, writeFirstKey, rollbackFirstKey, -4, writeFlag)
+	RegisterCommand("migrate", execMigrate, prepareMigrate, rollbackMigrate, -6, writeFlag)
+}
@@ -0,0 +1,186 @@
+package database
+
+import (
+	"godis-learn/interface/redis"
+	"godis-learn/lib/utils"
+	"godis-learn/redis/connection"
+	"godis-learn/redis/parse"
+	"godis-learn/redis/protocol"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestoreOptions(t *testing.T) {
+	db := NewStandaloneServer()
+	defer db.Close()
+	conn := connection.NewClientConn(nil)
+	db.Execute(conn, utils.StringsToLine("SET", "key", "value"))
+	payload, _ := protocol.FetchBulkString(db.Execute(conn, utils.StringsToLine("DUMP", "key")))
+	restore := func(args ...string) redis.Reply {
+		line := utils.StringsToLine(append([]string{"RESTORE", "copy", "0", ""}, args...)...)
+		line[3] = payload
+		return db.Execute(conn, line)
+	}
+
+	for _, args := range [][]string{
+		{"IDLETIME", "-1"},
+		{"FREQ", "256"},
+		{"IDLETIME", "10", "FREQ", "1"},
+		{"ABSTTL", "IDLETIME"},
+		{"UNKNOWN"},
+	} {
+		if reply := restore(args...); !protocol.CheckErrorReply(reply) {
+			t.Errorf("expected error for RESTORE options %v, got %s", args, reply.GetBytes())
+		}
+	}
+	if reply := restore("IDLETIME", "10"); !protocol.CheckOKReply(reply) {
+		t.Fatalf("expected OK, got %s", reply.GetBytes())
+	}
+	if reply := restore("FREQ", "5"); !strings.HasPrefix(string(reply.GetBytes()), "-BUSYKEY") {
+		t.Errorf("expected BUSYKEY, got %s", reply.GetBytes())
+	}
+
+	// ABSTTL 为过去的时间时只删除被替换的旧值
+	line := utils.StringsToLine("RESTORE", "copy", strconv.FormatInt(time.Now().Add(-time.Second).UnixMilli(), 10), "", "ABSTTL", "REPLACE")
+	line[3] = payload
+	if reply := db.Execute(conn, line); !protocol.CheckOKReply(reply) {
+		t.Fatalf("expected OK, got %s", reply.GetBytes())
+	}
+	if reply := db.Execute(conn, utils.StringsToLine("EXISTS", "copy")); string(reply.GetBytes()) != ":0\r\n" {
+		t.Errorf("expected expired key not to be restored, got %s", reply.GetBytes())
+	}
+
+	expireAt := time.Now().Add(time.Hour).UnixMilli()
+	line = utils.StringsToLine("RESTORE", "copy", strconv.FormatInt(expireAt, 10), "", "ABSTTL")
+	line[3] = payload
+	if reply := db.Execute(conn, line); !protocol.CheckOKReply(reply) {
+		t.Fatalf("expected OK, got %s", reply.GetBytes())
+	}
+	pttl, _ := strconv.ParseInt(strings.TrimSpace(string(db.Execute(conn, utils.StringsToLine("PTTL", "copy")).GetBytes()[1:])), 10, 64)
+	if pttl <= 0 || pttl > time.Hour.Milliseconds() {
+		t.Errorf("expected ttl close to one hour, got %d", pttl)
+	}
+}
+
+// serveDB 在本地端口上把收到的命令交给 db 执行，作为 MIGRATE 的目标实例
+func serveDB(t *testing.T, db *MultiDB) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer func() {
+					_ = conn.Close()
+				}()
+				client := connection.NewFakeConn()
+				for payload := range parse.StartParseStream(conn) {
+					if payload.Err != nil {
+						return
+					}
+					args, _ := protocol.FetchArrayArgs(payload.Data)
+					if _, err := conn.Write(db.Execute(client, args).GetBytes()); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestMigrate(t *testing.T) {
+	source := NewStandaloneServer()
+	defer source.Close()
+	target := NewStandaloneServer()
+	defer target.Close()
+	host, port, _ := net.SplitHostPort(serveDB(t, target))
+	conn := connection.NewClientConn(nil)
+	targetConn := connection.NewClientConn(nil)
+	target.Execute(targetConn, utils.StringsToLine("SELECT", "1"))
+	source.Execute(conn, utils.StringsToLine("MSET", "a", "1", "b", "2", "c", "3", "d", "4"))
+	source.Execute(conn, utils.StringsToLine("PEXPIRE", "b", "100000"))
+
+	migrate := func(args ...string) string {
+		line := utils.StringsToLine(append([]string{"MIGRATE", host, port}, args...)...)
+		return string(source.Execute(conn, line).GetBytes())
+	}
+	if reply := migrate("", "1", "1000", "KEYS", "a", "b", "missing"); reply != "+OK\r\n" {
+		t.Fatalf("expected OK, got %s", reply)
+	}
+	for key, expected := range map[string]string{"a": "1", "b": "2"} {
+		if value, _ := protocol.FetchBulkString(target.Execute(targetConn, utils.StringsToLine("GET", key))); string(value) != expected {
+			t.Errorf("expected %s to be migrated, got %q", key, value)
+		}
+		if reply := source.Execute(conn, utils.StringsToLine("EXISTS", key)); string(reply.GetBytes()) != ":0\r\n" {
+			t.Errorf("expected %s to be removed from source", key)
+		}
+	}
+	if reply := target.Execute(targetConn, utils.StringsToLine("TTL", "b")); strings.HasPrefix(string(reply.GetBytes()), ":-") {
+		t.Errorf("expected ttl of b to be migrated")
+	}
+
+	if reply := migrate("c", "1", "1000", "COPY"); reply != "+OK\r\n" {
+		t.Fatalf("expected OK, got %s", reply)
+	}
+	if reply := source.Execute(conn, utils.StringsToLine("EXISTS", "c")); string(reply.GetBytes()) != ":1\r\n" {
+		t.Error("expected c to be kept with COPY")
+	}
+	if reply := migrate("c", "1", "1000"); !strings.HasPrefix(reply, "-ERR Target instance replied with error: BUSYKEY") {
+		t.Errorf("expected BUSYKEY from target, got %s", reply)
+	}
+	if reply := migrate("c", "1", "1000", "REPLACE"); reply != "+OK\r\n" {
+		t.Errorf("expected OK with REPLACE, got %s", reply)
+	}
+	if reply := migrate("missing", "1", "1000"); reply != "+NOKEY\r\n" {
+		t.Errorf("expected NOKEY, got %s", reply)
+	}
+	if reply := migrate("d", "1", "1000", "KEYS", "a"); !strings.HasPrefix(reply, "-ERR When using MIGRATE KEYS") {
+		t.Errorf("expected error for KEYS with a key argument, got %s", reply)
+	}
+
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	_, closedPort, _ := net.SplitHostPort(closed.Addr().String())
+	_ = closed.Close()
+	line := utils.StringsToLine("MIGRATE", host, closedPort, "d", "0", "100")
+	if reply := string(source.Execute(conn, line).GetBytes()); !strings.HasPrefix(reply, "-IOERR") {
+		t.Errorf("expected IOERR, got %s", reply)
+	}
+	if reply := source.Execute(conn, utils.StringsToLine("EXISTS", "d")); string(reply.GetBytes()) != ":1\r\n" {
+		t.Error("expected d to be kept after IOERR")
+	}
+}
+
+func TestCopyDoesNotShareValue(t *testing.T) {
+	db := NewStandaloneServer()
+	defer db.Close()
+	conn := connection.NewClientConn(nil)
+	db.Execute(conn, utils.StringsToLine("SET", "src", "value"))
+	if reply := db.Execute(conn, utils.StringsToLine("COPY", "src", "dst", "DB", "1")); string(reply.GetBytes()) != ":1\r\n" {
+		t.Fatalf("expected 1, got %s", reply.GetBytes())
+	}
+	src, _ := db.dbPanicAt(0).Get("src")
+	dst, ok := db.dbPanicAt(1).Get("dst")
+	if !ok {
+		t.Fatal("expected dst to exist")
+	}
+	if src == dst {
+		t.Fatal("expected COPY to create a new value")
+	}
+	// 即使有命令原地修改了源值，拷贝也不受影响
+	src.V.([]byte)[0] = 'V'
+	if string(dst.V.([]byte)) != "value" {
+		t.Errorf("expected the copy to be independent, got %s", dst.V)
+	}
+}
@@ -0,0 +1,177 @@
+package database
+
+import (
+	"bytes"
+	"godis-learn/interface/redis"
+	"godis-learn/lib/logger"
+	"godis-learn/lib/utils"
+	"godis-learn/persistent"
+	"godis-learn/redis/connection"
+	"godis-learn/redis/protocol"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// replPingPeriod 是 master 通过复制流向副本发送 PING 的间隔，单位为秒，副本据此判断连接没有超时
+const replPingPeriod = 10
+
+// replicaFeed 是 master 向一个副本发送的复制流，全量同步的 RDB 发出之前，之后的写命令先缓存在 pending 中
+type replicaFeed struct {
+	conn    redis.Connection
+	mutex   sync.Mutex
+	ready   bool
+	pending [][]byte
+	// ackOffset 是副本通过 REPLCONF ACK 报告的偏移量
+	ackOffset int64
+}
+
+func (f *replicaFeed) push(data []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.ready {
+		f.pending = append(f.pending, data)
+		return nil
+	}
+	return f.conn.Write(data)
+}
+
+// start 发送全量同步的回复，随后发送生成快照之后缓存的写命令
+func (f *replicaFeed) start(header []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.conn.Write(header); err != nil {
+		return err
+	}
+	for _, data := range f.pending {
+		if err := f.conn.Write(data); err != nil {
+			return err
+		}
+	}
+	f.ready, f.pending = true, nil
+	return nil
+}
+
+// propagate 把写命令追加到 AOF，并写入所有副本的复制流。
+// 命令已经在内存中执行，写入 AOF 失败时仍然写入复制流，返回的错误由调用方回复给客户端，之后的写命令会被 checkAOFError 拒绝
+func (db *MultiDB) propagate(dbIndex int, line redis.Line) error {
+	atomic.AddInt64(&db.saver.dirty, 1)
+	var aofErr error
+	if db.aofHandler != nil {
+		if aofErr = db.aofHandler.AddAOF(dbIndex, line); aofErr != nil {
+			logger.Error("writing AOF failed: " + aofErr.Error())
+		}
+	}
+	db.feedMutex.Lock()
+	defer db.feedMutex.Unlock()
+	if len(db.feeds) == 0 {
+		return aofErr
+	}
+	data := protocol.ArrayReply(line).GetBytes()
+	// 所有副本共用一个复制流，数据库变化时先写入 SELECT，偏移量在各个副本之间保持一致
+	if dbIndex != db.replDB {
+		selectCmd := protocol.ArrayReply(utils.StringsToLine("SELECT", strconv.Itoa(dbIndex))).GetBytes()
+		data = append(selectCmd, data...)
+		db.replDB = dbIndex
+	}
+	db.feedReplicasWithLock(data)
+	return aofErr
+}
+
+// feedReplicasWithLock 把 data 写入复制流，调用者需要持有 feedMutex
+func (db *MultiDB) feedReplicasWithLock(data []byte) {
+	db.replOffset += int64(len(data))
+	for conn, feed := range db.feeds {
+		if err := feed.push(data); err != nil {
+			logger.Warn("replica disconnected: " + err.Error())
+			delete(db.feeds, conn)
+		}
+	}
+}
+
+// pingReplicas 通过复制流向副本发送 PING，没有写入时副本也能持续收到数据
+func (db *MultiDB) pingReplicas() {
+	db.feedMutex.Lock()
+	defer db.feedMutex.Unlock()
+	if len(db.feeds) > 0 {
+		db.feedReplicasWithLock(protocol.ArrayReply(utils.StringsToLine("PING")).GetBytes())
+	}
+}
+
+// execPSync 对副本进行全量同步。生成快照时开始缓存之后的写命令，发送 RDB 之后再发送缓存的命令，
+// 不支持部分同步，副本的复制 ID 和偏移量都会被忽略
+func (db *MultiDB) execPSync(conn redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 2 {
+		return protocol.ArgumentCountErrorReply([]byte("psync"))
+	}
+	feed := &replicaFeed{conn: conn}
+	var offset int64
+	isSlave := false
+	snapshot := db.Snapshot(func() {
+		db.feedMutex.Lock()
+		defer db.feedMutex.Unlock()
+		// 不支持级联复制，SlaveOf 先修改角色再清空副本，这里检查角色之后不会留下副本
+		if atomic.LoadInt32(&db.role) == slaveRole {
+			isSlave = true
+			return
+		}
+		db.feeds[conn] = feed
+		// 新的副本不知道当前的数据库，下一条命令之前需要写入 SELECT
+		db.replDB = -1
+		offset = db.replOffset
+	})
+	if isSlave {
+		return protocol.NewErrorReply([]byte("ERR PSYNC is not supported by a replica"))
+	}
+	var rdb bytes.Buffer
+	if err := persistent.WriteRDB(&rdb, snapshot); err != nil {
+		db.removeReplica(conn)
+		return protocol.NewErrorReply([]byte("ERR generating RDB failed: " + err.Error()))
+	}
+	conn.SetRole(connection.ReplicationClient)
+	header := "+FULLRESYNC " + db.replID + " " + strconv.FormatInt(offset, 10) + "\r\n"
+	if err := feed.start(append([]byte(header), protocol.BulkStringReply(rdb.Bytes()).GetBytes()...)); err != nil {
+		db.removeReplica(conn)
+		logger.Warn("full sync failed: " + err.Error())
+	} else {
+		logger.Infof("full sync with replica finished at offset %d", offset)
+	}
+	// 回复已经写入复制流
+	return protocol.EmptyReply()
+}
+
+// execReplConf 处理副本发来的 REPLCONF，ACK 不需要回复
+func (db *MultiDB) execReplConf(conn redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return protocol.ArgumentCountErrorReply([]byte("replconf"))
+	}
+	if strings.EqualFold(string(args[0]), "ack") {
+		offset, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return protocol.EmptyReply()
+		}
+		db.feedMutex.Lock()
+		if feed, ok := db.feeds[conn]; ok {
+			feed.mutex.Lock()
+			feed.ackOffset = offset
+			feed.mutex.Unlock()
+		}
+		db.feedMutex.Unlock()
+		return protocol.EmptyReply()
+	}
+	return protocol.OkReply()
+}
+
+func (db *MultiDB) removeReplica(conn redis.Connection) {
+	db.feedMutex.Lock()
+	defer db.feedMutex.Unlock()
+	delete(db.feeds, conn)
+}
+
+// dropReplicas 不再向已有的副本发送数据，它们会在超时后重新同步
+func (db *MultiDB) dropReplicas() {
+	db.feedMutex.Lock()
+	defer db.feedMutex.Unlock()
+	db.feeds = make(map[redis.Connection]*replicaFeed)
+}
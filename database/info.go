@@ -0,0 +1,121 @@
+package database
+
+import (
+	"fmt"
+	"godis-learn/config"
+	"godis-learn/interface/redis"
+	"godis-learn/redis/protocol"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type infoSection struct {
+	name   string
+	render func(db *MultiDB) string
+}
+
+var (
+	startTime    = time.Now()
+	infoSections = []infoSection{
+		{"server", serverInfo},
+		{"persistence", persistenceInfo},
+		{"replication", replicationInfo},
+		{"keyspace", keyspaceInfo},
+	}
+)
+
+// info 按照 Redis 的格式返回服务器状态，section 为空或 all/everything/default 时返回全部内容
+func (db *MultiDB) info(line redis.Line) redis.Reply {
+	if len(line) > 1 {
+		return protocol.ArgumentCountErrorReply([]byte("info"))
+	}
+	section := "all"
+	if len(line) == 1 {
+		section = strings.ToLower(string(line[0]))
+	}
+	all := section == "all" || section == "everything" || section == "default"
+	builder := strings.Builder{}
+	for _, s := range infoSections {
+		if !all && s.name != section {
+			continue
+		}
+		if builder.Len() > 0 {
+			builder.WriteString("\r\n")
+		}
+		builder.WriteString("# " + strings.ToUpper(s.name[:1]) + s.name[1:] + "\r\n")
+		builder.WriteString(s.render(db))
+	}
+	return protocol.BulkStringReply([]byte(builder.String()))
+}
+
+func serverInfo(_ *MultiDB) string {
+	uptime := time.Since(startTime)
+	return fmt.Sprintf("redis_mode:standalone\r\nos:%s %s\r\nprocess_id:%d\r\ntcp_port:%d\r\nuptime_in_seconds:%d\r\nuptime_in_days:%d\r\n",
+		runtime.GOOS, runtime.GOARCH, os.Getpid(), config.Properties.Port,
+		int64(uptime.Seconds()), int64(uptime.Hours()/24))
+}
+
+func persistenceInfo(db *MultiDB) string {
+	status := "ok"
+	if atomic.LoadInt32(&db.saver.failed) == 1 {
+		status = "err"
+	}
+	rdb := fmt.Sprintf("rdb_changes_since_last_save:%d\r\nrdb_bgsave_in_progress:%d\r\nrdb_last_save_time:%d\r\nrdb_last_bgsave_status:%s\r\n",
+		atomic.LoadInt64(&db.saver.dirty), atomic.LoadInt32(&db.saver.saving), atomic.LoadInt64(&db.saver.lastSave), status)
+	if db.aofHandler == nil {
+		return rdb + "aof_enabled:0\r\n"
+	}
+	fsync := db.aofHandler.FsyncStatus()
+	rewrite := db.aofHandler.RewriteStatus()
+	inProgress := 0
+	if rewrite.InProgress {
+		inProgress = 1
+	}
+	writeStatus := "ok"
+	if db.aofHandler.WriteError() != nil {
+		writeStatus = "err"
+	}
+	return rdb + fmt.Sprintf("aof_enabled:1\r\naof_rewrite_in_progress:%d\r\naof_current_size:%d\r\naof_base_size:%d\r\n"+
+		"aof_fsync_policy:%s\r\naof_last_fsync_time:%d\r\naof_delayed_fsync:%d\r\naof_last_write_status:%s\r\n",
+		inProgress, rewrite.CurrentSize, rewrite.BaseSize, fsync.Policy, fsync.LastFsync, fsync.Delayed, writeStatus)
+}
+
+func replicationInfo(db *MultiDB) string {
+	if atomic.LoadInt32(&db.role) == slaveRole {
+		db.rep.mutex.Lock()
+		defer db.rep.mutex.Unlock()
+		linkStatus := "down"
+		if db.rep.masterConn != nil {
+			linkStatus = "up"
+		}
+		return fmt.Sprintf("role:slave\r\nmaster_host:%s\r\nmaster_port:%d\r\nmaster_link_status:%s\r\nslave_repl_offset:%d\r\n",
+			db.rep.masterHost, db.rep.masterPort, linkStatus, atomic.LoadInt64(&db.rep.replicationOffset))
+	}
+	db.feedMutex.Lock()
+	defer db.feedMutex.Unlock()
+	builder := strings.Builder{}
+	builder.WriteString(fmt.Sprintf("role:master\r\nconnected_slaves:%d\r\n", len(db.feeds)))
+	i := 0
+	for _, feed := range db.feeds {
+		feed.mutex.Lock()
+		builder.WriteString(fmt.Sprintf("slave%d:offset=%d\r\n", i, feed.ackOffset))
+		feed.mutex.Unlock()
+		i++
+	}
+	builder.WriteString(fmt.Sprintf("master_replid:%s\r\nmaster_repl_offset:%d\r\n", db.replID, db.replOffset))
+	return builder.String()
+}
+
+func keyspaceInfo(db *MultiDB) string {
+	builder := strings.Builder{}
+	for i := range db.dbs {
+		keys, expires := db.GetDBSize(i)
+		if keys > 0 {
+			builder.WriteString(fmt.Sprintf("db%d:keys=%d,expires=%d\r\n", i, keys, expires))
+		}
+	}
+	return builder.String()
+}
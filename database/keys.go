@@ -0,0 +1,199 @@
+package database
+
+import (
+	"godis-learn/datastruct/dict"
+	"godis-learn/datastruct/list"
+	"godis-learn/datastruct/set"
+	"godis-learn/interface/redis"
+	"godis-learn/lib/utils"
+	"godis-learn/persistent"
+	"godis-learn/redis/protocol"
+	"strconv"
+	"time"
+)
+
+func execDel(db *DB, line redis.Line) redis.Reply {
+	deleted := 0
+	for _, arg := range line {
+		if db.Delete(string(arg)) {
+			deleted++
+			db.notifyEvent(notifyGeneric, "del", string(arg))
+		}
+	}
+	if deleted > 0 {
+		if err := db.addAOF(utils.StringsWithNameToLine("del", line)); err != nil {
+			return aofErrorReply(err)
+		}
+	}
+	return protocol.IntReply(int64(deleted))
+}
+
+func execExists(db *DB, line redis.Line) redis.Reply {
+	res := int64(0)
+	for _, arg := range line {
+		if _, ok := db.Get(string(arg)); ok {
+			res++
+		}
+	}
+	return protocol.IntReply(res)
+}
+
+func execExpire(db *DB, line redis.Line) redis.Reply {
+	return expireAfter(db, line, time.Second)
+}
+
+func execPExpire(db *DB, line redis.Line) redis.Reply {
+	return expireAfter(db, line, time.Millisecond)
+}
+
+func execPExpireAt(db *DB, line redis.Line) redis.Reply {
+	key := string(line[0])
+	ms, err := strconv.ParseInt(string(line[1]), 10, 64)
+	if err != nil {
+		return protocol.NewErrorReply([]byte("ERR value is not an integer or out of range"))
+	}
+	return expireAt(db, key, time.UnixMilli(ms))
+}
+
+func expireAfter(db *DB, line redis.Line, unit time.Duration) redis.Reply {
+	key := string(line[0])
+	n, err := strconv.ParseInt(string(line[1]), 10, 64)
+	if err != nil {
+		return protocol.NewErrorReply([]byte("ERR value is not an integer or out of range"))
+	}
+	return expireAt(db, key, time.Now().Add(time.Duration(n)*unit))
+}
+
+// expireAt 设置过期时间，时间已经过去时与 Redis 一样直接删除 key，AOF 中记录 del 并发送 del 事件
+func expireAt(db *DB, key string, expireTime time.Time) redis.Reply {
+	if _, ok := db.Get(key); !ok {
+		return protocol.IntReply(0)
+	}
+	if !expireTime.After(time.Now()) {
+		db.Delete(key)
+		err := db.addAOF(utils.StringsToLine("del", key))
+		db.notifyEvent(notifyGeneric, "del", key)
+		if err != nil {
+			return aofErrorReply(err)
+		}
+		return protocol.IntReply(1)
+	}
+	db.Expire(key, expireTime)
+	err := db.addAOF(persistent.ExpireToLine(key, expireTime))
+	db.notifyEvent(notifyGeneric, "expire", key)
+	if err != nil {
+		return aofErrorReply(err)
+	}
+	return protocol.IntReply(1)
+}
+
+func execTTL(db *DB, line redis.Line) redis.Reply {
+	return remainingTTL(db, string(line[0]), time.Second)
+}
+
+func execPTTL(db *DB, line redis.Line) redis.Reply {
+	return remainingTTL(db, string(line[0]), time.Millisecond)
+}
+
+func remainingTTL(db *DB, key string, unit time.Duration) redis.Reply {
+	if _, ok := db.Get(key); !ok {
+		return protocol.IntReply(-2)
+	}
+	expireTime, ok := db.ttlMap.Get(key)
+	if !ok {
+		return protocol.IntReply(-1)
+	}
+	remaining := expireTime.(time.Time).Sub(time.Now())
+	return protocol.IntReply(int64(remaining / unit))
+}
+
+func execPersist(db *DB, line redis.Line) redis.Reply {
+	key := string(line[0])
+	if _, ok := db.Get(key); !ok {
+		return protocol.IntReply(0)
+	}
+	if _, ok := db.ttlMap.Get(key); !ok {
+		return protocol.IntReply(0)
+	}
+	db.Persist(key)
+	err := db.addAOF(utils.StringsWithNameToLine("persist", line))
+	db.notifyEvent(notifyGeneric, "persist", key)
+	if err != nil {
+		return aofErrorReply(err)
+	}
+	return protocol.IntReply(1)
+}
+
+func execType(db *DB, line redis.Line) redis.Reply {
+	val, ok := db.Get(string(line[0]))
+	if !ok {
+		return protocol.StatusReply([]byte("none"))
+	}
+	switch val.V.(type) {
+	case []byte:
+		return protocol.StatusReply([]byte("string"))
+	case list.List:
+		return protocol.StatusReply([]byte("list"))
+	case *set.HashSet:
+		return protocol.StatusReply([]byte("set"))
+	case dict.HashMap:
+		return protocol.StatusReply([]byte("hash"))
+	case *set.SortedSet:
+		return protocol.StatusReply([]byte("zset"))
+	}
+	return protocol.UnknownErrorReply()
+}
+
+func execRename(db *DB, line redis.Line) redis.Reply {
+	src, dst := string(line[0]), string(line[1])
+	if _, ok := db.Get(src); !ok {
+		return protocol.NewErrorReply([]byte("ERR no such key"))
+	}
+	db.rename(src, dst)
+	if err := db.addAOF(utils.StringsWithNameToLine("rename", line)); err != nil {
+		return aofErrorReply(err)
+	}
+	return protocol.OkReply()
+}
+
+func execRenameNX(db *DB, line redis.Line) redis.Reply {
+	src, dst := string(line[0]), string(line[1])
+	if _, ok := db.Get(src); !ok {
+		return protocol.NewErrorReply([]byte("ERR no such key"))
+	}
+	if _, ok := db.Get(dst); ok {
+		return protocol.IntReply(0)
+	}
+	db.rename(src, dst)
+	if err := db.addAOF(utils.StringsWithNameToLine("renamenx", line)); err != nil {
+		return aofErrorReply(err)
+	}
+	return protocol.IntReply(1)
+}
+
+func (db *DB) rename(src, dst string) {
+	val, _ := db.Get(src)
+	expireTime, hasTTL := db.ttlMap.Get(src)
+	db.Delete(src)
+	db.Delete(dst)
+	db.Put(dst, val)
+	if hasTTL {
+		db.Expire(dst, expireTime.(time.Time))
+	}
+	db.notifyEvent(notifyGeneric, "rename_from", src)
+	db.notifyEvent(notifyGeneric, "rename_to", dst)
+}
+
+func init() {
+	RegisterCommand("del", execDel, writeAllKeys, rollbackAllKeys, -2, writeFlag)
+	RegisterCommand("exists", execExists, readAllKeys, nil, -2, readOnlyFlag)
+	RegisterCommand("expire", execExpire, writeFirstKey, rollbackFirstKey, 3, writeFlag)
+	RegisterCommand("pexpire", execPExpire, writeFirstKey, rollbackFirstKey, 3, writeFlag)
+	RegisterCommand("pexpireat", execPExpireAt, writeFirstKey, rollbackFirstKey, 3, writeFlag)
+	RegisterCommand("ttl", execTTL, readFirstKey, nil, 2, readOnlyFlag)
+	RegisterCommand("pttl", execPTTL, readFirstKey, nil, 2, readOnlyFlag)
+	RegisterCommand("persist", execPersist, writeFirstKey, rollbackFirstKey, 2, writeFlag)
+	RegisterCommand("type", execType, readFirstKey, nil, 2, readOnlyFlag)
+	RegisterCommand("rename", execRename, writeFirstTwoKeys, rollbackFirstTwoKeys, 3, writeFlag)
+	RegisterCommand("renamenx", execRenameNX, writeFirstTwoKeys, rollbackFirstTwoKeys, 3, writeFlag)
+}
@@ -4,13 +4,14 @@ import (
 	"bytes"
 	"godis-learn/config"
 	"godis-learn/hub"
-	"godis-learn/interface/dbinterface"
 	"godis-learn/interface/redis"
+	"godis-learn/lib/logger"
 	"godis-learn/lib/utils"
 	"godis-learn/persistent"
 	"godis-learn/redis/connection"
 	"godis-learn/redis/protocol"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -22,6 +23,16 @@ type MultiDB struct {
 	masterAddr string
 	role       int32
 	rep        *replicationStatus
+	// 以下字段由 feedMutex 保护，feeds 是各个副本的复制流，replDB 是复制流当前选择的数据库，
+	// replOffset 是写入复制流的总字节数
+	feedMutex  sync.Mutex
+	feeds      map[redis.Connection]*replicaFeed
+	replID     string
+	replDB     int
+	replOffset int64
+	// FLUSHDB/FLUSHALL 直接替换数据库而不经过 key 锁，需要持有读锁以免与 Snapshot 交错
+	snapshotMutex sync.RWMutex
+	saver         *rdbSaver
 }
 
 func NewStandaloneServer() *MultiDB {
@@ -30,34 +41,45 @@ func NewStandaloneServer() *MultiDB {
 		config.Properties.DatabaseCount = 16
 	}
 	db.dbs = make([]*atomic.Value, config.Properties.DatabaseCount)
+	db.feeds = make(map[redis.Connection]*replicaFeed)
+	db.replID = utils.AlnumString(40)
+	notifyFlags, err := parseNotifyFlags(config.Properties.NotifyKeyspaceEvents)
+	if err != nil {
+		logger.Warn("notify-keyspace-events: " + err.Error())
+	}
 	for i := 0; i < config.Properties.DatabaseCount; i++ {
 		singleDB := newConcurrentDB()
 		singleDB.index = i
+		singleDB.addAOF = func(line redis.Line) error {
+			return db.propagate(singleDB.index, line)
+		}
+		singleDB.notifyFlags = notifyFlags
+		singleDB.notify = func(flags int, event, key string) {
+			db.notifyKeyspaceEvent(singleDB.index, flags, event, key)
+		}
 		holder := &atomic.Value{}
 		holder.Store(singleDB)
 		db.dbs[i] = holder
 	}
 	db.hub = hub.NewHub()
+	db.saver = newRDBSaver()
 	validAOF := false
 	if config.Properties.AppendOnly {
-		aofHandler, err := persistent.NewAOFHandler(db, func() dbinterface.EmbedDB {
-			return NewBasicMultiDB()
-		})
+		aofHandler, err := persistent.NewAOFHandler(db)
 		if err != nil {
 			panic(err)
 		}
 		db.aofHandler = aofHandler
-		for _, value := range db.dbs {
-			single := value.Load().(*DB)
-			single.addAOF = func(line redis.Line) {
-				db.aofHandler.AddAOF(single.index, line)
-			}
-		}
 		validAOF = true
 	}
 	if config.Properties.RDBFilename != "" && !validAOF {
-		loadRDBFile(db)
+		if err := loadRDBFile(db); err != nil {
+			panic(err)
+		}
 	}
+	// 加载数据时执行的命令不计入未保存的写入
+	atomic.StoreInt64(&db.saver.dirty, 0)
+	startSaveCron(db)
 	db.rep = newReplicationStatus()
 	startReplicationCron(db)
 	db.role = masterRole
@@ -91,13 +113,29 @@ func (db *MultiDB) doExecute(conn redis.Connection, line redis.Line) redis.Reply
 		}
 		return db.execSlaveOf(conn, content)
 	}
-	role := atomic.LoadInt32(&(db.role))
-	if role == slaveRole && conn.GetRole() != connection.ReplicationClient {
-		if !checkReadOnlyCommand(cmdName) {
-			return protocol.NewErrorReply([]byte("READONLY You cannot write against a read only slave"))
-		}
+	switch cmdName {
+	case "psync":
+		return db.execPSync(conn, content)
+	case "replconf":
+		return db.execReplConf(conn, content)
+	}
+	if errReply := CheckSubscriberMode(conn, cmdName); errReply != nil {
+		return errReply
 	}
 	switch cmdName {
+	case "info":
+		return db.info(content)
+	case "quit":
+		return protocol.OkReply()
+	case "reset":
+		return db.reset(conn)
+	case "lastsave":
+		return db.lastSave()
+	case "ping":
+		if conn != nil && conn.SubscriberCount()+conn.ShardSubscriberCount() > 0 {
+			return SubscriberPing(content)
+		}
+	// 发布订阅与数据无关，从节点上也可以使用
 	case "subscribe":
 		if len(line) < 2 {
 			return protocol.ArgumentCountErrorReply([]byte("subscribe"))
@@ -107,6 +145,40 @@ func (db *MultiDB) doExecute(conn redis.Connection, line redis.Line) redis.Reply
 		return db.hub.Publish(content)
 	case "unsubscribe":
 		return db.hub.Unsubscribe(conn, content)
+	case "psubscribe":
+		if len(line) < 2 {
+			return protocol.ArgumentCountErrorReply([]byte("psubscribe"))
+		}
+		return db.hub.PSubscribe(conn, content)
+	case "punsubscribe":
+		return db.hub.PUnsubscribe(conn, content)
+	case "ssubscribe":
+		if len(line) < 2 {
+			return protocol.ArgumentCountErrorReply([]byte("ssubscribe"))
+		}
+		return db.hub.SSubscribe(conn, content)
+	case "sunsubscribe":
+		return db.hub.SUnsubscribe(conn, content)
+	case "spublish":
+		return db.hub.SPublish(content)
+	case "pubsub":
+		return db.hub.PubSub(content)
+	}
+	role := atomic.LoadInt32(&(db.role))
+	if role == slaveRole && conn.GetRole() != connection.ReplicationClient {
+		if !checkReadOnlyCommand(cmdName) {
+			return protocol.NewErrorReply([]byte("READONLY You cannot write against a read only slave"))
+		}
+	}
+	if role == masterRole {
+		if errReply := db.checkSaveError(cmdName); errReply != nil {
+			return errReply
+		}
+		if errReply := db.checkAOFError(cmdName); errReply != nil {
+			return errReply
+		}
+	}
+	switch cmdName {
 	case "rewriteaof":
 		return db.RewriteAOF()
 	case "bgrewriteaof":
@@ -121,7 +193,13 @@ func (db *MultiDB) doExecute(conn redis.Connection, line redis.Line) redis.Reply
 		} else if conn != nil && conn.CheckMultiMode() {
 			return protocol.NewErrorReply([]byte("ERR command 'FLUSHDB' cannot be used in MULTI"))
 		}
-		return db.flushAt(conn.GetDBIndex())
+		db.snapshotMutex.RLock()
+		defer db.snapshotMutex.RUnlock()
+		reply := db.flushAt(conn.GetDBIndex())
+		if err := db.propagate(conn.GetDBIndex(), utils.StringsToLine("FlushDB")); err != nil {
+			return aofErrorReply(err)
+		}
+		return reply
 	case "flushall":
 		return db.flushAll()
 	case "select":
@@ -150,17 +228,22 @@ func (db *MultiDB) storeNewDB(dbIndex int, single *DB) redis.Reply {
 		return err
 	}
 	single.index = dbIndex
-	single.addAOF = db.dbPanicAt(dbIndex).addAOF
+	old := db.dbPanicAt(dbIndex)
+	single.addAOF = old.addAOF
+	single.notifyFlags = old.notifyFlags
+	single.notify = old.notify
 	db.dbs[dbIndex].Store(single)
 	return protocol.OkReply()
 }
 
 func (db *MultiDB) flushAll() redis.Reply {
+	db.snapshotMutex.RLock()
+	defer db.snapshotMutex.RUnlock()
 	for i := 0; i < len(db.dbs); i++ {
 		db.flushAt(i)
 	}
-	if db.aofHandler != nil {
-		db.aofHandler.AddAOF(0, utils.StringsToLine("FlushAll"))
+	if err := db.propagate(0, utils.StringsToLine("FlushAll")); err != nil {
+		return aofErrorReply(err)
 	}
 	return protocol.OkReply()
 }
@@ -174,6 +257,14 @@ func (db *MultiDB) flushAt(dbIndex int) redis.Reply {
 	return protocol.OkReply()
 }
 
+// reset 退出订阅模式和事务，并切换回 0 号数据库
+func (db *MultiDB) reset(conn redis.Connection) redis.Reply {
+	db.hub.UnsubscribeAll(conn)
+	conn.SetMultiMode(false)
+	conn.SelectDB(0)
+	return protocol.StatusReply([]byte("RESET"))
+}
+
 func (db *MultiDB) select_(conn redis.Connection, line redis.Line) redis.Reply {
 	dbIndex, err := strconv.Atoi(string(line[0]))
 	if err != nil {
@@ -223,10 +314,18 @@ func (db *MultiDB) copy_(conn redis.Connection, line redis.Line) redis.Reply {
 	if _, ok = dst.Get(dstKey); ok && !allowReplace {
 		return protocol.IntReply(0)
 	}
-	dst.Put(dstKey, val)
+	// 快照与旧值共享 EntryValue，COPY 需要复制出一个独立的值，不能让两个 key 共享
+	copied, err := cloneValue(val)
+	if err != nil {
+		return protocol.NewErrorReply([]byte("ERR " + err.Error()))
+	}
+	dst.Put(dstKey, copied)
 	if expireTime, ok := single.ttlMap.Get(valKey); ok {
 		dst.Expire(dstKey, expireTime.(time.Time))
 	}
-	db.aofHandler.AddAOF(conn.GetDBIndex(), utils.StringsWithNameToLine("copy", line))
+	dst.notifyEvent(notifyGeneric, "copy_to", dstKey)
+	if err := db.propagate(conn.GetDBIndex(), utils.StringsWithNameToLine("copy", line)); err != nil {
+		return aofErrorReply(err)
+	}
 	return protocol.IntReply(1)
 }
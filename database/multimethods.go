@@ -5,7 +5,6 @@ import (
 	"godis-learn/interface/dbinterface"
 	"godis-learn/interface/redis"
 	"godis-learn/lib/logger"
-	"godis-learn/persistent"
 	"godis-learn/redis/protocol"
 	"runtime/debug"
 )
@@ -28,11 +27,14 @@ func (db *MultiDB) Execute(conn redis.Connection, line redis.Line) redis.Reply {
 	return res
 }
 
+// ExecWithLock 执行命令，调用者需要持有命令涉及的 key 的锁。与 Execute 一样更新写入的 key 的版本，WATCH 能够发现这些修改
 func (db *MultiDB) ExecWithLock(conn redis.Connection, line redis.Line) redis.Reply {
 	single, err := db.dbAt(conn.GetDBIndex())
 	if err != nil {
 		return err
 	}
+	_, wKeys := RelatedKeys(line)
+	single.incrVersions(wKeys)
 	return single.executeWithLock(line)
 }
 
@@ -50,10 +52,12 @@ func (db *MultiDB) GetUndoLogs(dbIndex int, line redis.Line) []redis.Line {
 
 func (db *MultiDB) AfterClientClose(conn redis.Connection) {
 	db.hub.UnsubscribeAll(conn)
+	db.removeReplica(conn)
 }
 
 func (db *MultiDB) Close() {
 	_ = db.rep.close()
+	db.closeSaver()
 	if db.aofHandler != nil {
 		db.aofHandler.Close()
 	}
@@ -79,34 +83,10 @@ func (db *MultiDB) RewriteAOF() redis.Reply {
 }
 
 func (db *MultiDB) BGRewriteAOF() redis.Reply {
-	go func(h *persistent.Handler) {
-		_ = h.Rewrite()
-	}(db.aofHandler)
-	return protocol.StatusReply([]byte("Background append only file rewriting started"))
-}
-
-func (db *MultiDB) SaveRDB() redis.Reply {
-	if err := db.aofHandler.Rewrite2RDB(); err != nil {
+	if err := db.aofHandler.BGRewrite(); err != nil {
 		return protocol.NewErrorReply([]byte(err.Error()))
 	}
-	return protocol.OkReply()
-}
-
-func (db *MultiDB) BGSaveRDB() redis.Reply {
-	if db.aofHandler == nil {
-		return protocol.NewErrorReply([]byte("please enable aof before using save"))
-	}
-	go func(h *persistent.Handler) {
-		defer func() {
-			if err := recover(); err != nil {
-				logger.Error(err)
-			}
-		}()
-		if err := h.Rewrite2RDB(); err != nil {
-			logger.Error(err)
-		}
-	}(db.aofHandler)
-	return protocol.StatusReply([]byte("Background saving started"))
+	return protocol.StatusReply([]byte("Background append only file rewriting started"))
 }
 
 func (db *MultiDB) dbAt(dbIndex int) (*DB, redis.ErrorReply) {
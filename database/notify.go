@@ -0,0 +1,83 @@
+package database
+
+import (
+	"errors"
+	"godis-learn/lib/utils"
+	"strconv"
+)
+
+// notify-keyspace-events 中每个字符对应的事件类别
+const (
+	notifyKeyspace = 1 << iota
+	notifyKeyevent
+	notifyGeneric
+	notifyString
+	notifyList
+	notifySet
+	notifyHash
+	notifyZSet
+	notifyExpired
+	notifyEvicted
+	notifyNew
+
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZSet |
+		notifyExpired | notifyEvicted
+)
+
+// parseNotifyFlags 解析 notify-keyspace-events 配置，例如 "KEA" 或 "Ex"
+func parseNotifyFlags(s string) (int, error) {
+	flags := 0
+	for _, c := range s {
+		switch c {
+		case 'K':
+			flags |= notifyKeyspace
+		case 'E':
+			flags |= notifyKeyevent
+		case 'A':
+			flags |= notifyAll
+		case 'g':
+			flags |= notifyGeneric
+		case '$':
+			flags |= notifyString
+		case 'l':
+			flags |= notifyList
+		case 's':
+			flags |= notifySet
+		case 'h':
+			flags |= notifyHash
+		case 'z':
+			flags |= notifyZSet
+		case 'x':
+			flags |= notifyExpired
+		case 'e':
+			flags |= notifyEvicted
+		case 'n':
+			flags |= notifyNew
+		default:
+			return 0, errors.New("invalid event class character '" + string(c) + "'")
+		}
+	}
+	// 没有指定 K 或 E 时不发送任何通知
+	if flags&(notifyKeyspace|notifyKeyevent) == 0 {
+		return 0, nil
+	}
+	return flags, nil
+}
+
+// notifyEvent 在对应类别的通知开启时发送键空间通知
+func (db *DB) notifyEvent(class int, event, key string) {
+	if db.notifyFlags&class != 0 {
+		db.notify(db.notifyFlags, event, key)
+	}
+}
+
+// notifyKeyspaceEvent 向 __keyspace@<db>__:<key> 发送事件名，向 __keyevent@<db>__:<event> 发送键名
+func (db *MultiDB) notifyKeyspaceEvent(dbIndex, flags int, event, key string) {
+	prefix := "@" + strconv.Itoa(dbIndex) + "__:"
+	if flags&notifyKeyspace != 0 {
+		db.hub.Publish(utils.StringsToLine("__keyspace"+prefix+key, event))
+	}
+	if flags&notifyKeyevent != 0 {
+		db.hub.Publish(utils.StringsToLine("__keyevent"+prefix+event, key))
+	}
+}
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"godis-learn/interface/dbinterface"
+	"godis-learn/interface/redis"
+	"godis-learn/lib/utils"
+	"testing"
+)
+
+func TestParseNotifyFlags(t *testing.T) {
+	flags, err := parseNotifyFlags("KEA")
+	if err != nil || flags != notifyKeyspace|notifyKeyevent|notifyAll {
+		t.Fatalf("unexpected flags %b, err %v", flags, err)
+	}
+	if flags&notifyNew != 0 {
+		t.Fatal("A should not include n")
+	}
+	if flags, _ = parseNotifyFlags("Ex"); flags != notifyKeyevent|notifyExpired {
+		t.Fatalf("unexpected flags %b", flags)
+	}
+	if flags, _ = parseNotifyFlags("g$"); flags != 0 {
+		t.Fatal("flags without K or E should disable notifications")
+	}
+	if _, err = parseNotifyFlags("Kq"); err == nil {
+		t.Fatal("expected error for invalid class")
+	}
+}
+
+func TestExpireInThePast(t *testing.T) {
+	db := newSimpleDB()
+	db.notifyFlags, _ = parseNotifyFlags("Eg")
+	var events []string
+	db.notify = func(_ int, event, key string) {
+		events = append(events, event+" "+key)
+	}
+	var aof []string
+	db.addAOF = func(line redis.Line) error {
+		aof = append(aof, string(line[0]))
+		return nil
+	}
+	db.Put("a", &dbinterface.EntryValue{V: []byte("1")})
+	db.Put("b", &dbinterface.EntryValue{V: []byte("1")})
+	if reply := execExpire(db, utils.StringsToLine("a", "-1")); string(reply.GetBytes()) != ":1\r\n" {
+		t.Fatalf("expected 1, got %s", reply.GetBytes())
+	}
+	if reply := execPExpireAt(db, utils.StringsToLine("b", "1")); string(reply.GetBytes()) != ":1\r\n" {
+		t.Fatalf("expected 1, got %s", reply.GetBytes())
+	}
+	if _, ok := db.Get("a"); ok {
+		t.Error("expected a to be deleted")
+	}
+	if _, ok := db.Get("b"); ok {
+		t.Error("expected b to be deleted")
+	}
+	if len(events) != 2 || events[0] != "del a" || events[1] != "del b" {
+		t.Errorf("expected del events, got %v", events)
+	}
+	if len(aof) != 2 || aof[0] != "del" || aof[1] != "del" {
+		t.Errorf("expected del in aof, got %v", aof)
+	}
+}
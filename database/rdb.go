@@ -1,65 +1,47 @@
 package database
 
 import (
-	"github.com/hdt3213/rdb/core"
-	rdb "github.com/hdt3213/rdb/parser"
+	"fmt"
 	"godis-learn/config"
-	"godis-learn/datastruct/dict"
-	"godis-learn/datastruct/list"
-	"godis-learn/datastruct/set"
 	"godis-learn/interface/dbinterface"
 	"godis-learn/lib/logger"
+	"godis-learn/persistent"
+	"io"
 	"os"
+	"time"
 )
 
-func loadRDBFile(db *MultiDB) {
+// loadRDBFile 加载 dbfilename，文件不存在时视为空数据库，文件损坏或者包含不支持的类型时返回错误
+func loadRDBFile(db *MultiDB) error {
 	rdbFile, err := os.Open(config.Properties.RDBFilename)
+	if os.IsNotExist(err) {
+		logger.Info("rdb file " + config.Properties.RDBFilename + " does not exist, starting with an empty database")
+		return nil
+	}
 	if err != nil {
-		logger.Error("open rdb file failed " + err.Error())
-		return
+		return err
 	}
 	defer func(f *os.File) {
 		_ = f.Close()
 	}(rdbFile)
-	decoder := rdb.NewDecoder(rdbFile)
-	err = dumpRDB(decoder, db)
-	if err != nil {
-		logger.Error("dump rdb file failed " + err.Error())
+	if err = dumpRDB(rdbFile, db); err != nil {
+		return fmt.Errorf("load rdb file %s failed: %w", config.Properties.RDBFilename, err)
 	}
+	return nil
 }
 
-func dumpRDB(decoder *core.Decoder, db *MultiDB) error {
-	return decoder.Parse(func(obj rdb.RedisObject) bool {
-		single := db.dbPanicAt(obj.GetDBIndex())
-		switch obj.GetType() {
-		case rdb.StringType:
-			strObj := obj.(*rdb.StringObject)
-			single.Put(obj.GetKey(), &dbinterface.EntryValue{V: strObj.Value})
-		case rdb.ListType:
-			listObj := obj.(*rdb.ListObject)
-			l := list.NewQuickList()
-			for _, v := range listObj.Values {
-				l.Add(v)
-			}
-			single.Put(obj.GetKey(), &dbinterface.EntryValue{V: l})
-		case rdb.HashType:
-			hashObj := obj.(*rdb.HashObject)
-			m := dict.NewSimpleHashMap()
-			for k, v := range hashObj.Hash {
-				m.Put(k, v)
-			}
-			single.Put(obj.GetKey(), &dbinterface.EntryValue{V: m})
-		case rdb.ZSetType:
-			setObj := obj.(*rdb.ZSetObject)
-			s := set.NewSortedSet()
-			for _, e := range setObj.Entries {
-				s.Add(e.Member, e.Score)
-			}
-			single.Put(obj.GetKey(), &dbinterface.EntryValue{V: s})
-		}
-		if obj.GetExpiration() != nil {
-			single.Expire(obj.GetKey(), *obj.GetExpiration())
+func (db *MultiDB) LoadRDB(reader io.Reader) error {
+	return dumpRDB(reader, db)
+}
+
+// dumpRDB 把 RDB 中的对象写入数据库，遇到无法转换的对象时停止并返回错误，而不是跳过导致数据丢失
+func dumpRDB(reader io.Reader, db *MultiDB) error {
+	return persistent.ParseRDB(reader, func(dbIndex int, key string, val *dbinterface.EntryValue, expiration *time.Time) error {
+		single := db.dbPanicAt(dbIndex)
+		single.Put(key, val)
+		if expiration != nil {
+			single.Expire(key, *expiration)
 		}
-		return true
+		return nil
 	})
 }
@@ -0,0 +1,173 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"godis-learn/config"
+	"godis-learn/datastruct/dict"
+	"godis-learn/datastruct/list"
+	"godis-learn/datastruct/set"
+	"godis-learn/datastruct/stream"
+	"godis-learn/interface/dbinterface"
+	"godis-learn/persistent"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// describeValue 把值转换为与内部编码和遍历顺序无关的形式，用于比较
+func describeValue(val *dbinterface.EntryValue) []string {
+	var res []string
+	sorted := true
+	switch v := val.V.(type) {
+	case []byte:
+		res = []string{"string", string(v)}
+	case list.List:
+		sorted = false
+		res = []string{"list"}
+		v.ForEach(func(i int, item any) bool {
+			res = append(res, string(item.([]byte)))
+			return true
+		})
+	case *set.HashSet:
+		v.ForEach(func(member string) bool {
+			res = append(res, member)
+			return true
+		})
+	case dict.HashMap:
+		v.ForEach(func(key string, item any) bool {
+			res = append(res, key+"="+string(item.([]byte)))
+			return true
+		})
+	case *set.SortedSet:
+		v.ForEachRankBetween(0, v.Size(), false, func(e *set.Element) bool {
+			res = append(res, fmt.Sprintf("%s:%v", e.Member, e.Score))
+			return true
+		})
+	case *stream.Stream:
+		sorted = false
+		res = []string{"stream", v.LastID.String()}
+		v.ForEach(func(entry *stream.Entry) bool {
+			res = append(res, fmt.Sprintf("%s %q", entry.ID, entry.Fields))
+			return true
+		})
+		for _, group := range v.Groups {
+			res = append(res, fmt.Sprintf("group %s %s %d", group.Name, group.LastID, len(group.Pending)))
+		}
+	}
+	if sorted {
+		sort.Strings(res)
+		res = append([]string{fmt.Sprintf("%T", val.V)}, res...)
+	}
+	return res
+}
+
+func makeRDBTestValues() map[string]*dbinterface.EntryValue {
+	values := map[string]*dbinterface.EntryValue{
+		"string": {V: []byte("value")},
+		"intset": {V: set.NewHashSet("1", "2", "300000", "-5")},
+		"bigint": {V: set.NewHashSet("70000")},
+		"set":    {V: set.NewHashSet("a", "b", "c")},
+	}
+	small, large := list.NewQuickList(), list.NewQuickList()
+	small.Add([]byte("a"))
+	small.Add([]byte("b"))
+	smallHash, largeHash := dict.NewSimpleHashMap(), dict.NewSimpleHashMap()
+	smallHash.Put("field", []byte("value"))
+	smallZSet, largeZSet := set.NewSortedSet(), set.NewSortedSet()
+	smallZSet.Add("member", 1.5)
+	// 超过 ziplist 的条目数限制，使用普通编码
+	for i := 0; i < 600; i++ {
+		large.Add([]byte(strconv.Itoa(i)))
+		largeHash.Put("field"+strconv.Itoa(i), []byte(strconv.Itoa(i)))
+		largeZSet.Add("member"+strconv.Itoa(i), float64(i))
+	}
+	values["ziplist"] = &dbinterface.EntryValue{V: small}
+	values["quicklist"] = &dbinterface.EntryValue{V: large}
+	values["hash-ziplist"] = &dbinterface.EntryValue{V: smallHash}
+	values["hash"] = &dbinterface.EntryValue{V: largeHash}
+	values["zset-ziplist"] = &dbinterface.EntryValue{V: smallZSet}
+	values["zset"] = &dbinterface.EntryValue{V: largeZSet}
+	s := stream.New()
+	for i := 1; i <= 150; i++ {
+		_ = s.Append(stream.ID{Ms: uint64(i), Seq: 0}, [][]byte{[]byte("field"), []byte(strconv.Itoa(i))})
+	}
+	s.Groups = []*stream.Group{{Name: "group", LastID: stream.ID{Ms: 2}, Pending: []*stream.PendingEntry{{ID: stream.ID{Ms: 2}, Consumer: "consumer"}}, Consumers: []*stream.Consumer{{Name: "consumer"}}}}
+	values["stream"] = &dbinterface.EntryValue{V: s}
+	return values
+}
+
+func TestRDBRoundTrip(t *testing.T) {
+	defer func() {
+		config.Properties.RDBFilename = ""
+	}()
+	config.Properties.RDBFilename = filepath.Join(t.TempDir(), "dump.rdb")
+	db := NewStandaloneServer()
+	defer db.Close()
+	values := makeRDBTestValues()
+	expireAt := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	for _, dbIndex := range []int{0, 2} {
+		for key, val := range values {
+			db.dbPanicAt(dbIndex).Put(key, val)
+		}
+		db.dbPanicAt(dbIndex).Expire("string", expireAt)
+	}
+	if err := persistent.SaveRDB(db, config.Properties.RDBFilename); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(config.Properties.RDBFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("REDIS0009")) {
+		t.Errorf("unexpected rdb header %q", data[:9])
+	}
+	// 与 Redis 一样，文件末尾是对之前全部内容计算的 CRC64
+	if sum := binary.LittleEndian.Uint64(data[len(data)-8:]); sum != persistent.CRC64(data[:len(data)-8]) {
+		t.Error("rdb checksum mismatch")
+	}
+
+	reloaded := NewStandaloneServer()
+	defer reloaded.Close()
+	for _, dbIndex := range []int{0, 2} {
+		single := reloaded.dbPanicAt(dbIndex)
+		if size, _ := reloaded.GetDBSize(dbIndex); size != len(values) {
+			t.Errorf("expected %d keys in db %d, got %d", len(values), dbIndex, size)
+		}
+		for key, expected := range values {
+			val, ok := single.Get(key)
+			if !ok {
+				t.Errorf("key %s in db %d is lost", key, dbIndex)
+				continue
+			}
+			if !reflect.DeepEqual(describeValue(val), describeValue(expected)) {
+				t.Errorf("key %s in db %d is %v, expected %v", key, dbIndex, describeValue(val), describeValue(expected))
+			}
+		}
+		if raw, ok := single.ttlMap.Get("string"); !ok || !raw.(time.Time).Equal(expireAt) {
+			t.Errorf("expected expiration %v in db %d, got %v", expireAt, dbIndex, raw)
+		}
+	}
+}
+
+func TestLoadUnsupportedRDBType(t *testing.T) {
+	defer func() {
+		config.Properties.RDBFilename = ""
+	}()
+	config.Properties.RDBFilename = filepath.Join(t.TempDir(), "dump.rdb")
+	// SELECTDB 0 之后是一个 module 类型的 key
+	data := bytes.NewBufferString("REDIS0009")
+	data.Write([]byte{0xFE, 0x00, 0x07, 0x01, 'k', 0x01})
+	if err := os.WriteFile(config.Properties.RDBFilename, data.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db := NewBasicMultiDB()
+	if err := loadRDBFile(db); err == nil {
+		t.Error("expected unsupported object to fail loading")
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	rdb "github.com/hdt3213/rdb/parser"
 	"godis-learn/config"
 	"godis-learn/interface/redis"
 	"godis-learn/lib/logger"
@@ -27,54 +26,79 @@ const (
 )
 
 type replicationStatus struct {
-	mutex             sync.Mutex
-	ctx               context.Context
-	cancel            context.CancelFunc
-	modCount          int32
-	masterHost        string
-	masterPort        int
-	masterConn        net.Conn
-	masterChan        <-chan *parse.Payload
-	replicationId     string
+	mutex         sync.Mutex
+	ctx           context.Context
+	cancel        context.CancelFunc
+	modCount      int32
+	masterHost    string
+	masterPort    int
+	masterConn    net.Conn
+	masterChan    <-chan *parse.Payload
+	replicationId string
+	// replicationOffset 与 lastReceiveTime 在接收命令时更新，使用原子操作访问，lastReceiveTime 为 UnixNano
 	replicationOffset int64
-	lastReceiveTime   time.Time
+	lastReceiveTime   int64
 	running           sync.WaitGroup
+	// cronStop 在关闭数据库时停止 startReplicationCron，cronDone 在它退出后关闭
+	cronStop chan struct{}
+	cronDone chan struct{}
 }
 
 func newReplicationStatus() *replicationStatus {
-	return &replicationStatus{}
+	return &replicationStatus{
+		cronStop: make(chan struct{}),
+		cronDone: make(chan struct{}),
+	}
 }
 
 func startReplicationCron(db *MultiDB) {
 	go func() {
+		defer close(db.rep.cronDone)
 		defer func() {
 			if err := recover(); err != nil {
 				logger.Error("panic", err)
 			}
 		}()
-		ticker := time.Tick(time.Second)
-		for range ticker {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for tick := 1; ; tick++ {
+			select {
+			case <-db.rep.cronStop:
+				return
+			case <-ticker.C:
+			}
 			db.rep.slaveCron(db)
+			if tick%replPingPeriod == 0 {
+				db.pingReplicas()
+			}
 		}
 	}()
 }
 
+// slaveCron 定期向 master 报告复制偏移量，超过 repl-timeout 没有收到数据时重新连接，
+// 连接失败之后也在 repl-timeout 之后重试
 func (r *replicationStatus) slaveCron(db *MultiDB) {
-	if r.masterConn == nil {
+	r.mutex.Lock()
+	masterHost, masterConn := r.masterHost, r.masterConn
+	r.mutex.Unlock()
+	if masterHost == "" {
 		return
 	}
 	repTimeout := 60 * time.Second
 	if config.Properties.ReplTimeout != 0 {
 		repTimeout = time.Duration(config.Properties.ReplTimeout) * time.Second
 	}
-	if r.lastReceiveTime.Before(time.Now().Add(-repTimeout)) {
+	if time.Since(time.Unix(0, atomic.LoadInt64(&r.lastReceiveTime))) > repTimeout {
 		err := r.reconnectMaster(db)
 		if err != nil {
 			logger.Error("send failed " + err.Error())
 		}
 		return
 	}
-	err := r.sendAck()
+	if masterConn == nil {
+		return
+	}
+	err := r.sendAck(masterConn)
 	if err != nil {
 		logger.Error("send failed " + err.Error())
 	}
@@ -85,18 +109,18 @@ func (r *replicationStatus) reconnectMaster(db *MultiDB) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	r.stopSlaveWithMutex()
-	go r.syncWithMaster(db)
+	r.startSlaveWithMutex(db)
 	return nil
 }
 
-func (r *replicationStatus) sendAck() error {
+func (r *replicationStatus) sendAck(masterConn net.Conn) error {
 	line := utils.StringsToLine(
 		"REPLCONF",
 		"ACK",
-		strconv.FormatInt(r.replicationOffset, 10),
+		strconv.FormatInt(atomic.LoadInt64(&r.replicationOffset), 10),
 	)
 	reply := protocol.ArrayReply(line)
-	_, err := r.masterConn.Write(reply.GetBytes())
+	_, err := masterConn.Write(reply.GetBytes())
 	return err
 }
 
@@ -114,39 +138,66 @@ func (r *replicationStatus) stopSlaveWithMutex() {
 	r.masterConn, r.masterChan = nil, nil
 }
 
-func (r *replicationStatus) syncWithMaster(db *MultiDB) {
+// startSlaveWithMutex 在新的协程中与 master 同步，调用者需要持有 mutex 并且已经调用过 stopSlaveWithMutex。
+// 同步的每一步都检查 modCount，之后再次调用 stopSlaveWithMutex 的同步不会修改状态
+func (r *replicationStatus) startSlaveWithMutex(db *MultiDB) {
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	go r.syncWithMaster(db, r.modCount)
+}
+
+func (r *replicationStatus) syncWithMaster(db *MultiDB, modCount int32) {
 	defer func() {
 		if err := recover(); err != nil {
 			logger.Error(err)
 		}
 	}()
-	r.mutex.Lock()
-	r.ctx, r.cancel = context.WithCancel(context.Background())
-	r.mutex.Unlock()
-	if err := r.connectMaster(); err != nil {
+	// 从开始同步时计算超时，连接失败时 slaveCron 在 repl-timeout 之后重试
+	atomic.StoreInt64(&r.lastReceiveTime, time.Now().UnixNano())
+	if err := r.connectMaster(modCount); err != nil {
 		logger.Error("full sync failed during connecting " + err.Error())
-	} else if err := r.pSync(db); err != nil {
+	} else if err := r.pSync(db, modCount); err != nil {
 		logger.Error("full sync failed during PSYNC " + err.Error())
-	} else if err := r.receiveAOF(db); err != nil {
+	} else if err := r.receiveAOF(db, modCount); err != nil {
 		logger.Error("full sync failed during receiving aof " + err.Error())
 	}
 }
 
-func (r *replicationStatus) connectMaster() error {
-	modCount := atomic.LoadInt32(&(r.modCount))
+func (r *replicationStatus) connectMaster(modCount int32) error {
+	r.mutex.Lock()
+	if r.modCount != modCount {
+		r.mutex.Unlock()
+		return errors.New("replication is restarted")
+	}
 	addr := fmt.Sprintf("%s:%d", r.masterHost, r.masterPort)
+	r.mutex.Unlock()
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
-		r.abortConnect()
 		return errors.New("connect master failed " + err.Error())
 	}
 	masterChan := parse.StartParseStream(conn)
-	if err = r.tryPing(conn, masterChan); err != nil {
+	if err = r.handshake(conn, masterChan, modCount); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.modCount != modCount {
+		_ = conn.Close()
+		return errors.New("replication is restarted")
+	}
+	r.masterConn = conn
+	r.masterChan = masterChan
+	return nil
+}
+
+// handshake 在 PSYNC 之前向 master 发送 PING、AUTH 和 REPLCONF
+func (r *replicationStatus) handshake(conn net.Conn, masterChan <-chan *parse.Payload, modCount int32) error {
+	if err := r.tryPing(conn, masterChan, modCount); err != nil {
 		return err
 	}
 	if auth := config.Properties.MasterAuth; auth != "" {
 		authCmdLine := utils.StringsToLine("auth", auth)
-		if err = r.sendCmdToMaster(conn, authCmdLine, masterChan); err != nil {
+		if err := r.sendCmdToMaster(conn, authCmdLine, masterChan, modCount); err != nil {
 			return err
 		}
 	}
@@ -155,31 +206,27 @@ func (r *replicationStatus) connectMaster() error {
 		port = config.Properties.Port
 	}
 	portCmdLine := utils.StringsToLine("REPLCONF", "listening-port", strconv.Itoa(port))
-	if err = r.sendCmdToMaster(conn, portCmdLine, masterChan); err != nil {
+	if err := r.sendCmdToMaster(conn, portCmdLine, masterChan, modCount); err != nil {
 		return err
 	}
 	capCmdLine := utils.StringsToLine("REPLCONF", "capa", "psync2")
-	if err = r.sendCmdToMaster(conn, capCmdLine, masterChan); err != nil {
-		return err
-	}
+	return r.sendCmdToMaster(conn, capCmdLine, masterChan, modCount)
+}
+
+func (r *replicationStatus) pSync(db *MultiDB, modCount int32) error {
 	r.mutex.Lock()
-	if r.modCount != modCount {
-		return nil
+	if r.modCount != modCount || r.masterConn == nil {
+		r.mutex.Unlock()
+		return errors.New("replication is restarted")
 	}
-	r.masterConn = conn
-	r.masterChan = masterChan
+	masterConn, masterChan := r.masterConn, r.masterChan
 	r.mutex.Unlock()
-	return nil
-}
-
-func (r *replicationStatus) pSync(db *MultiDB) error {
-	modCount := atomic.LoadInt32(&(r.modCount))
 	cmdLine := utils.StringsToLine("psync", "?", "-1")
 	req := protocol.ArrayReply(cmdLine)
-	if _, err := r.masterConn.Write(req.GetBytes()); err != nil {
+	if _, err := masterConn.Write(req.GetBytes()); err != nil {
 		return errors.New("send failed " + err.Error())
 	}
-	payload := <-r.masterChan
+	payload := <-masterChan
 	if payload.Err != nil {
 		return errors.New("read response failed: " + payload.Err.Error())
 	}
@@ -192,7 +239,7 @@ func (r *replicationStatus) pSync(db *MultiDB) error {
 		return errors.New(fmt.Sprintf("illegal payload header: %s", entireHeader))
 	}
 	logger.Info("receive psync header from master")
-	payload = <-r.masterChan
+	payload = <-masterChan
 	if payload.Err != nil {
 		return errors.New("read response failed: " + payload.Err.Error())
 	}
@@ -201,16 +248,15 @@ func (r *replicationStatus) pSync(db *MultiDB) error {
 		return errors.New(fmt.Sprintf("illegal payload body: %s", payload.Data.GetBytes()))
 	}
 	logger.Infof("receive %d bytes of rdb from master", len(body))
-	rdbDecoder := rdb.NewDecoder(bytes.NewReader(body))
 	rdbHolder := NewBasicMultiDB()
-	if err := dumpRDB(rdbDecoder, rdbHolder); err != nil {
+	if err := dumpRDB(bytes.NewReader(body), rdbHolder); err != nil {
 		return errors.New("dump rdb failed " + err.Error())
 	}
 
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	if r.modCount != modCount {
-		return nil
+		return errors.New("replication is restarted")
 	}
 	id := headers[1]
 	offset, err := strconv.ParseInt(string(headers[2]), 10, 64)
@@ -219,30 +265,33 @@ func (r *replicationStatus) pSync(db *MultiDB) error {
 	}
 	logger.Infof("full rsync from master: %s", id)
 	logger.Infof("current offset: %d", int(offset))
-	r.replicationId, r.replicationOffset = string(id), offset
+	r.replicationId = string(id)
+	atomic.StoreInt64(&r.replicationOffset, offset)
+	atomic.StoreInt64(&r.lastReceiveTime, time.Now().UnixNano())
 	for i, value := range rdbHolder.dbs {
 		single := value.Load().(*DB)
 		_ = db.storeNewDB(i, single)
 	}
-	r.masterChan = parse.StartParseStream(r.masterConn)
 	return nil
 }
 
-func (r *replicationStatus) receiveAOF(db *MultiDB) error {
-	cc := connection.NewClientConn(r.masterConn)
-	cc.SetRole(connection.ReplicationClient)
+func (r *replicationStatus) receiveAOF(db *MultiDB, modCount int32) error {
 	r.mutex.Lock()
-	modCount := r.modCount
-	done := r.ctx.Done()
-	r.mutex.Unlock()
-	if done == nil {
+	if r.modCount != modCount || r.masterChan == nil {
+		r.mutex.Unlock()
 		return nil
 	}
+	done := r.ctx.Done()
+	masterConn, masterChan := r.masterConn, r.masterChan
+	// 在持有锁并且 modCount 没有变化时登记，下一次 stopSlaveWithMutex 一定会取消 done 并等待当前协程退出
 	r.running.Add(1)
+	r.mutex.Unlock()
 	defer r.running.Done()
+	cc := connection.NewClientConn(masterConn)
+	cc.SetRole(connection.ReplicationClient)
 	for {
 		select {
-		case payload, open := <-r.masterChan:
+		case payload, open := <-masterChan:
 			if !open {
 				return errors.New("master channel unexpected close")
 			}
@@ -253,32 +302,36 @@ func (r *replicationStatus) receiveAOF(db *MultiDB) error {
 			if !ok {
 				return errors.New(fmt.Sprintf("unexpected payload: %s", payload.Data.GetBytes()))
 			}
-			r.mutex.Lock()
-			if r.modCount != modCount {
+			// stopSlaveWithMutex 持有锁等待当前协程退出，这里不能获取 r.mutex
+			if atomic.LoadInt32(&r.modCount) != modCount {
 				return nil
 			}
 			db.Execute(cc, line)
 			n := len(payload.Data.GetBytes())
-			r.replicationOffset += int64(n)
-			logger.Infof("receive %d bytes from master, current offset %d", n, int(r.replicationOffset))
-			r.mutex.Unlock()
+			offset := atomic.AddInt64(&r.replicationOffset, int64(n))
+			atomic.StoreInt64(&r.lastReceiveTime, time.Now().UnixNano())
+			logger.Infof("receive %d bytes from master, current offset %d", n, int(offset))
 		case <-done:
 			return nil
 		}
 	}
 }
 
-func (r *replicationStatus) abortConnect() {
+// abortConnect 在 master 拒绝同步时放弃复制，modCount 已经变化时说明复制已经重新开始，不做任何修改
+func (r *replicationStatus) abortConnect(modCount int32) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
+	if r.modCount != modCount {
+		return
+	}
 	r.masterHost = ""
 	r.masterPort = 0
 	r.replicationId = ""
-	r.replicationOffset = -1
+	atomic.StoreInt64(&r.replicationOffset, -1)
 	r.stopSlaveWithMutex()
 }
 
-func (r *replicationStatus) tryPing(c net.Conn, masterChan <-chan *parse.Payload) error {
+func (r *replicationStatus) tryPing(c net.Conn, masterChan <-chan *parse.Payload, modCount int32) error {
 	pingLine := utils.StringsToLine("ping")
 	pingReq := protocol.ArrayReply(pingLine)
 	_, err := c.Write(pingReq.GetBytes())
@@ -294,43 +347,86 @@ func (r *replicationStatus) tryPing(c net.Conn, masterChan <-chan *parse.Payload
 		if hasNonePrefix(reply.(redis.ErrorReply).Error(), "NOAUTH", "NOPERM", "ERR operation not permitted") {
 			info := fmt.Sprintf("Error reply to PING from master: %s", reply.GetBytes())
 			logger.Error(info)
-			r.abortConnect()
+			r.abortConnect(modCount)
 			return errors.New(info)
 		}
 	}
 	return nil
 }
 
-func (r *replicationStatus) sendCmdToMaster(c net.Conn, line redis.Line, masterChan <-chan *parse.Payload) error {
+// sendCmdToMaster 发送握手命令，读写失败时由 slaveCron 重试，master 拒绝时放弃复制
+func (r *replicationStatus) sendCmdToMaster(c net.Conn, line redis.Line, masterChan <-chan *parse.Payload, modCount int32) error {
 	req := protocol.ArrayReply(line)
 	_, err := c.Write(req.GetBytes())
 	if err != nil {
-		r.abortConnect()
 		return errors.New("send failed " + err.Error())
 	}
 	resp := <-masterChan
 	if resp.Err != nil {
-		r.abortConnect()
 		return errors.New("read reaponse failed" + resp.Err.Error())
 	}
 	if !protocol.CheckOKReply(resp.Data) {
-		r.abortConnect()
+		r.abortConnect(modCount)
 		return errors.New(fmt.Sprintf("unexpected auth response: %s", resp.Data.GetBytes()))
 	}
 	return nil
 }
 
 func (r *replicationStatus) close() error {
+	// slaveCron 没有持有锁，需要等它退出之后再修改状态
+	close(r.cronStop)
+	<-r.cronDone
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	r.stopSlaveWithMutex()
 	return nil
 }
 
-func (db *MultiDB) execSlaveOf(conn redis.Connection, line redis.Line) redis.Reply {
+func (db *MultiDB) execSlaveOf(_ redis.Connection, line redis.Line) redis.Reply {
+	if len(line) != 2 {
+		return protocol.ArgumentCountErrorReply([]byte("slaveof"))
+	}
+	if strings.EqualFold(string(line[0]), "no") && strings.EqualFold(string(line[1]), "one") {
+		db.slaveOfNoOne()
+	}
 	return protocol.OkReply()
 }
 
+// SlaveOf 成为 host:port 的副本，之前的数据由全量同步得到的数据替换，此后只执行 master 传来的写命令
+func (db *MultiDB) SlaveOf(host string, port int) {
+	atomic.StoreInt32(&(db.role), slaveRole)
+	db.dropReplicas()
+	db.rep.mutex.Lock()
+	db.rep.masterHost, db.rep.masterPort = host, port
+	db.rep.replicationId = ""
+	atomic.StoreInt64(&db.rep.replicationOffset, -1)
+	db.rep.stopSlaveWithMutex()
+	db.rep.startSlaveWithMutex(db)
+	db.rep.mutex.Unlock()
+}
+
+// slaveOfNoOne 断开与 master 的连接并成为 master，已经同步的数据会被保留
+func (db *MultiDB) slaveOfNoOne() {
+	db.rep.mutex.Lock()
+	defer db.rep.mutex.Unlock()
+	db.rep.masterHost, db.rep.masterPort = "", 0
+	db.rep.stopSlaveWithMutex()
+	atomic.StoreInt32(&(db.role), masterRole)
+}
+
+// ReplicationOffset 返回复制偏移量。master 返回已经发给副本的字节数，ok 总是为 true；
+// 副本返回从 master 收到的字节数，还没有完成全量同步时 ok 为 false
+func (db *MultiDB) ReplicationOffset() (offset int64, ok bool) {
+	if atomic.LoadInt32(&db.role) == masterRole {
+		db.feedMutex.Lock()
+		defer db.feedMutex.Unlock()
+		return db.replOffset, true
+	}
+	db.rep.mutex.Lock()
+	defer db.rep.mutex.Unlock()
+	return atomic.LoadInt64(&db.rep.replicationOffset), db.rep.replicationId != ""
+}
+
 func hasNonePrefix(s string, prefixes ...string) bool {
 	for _, prefix := range prefixes {
 		if strings.HasPrefix(s, prefix) {
@@ -0,0 +1,98 @@
+package database
+
+import (
+	"godis-learn/lib/utils"
+	"godis-learn/redis/connection"
+	"godis-learn/redis/parse"
+	"godis-learn/redis/protocol"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveTestMaster 在本地端口上用 db 处理收到的命令，返回监听的端口
+func serveTestMaster(t *testing.T, db *MultiDB) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				client := connection.NewClientConn(conn)
+				for payload := range parse.StartParseStream(conn) {
+					if payload.Err != nil {
+						break
+					}
+					args, _ := protocol.FetchArrayArgs(payload.Data)
+					if err := client.Write(db.Execute(client, args).GetBytes()); err != nil {
+						break
+					}
+				}
+				db.AfterClientClose(client)
+				_ = client.Close()
+			}(conn)
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestSlaveOf(t *testing.T) {
+	master := NewStandaloneServer()
+	defer master.Close()
+	slave := NewStandaloneServer()
+	defer slave.Close()
+	conn := connection.NewClientConn(nil)
+	master.Execute(conn, utils.StringsToLine("SET", "before", "1"))
+	slave.Execute(conn, utils.StringsToLine("SET", "stale", "1"))
+
+	slave.SlaveOf("127.0.0.1", serveTestMaster(t, master))
+	selected := connection.NewClientConn(nil)
+	selected.SelectDB(1)
+	master.Execute(selected, utils.StringsToLine("SET", "after", "2"))
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		value, _ := protocol.FetchBulkString(slave.Execute(selected, utils.StringsToLine("GET", "after")))
+		if string(value) == "2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected writes after full sync to be replicated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if value, _ := protocol.FetchBulkString(slave.Execute(conn, utils.StringsToLine("GET", "before"))); string(value) != "1" {
+		t.Errorf("expected data of full sync, got %q", value)
+	}
+	if n, _ := protocol.FetchCode(slave.Execute(conn, utils.StringsToLine("EXISTS", "stale"))); n != 0 {
+		t.Error("expected data of the slave to be replaced")
+	}
+	masterOffset, _ := master.ReplicationOffset()
+	if offset, synced := slave.ReplicationOffset(); !synced || offset != masterOffset {
+		t.Errorf("expected offset %d, got %d (synced %v)", masterOffset, offset, synced)
+	}
+	if reply := slave.Execute(conn, utils.StringsToLine("SET", "key", "value")); !protocol.CheckErrorReply(reply) {
+		t.Errorf("expected slave to be read only, got %s", reply.GetBytes())
+	}
+	if reply := master.Execute(conn, utils.StringsToLine("INFO", "replication")); !strings.Contains(string(reply.GetBytes()), "connected_slaves:1") {
+		t.Errorf("expected one connected slave, got %s", reply.GetBytes())
+	}
+
+	slave.Execute(conn, utils.StringsToLine("SLAVEOF", "NO", "ONE"))
+	if reply := slave.Execute(conn, utils.StringsToLine("SET", "key", "value")); !protocol.CheckOKReply(reply) {
+		t.Errorf("expected writes after SLAVEOF NO ONE, got %s", reply.GetBytes())
+	}
+	master.Execute(conn, utils.StringsToLine("SET", "later", "3"))
+	time.Sleep(100 * time.Millisecond)
+	if n, _ := protocol.FetchCode(slave.Execute(conn, utils.StringsToLine("EXISTS", "later"))); n != 0 {
+		t.Error("expected replication to stop after SLAVEOF NO ONE")
+	}
+}
@@ -0,0 +1,226 @@
+package database
+
+import (
+	"errors"
+	"godis-learn/config"
+	"godis-learn/interface/redis"
+	"godis-learn/lib/logger"
+	"godis-learn/persistent"
+	"godis-learn/redis/protocol"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// saveRetryDelay 是自动保存失败之后再次尝试的最短间隔，单位为秒
+const saveRetryDelay = 5
+
+var errSaveInProgress = errors.New("ERR Background save already in progress")
+
+// saveParam 对应一条 save <seconds> <changes> 规则
+type saveParam struct {
+	seconds int64
+	changes int64
+}
+
+func parseSaveParams(raw string) ([]saveParam, error) {
+	fields := strings.Fields(raw)
+	if len(fields)%2 != 0 {
+		return nil, errors.New("save rules must be pairs of <seconds> <changes>")
+	}
+	params := make([]saveParam, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || seconds <= 0 {
+			return nil, errors.New("invalid save seconds " + fields[i])
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes <= 0 {
+			return nil, errors.New("invalid save changes " + fields[i+1])
+		}
+		params = append(params, saveParam{seconds: seconds, changes: changes})
+	}
+	return params, nil
+}
+
+// rdbSaver 记录 RDB 保存的状态，并按照 save 规则定期在后台保存
+type rdbSaver struct {
+	params []saveParam
+	// dirty 是上一次保存成功之后执行的写命令数量
+	dirty int64
+	// lastSave 为上一次保存成功的 Unix 时间戳，lastTry 为上一次开始保存的时间戳
+	lastSave int64
+	lastTry  int64
+	saving   int32
+	// failed 表示最近一次保存失败
+	failed int32
+	stop   chan struct{}
+}
+
+func newRDBSaver() *rdbSaver {
+	params, err := parseSaveParams(config.Properties.Save)
+	if err != nil {
+		logger.Warn("save: " + err.Error())
+	}
+	return &rdbSaver{
+		params:   params,
+		lastSave: time.Now().Unix(),
+		stop:     make(chan struct{}),
+	}
+}
+
+// shouldSave 判断是否满足任意一条 save 规则，保存失败之后至少等待 saveRetryDelay 秒再重试
+func (s *rdbSaver) shouldSave(now int64) bool {
+	if atomic.LoadInt32(&s.failed) == 1 && now-atomic.LoadInt64(&s.lastTry) < saveRetryDelay {
+		return false
+	}
+	dirty := atomic.LoadInt64(&s.dirty)
+	elapsed := now - atomic.LoadInt64(&s.lastSave)
+	for _, param := range s.params {
+		if dirty >= param.changes && elapsed >= param.seconds {
+			return true
+		}
+	}
+	return false
+}
+
+// stopWrites 判断是否因为保存失败而拒绝写命令
+func (s *rdbSaver) stopWrites() bool {
+	return len(s.params) > 0 && atomic.LoadInt32(&s.failed) == 1 &&
+		!strings.EqualFold(config.Properties.StopWritesOnBGSaveError, "no")
+}
+
+func startSaveCron(db *MultiDB) {
+	if len(db.saver.params) == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.saver.stop:
+				return
+			case <-ticker.C:
+			}
+			if db.saver.shouldSave(time.Now().Unix()) {
+				if err := db.bgSave(); err != nil && err != errSaveInProgress {
+					logger.Error("background saving failed: " + err.Error())
+				}
+			}
+		}
+	}()
+}
+
+// save 生成 RDB 文件，调用者需要已经把 saving 设置为 1
+func (db *MultiDB) save() error {
+	s := db.saver
+	defer atomic.StoreInt32(&s.saving, 0)
+	dirty := atomic.LoadInt64(&s.dirty)
+	atomic.StoreInt64(&s.lastTry, time.Now().Unix())
+	var err error
+	if db.aofHandler != nil {
+		// 与 AOF 重写互斥
+		err = db.aofHandler.Rewrite2RDB()
+	} else {
+		err = persistent.SaveRDB(db, persistent.RDBFilename())
+	}
+	if err == persistent.ErrRewriteInProgress {
+		// 没有真正开始保存，不影响保存状态
+		return err
+	}
+	if err != nil {
+		atomic.StoreInt32(&s.failed, 1)
+		return err
+	}
+	// 保存期间的写命令不在快照中，仍然需要计入下一次保存
+	atomic.AddInt64(&s.dirty, -dirty)
+	atomic.StoreInt64(&s.lastSave, time.Now().Unix())
+	atomic.StoreInt32(&s.failed, 0)
+	return nil
+}
+
+func (db *MultiDB) bgSave() error {
+	if !atomic.CompareAndSwapInt32(&db.saver.saving, 0, 1) {
+		return errSaveInProgress
+	}
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				atomic.StoreInt32(&db.saver.failed, 1)
+				logger.Error(err)
+			}
+		}()
+		if err := db.save(); err != nil {
+			logger.Error("background saving failed: " + err.Error())
+		}
+	}()
+	return nil
+}
+
+func (db *MultiDB) SaveRDB() redis.Reply {
+	if !atomic.CompareAndSwapInt32(&db.saver.saving, 0, 1) {
+		return protocol.NewErrorReply([]byte(errSaveInProgress.Error()))
+	}
+	if err := db.save(); err != nil {
+		return protocol.NewErrorReply([]byte(err.Error()))
+	}
+	return protocol.OkReply()
+}
+
+func (db *MultiDB) BGSaveRDB() redis.Reply {
+	if err := db.bgSave(); err != nil {
+		return protocol.NewErrorReply([]byte(err.Error()))
+	}
+	return protocol.StatusReply([]byte("Background saving started"))
+}
+
+func (db *MultiDB) lastSave() redis.Reply {
+	return protocol.IntReply(atomic.LoadInt64(&db.saver.lastSave))
+}
+
+// checkSaveError 在保存失败并且开启了 stop-writes-on-bgsave-error 时拒绝写命令
+func (db *MultiDB) checkSaveError(cmdName string) redis.Reply {
+	if !db.saver.stopWrites() || !IsWriteCommand(cmdName) {
+		return nil
+	}
+	return protocol.NewErrorReply([]byte("MISCONF Errors writing to the RDB file, commands that may modify the data set are disabled, " +
+		"because this instance is configured to report errors during writes if RDB snapshotting fails (stop-writes-on-bgsave-error option)"))
+}
+
+// checkAOFError 在 appendfsync always 策略下写入 AOF 失败之后拒绝写命令
+func (db *MultiDB) checkAOFError(cmdName string) redis.Reply {
+	if db.aofHandler == nil || !IsWriteCommand(cmdName) {
+		return nil
+	}
+	if err := db.aofHandler.WriteError(); err != nil {
+		return aofErrorReply(err)
+	}
+	return nil
+}
+
+// aofErrorReply 是写入 AOF 失败时的错误回复，命令已经在内存中执行但没有持久化
+func aofErrorReply(err error) redis.Reply {
+	return protocol.NewErrorReply([]byte("MISCONF Errors writing to the AOF file: " + err.Error()))
+}
+
+// IsWriteCommand 判断命令是否可能修改数据
+func IsWriteCommand(cmdName string) bool {
+	_, known := cmdMap[cmdName]
+	return (known && !checkReadOnlyCommand(cmdName)) || cmdName == "flushdb" || cmdName == "flushall"
+}
+
+// closeSaver 停止定期保存，配置了 save 规则并且有未保存的写入时最后保存一次
+func (db *MultiDB) closeSaver() {
+	close(db.saver.stop)
+	if len(db.saver.params) == 0 || atomic.LoadInt64(&db.saver.dirty) == 0 {
+		return
+	}
+	for !atomic.CompareAndSwapInt32(&db.saver.saving, 0, 1) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := db.save(); err != nil {
+		logger.Error("saving before shutdown failed: " + err.Error())
+	}
+}
@@ -0,0 +1,135 @@
+package database
+
+import (
+	"errors"
+	"godis-learn/config"
+	"godis-learn/interface/redis"
+	"godis-learn/lib/utils"
+	"godis-learn/redis/connection"
+	"godis-learn/redis/protocol"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSaveParams(t *testing.T) {
+	params, err := parseSaveParams("900 1 300 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(params) != 2 || params[1].seconds != 300 || params[1].changes != 10 {
+		t.Errorf("unexpected save params %+v", params)
+	}
+	for _, raw := range []string{"900", "900 x", "0 1"} {
+		if _, err := parseSaveParams(raw); err == nil {
+			t.Errorf("expected error for %q", raw)
+		}
+	}
+}
+
+func TestSaveWithoutAOF(t *testing.T) {
+	defer func() {
+		config.Properties.RDBFilename = ""
+	}()
+	config.Properties.RDBFilename = filepath.Join(t.TempDir(), "dump.rdb")
+	db := NewStandaloneServer()
+	defer db.Close()
+	conn := connection.NewClientConn(nil)
+	db.Execute(conn, utils.StringsToLine("SET", "key", "value"))
+	before, ok := protocol.FetchCode(db.Execute(conn, utils.StringsToLine("LASTSAVE")))
+	if !ok {
+		t.Fatal("expected LASTSAVE to return an integer")
+	}
+	if reply := db.Execute(conn, utils.StringsToLine("SAVE")); protocol.CheckErrorReply(reply) {
+		t.Fatalf("save failed: %s", reply.GetBytes())
+	}
+	if after, _ := protocol.FetchCode(db.Execute(conn, utils.StringsToLine("LASTSAVE"))); after < before {
+		t.Errorf("expected LASTSAVE to be updated, got %v and %v", before, after)
+	}
+	if info := string(db.Execute(conn, utils.StringsToLine("INFO", "persistence")).GetBytes()); !strings.Contains(info, "rdb_changes_since_last_save:0") {
+		t.Errorf("expected no unsaved changes, got %s", info)
+	}
+
+	reloaded := NewStandaloneServer()
+	defer reloaded.Close()
+	if value, _ := protocol.FetchBulkString(reloaded.Execute(conn, utils.StringsToLine("GET", "key"))); string(value) != "value" {
+		t.Errorf("expected value after loading RDB, got %q", value)
+	}
+}
+
+func TestSavePoints(t *testing.T) {
+	defer func() {
+		config.Properties.RDBFilename = ""
+		config.Properties.Save = ""
+	}()
+	config.Properties.RDBFilename = filepath.Join(t.TempDir(), "dump.rdb")
+	config.Properties.Save = "1 2"
+	db := NewStandaloneServer()
+	defer db.Close()
+	conn := connection.NewClientConn(nil)
+	db.Execute(conn, utils.StringsToLine("SET", "key", "value"))
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := os.Stat(config.Properties.RDBFilename); !os.IsNotExist(err) {
+		t.Fatalf("expected no save before reaching the save point, got %v", err)
+	}
+	db.Execute(conn, utils.StringsToLine("SET", "key", "value2"))
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, err := os.Stat(config.Properties.RDBFilename); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected RDB to be saved after reaching the save point")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestStopWritesOnSaveError(t *testing.T) {
+	defer func() {
+		config.Properties.RDBFilename = ""
+		config.Properties.Save = ""
+		config.Properties.StopWritesOnBGSaveError = ""
+	}()
+	// 目录不存在，保存总是失败
+	config.Properties.RDBFilename = filepath.Join(t.TempDir(), "missing", "dump.rdb")
+	config.Properties.Save = "3600 1"
+	db := NewStandaloneServer()
+	defer db.Close()
+	conn := connection.NewClientConn(nil)
+	if reply := db.Execute(conn, utils.StringsToLine("SAVE")); !protocol.CheckErrorReply(reply) {
+		t.Fatalf("expected save to fail, got %s", reply.GetBytes())
+	}
+	reply := db.Execute(conn, utils.StringsToLine("SET", "key", "value"))
+	if !strings.HasPrefix(string(reply.GetBytes()), "-MISCONF") {
+		t.Errorf("expected MISCONF error, got %s", reply.GetBytes())
+	}
+	if reply := db.Execute(conn, utils.StringsToLine("GET", "key")); protocol.CheckErrorReply(reply) {
+		t.Errorf("expected reads to be allowed, got %s", reply.GetBytes())
+	}
+	config.Properties.StopWritesOnBGSaveError = "no"
+	if reply := db.Execute(conn, utils.StringsToLine("SET", "key", "value")); protocol.CheckErrorReply(reply) {
+		t.Errorf("expected writes to be allowed, got %s", reply.GetBytes())
+	}
+}
+
+func TestAOFWriteErrorReply(t *testing.T) {
+	db := newSimpleDB()
+	db.addAOF = func(redis.Line) error {
+		return errors.New("no space left on device")
+	}
+	// 命令已经在内存中执行，但写入 AOF 失败时要回复错误
+	reply := execSet(db, utils.StringsToLine("key", "value"))
+	if !strings.HasPrefix(string(reply.GetBytes()), "-MISCONF") {
+		t.Errorf("expected MISCONF error, got %s", reply.GetBytes())
+	}
+	if reply := execDel(db, utils.StringsToLine("key")); !strings.HasPrefix(string(reply.GetBytes()), "-MISCONF") {
+		t.Errorf("expected MISCONF error, got %s", reply.GetBytes())
+	}
+	// 没有修改数据时不写入 AOF
+	if reply := execDel(db, utils.StringsToLine("key")); protocol.CheckErrorReply(reply) {
+		t.Errorf("expected no error, got %s", reply.GetBytes())
+	}
+}
@@ -26,7 +26,10 @@ type DB struct {
 	ttlMap     dict.HashMap
 	versionMap dict.HashMap
 	locker     *lock.StringLock
-	addAOF     func(redis.Line)
+	addAOF     func(redis.Line) error
+	// notifyFlags 为 notify-keyspace-events 解析后的结果，notify 负责发布通知
+	notifyFlags int
+	notify      func(flags int, event, key string)
 }
 
 func newConcurrentDB() *DB {
@@ -36,7 +39,8 @@ func newConcurrentDB() *DB {
 		ttlMap:     dict.NewConcurrentHashMap(ttlMapSize),
 		versionMap: dict.NewConcurrentHashMap(dataMapSize),
 		locker:     lock.NewStringLock(lockerSize),
-		addAOF:     func(redis.Line) {},
+		addAOF:     func(redis.Line) error { return nil },
+		notify:     func(int, string, string) {},
 	}
 }
 
@@ -47,7 +51,8 @@ func newSimpleDB() *DB {
 		ttlMap:     dict.NewSimpleHashMap(),
 		versionMap: dict.NewSimpleHashMap(),
 		locker:     lock.NewStringLock(1),
-		addAOF:     func(redis.Line) {},
+		addAOF:     func(redis.Line) error { return nil },
+		notify:     func(int, string, string) {},
 	}
 }
 
@@ -7,12 +7,24 @@ import (
 	"time"
 )
 
+// Put 写入 key。value 写入之后只能被整体替换，不能原地修改：AOF 重写和 RDB 保存使用的写时复制快照
+// 只复制 map，与当前数据库共享 EntryValue，修改数据的命令需要创建新的 EntryValue 再调用 Put。
+// PutIfAbsent 和 PutIfExists 同样如此
 func (db *DB) Put(key string, value *dbinterface.EntryValue) {
+	if db.notifyFlags&notifyNew != 0 {
+		if _, exists := db.m.Get(key); !exists {
+			defer db.notifyEvent(notifyNew, "new", key)
+		}
+	}
 	db.m.Put(key, value)
 }
 
 func (db *DB) PutIfAbsent(key string, value *dbinterface.EntryValue) (ok bool) {
-	return db.m.PutIfAbsent(key, value)
+	ok = db.m.PutIfAbsent(key, value)
+	if ok {
+		db.notifyEvent(notifyNew, "new", key)
+	}
+	return ok
 }
 
 func (db *DB) PutIfExists(key string, value *dbinterface.EntryValue) (ok bool) {
@@ -70,6 +82,7 @@ func (db *DB) CheckExpired(key string) bool {
 	expired := time.Now().After(expireTime.(time.Time))
 	if expired {
 		db.Delete(key)
+		db.notifyEvent(notifyExpired, "expired", key)
 	}
 	return expired
 }
@@ -0,0 +1,44 @@
+package database
+
+import (
+	"godis-learn/interface/dbinterface"
+)
+
+type dbSnapshot []*DB
+
+func (s dbSnapshot) ForEach(dbIndex int, p dbinterface.EntryProcessor) {
+	s[dbIndex].ForEach(p)
+}
+
+func (s dbSnapshot) GetDBSize(dbIndex int) (dataSize, ttlMapSize int) {
+	return s[dbIndex].m.Size(), s[dbIndex].ttlMap.Size()
+}
+
+// Snapshot 锁住所有数据库的全部 key 并阻止 FLUSHDB/FLUSHALL，在同一时刻调用 mark 并生成写时复制快照，
+// 暂停写入的时间只与 shard 数量有关，与数据量无关
+func (db *MultiDB) Snapshot(mark func()) dbinterface.Snapshot {
+	db.snapshotMutex.Lock()
+	defer db.snapshotMutex.Unlock()
+	singles := make([]*DB, len(db.dbs))
+	for i := range db.dbs {
+		singles[i] = db.dbPanicAt(i)
+		singles[i].locker.LockAll()
+	}
+	defer func() {
+		for i := len(singles) - 1; i >= 0; i-- {
+			singles[i].locker.UnlockAll()
+		}
+	}()
+	if mark != nil {
+		mark()
+	}
+	snapshot := make(dbSnapshot, len(singles))
+	for i, single := range singles {
+		snapshot[i] = &DB{
+			index:  i,
+			m:      single.m.Snapshot(),
+			ttlMap: single.ttlMap.Snapshot(),
+		}
+	}
+	return snapshot
+}
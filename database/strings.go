@@ -0,0 +1,166 @@
+package database
+
+import (
+	"bytes"
+	"godis-learn/interface/dbinterface"
+	"godis-learn/interface/redis"
+	"godis-learn/lib/utils"
+	"godis-learn/persistent"
+	"godis-learn/redis/protocol"
+	"strconv"
+	"time"
+)
+
+const (
+	upsertPolicy = iota
+	insertPolicy
+	updatePolicy
+)
+
+func (db *DB) getAsString(key string) ([]byte, redis.ErrorReply) {
+	val, ok := db.Get(key)
+	if !ok {
+		return nil, nil
+	}
+	bs, ok := val.V.([]byte)
+	if !ok {
+		return nil, protocol.WrongTypeErrorReply()
+	}
+	return bs, nil
+}
+
+func execGet(db *DB, line redis.Line) redis.Reply {
+	bs, err := db.getAsString(string(line[0]))
+	if err != nil {
+		return err
+	}
+	if bs == nil {
+		return protocol.NullBulkStringReply()
+	}
+	return protocol.BulkStringReply(bs)
+}
+
+func execSet(db *DB, line redis.Line) redis.Reply {
+	key, value := string(line[0]), line[1]
+	policy := upsertPolicy
+	var ttl time.Duration
+	for i := 2; i < len(line); i++ {
+		arg := string(bytes.ToLower(line[i]))
+		switch arg {
+		case "nx":
+			if policy == updatePolicy {
+				return protocol.SyntaxErrorReply()
+			}
+			policy = insertPolicy
+		case "xx":
+			if policy == insertPolicy {
+				return protocol.SyntaxErrorReply()
+			}
+			policy = updatePolicy
+		case "ex", "px":
+			if ttl != 0 || i+1 == len(line) {
+				return protocol.SyntaxErrorReply()
+			}
+			n, err := strconv.ParseInt(string(line[i+1]), 10, 64)
+			if err != nil || n <= 0 {
+				return protocol.NewErrorReply([]byte("ERR invalid expire time in 'set' command"))
+			}
+			unit := time.Second
+			if arg == "px" {
+				unit = time.Millisecond
+			}
+			ttl = time.Duration(n) * unit
+			i++
+		default:
+			return protocol.SyntaxErrorReply()
+		}
+	}
+	entry := &dbinterface.EntryValue{V: value}
+	var ok bool
+	switch policy {
+	case upsertPolicy:
+		db.Put(key, entry)
+		ok = true
+	case insertPolicy:
+		if _, exists := db.Get(key); !exists {
+			ok = db.PutIfAbsent(key, entry)
+		}
+	case updatePolicy:
+		if _, exists := db.Get(key); exists {
+			ok = db.PutIfExists(key, entry)
+		}
+	}
+	if !ok {
+		return protocol.NullBulkStringReply()
+	}
+	db.notifyEvent(notifyString, "set", key)
+	var err error
+	if ttl > 0 {
+		expireTime := time.Now().Add(ttl)
+		db.Expire(key, expireTime)
+		if err = db.addAOF(utils.StringsToLine("SET", key, string(value))); err == nil {
+			err = db.addAOF(persistent.ExpireToLine(key, expireTime))
+		}
+		db.notifyEvent(notifyGeneric, "expire", key)
+	} else {
+		db.Persist(key)
+		err = db.addAOF(utils.StringsToLine("SET", key, string(value)))
+	}
+	if err != nil {
+		return aofErrorReply(err)
+	}
+	return protocol.OkReply()
+}
+
+func execSetNX(db *DB, line redis.Line) redis.Reply {
+	key := string(line[0])
+	if _, exists := db.Get(key); exists {
+		return protocol.IntReply(0)
+	}
+	if !db.PutIfAbsent(key, &dbinterface.EntryValue{V: line[1]}) {
+		return protocol.IntReply(0)
+	}
+	err := db.addAOF(utils.StringsWithNameToLine("setnx", line))
+	db.notifyEvent(notifyString, "set", key)
+	if err != nil {
+		return aofErrorReply(err)
+	}
+	return protocol.IntReply(1)
+}
+
+func execMGet(db *DB, line redis.Line) redis.Reply {
+	res := make([]redis.Reply, len(line))
+	for i, arg := range line {
+		bs, err := db.getAsString(string(arg))
+		if err != nil || bs == nil {
+			res[i] = protocol.NullBulkStringReply()
+		} else {
+			res[i] = protocol.BulkStringReply(bs)
+		}
+	}
+	return protocol.ContainingReply(res)
+}
+
+func execMSet(db *DB, line redis.Line) redis.Reply {
+	if len(line)&1 == 1 {
+		return protocol.ArgumentCountErrorReply([]byte("mset"))
+	}
+	for i := 0; i < len(line); i += 2 {
+		key := string(line[i])
+		db.Put(key, &dbinterface.EntryValue{V: line[i+1]})
+		db.Persist(key)
+		db.notifyEvent(notifyString, "set", key)
+	}
+	if err := db.addAOF(utils.StringsWithNameToLine("mset", line)); err != nil {
+		return aofErrorReply(err)
+	}
+	return protocol.OkReply()
+}
+
+func init() {
+	RegisterCommand("get", execGet, readFirstKey, nil, 2, readOnlyFlag)
+	RegisterCommand("set", execSet, writeFirstKey, rollbackFirstKey, -3, writeFlag)
+	RegisterCommand("setnx", execSetNX, writeFirstKey, rollbackFirstKey, 3, writeFlag)
+	RegisterCommand("mget", execMGet, readAllKeys, nil, -2, readOnlyFlag)
+	RegisterCommand("mset", execMSet, writeEvenKeys, rollbackEvenKeys, -3, writeFlag)
+}
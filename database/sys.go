@@ -1,6 +1,7 @@
 package database
 
 import (
+	"fmt"
 	"godis-learn/config"
 	"godis-learn/interface/redis"
 	"godis-learn/redis/protocol"
@@ -39,6 +40,32 @@ func authenticated(conn redis.Connection) bool {
 	return conn.GetPassword() == config.Properties.RequirePass
 }
 
+// CheckSubscriberMode 订阅了频道或模式的连接只能执行订阅相关的命令以及 PING、QUIT 和 RESET
+func CheckSubscriberMode(conn redis.Connection, cmdName string) redis.Reply {
+	if conn == nil || conn.SubscriberCount()+conn.ShardSubscriberCount() == 0 {
+		return nil
+	}
+	switch cmdName {
+	case "subscribe", "unsubscribe", "psubscribe", "punsubscribe", "ssubscribe", "sunsubscribe",
+		"ping", "quit", "reset":
+		return nil
+	}
+	return protocol.NewErrorReply([]byte(fmt.Sprintf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / "+
+		"(P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", cmdName)))
+}
+
+// SubscriberPing 是订阅模式下的 PING，回复为 pong 和参数组成的数组
+func SubscriberPing(line redis.Line) redis.Reply {
+	switch len(line) {
+	case 0:
+		return protocol.ArrayReply([][]byte{[]byte("pong"), {}})
+	case 1:
+		return protocol.ArrayReply([][]byte{[]byte("pong"), line[0]})
+	default:
+		return protocol.NewErrorReply([]byte("ERR wrong number of arguments for 'ping' command"))
+	}
+}
+
 func init() {
 	RegisterCommand("ping", Ping, noPrepare, nil, -1, readOnlyFlag)
 }
@@ -5,3 +5,39 @@ import "godis-learn/interface/redis"
 func noPrepare(_ redis.Line) (rKeys, wKeys []string) {
 	return nil, nil
 }
+
+func readFirstKey(line redis.Line) (rKeys, wKeys []string) {
+	return []string{string(line[0])}, nil
+}
+
+func writeFirstKey(line redis.Line) (rKeys, wKeys []string) {
+	return nil, []string{string(line[0])}
+}
+
+func readAllKeys(line redis.Line) (rKeys, wKeys []string) {
+	rKeys = make([]string, len(line))
+	for i, arg := range line {
+		rKeys[i] = string(arg)
+	}
+	return rKeys, nil
+}
+
+func writeAllKeys(line redis.Line) (rKeys, wKeys []string) {
+	wKeys = make([]string, len(line))
+	for i, arg := range line {
+		wKeys[i] = string(arg)
+	}
+	return nil, wKeys
+}
+
+func writeEvenKeys(line redis.Line) (rKeys, wKeys []string) {
+	wKeys = make([]string, 0, len(line)>>1)
+	for i := 0; i < len(line); i += 2 {
+		wKeys = append(wKeys, string(line[i]))
+	}
+	return nil, wKeys
+}
+
+func writeFirstTwoKeys(line redis.Line) (rKeys, wKeys []string) {
+	return nil, []string{string(line[0]), string(line[1])}
+}
@@ -0,0 +1,45 @@
+package database
+
+import (
+	"godis-learn/interface/redis"
+	"godis-learn/lib/utils"
+	"godis-learn/persistent"
+	"time"
+)
+
+func rollbackFirstKey(db *DB, line redis.Line) []redis.Line {
+	return rollbackGivenKeys(db, string(line[0]))
+}
+
+func rollbackAllKeys(db *DB, line redis.Line) []redis.Line {
+	keys := make([]string, len(line))
+	for i, arg := range line {
+		keys[i] = string(arg)
+	}
+	return rollbackGivenKeys(db, keys...)
+}
+
+func rollbackEvenKeys(db *DB, line redis.Line) []redis.Line {
+	_, keys := writeEvenKeys(line)
+	return rollbackGivenKeys(db, keys...)
+}
+
+func rollbackFirstTwoKeys(db *DB, line redis.Line) []redis.Line {
+	return rollbackGivenKeys(db, string(line[0]), string(line[1]))
+}
+
+func rollbackGivenKeys(db *DB, keys ...string) []redis.Line {
+	var res []redis.Line
+	for _, key := range keys {
+		res = append(res, utils.StringsToLine("DEL", key))
+		val, ok := db.Get(key)
+		if !ok {
+			continue
+		}
+		res = append(res, persistent.ValueToLine(key, val))
+		if expireTime, ok := db.ttlMap.Get(key); ok {
+			res = append(res, persistent.ExpireToLine(key, expireTime.(time.Time)))
+		}
+	}
+	return res
+}
@@ -11,6 +11,9 @@ type ConcurrentHashMap struct {
 	shards  []*shard
 	size    int32
 	nShards int
+	// shared 按位记录 shard 的 data 是否同时被快照引用，修改之前需要先复制，
+	// 与在 shard 中增加字段相比，位图几乎不占用额外的内存
+	shared []uint32
 }
 
 type shard struct {
@@ -30,6 +33,7 @@ func NewConcurrentHashMap(nShards int) *ConcurrentHashMap {
 		size:    0,
 		shards:  shards,
 		nShards: nShards,
+		shared:  make([]uint32, (nShards+31)/32),
 	}
 }
 
@@ -49,6 +53,7 @@ func (m *ConcurrentHashMap) Put(key string, value any) {
 	shard := m.shardAt(index)
 	shard.mutex.Lock()
 	defer shard.mutex.Unlock()
+	m.own(index, shard)
 	if _, ok := shard.data[key]; !ok {
 		m.ascendSize()
 	}
@@ -64,6 +69,7 @@ func (m *ConcurrentHashMap) PutIfAbsent(key string, value any) (ok bool) {
 	shard := m.shardAt(index)
 	shard.mutex.Lock()
 	defer shard.mutex.Unlock()
+	m.own(index, shard)
 	if _, ok := shard.data[key]; ok {
 		return false
 	}
@@ -81,6 +87,7 @@ func (m *ConcurrentHashMap) PutIfExists(key string, value any) (ok bool) {
 	shard := m.shardAt(index)
 	shard.mutex.Lock()
 	defer shard.mutex.Unlock()
+	m.own(index, shard)
 	if _, ok := shard.data[key]; !ok {
 		return false
 	}
@@ -111,6 +118,7 @@ func (m *ConcurrentHashMap) Delete(key string) (ok bool) {
 	shard.mutex.Lock()
 	defer shard.mutex.Unlock()
 	if _, ok := shard.data[key]; ok {
+		m.own(index, shard)
 		delete(shard.data, key)
 		m.descendSize()
 		return true
@@ -187,6 +195,32 @@ func (m *ConcurrentHashMap) RandomDistinctKeys(nKeys int) []string {
 	return m2.Keys()
 }
 
+// Snapshot 只标记每个 shard 被共享，shard 在下一次被修改时才复制，因此耗时只与 shard 数量有关。
+// 快照只复制 map 本身，与原 map 共享 value，因此 value 需要整体替换而不能原地修改，数据库在 DB.Put 处约定了这一点
+func (m *ConcurrentHashMap) Snapshot() HashMap {
+	if m == nil {
+		panic("Nil ConcurrentHashMap")
+	}
+	snapshot := &ConcurrentHashMap{
+		shards:  make([]*shard, m.nShards),
+		nShards: m.nShards,
+		shared:  make([]uint32, len(m.shared)),
+	}
+	size := 0
+	for i, s := range m.shards {
+		s.mutex.Lock()
+		m.setShared(uint32(i), true)
+		snapshot.shards[i] = &shard{data: s.data}
+		size += len(s.data)
+		s.mutex.Unlock()
+	}
+	for i := range snapshot.shared {
+		snapshot.shared[i] = ^uint32(0)
+	}
+	snapshot.size = int32(size)
+	return snapshot
+}
+
 func (m *ConcurrentHashMap) Clear() {
 	*m = *NewConcurrentHashMap(m.nShards)
 }
@@ -245,6 +279,35 @@ func (m *ConcurrentHashMap) descendSize() int32 {
 	return atomic.AddInt32(&(m.size), -1)
 }
 
+// own 在修改被快照共享的 shard 之前复制一份 data，调用者需要持有 shard 的写锁
+func (m *ConcurrentHashMap) own(index uint32, s *shard) {
+	if atomic.LoadUint32(&m.shared[index/32])&(1<<(index%32)) == 0 {
+		return
+	}
+	data := make(map[string]any, len(s.data))
+	for key, value := range s.data {
+		data[key] = value
+	}
+	s.data = data
+	m.setShared(index, false)
+}
+
+// setShared 修改 shard 的共享标记，同一个字中的其它位可能同时被其它 shard 修改
+func (m *ConcurrentHashMap) setShared(index uint32, shared bool) {
+	word := &m.shared[index/32]
+	bit := uint32(1) << (index % 32)
+	for {
+		old := atomic.LoadUint32(word)
+		updated := old &^ bit
+		if shared {
+			updated = old | bit
+		}
+		if atomic.CompareAndSwapUint32(word, old, updated) {
+			return
+		}
+	}
+}
+
 // randomKey 从 shard 处随机取得一个 key
 func (s *shard) randomKey() string {
 	if s == nil {
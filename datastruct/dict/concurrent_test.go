@@ -292,3 +292,29 @@ func TestConcurrentDict_Keys(t *testing.T) {
 		t.Errorf("expect %d keys, actual: %d", size, len(d.Keys()))
 	}
 }
+
+func TestConcurrentSnapshot(t *testing.T) {
+	d := NewConcurrentHashMap(0)
+	for i := 0; i < 100; i++ {
+		d.Put("k"+strconv.Itoa(i), i)
+	}
+	snapshot := d.Snapshot()
+	d.Put("k0", -1)
+	d.Put("new", 0)
+	d.Delete("k1")
+	if snapshot.Size() != 100 {
+		t.Errorf("expected snapshot size 100, got %d", snapshot.Size())
+	}
+	if val, _ := snapshot.Get("k0"); val != 0 {
+		t.Errorf("expected k0 to be 0 in snapshot, got %v", val)
+	}
+	if _, ok := snapshot.Get("new"); ok {
+		t.Error("new key should not be visible in snapshot")
+	}
+	if _, ok := snapshot.Get("k1"); !ok {
+		t.Error("deleted key should remain in snapshot")
+	}
+	if val, _ := d.Get("k0"); val != -1 || d.Size() != 100 {
+		t.Errorf("unexpected map state, k0 = %v, size = %d", val, d.Size())
+	}
+}
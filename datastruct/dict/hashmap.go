@@ -14,4 +14,6 @@ type HashMap interface {
 	RandomKeys(nKeys int) []string
 	RandomDistinctKeys(nKeys int) []string
 	Clear()
+	// Snapshot 返回当前内容的只读副本，之后对原 map 的修改不会影响副本
+	Snapshot() HashMap
 }
@@ -123,3 +123,11 @@ func (m *SimpleHashMap) RandomDistinctKeys(nKeys int) []string {
 func (m *SimpleHashMap) Clear() {
 	*m = *NewSimpleHashMap()
 }
+
+func (m *SimpleHashMap) Snapshot() HashMap {
+	data := make(map[string]any, len(m.data))
+	for key, value := range m.data {
+		data[key] = value
+	}
+	return &SimpleHashMap{data: data}
+}
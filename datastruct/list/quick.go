@@ -199,7 +199,7 @@ func (l *QuickList) GetSlice(begin, end int) []any {
 
 func (l *QuickList) addNewPage(val any) {
 	page := make([]any, 0, pageSize)
-	page[0] = val
+	page = append(page, val)
 	l.data.PushBack(page)
 }
 
@@ -92,6 +92,20 @@ func (l *StringLock) RWUnlockKeys(rKeys, wKeys []string) {
 	l.executeRWKeys(rKeys, wKeys, true)
 }
 
+// LockAll 按顺序获取全部的排他锁，相当于暂停所有对 key 的访问
+func (l *StringLock) LockAll() {
+	for _, mu := range l.mutexes {
+		mu.Lock()
+	}
+}
+
+// UnlockAll 按相反的顺序释放全部的排他锁
+func (l *StringLock) UnlockAll() {
+	for i := len(l.mutexes) - 1; i >= 0; i-- {
+		l.mutexes[i].Unlock()
+	}
+}
+
 // fnv32 是一个哈希函数
 func fnv32(key string) uint32 {
 	hash := initialHash
@@ -0,0 +1,105 @@
+package stream
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+)
+
+// ID 是 stream 中条目的 ID，由毫秒时间戳和同一毫秒内的序号组成
+type ID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+func (id ID) Less(other ID) bool {
+	return id.Ms < other.Ms || (id.Ms == other.Ms && id.Seq < other.Seq)
+}
+
+func (id ID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+// Entry 是 stream 中的一个条目，Fields 中依次存放字段和值
+type Entry struct {
+	ID     ID
+	Fields [][]byte
+}
+
+// PendingEntry 是消费组中已经投递但还没有确认的条目
+type PendingEntry struct {
+	ID            ID
+	Consumer      string
+	DeliveryTime  int64
+	DeliveryCount uint64
+}
+
+// Consumer 是消费组中的消费者，SeenTime 为最后一次活动的毫秒时间戳
+type Consumer struct {
+	Name     string
+	SeenTime int64
+}
+
+// Group 是消费组，Pending 按 ID 升序排列
+type Group struct {
+	Name      string
+	LastID    ID
+	Pending   []*PendingEntry
+	Consumers []*Consumer
+}
+
+// Stream 按 ID 升序保存条目。LastID 是添加过的最大 ID，条目被删除之后也不会变小
+type Stream struct {
+	entries []*Entry
+	LastID  ID
+	Groups  []*Group
+}
+
+var ErrIDNotIncreasing = errors.New("the ID specified is equal or smaller than the target stream top item")
+
+func New() *Stream {
+	return &Stream{}
+}
+
+func (s *Stream) Len() int {
+	return len(s.entries)
+}
+
+// Append 在末尾添加条目，id 必须大于 LastID
+func (s *Stream) Append(id ID, fields [][]byte) error {
+	if !s.LastID.Less(id) {
+		return ErrIDNotIncreasing
+	}
+	s.entries = append(s.entries, &Entry{ID: id, Fields: fields})
+	s.LastID = id
+	return nil
+}
+
+func (s *Stream) ForEach(consumer func(entry *Entry) bool) {
+	for _, entry := range s.entries {
+		if !consumer(entry) {
+			return
+		}
+	}
+}
+
+// Get 二分查找指定 ID 的条目
+func (s *Stream) Get(id ID) (*Entry, bool) {
+	i := sort.Search(len(s.entries), func(i int) bool {
+		return !s.entries[i].ID.Less(id)
+	})
+	if i < len(s.entries) && s.entries[i].ID == id {
+		return s.entries[i], true
+	}
+	return nil, false
+}
+
+// Group 按名称查找消费组
+func (s *Stream) Group(name string) (*Group, bool) {
+	for _, group := range s.Groups {
+		if group.Name == name {
+			return group, true
+		}
+	}
+	return nil, false
+}
@@ -2,46 +2,113 @@ package hub
 
 import (
 	"fmt"
+	"godis-learn/config"
 	"godis-learn/datastruct/dict"
 	"godis-learn/datastruct/list"
 	"godis-learn/datastruct/lock"
 	"godis-learn/interface/redis"
 	"godis-learn/lib/utils"
+	"godis-learn/lib/wildcard"
 	"godis-learn/redis/protocol"
+	"sync"
+	"sync/atomic"
 )
 
 type Hub struct {
 	subsMap dict.HashMap
-	locker  *lock.StringLock
+	// numSubMap 记录每个频道的订阅者数量，PUBSUB 读取时不需要持有频道锁
+	numSubMap dict.HashMap
+	// 分片频道与普通频道的命名空间相互独立
+	shardSubsMap   dict.HashMap
+	shardNumSubMap dict.HashMap
+	locker         *lock.StringLock
+	// 发布消息时需要遍历全部模式，因此模式订阅使用一把读写锁保护
+	patternMutex sync.RWMutex
+	patternMap   map[string]*list.LinkedList
+	numPat       int32
 }
 
 func NewHub() *Hub {
 	return &Hub{
-		subsMap: dict.NewConcurrentHashMap(16),
-		locker:  lock.NewStringLock(16),
+		subsMap:        dict.NewConcurrentHashMap(16),
+		numSubMap:      dict.NewConcurrentHashMap(16),
+		shardSubsMap:   dict.NewConcurrentHashMap(16),
+		shardNumSubMap: dict.NewConcurrentHashMap(16),
+		locker:         lock.NewStringLock(16),
+		patternMap:     make(map[string]*list.LinkedList),
 	}
 }
 
+// Publish 向频道和匹配的模式发送消息，消息只是放入订阅者的输出队列，不会被慢客户端阻塞
 func (h *Hub) Publish(args [][]byte) redis.Reply {
 	if len(args) != 2 {
 		return protocol.ArgumentCountErrorReply([]byte("publish"))
 	}
 	channel := string(args[0])
+	receivers, dropped := h.deliver(h.subsMap, "message", args)
+	h.patternMutex.RLock()
+	for pattern, subs := range h.patternMap {
+		if !wildcard.Match(pattern, channel) {
+			continue
+		}
+		message := protocol.ArrayReply([][]byte{
+			[]byte("pmessage"),
+			[]byte(pattern),
+			args[0],
+			args[1],
+		}).GetBytes()
+		subs.ForEach(func(_ int, conn any) bool {
+			if conn.(redis.Connection).Write(message) != nil {
+				dropped = append(dropped, conn.(redis.Connection))
+			}
+			receivers++
+			return true
+		})
+	}
+	h.patternMutex.RUnlock()
+	h.dropAll(dropped)
+	return protocol.IntReply(int64(receivers))
+}
+
+// SPublish 向分片频道发送 smessage，分片频道不会匹配模式订阅
+func (h *Hub) SPublish(args [][]byte) redis.Reply {
+	if len(args) != 2 {
+		return protocol.ArgumentCountErrorReply([]byte("spublish"))
+	}
+	receivers, dropped := h.deliver(h.shardSubsMap, "smessage", args)
+	h.dropAll(dropped)
+	return protocol.IntReply(int64(receivers))
+}
+
+// deliver 把消息发送给 subsMap 中订阅了 args[0] 的连接，返回接收者数量以及写入失败的连接
+func (h *Hub) deliver(subsMap dict.HashMap, kind string, args [][]byte) (int, []redis.Connection) {
+	channel := string(args[0])
+	receivers := 0
+	var dropped []redis.Connection
 	h.locker.Lock(channel)
 	defer h.locker.Unlock(channel)
-	subs, ok := h.subsMap.Get(channel)
-	if !ok {
-		return protocol.IntReply(0)
-	}
-	subs.(*list.LinkedList).ForEach(func(_ int, conn any) bool {
+	if subs, ok := subsMap.Get(channel); ok {
 		message := protocol.ArrayReply([][]byte{
-			[]byte("message"),
+			[]byte(kind),
 			args[0],
 			args[1],
+		}).GetBytes()
+		subs.(*list.LinkedList).ForEach(func(_ int, conn any) bool {
+			if conn.(redis.Connection).Write(message) != nil {
+				dropped = append(dropped, conn.(redis.Connection))
+			}
+			receivers++
+			return true
 		})
-		return conn.(redis.Connection).Write(message.GetBytes()) == nil
-	})
-	return protocol.IntReply(int64(h.subsMap.Size()))
+	}
+	return receivers, dropped
+}
+
+// dropAll 移除写入失败的订阅者，这些连接已经因为超过输出缓冲区限制等原因被断开
+func (h *Hub) dropAll(conns []redis.Connection) {
+	for _, conn := range conns {
+		h.UnsubscribeAll(conn)
+	}
 }
 
 func (h *Hub) Subscribe(conn redis.Connection, args [][]byte) redis.Reply {
@@ -52,9 +119,11 @@ func (h *Hub) Subscribe(conn redis.Connection, args [][]byte) redis.Reply {
 	h.locker.LockKeys(channels)
 	defer h.locker.UnlockKeys(channels)
 	for _, channel := range channels {
-		if h.subscribe(channel, conn) {
-			_ = conn.Write(generateBytes("subscribe", channel, conn.SubscriberCount()))
+		if !contains(conn.GetChannels(), channel) && subscriptionsExceeded(conn) {
+			return maxSubscriptionsErrorReply()
 		}
+		h.subscribe(channel, conn)
+		_ = conn.Write(generateBytes("subscribe", channel, conn.SubscriberCount()))
 	}
 	return protocol.EmptyReply()
 }
@@ -72,52 +141,162 @@ func (h *Hub) Unsubscribe(conn redis.Connection, args [][]byte) redis.Reply {
 	h.locker.LockKeys(channels)
 	defer h.locker.UnlockKeys(channels)
 	if len(channels) == 0 {
-		_ = conn.Write([]byte("*3\r\n$11\r\nunsubscribe\r\n$-1\n:0\r\n"))
+		_ = conn.Write(generateNilBytes("unsubscribe", conn.SubscriberCount()))
 	} else {
+		// 即使没有订阅该频道也要回复，否则客户端会一直等待
 		for _, channel := range channels {
-			if h.unsubscribe(channel, conn) {
-				_ = conn.Write(generateBytes("unsubscribe", channel, conn.SubscriberCount()))
-			}
+			h.unsubscribe(channel, conn)
+			_ = conn.Write(generateBytes("unsubscribe", channel, conn.SubscriberCount()))
 		}
 	}
 	return protocol.EmptyReply()
 }
 
+func (h *Hub) SSubscribe(conn redis.Connection, args [][]byte) redis.Reply {
+	channels := make([]string, len(args))
+	for i, s := range args {
+		channels[i] = string(s)
+	}
+	h.locker.LockKeys(channels)
+	defer h.locker.UnlockKeys(channels)
+	for _, channel := range channels {
+		if !contains(conn.GetShardChannels(), channel) && subscriptionsExceeded(conn) {
+			return maxSubscriptionsErrorReply()
+		}
+		h.ssubscribe(channel, conn)
+		_ = conn.Write(generateBytes("ssubscribe", channel, conn.ShardSubscriberCount()))
+	}
+	return protocol.EmptyReply()
+}
+
+func (h *Hub) SUnsubscribe(conn redis.Connection, args [][]byte) redis.Reply {
+	var channels []string
+	if len(args) > 0 {
+		channels = make([]string, len(args))
+		for i, arg := range args {
+			channels[i] = string(arg)
+		}
+	} else {
+		channels = conn.GetShardChannels()
+	}
+	h.locker.LockKeys(channels)
+	defer h.locker.UnlockKeys(channels)
+	if len(channels) == 0 {
+		_ = conn.Write(generateNilBytes("sunsubscribe", conn.ShardSubscriberCount()))
+		return protocol.EmptyReply()
+	}
+	for _, channel := range channels {
+		h.sunsubscribe(channel, conn)
+		_ = conn.Write(generateBytes("sunsubscribe", channel, conn.ShardSubscriberCount()))
+	}
+	return protocol.EmptyReply()
+}
+
+func (h *Hub) PSubscribe(conn redis.Connection, args [][]byte) redis.Reply {
+	h.patternMutex.Lock()
+	defer h.patternMutex.Unlock()
+	for _, arg := range args {
+		pattern := string(arg)
+		if !contains(conn.GetPatterns(), pattern) && subscriptionsExceeded(conn) {
+			return maxSubscriptionsErrorReply()
+		}
+		h.psubscribe(pattern, conn)
+		_ = conn.Write(generateBytes("psubscribe", pattern, conn.SubscriberCount()))
+	}
+	return protocol.EmptyReply()
+}
+
+func (h *Hub) PUnsubscribe(conn redis.Connection, args [][]byte) redis.Reply {
+	var patterns []string
+	if len(args) > 0 {
+		patterns = make([]string, len(args))
+		for i, arg := range args {
+			patterns[i] = string(arg)
+		}
+	} else {
+		patterns = conn.GetPatterns()
+	}
+	h.patternMutex.Lock()
+	defer h.patternMutex.Unlock()
+	if len(patterns) == 0 {
+		_ = conn.Write(generateNilBytes("punsubscribe", conn.SubscriberCount()))
+		return protocol.EmptyReply()
+	}
+	for _, pattern := range patterns {
+		h.punsubscribe(pattern, conn)
+		_ = conn.Write(generateBytes("punsubscribe", pattern, conn.SubscriberCount()))
+	}
+	return protocol.EmptyReply()
+}
+
 func (h *Hub) UnsubscribeAll(conn redis.Connection) {
 	channels := conn.GetChannels()
 	h.locker.LockKeys(channels)
-	defer h.locker.UnlockKeys(channels)
 	for _, channel := range channels {
 		h.unsubscribe(channel, conn)
 	}
+	h.locker.UnlockKeys(channels)
+	shardChannels := conn.GetShardChannels()
+	h.locker.LockKeys(shardChannels)
+	for _, channel := range shardChannels {
+		h.sunsubscribe(channel, conn)
+	}
+	h.locker.UnlockKeys(shardChannels)
+	h.patternMutex.Lock()
+	defer h.patternMutex.Unlock()
+	for _, pattern := range conn.GetPatterns() {
+		h.punsubscribe(pattern, conn)
+	}
 }
 
 func (h *Hub) subscribe(channel string, conn redis.Connection) bool {
 	conn.Subscribe(channel)
+	return addSubscriber(h.subsMap, h.numSubMap, channel, conn)
+}
+
+func (h *Hub) unsubscribe(channel string, conn redis.Connection) bool {
+	conn.Unsubscribe(channel)
+	return removeSubscriber(h.subsMap, h.numSubMap, channel, conn)
+}
+
+func (h *Hub) ssubscribe(channel string, conn redis.Connection) bool {
+	conn.SSubscribe(channel)
+	return addSubscriber(h.shardSubsMap, h.shardNumSubMap, channel, conn)
+}
+
+func (h *Hub) sunsubscribe(channel string, conn redis.Connection) bool {
+	conn.SUnsubscribe(channel)
+	return removeSubscriber(h.shardSubsMap, h.shardNumSubMap, channel, conn)
+}
+
+func addSubscriber(subsMap, numSubMap dict.HashMap, channel string, conn redis.Connection) bool {
 	l := list.NewLinkedList(nil)
-	subs, ok := h.subsMap.Get(channel)
+	subs, ok := subsMap.Get(channel)
 	if ok {
 		l = subs.(*list.LinkedList)
 	} else {
-		h.subsMap.Put(channel, l)
+		subsMap.Put(channel, l)
 	}
 	if l.Count(func(c any) bool { return c == conn }) > 0 {
 		return false
 	}
 	l.Add(conn)
+	numSubMap.Put(channel, l.Size())
 	return true
 }
 
-func (h *Hub) unsubscribe(channel string, conn redis.Connection) bool {
-	conn.Unsubscribe(channel)
-	subs, ok := h.subsMap.Get(channel)
+func removeSubscriber(subsMap, numSubMap dict.HashMap, channel string, conn redis.Connection) bool {
+	subs, ok := subsMap.Get(channel)
 	if !ok {
 		return false
 	}
 	l := subs.(*list.LinkedList)
 	l.RemoveAll(func(c any) bool { return utils.PotentialBytesEqual(c, conn) })
 	if l.Size() == 0 {
-		h.subsMap.Delete(channel)
+		subsMap.Delete(channel)
+		numSubMap.Delete(channel)
+	} else {
+		numSubMap.Put(channel, l.Size())
 	}
 	return true
 }
@@ -126,3 +305,54 @@ func generateBytes(name, channel string, code int) []byte {
 	return []byte(fmt.Sprintf("*3\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n:%d\r\n",
 		len(name), name, len(channel), channel, code))
 }
+
+// generateNilBytes 生成没有任何订阅时退订的回复，频道名为 nil
+func generateNilBytes(name string, code int) []byte {
+	return []byte(fmt.Sprintf("*3\r\n$%d\r\n%s\r\n$-1\r\n:%d\r\n", len(name), name, code))
+}
+
+// subscriptionsExceeded 判断连接的订阅数是否已经达到 client-max-subscriptions
+func subscriptionsExceeded(conn redis.Connection) bool {
+	limit := config.Properties.ClientMaxSubscriptions
+	return limit > 0 && conn.SubscriberCount()+conn.ShardSubscriberCount() >= limit
+}
+
+func maxSubscriptionsErrorReply() redis.Reply {
+	return protocol.NewErrorReply([]byte("ERR max number of subscriptions per client reached"))
+}
+
+func contains(list []string, target string) bool {
+	for _, s := range list {
+		if s == target {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Hub) psubscribe(pattern string, conn redis.Connection) {
+	conn.PSubscribe(pattern)
+	l, ok := h.patternMap[pattern]
+	if !ok {
+		l = list.NewLinkedList(nil)
+		h.patternMap[pattern] = l
+		atomic.AddInt32(&h.numPat, 1)
+	}
+	if l.Count(func(c any) bool { return c == conn }) == 0 {
+		l.Add(conn)
+	}
+}
+
+func (h *Hub) punsubscribe(pattern string, conn redis.Connection) bool {
+	conn.PUnsubscribe(pattern)
+	l, ok := h.patternMap[pattern]
+	if !ok {
+		return false
+	}
+	l.RemoveAll(func(c any) bool { return c == conn })
+	if l.Size() == 0 {
+		delete(h.patternMap, pattern)
+		atomic.AddInt32(&h.numPat, -1)
+	}
+	return true
+}
@@ -0,0 +1,146 @@
+package hub
+
+import (
+	"bytes"
+	"godis-learn/config"
+	"godis-learn/lib/utils"
+	"godis-learn/redis/connection"
+	"godis-learn/redis/protocol"
+	"net"
+	"strings"
+	"testing"
+)
+
+type recordConn struct {
+	*connection.ClientConn
+	buf bytes.Buffer
+}
+
+func newRecordConn() *recordConn {
+	return &recordConn{ClientConn: connection.NewClientConn(nil)}
+}
+
+func (c *recordConn) Write(b []byte) error {
+	c.buf.Write(b)
+	return nil
+}
+
+func TestPatternSubscribe(t *testing.T) {
+	h := NewHub()
+	orders := newRecordConn()
+	both := newRecordConn()
+	h.PSubscribe(orders, utils.StringsToLine("orders.*"))
+	h.Subscribe(both, utils.StringsToLine("orders.created"))
+	h.PSubscribe(both, utils.StringsToLine("orders.*", "*.created"))
+	if expected := generateBytes("psubscribe", "*.created", 3); !bytes.HasSuffix(both.buf.Bytes(), expected) {
+		t.Fatalf("unexpected confirmation %q", both.buf.Bytes())
+	}
+	orders.buf.Reset()
+	both.buf.Reset()
+
+	reply := h.Publish(utils.StringsToLine("orders.created", "42"))
+	if code, _ := protocol.FetchCode(reply); code != 4 {
+		t.Errorf("expected 4 receivers, got %d", code)
+	}
+	pmessage := protocol.ArrayReply(utils.StringsToLine("pmessage", "orders.*", "orders.created", "42")).GetBytes()
+	if !bytes.Equal(orders.buf.Bytes(), pmessage) {
+		t.Errorf("unexpected pmessage %q", orders.buf.Bytes())
+	}
+	if n := bytes.Count(both.buf.Bytes(), []byte("42")); n != 3 {
+		t.Errorf("expected 3 deliveries, got %q", both.buf.Bytes())
+	}
+
+	h.PUnsubscribe(orders, nil)
+	h.UnsubscribeAll(both)
+	if len(h.patternMap) != 0 || h.subsMap.Size() != 0 {
+		t.Errorf("expected all subscriptions to be removed, got %d patterns and %d channels", len(h.patternMap), h.subsMap.Size())
+	}
+	if code, _ := protocol.FetchCode(h.Publish(utils.StringsToLine("orders.created", "43"))); code != 0 {
+		t.Errorf("expected 0 receivers, got %d", code)
+	}
+}
+
+func TestPubSubIntrospection(t *testing.T) {
+	h := NewHub()
+	a := newRecordConn()
+	b := newRecordConn()
+	h.Subscribe(a, utils.StringsToLine("orders.created", "news"))
+	h.Subscribe(b, utils.StringsToLine("orders.created"))
+	h.PSubscribe(a, utils.StringsToLine("orders.*"))
+	h.PSubscribe(b, utils.StringsToLine("orders.*", "news.*"))
+
+	channels, _ := protocol.FetchArrayArgs(h.PubSub(utils.StringsToLine("CHANNELS", "orders.*")))
+	if len(channels) != 1 || string(channels[0]) != "orders.created" {
+		t.Errorf("unexpected channels %q", channels)
+	}
+	expected := "*4\r\n$14\r\norders.created\r\n:2\r\n$7\r\nmissing\r\n:0\r\n"
+	if reply := h.PubSub(utils.StringsToLine("NUMSUB", "orders.created", "missing")); string(reply.GetBytes()) != expected {
+		t.Errorf("unexpected numsub %q", reply.GetBytes())
+	}
+	if code, _ := protocol.FetchCode(h.PubSub(utils.StringsToLine("NUMPAT"))); code != 2 {
+		t.Errorf("expected 2 patterns, got %d", code)
+	}
+	h.UnsubscribeAll(b)
+	if reply := h.PubSub(utils.StringsToLine("NUMSUB", "orders.created")); string(reply.GetBytes()) != "*2\r\n$14\r\norders.created\r\n:1\r\n" {
+		t.Errorf("unexpected numsub %q", reply.GetBytes())
+	}
+	if code, _ := protocol.FetchCode(h.PubSub(utils.StringsToLine("NUMPAT"))); code != 1 {
+		t.Errorf("expected 1 pattern, got %d", code)
+	}
+}
+
+func TestSubscriptionConfirmations(t *testing.T) {
+	h := NewHub()
+	conn := newRecordConn()
+	h.Unsubscribe(conn, nil)
+	if expected := "*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:0\r\n"; conn.buf.String() != expected {
+		t.Errorf("unexpected reply %q", conn.buf.String())
+	}
+	conn.buf.Reset()
+	h.Subscribe(conn, utils.StringsToLine("news", "news"))
+	h.PSubscribe(conn, utils.StringsToLine("orders.*"))
+	h.Unsubscribe(conn, nil)
+	expected := string(generateBytes("subscribe", "news", 1)) + string(generateBytes("subscribe", "news", 1)) +
+		string(generateBytes("psubscribe", "orders.*", 2)) + string(generateBytes("unsubscribe", "news", 1))
+	if conn.buf.String() != expected {
+		t.Errorf("unexpected replies %q", conn.buf.String())
+	}
+
+	config.Properties.ClientMaxSubscriptions = 2
+	defer func() {
+		config.Properties.ClientMaxSubscriptions = 0
+	}()
+	h.Subscribe(conn, utils.StringsToLine("a"))
+	if reply := h.Subscribe(conn, utils.StringsToLine("a", "b")); !protocol.CheckErrorReply(reply) {
+		t.Errorf("expected subscription limit error, got %q", reply.GetBytes())
+	}
+	if count := conn.SubscriberCount(); count != 2 {
+		t.Errorf("expected 2 subscriptions, got %d", count)
+	}
+}
+
+func TestSlowSubscriberDropped(t *testing.T) {
+	config.Properties.ClientOutputBufferLimit = "pubsub 1kb 0 0"
+	defer func() {
+		config.Properties.ClientOutputBufferLimit = ""
+	}()
+	h := NewHub()
+	server, client := net.Pipe()
+	defer func() {
+		_ = client.Close()
+	}()
+	slow := connection.NewClientConn(server)
+	fast := newRecordConn()
+	h.Subscribe(slow, utils.StringsToLine("news"))
+	h.Subscribe(fast, utils.StringsToLine("news"))
+	payload := strings.Repeat("x", 256)
+	for i := 0; i < 8; i++ {
+		h.Publish(utils.StringsToLine("news", payload))
+	}
+	if n := bytes.Count(fast.buf.Bytes(), []byte(payload)); n != 8 {
+		t.Errorf("expected 8 messages, got %d", n)
+	}
+	if reply := h.PubSub(utils.StringsToLine("NUMSUB", "news")); string(reply.GetBytes()) != "*2\r\n$4\r\nnews\r\n:1\r\n" {
+		t.Errorf("expected slow subscriber to be dropped, got %q", reply.GetBytes())
+	}
+}
@@ -0,0 +1,68 @@
+package hub
+
+import (
+	"godis-learn/datastruct/dict"
+	"godis-learn/interface/redis"
+	"godis-learn/lib/wildcard"
+	"godis-learn/redis/protocol"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// PubSub 实现 PUBSUB CHANNELS/NUMSUB/NUMPAT/SHARDCHANNELS/SHARDNUMSUB，
+// 订阅者数量单独记录，不需要持有频道锁
+func (h *Hub) PubSub(args [][]byte) redis.Reply {
+	if len(args) == 0 {
+		return protocol.ArgumentCountErrorReply([]byte("pubsub"))
+	}
+	subCommand := strings.ToLower(string(args[0]))
+	args = args[1:]
+	switch subCommand {
+	case "channels":
+		return activeChannels(h.numSubMap, args)
+	case "shardchannels":
+		return activeChannels(h.shardNumSubMap, args)
+	case "numsub":
+		return numSub(h.numSubMap, args)
+	case "shardnumsub":
+		return numSub(h.shardNumSubMap, args)
+	case "numpat":
+		if len(args) != 0 {
+			return protocol.ArgumentCountErrorReply([]byte("pubsub|numpat"))
+		}
+		return protocol.IntReply(int64(atomic.LoadInt32(&h.numPat)))
+	}
+	return protocol.NewErrorReply([]byte("ERR unknown subcommand '" + subCommand + "'. Try PUBSUB HELP."))
+}
+
+func activeChannels(numSubMap dict.HashMap, args [][]byte) redis.Reply {
+	if len(args) > 1 {
+		return protocol.ArgumentCountErrorReply([]byte("pubsub|channels"))
+	}
+	channels := make([]string, 0)
+	numSubMap.ForEach(func(channel string, _ any) bool {
+		if len(args) == 0 || wildcard.Match(string(args[0]), channel) {
+			channels = append(channels, channel)
+		}
+		return true
+	})
+	sort.Strings(channels)
+	res := make([][]byte, len(channels))
+	for i, channel := range channels {
+		res[i] = []byte(channel)
+	}
+	return protocol.ArrayReply(res)
+}
+
+func numSub(numSubMap dict.HashMap, args [][]byte) redis.Reply {
+	res := make([]redis.Reply, 0, 2*len(args))
+	for _, arg := range args {
+		count := 0
+		if val, ok := numSubMap.Get(string(arg)); ok {
+			count = val.(int)
+		}
+		res = append(res, protocol.BulkStringReply(arg), protocol.IntReply(int64(count)))
+	}
+	return protocol.ContainingReply(res)
+}
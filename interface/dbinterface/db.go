@@ -2,6 +2,7 @@ package dbinterface
 
 import (
 	"godis-learn/interface/redis"
+	"io"
 	"time"
 )
 
@@ -11,6 +12,12 @@ type EntryValue struct {
 
 type EntryProcessor func(string, *EntryValue, *time.Time) bool
 
+// Snapshot 是某一时刻全部数据库的只读视图
+type Snapshot interface {
+	ForEach(dbIndex int, p EntryProcessor)
+	GetDBSize(dbIndex int) (dataSize, ttlMapSize int)
+}
+
 type DB interface {
 	Execute(conn redis.Connection, line redis.Line) redis.Reply
 	AfterClientClose(conn redis.Connection)
@@ -26,4 +33,12 @@ type EmbedDB interface {
 	RWLockKeys(dbIndex int, rKeys, wKeys []string)
 	RWUnlockKeys(dbIndex int, rKeys, wKeys []string)
 	GetDBSize(dbIndex int) (dataSize, ttlMapSize int)
+	// SlaveOf 成为 host:port 的副本，全量同步在后台进行
+	SlaveOf(host string, port int)
+	// ReplicationOffset 返回复制偏移量，副本还没有完成全量同步时 ok 为 false
+	ReplicationOffset() (offset int64, ok bool)
+	// Snapshot 暂停全部写入，调用 mark 后生成快照，mark 可以为 nil
+	Snapshot(mark func()) Snapshot
+	// LoadRDB 把 RDB 中的对象直接写入数据库，比逐条执行命令快得多。reader 为 *bufio.Reader 时不会读取 RDB 之后的内容
+	LoadRDB(reader io.Reader) error
 }
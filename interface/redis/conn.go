@@ -12,8 +12,17 @@ type Connection interface {
 	GetPassword() string
 	Subscribe(string)
 	Unsubscribe(string)
+	PSubscribe(string)
+	PUnsubscribe(string)
+	SSubscribe(string)
+	SUnsubscribe(string)
+	// SubscriberCount 返回订阅的频道和模式的总数
 	SubscriberCount() int
+	// ShardSubscriberCount 返回订阅的分片频道数
+	ShardSubscriberCount() int
 	GetChannels() []string
+	GetPatterns() []string
+	GetShardChannels() []string
 	CheckMultiMode() bool
 	SetMultiMode(bool)
 	GetQueuedCmdLines() []Line
@@ -26,6 +35,8 @@ type Connection interface {
 	SelectDB(int)
 	SetRole(int32)
 	GetRole() int32
+	SetAsking(bool)
+	CheckAsking() bool
 }
 
 func (l Line) CommandName() []byte {
@@ -60,11 +60,16 @@ func (p *ConsistentPicker) PickNode(key string) string {
 	return p.m[p.keys[index]]
 }
 
+// getPartitionKey 返回 key 中的哈希标签，与 Redis Cluster 相同：取第一个 { 与其后第一个 } 之间的内容，
+// 内容为空或者没有匹配的 } 时使用整个 key。出现在 { 之前的 } 不再使整个 key 被忽略标签
 func getPartitionKey(key string) string {
 	begin := strings.Index(key, "{")
-	end := strings.Index(key, "}")
-	if begin < 0 || end <= begin+1 {
+	if begin < 0 {
 		return key
 	}
-	return key[begin+1 : end]
+	end := strings.Index(key[begin+1:], "}")
+	if end <= 0 {
+		return key
+	}
+	return key[begin+1 : begin+1+end]
 }
@@ -0,0 +1,20 @@
+package consistenthash
+
+import "testing"
+
+func TestPartitionKey(t *testing.T) {
+	cases := map[string]string{
+		"{user1000}.following": "user1000",
+		"foo{}{bar}":           "foo{}{bar}",
+		"foo{{bar}}zap":        "{bar",
+		"foo{bar}{zap}":        "bar",
+		"a}b{c}":               "c",
+		"foo{bar":              "foo{bar",
+		"foo":                  "foo",
+	}
+	for key, expected := range cases {
+		if partitionKey := getPartitionKey(key); partitionKey != expected {
+			t.Errorf("partition key of %s: expected %s, got %s", key, expected, partitionKey)
+		}
+	}
+}
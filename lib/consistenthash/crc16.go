@@ -0,0 +1,27 @@
+package consistenthash
+
+// crc16Table 是 CRC16/XMODEM 的查找表，与 Redis Cluster 计算 hash slot 时使用的算法一致
+var crc16Table = func() [256]uint16 {
+	var table [256]uint16
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// CRC16 计算 data 的 CRC16/XMODEM 校验和
+func CRC16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^b]
+	}
+	return crc
+}
@@ -0,0 +1,162 @@
+package consistenthash
+
+import (
+	"sort"
+	"sync"
+)
+
+const SlotCount = 16384
+
+// SlotRange 表示一段连续的、属于同一个节点的 slot，两端均包含在内
+type SlotRange struct {
+	Start int
+	End   int
+	Node  string
+}
+
+// SlotPicker 按照 Redis Cluster 的规则，以 CRC16(key) mod 16384 将 key 映射到 slot，再由 slot 表找到节点
+type SlotPicker struct {
+	mutex sync.RWMutex
+	nodes []string
+	slots []string
+}
+
+func NewSlotPicker() *SlotPicker {
+	return &SlotPicker{
+		slots: make([]string, SlotCount),
+	}
+}
+
+// KeySlot 计算 key 所在的 slot，若 key 中含有 {tag} 则只对 tag 计算
+func KeySlot(key string) int {
+	return int(CRC16([]byte(getPartitionKey(key))) & (SlotCount - 1))
+}
+
+// AddNodes 加入新节点，并将全部 slot 按节点地址排序后平均分配，保证各节点计算出相同的 slot 表
+func (p *SlotPicker) AddNodes(keys ...string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	exists := make(map[string]struct{}, len(p.nodes))
+	for _, node := range p.nodes {
+		exists[node] = struct{}{}
+	}
+	for _, key := range keys {
+		if _, ok := exists[key]; key != "" && !ok {
+			exists[key] = struct{}{}
+			p.nodes = append(p.nodes, key)
+		}
+	}
+	sort.Strings(p.nodes)
+	n := len(p.nodes)
+	if n == 0 {
+		return
+	}
+	for i, node := range p.nodes {
+		for slot := i * SlotCount / n; slot < (i+1)*SlotCount/n; slot++ {
+			p.slots[slot] = node
+		}
+	}
+}
+
+// SetSlotOwner 将 slot 指派给 node，node 不存在时会被加入节点列表，node 为空表示 slot 不再被任何节点持有
+func (p *SlotPicker) SetSlotOwner(slot int, node string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	found := node == ""
+	for _, n := range p.nodes {
+		if n == node {
+			found = true
+			break
+		}
+	}
+	if !found {
+		p.nodes = append(p.nodes, node)
+		sort.Strings(p.nodes)
+	}
+	p.slots[slot] = node
+}
+
+// JoinNode 加入一个不持有任何 slot 的节点，slot 需要通过迁移分配给它
+func (p *SlotPicker) JoinNode(node string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, n := range p.nodes {
+		if n == node {
+			return false
+		}
+	}
+	p.nodes = append(p.nodes, node)
+	sort.Strings(p.nodes)
+	return true
+}
+
+// RemoveNode 移除一个节点，仍持有 slot 的节点不能被移除
+func (p *SlotPicker) RemoveNode(node string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, owner := range p.slots {
+		if owner == node {
+			return false
+		}
+	}
+	for i, n := range p.nodes {
+		if n == node {
+			p.nodes = append(p.nodes[:i], p.nodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// SlotCounts 统计每个节点持有的 slot 数量，不持有 slot 的节点数量为 0
+func (p *SlotPicker) SlotCounts() map[string]int {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	res := make(map[string]int, len(p.nodes))
+	for _, node := range p.nodes {
+		res[node] = 0
+	}
+	for _, owner := range p.slots {
+		if owner != "" {
+			res[owner]++
+		}
+	}
+	return res
+}
+
+func (p *SlotPicker) PickNode(key string) string {
+	return p.NodeOfSlot(KeySlot(key))
+}
+
+func (p *SlotPicker) NodeOfSlot(slot int) string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.slots[slot]
+}
+
+// SlotRanges 返回按 slot 升序排列的连续区间，未分配的 slot 不包含在内
+func (p *SlotPicker) SlotRanges() []SlotRange {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	var res []SlotRange
+	for slot := 0; slot < SlotCount; slot++ {
+		node := p.slots[slot]
+		if node == "" {
+			continue
+		}
+		if n := len(res); n > 0 && res[n-1].Node == node && res[n-1].End == slot-1 {
+			res[n-1].End = slot
+		} else {
+			res = append(res, SlotRange{Start: slot, End: slot, Node: node})
+		}
+	}
+	return res
+}
+
+func (p *SlotPicker) Nodes() []string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	res := make([]string, len(p.nodes))
+	copy(res, p.nodes)
+	return res
+}
@@ -0,0 +1,42 @@
+package consistenthash
+
+import "testing"
+
+func TestCRC16(t *testing.T) {
+	if sum := CRC16([]byte("123456789")); sum != 0x31C3 {
+		t.Errorf("expected 0x31C3, got %#x", sum)
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	cases := map[string]int{
+		"foo":                  12182,
+		"bar":                  5061,
+		"{user1000}.following": 3443,
+		"{user1000}.followers": 3443,
+		"foo{}{bar}":           8363,
+		"foo{{bar}}zap":        4015,
+		"foo{bar}{zap}":        5061,
+	}
+	for key, expected := range cases {
+		if slot := KeySlot(key); slot != expected {
+			t.Errorf("slot of %s: expected %d, got %d", key, expected, slot)
+		}
+	}
+}
+
+func TestSlotRanges(t *testing.T) {
+	p := NewSlotPicker()
+	p.AddNodes("c:3", "a:1")
+	p.AddNodes("b:2", "a:1")
+	ranges := p.SlotRanges()
+	if len(ranges) != 3 {
+		t.Fatalf("expected 3 ranges, got %d", len(ranges))
+	}
+	if ranges[0].Node != "a:1" || ranges[0].Start != 0 || ranges[2].End != SlotCount-1 {
+		t.Errorf("unexpected ranges: %v", ranges)
+	}
+	if node := p.PickNode("foo"); node != "c:3" {
+		t.Errorf("expected c:3, got %s", node)
+	}
+}
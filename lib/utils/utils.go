@@ -1,6 +1,11 @@
 package utils
 
-import "math/rand"
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
 
 func Xor(a, b bool) bool {
 	return a && !b || !a && b
@@ -61,3 +66,28 @@ func StringsWithNameToLine(name string, strs [][]byte) [][]byte {
 	}
 	return res
 }
+
+// ParseMemory 解析带单位的内存大小，k、m、g 以 1000 为进制，kb、mb、gb 以 1024 为进制
+func ParseMemory(s string) (int64, error) {
+	lower := strings.ToLower(s)
+	units := []struct {
+		suffix string
+		unit   int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+	}
+	unit := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower = strings.TrimSuffix(lower, u.suffix)
+			unit = u.unit
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory size '%s'", s)
+	}
+	return n * unit, nil
+}
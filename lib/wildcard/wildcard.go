@@ -0,0 +1,83 @@
+package wildcard
+
+// Match 判断 str 是否匹配 Redis 风格的 glob 模式，支持 *、?、[abc]、[^abc]、[a-z] 以及 \ 转义
+func Match(pattern, str string) bool {
+	p, s := 0, 0
+	// 最近一个 * 的位置以及它匹配到的位置，用于回溯
+	star, mark := -1, 0
+	for s < len(str) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				star, mark = p, s
+				p++
+				continue
+			case '?':
+				p++
+				s++
+				continue
+			case '[':
+				if next, ok := matchClass(pattern, p, str[s]); ok {
+					p = next
+					s++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == str[s] {
+					p += 2
+					s++
+					continue
+				}
+			default:
+				if pattern[p] == str[s] {
+					p++
+					s++
+					continue
+				}
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// 让上一个 * 多匹配一个字符后重试
+		mark++
+		p, s = star+1, mark
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass 匹配从 pattern[start] 开始的 [...]，返回 ] 之后的位置
+func matchClass(pattern string, start int, c byte) (int, bool) {
+	i := start + 1
+	negate := false
+	if i < len(pattern) && pattern[i] == '^' {
+		negate = true
+		i++
+	}
+	matched := false
+	for i < len(pattern) && pattern[i] != ']' {
+		switch {
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			matched = matched || pattern[i+1] == c
+			i += 2
+		case i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']':
+			lo, hi := pattern[i], pattern[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || lo <= c && c <= hi
+			i += 3
+		default:
+			matched = matched || pattern[i] == c
+			i++
+		}
+	}
+	if i >= len(pattern) {
+		// 没有闭合的 [ 按照普通字符处理
+		return start + 1, c == '['
+	}
+	return i + 1, matched != negate
+}
@@ -0,0 +1,33 @@
+package wildcard
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern, str string
+		expected     bool
+	}{
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders.", true},
+		{"orders.*", "order.created", false},
+		{"*", "", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"h[llo", "h[llo", true},
+	}
+	for _, c := range cases {
+		if actual := Match(c.pattern, c.str); actual != c.expected {
+			t.Errorf("Match(%q, %q) = %v, expected %v", c.pattern, c.str, actual, c.expected)
+		}
+	}
+}
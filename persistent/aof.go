@@ -1,18 +1,20 @@
 package persistent
 
 import (
+	"fmt"
 	"godis-learn/config"
 	"godis-learn/interface/dbinterface"
 	"godis-learn/interface/redis"
 	"godis-learn/lib/logger"
 	"godis-learn/lib/utils"
 	"godis-learn/redis/connection"
-	"godis-learn/redis/parse"
 	"godis-learn/redis/protocol"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -22,81 +24,129 @@ const (
 type payload struct {
 	cmdLine redis.Line
 	dbIndex int
+	// synced 在 always 策略下用于等待命令被 fsync，关闭前把写入或 fsync 的错误记录在 err 中
+	synced chan struct{}
+	err    error
+	// rewriteMark 不为 nil 时标记重写快照的时刻，handleAOF 切换到新的增量文件后把结果发送给它
+	rewriteMark chan error
 }
 
 type Handler struct {
 	db            dbinterface.EmbedDB
-	tempProducer  func() dbinterface.EmbedDB
 	aofChan       chan *payload
 	aofFile       *os.File
-	aofFilename   string
 	aofFinishChan chan struct{}
 	aofMutex      sync.RWMutex
 	currentIndex  int
+	fsyncPolicy   string
+	fsyncStop     chan struct{}
+	lastFsync     int64
+	delayedFsync  int64
+	fsyncing      int32
+	// dirty 表示上一次 fsync 之后有新的写入
+	dirty int32
+	// writeErr 保存 always 策略下第一次写入或 fsync 失败的错误，类型为 writeError
+	writeErr atomic.Value
+	// rewriting 保证 AOF 重写与 RDB 保存不会同时进行
+	rewriting int32
+	aofSize   int64
+	baseSize  int64
+	// dir 保存基础文件、增量文件和清单，aofFile 是清单中最后一个增量文件
+	dir      string
+	baseName string
+	// manifest 由 aofMutex 保护，只在切换增量文件和重写结束时替换
+	manifest *manifest
 }
 
-func NewAOFHandler(db dbinterface.EmbedDB, producer func() dbinterface.EmbedDB) (*Handler, error) {
+func NewAOFHandler(db dbinterface.EmbedDB) (*Handler, error) {
 	filename := config.Properties.AppendFilename
-	aofFile, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
-	if err != nil {
-		return nil, err
+	if filename == "" {
+		filename = defaultAppendFilename
 	}
 	res := &Handler{
 		db:            db,
-		tempProducer:  producer,
 		aofChan:       make(chan *payload, aofQueueSize),
-		aofFile:       aofFile,
-		aofFilename:   filename,
+		dir:           aofDir(filename),
+		baseName:      filepath.Base(filename),
 		aofFinishChan: make(chan struct{}),
+		fsyncPolicy:   fsyncPolicy(),
+		fsyncStop:     make(chan struct{}),
+		lastFsync:     -1,
+	}
+	if err := res.openManifest(filename); err != nil {
+		return nil, err
 	}
-	res.LoadAOF(0)
+	if err := res.LoadAOF(); err != nil {
+		return nil, err
+	}
+	res.removeStaleFiles()
+	aofFile, err := os.OpenFile(res.path(res.manifest.lastIncr().name), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	res.aofFile = aofFile
+	res.resetSize()
 	go func() {
 		res.handleAOF()
 	}()
+	if res.fsyncPolicy == FsyncEverySec {
+		go res.fsyncEverySec()
+	}
 	return res, nil
 }
 
-func (h *Handler) LoadAOF(maxBytes int) {
+// LoadAOF 按照清单的顺序加载基础文件和增量文件
+func (h *Handler) LoadAOF() error {
 	aofChan := h.aofChan
 	h.aofChan = nil
 	defer func(ac chan *payload) {
 		h.aofChan = ac
 	}(aofChan)
-	file, err := os.Open(h.aofFilename)
-	if err != nil {
-		if _, ok := err.(*os.PathError); ok {
-			return
+	files := h.manifest.files()
+	for i, info := range files {
+		// 只有最后一个增量文件还在被写入，其它文件出现截断都说明已经损坏
+		if err := h.loadAOFFile(h.path(info.name), info.isRDB(), i == len(files)-1); err != nil {
+			return err
 		}
-		logger.Warn(err)
-		return
+	}
+	return nil
+}
+
+// loadAOFFile 加载文件开头的 RDB 部分并执行之后的命令，文件损坏时返回带有位置的错误。
+// RDB 格式的基础文件只有 RDB 部分，从旧版本升级的 AOF 文件可能以 RDB 开头、以命令结尾。
+// 最后一条命令不完整时，如果配置了 aof-load-truncated 并且 repairable 为 true，就截断到最后一条完整命令的末尾
+func (h *Handler) loadAOFFile(filename string, isRDB, repairable bool) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
 	}
 	defer func(f *os.File) {
 		_ = f.Close()
 	}(file)
-	var reader io.Reader
-	if maxBytes > 0 {
-		reader = io.LimitReader(file, int64(maxBytes))
-	} else {
-		reader = file
+	reader := newAOFReader(file)
+	hasPreamble, err := reader.readPreamble(h.db.LoadRDB)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	if isRDB && !hasPreamble {
+		return fmt.Errorf("%s is not an rdb file", filename)
 	}
-	payloadChan := parse.StartParseStream(reader)
 	fakeConn := connection.NewFakeConn()
-	for p := range payloadChan {
-		if p.Err != nil {
-			if p.Err == io.EOF {
-				break
-			}
-			logger.Error("parse error: " + p.Err.Error())
-			continue
+	for {
+		offset := reader.offset
+		args, err := reader.readCommand()
+		if err == io.EOF {
+			return nil
 		}
-		if p.Data == nil {
-			logger.Error("empty payload")
-			continue
+		if err == errTruncated {
+			if !repairable || !config.Properties.AOFLoadTruncated {
+				return fmt.Errorf("%s is truncated after offset %d, set aof-load-truncated yes to drop the incomplete command", filename, offset)
+			}
+			logger.Warn(fmt.Sprintf("%s is truncated, dropping the incomplete command by truncating the file to offset %d", filename, offset))
+			return os.Truncate(filename, offset)
 		}
-		args, ok := protocol.FetchArrayArgs(p.Data)
-		if !ok {
-			logger.Error("require multi bulk protocol")
-			continue
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
 		}
 		reply := h.db.Execute(fakeConn, args)
 		if protocol.CheckErrorReply(reply) {
@@ -105,13 +155,27 @@ func (h *Handler) LoadAOF(maxBytes int) {
 	}
 }
 
-func (h *Handler) AddAOF(dbIndex int, line redis.Line) {
+// AddAOF 把命令交给 handleAOF 写入，always 策略下等到命令被 fsync 之后才返回，
+// 写入或 fsync 失败时返回错误，此后的命令都不再写入并返回同一个错误
+func (h *Handler) AddAOF(dbIndex int, line redis.Line) error {
 	if config.Properties.AppendOnly && h.aofChan != nil {
-		h.aofChan <- &payload{
+		if err := h.WriteError(); err != nil {
+			return err
+		}
+		p := &payload{
 			cmdLine: line,
 			dbIndex: dbIndex,
 		}
+		if h.fsyncPolicy == FsyncAlways {
+			p.synced = make(chan struct{})
+		}
+		h.aofChan <- p
+		if p.synced != nil {
+			<-p.synced
+			return p.err
+		}
 	}
+	return nil
 }
 
 func (h *Handler) Close() {
@@ -120,30 +184,105 @@ func (h *Handler) Close() {
 	}
 	close(h.aofChan)
 	<-h.aofFinishChan
+	close(h.fsyncStop)
+	h.aofMutex.Lock()
+	_ = h.fsync()
+	h.aofMutex.Unlock()
 	if err := h.aofFile.Close(); err != nil {
 		logger.Warn(err)
 	}
 }
 
+// handleAOF 写入 AOF 文件，always 策略下把同时到达的命令合并为一次 fsync
 func (h *Handler) handleAOF() {
-	h.currentIndex = 0
+	// 新打开的增量文件需要先写入 SELECT
+	h.currentIndex = -1
 	for p := range h.aofChan {
+		batch := []*payload{p}
+		if h.fsyncPolicy == FsyncAlways {
+			batch = h.collectBatch(p)
+		}
+		// always 策略下失败之后的命令都不再写入，避免 AOF 中出现缺失了部分命令的内容
+		err := h.WriteError()
 		h.aofMutex.RLock()
-		if p.dbIndex != h.currentIndex {
-			data := protocol.ArrayReply(utils.StringsToLine("SELECT", strconv.Itoa(p.dbIndex))).GetBytes()
-			_, err := h.aofFile.Write(data)
-			if err != nil {
-				logger.Warn(err)
+		for _, p := range batch {
+			if p.rewriteMark != nil {
+				h.aofMutex.RUnlock()
+				h.aofMutex.Lock()
+				p.rewriteMark <- h.rotateIncr()
+				h.aofMutex.Unlock()
+				h.aofMutex.RLock()
 				continue
 			}
-			h.currentIndex = p.dbIndex
+			if err == nil {
+				err = h.writePayload(p)
+			}
 		}
-		data := protocol.ArrayReply(p.cmdLine).GetBytes()
-		_, err := h.aofFile.Write(data)
-		if err != nil {
-			logger.Warn(err)
+		if h.fsyncPolicy == FsyncAlways {
+			if err == nil {
+				err = h.fsync()
+			}
+			if err != nil {
+				// 只有 handleAOF 写入 writeErr
+				h.writeErr.Store(writeError{err: err})
+			}
 		}
 		h.aofMutex.RUnlock()
+		atomic.StoreInt32(&h.dirty, 1)
+		for _, p := range batch {
+			if p.synced != nil {
+				p.err = err
+				close(p.synced)
+			}
+		}
+		h.checkAutoRewrite()
 	}
 	h.aofFinishChan <- struct{}{}
 }
+
+// rotateIncr 打开新的增量文件并写入清单，此后的命令都写入新的增量文件，调用者需要持有 aofMutex 的写锁
+func (h *Handler) rotateIncr() error {
+	incr := h.newIncrInfo(h.manifest.lastIncr().seq + 1)
+	file, err := os.OpenFile(h.path(incr.name), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	updated := &manifest{
+		base:  h.manifest.base,
+		incrs: append(append([]*aofInfo{}, h.manifest.incrs...), incr),
+	}
+	if err := h.persistManifest(updated); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return err
+	}
+	if h.fsyncPolicy != FsyncNo {
+		// 之后的 fsync 只针对新的增量文件
+		_ = h.fsync()
+	}
+	_ = h.aofFile.Close()
+	h.aofFile = file
+	h.manifest = updated
+	h.currentIndex = -1
+	return nil
+}
+
+func (h *Handler) writePayload(p *payload) error {
+	if p.dbIndex != h.currentIndex {
+		data := protocol.ArrayReply(utils.StringsToLine("SELECT", strconv.Itoa(p.dbIndex))).GetBytes()
+		n, err := h.aofFile.Write(data)
+		atomic.AddInt64(&h.aofSize, int64(n))
+		if err != nil {
+			logger.Warn(err)
+			return err
+		}
+		h.currentIndex = p.dbIndex
+	}
+	data := protocol.ArrayReply(p.cmdLine).GetBytes()
+	n, err := h.aofFile.Write(data)
+	atomic.AddInt64(&h.aofSize, int64(n))
+	if err != nil {
+		logger.Warn(err)
+	}
+	return err
+}
@@ -0,0 +1,126 @@
+package persistent
+
+import (
+	"errors"
+	"godis-learn/config"
+	"godis-learn/lib/logger"
+	"godis-learn/lib/utils"
+	"os"
+	"sync/atomic"
+)
+
+const defaultAutoRewriteMinSize = 64 << 20
+
+// ErrRewriteInProgress 表示已经有 AOF 重写或 RDB 保存在进行，二者都需要读取 AOF 快照，不能同时进行
+var ErrRewriteInProgress = errors.New("ERR Background append only file rewriting or saving already in progress")
+
+// RewriteStatus 是 INFO persistence 展示的重写状态
+type RewriteStatus struct {
+	InProgress bool
+	// CurrentSize 为 AOF 当前大小，BaseSize 为启动或上一次重写之后的大小
+	CurrentSize int64
+	BaseSize    int64
+}
+
+func (h *Handler) RewriteStatus() RewriteStatus {
+	return RewriteStatus{
+		InProgress:  atomic.LoadInt32(&h.rewriting) == 1,
+		CurrentSize: atomic.LoadInt64(&h.aofSize),
+		BaseSize:    atomic.LoadInt64(&h.baseSize),
+	}
+}
+
+func (h *Handler) lockRewrite() bool {
+	return atomic.CompareAndSwapInt32(&h.rewriting, 0, 1)
+}
+
+func (h *Handler) unlockRewrite() {
+	atomic.StoreInt32(&h.rewriting, 0)
+}
+
+// BGRewrite 在后台重写 AOF，已经有重写或保存在进行时返回 ErrRewriteInProgress
+func (h *Handler) BGRewrite() error {
+	return h.background(h.rewrite)
+}
+
+// BGRewrite2RDB 在后台生成 RDB 文件，已经有重写或保存在进行时返回 ErrRewriteInProgress
+func (h *Handler) BGRewrite2RDB() error {
+	return h.background(h.rewrite2RDBFile)
+}
+
+func (h *Handler) background(task func() error) error {
+	if !h.lockRewrite() {
+		return ErrRewriteInProgress
+	}
+	go func() {
+		defer h.unlockRewrite()
+		defer func() {
+			if err := recover(); err != nil {
+				logger.Error(err)
+			}
+		}()
+		if err := task(); err != nil {
+			logger.Error(err)
+		}
+	}()
+	return nil
+}
+
+// resetSize 以清单中全部文件的大小之和作为计算增长率的基准，调用者需要持有 aofMutex 的写锁或者还没有开始写入
+func (h *Handler) resetSize() {
+	var size int64
+	for _, info := range h.manifest.files() {
+		stat, err := os.Stat(h.path(info.name))
+		if err != nil {
+			logger.Warn(err)
+			return
+		}
+		size += stat.Size()
+	}
+	atomic.StoreInt64(&h.aofSize, size)
+	atomic.StoreInt64(&h.baseSize, size)
+}
+
+// autoRewriteMinSize 解析 auto-aof-rewrite-min-size，未配置或格式错误时使用默认的 64mb
+func autoRewriteMinSize() int64 {
+	raw := config.Properties.AutoAOFRewriteMinSize
+	if raw == "" {
+		return defaultAutoRewriteMinSize
+	}
+	size, err := utils.ParseMemory(raw)
+	if err != nil {
+		logger.Warn("auto-aof-rewrite-min-size: " + err.Error())
+		return defaultAutoRewriteMinSize
+	}
+	return size
+}
+
+// shouldRewrite 判断 AOF 的增长是否达到了自动重写的阈值
+func shouldRewrite(current, base int64) bool {
+	percentage := config.Properties.AutoAOFRewritePercentage
+	if percentage <= 0 || current < autoRewriteMinSize() {
+		return false
+	}
+	if base <= 0 {
+		base = 1
+	}
+	return (current*100/base)-100 >= int64(percentage)
+}
+
+// checkAutoRewrite 在 AOF 增长超过阈值时启动后台重写
+func (h *Handler) checkAutoRewrite() {
+	current := atomic.LoadInt64(&h.aofSize)
+	base := atomic.LoadInt64(&h.baseSize)
+	if !shouldRewrite(current, base) || !h.lockRewrite() {
+		return
+	}
+	logger.Infof("starting automatic AOF rewrite, %d bytes now and %d bytes after last rewrite", current, base)
+	go func() {
+		defer h.unlockRewrite()
+		if err := h.rewrite(); err != nil {
+			// 等文件再增长一轮之后再尝试，避免每次写入都触发失败的重写
+			atomic.StoreInt64(&h.baseSize, current)
+			logger.Error("automatic AOF rewrite failed: " + err.Error())
+		}
+	}()
+}
@@ -0,0 +1,49 @@
+package persistent
+
+import (
+	"godis-learn/config"
+	"testing"
+)
+
+func TestShouldRewrite(t *testing.T) {
+	config.Properties.AutoAOFRewriteMinSize = "1kb"
+	defer func() {
+		config.Properties.AutoAOFRewritePercentage = 0
+		config.Properties.AutoAOFRewriteMinSize = ""
+	}()
+	if shouldRewrite(1<<20, 1) {
+		t.Error("expected auto rewrite to be disabled by default")
+	}
+	config.Properties.AutoAOFRewritePercentage = 100
+	cases := []struct {
+		current, base int64
+		expected      bool
+	}{
+		{1000, 0, false},
+		{1024, 0, true},
+		{2047, 1024, false},
+		{2048, 1024, true},
+	}
+	for _, c := range cases {
+		if shouldRewrite(c.current, c.base) != c.expected {
+			t.Errorf("shouldRewrite(%d, %d) should be %v", c.current, c.base, c.expected)
+		}
+	}
+}
+
+func TestRewriteExclusive(t *testing.T) {
+	h := &Handler{}
+	if !h.lockRewrite() {
+		t.Fatal("expected to acquire rewrite lock")
+	}
+	if err := h.Rewrite(); err != ErrRewriteInProgress {
+		t.Errorf("expected ErrRewriteInProgress, got %v", err)
+	}
+	if err := h.BGRewrite2RDB(); err != ErrRewriteInProgress {
+		t.Errorf("expected ErrRewriteInProgress, got %v", err)
+	}
+	h.unlockRewrite()
+	if status := h.RewriteStatus(); status.InProgress {
+		t.Error("expected no rewrite in progress")
+	}
+}
@@ -0,0 +1,71 @@
+package persistent
+
+import (
+	"godis-learn/interface/dbinterface"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CheckResult 是 CheckAOF 的检查结果
+type CheckResult struct {
+	// Preamble 表示文件以 RDB 部分开头
+	Preamble bool
+	Commands int
+	// Valid 为 RDB 部分与完整命令的总字节数，文件损坏时即为可以截断到的位置
+	Valid int64
+	// Err 为 nil 表示文件完整
+	Err error
+}
+
+// CheckAOF 使用与加载时相同的 aofReader 逐条读取命令但不执行，RDB 部分只解析不加载。
+// RDB 部分损坏时 Valid 为 0，这种文件无法通过截断修复
+func CheckAOF(reader io.Reader) *CheckResult {
+	res := &CheckResult{}
+	input := newAOFReader(reader)
+	skip := func(int, string, *dbinterface.EntryValue, *time.Time) error {
+		return nil
+	}
+	res.Preamble, res.Err = input.readPreamble(func(reader io.Reader) error {
+		return ParseRDB(reader, skip)
+	})
+	if res.Err != nil {
+		return res
+	}
+	for {
+		res.Valid = input.offset
+		_, err := input.readCommand()
+		if err == io.EOF {
+			return res
+		}
+		if err != nil {
+			res.Err = err
+			return res
+		}
+		res.Commands++
+	}
+}
+
+// ManifestFiles 读取清单文件，按加载顺序返回其中列出的文件路径，这些文件与清单位于同一目录
+func ManifestFiles(filename string) ([]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseManifest(data)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, info := range m.files() {
+		files = append(files, filepath.Join(filepath.Dir(filename), info.name))
+	}
+	return files, nil
+}
+
+// IsManifest 根据文件名判断是否为清单文件
+func IsManifest(filename string) bool {
+	return strings.HasSuffix(filename, manifestSuffix)
+}
@@ -0,0 +1,79 @@
+package persistent
+
+import (
+	"bytes"
+	"github.com/hdt3213/rdb/encoder"
+	"godis-learn/lib/utils"
+	"godis-learn/redis/protocol"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckAOF(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(protocol.ArrayReply(utils.StringsToLine("SELECT", "0")).GetBytes())
+	buf.Write(protocol.ArrayReply(utils.StringsToLine("SET", "key", "a\r\nb")).GetBytes())
+	valid := buf.Bytes()
+	if res := CheckAOF(bytes.NewReader(valid)); res.Err != nil || res.Commands != 2 || res.Valid != int64(len(valid)) {
+		t.Errorf("expected valid AOF with 2 commands, got %+v", res)
+	}
+
+	torn := append(append([]byte{}, valid...), "*3\r\n$3\r\nSET\r\n$3\r\nke"...)
+	if res := CheckAOF(bytes.NewReader(torn)); res.Err != errTruncated || res.Valid != int64(len(valid)) {
+		t.Errorf("expected truncation at %d, got %+v", len(valid), res)
+	}
+
+	corrupted := append(append([]byte{}, valid...), "+OK\r\n"...)
+	corrupted = append(corrupted, valid...)
+	if res := CheckAOF(bytes.NewReader(corrupted)); res.Err == nil || res.Valid != int64(len(valid)) {
+		t.Errorf("expected bad format at %d, got %+v", len(valid), res)
+	}
+}
+
+func TestCheckAOFWithPreamble(t *testing.T) {
+	var buf bytes.Buffer
+	enc := encoder.NewEncoder(&buf)
+	if err := enc.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteDBHeader(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteStringObject("key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteEnd(); err != nil {
+		t.Fatal(err)
+	}
+	size := buf.Len()
+	buf.Write(protocol.ArrayReply(utils.StringsToLine("SET", "key", "value")).GetBytes())
+	if res := CheckAOF(bytes.NewReader(buf.Bytes())); !res.Preamble || res.Err != nil || res.Commands != 1 {
+		t.Errorf("expected rdb preamble and 1 command, got %+v", res)
+	}
+	if res := CheckAOF(bytes.NewReader(buf.Bytes()[:size-10])); !res.Preamble || res.Err == nil || res.Valid != 0 {
+		t.Errorf("expected error for truncated rdb preamble, got %+v", res)
+	}
+}
+
+func TestManifestFiles(t *testing.T) {
+	dir := t.TempDir()
+	m := &manifest{
+		base:  &aofInfo{name: "appendonly.aof.1.base.rdb", seq: 1, fileType: baseFileType},
+		incrs: []*aofInfo{{name: "appendonly.aof.2.incr.aof", seq: 2, fileType: incrFileType}},
+	}
+	filename := filepath.Join(dir, "appendonly.aof"+manifestSuffix)
+	if err := os.WriteFile(filename, m.encode(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !IsManifest(filename) {
+		t.Errorf("expected %s to be a manifest", filename)
+	}
+	files, err := ManifestFiles(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0] != filepath.Join(dir, m.base.name) || files[1] != filepath.Join(dir, m.incrs[0].name) {
+		t.Errorf("unexpected files %v", files)
+	}
+}
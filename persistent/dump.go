@@ -0,0 +1,268 @@
+package persistent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	rdb "github.com/hdt3213/rdb/parser"
+	"godis-learn/datastruct/dict"
+	"godis-learn/datastruct/list"
+	"godis-learn/datastruct/set"
+	"godis-learn/datastruct/stream"
+	"godis-learn/interface/dbinterface"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	dumpRDBVersion = 9
+	rdbTypeSet     = 2
+	rdbTypeIntSet  = 11
+)
+
+var crc64Table = func() [256]uint64 {
+	// Redis 使用 CRC-64/JONES，此处为其反射形式的多项式
+	const poly = 0x95ac9329ac4bc9b5
+	var table [256]uint64
+	for i := 0; i < 256; i++ {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ poly
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// CRC64 计算与 Redis DUMP 格式一致的 CRC-64/JONES 校验和
+func CRC64(data []byte) uint64 {
+	return crc64Update(0, data)
+}
+
+// crc64Update 在 crc 的基础上继续计算 data 的校验和，用于分段写入的 RDB 文件
+func crc64Update(crc uint64, data []byte) uint64 {
+	for _, b := range data {
+		crc = crc64Table[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
+
+// DumpValue 将单个值序列化为与 Redis DUMP 命令兼容的格式：RDB 对象、2 字节的 RDB 版本号以及 8 字节的 CRC64 校验和
+func DumpValue(val *dbinterface.EntryValue) ([]byte, error) {
+	object, err := encodeObject(val)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]byte, 0, len(object)+10)
+	res = append(res, object...)
+	res = binary.LittleEndian.AppendUint16(res, dumpRDBVersion)
+	return binary.LittleEndian.AppendUint64(res, CRC64(res)), nil
+}
+
+// encodeObject 返回值在 RDB 中的类型标识和编码后的值，不包含 key。
+// 与 Redis 保存普通编码的对象相同：列表、哈希和有序集合依次写入元素，不使用 ziplist 等紧凑编码
+func encodeObject(val *dbinterface.EntryValue) ([]byte, error) {
+	switch v := val.V.(type) {
+	case []byte:
+		return appendRDBStringObject([]byte{rdbTypeString}, v), nil
+	case list.List:
+		res := appendRDBLength([]byte{rdbTypeList}, uint64(v.Size()))
+		v.ForEach(func(_ int, element any) bool {
+			res = appendRDBStringObject(res, element.([]byte))
+			return true
+		})
+		return res, nil
+	case *set.HashSet:
+		return dumpSet(v), nil
+	case dict.HashMap:
+		res := appendRDBLength([]byte{rdbTypeHash}, uint64(v.Size()))
+		v.ForEach(func(field string, value any) bool {
+			res = appendRDBStringObject(res, []byte(field))
+			res = appendRDBStringObject(res, value.([]byte))
+			return true
+		})
+		return res, nil
+	case *set.SortedSet:
+		// 分数以 8 字节小端序的二进制 double 保存
+		res := appendRDBLength([]byte{rdbTypeZSet2}, uint64(v.Size()))
+		v.ForEachRankBetween(0, v.Size(), true, func(e *set.Element) bool {
+			res = appendRDBStringObject(res, []byte(e.Member))
+			res = binary.LittleEndian.AppendUint64(res, math.Float64bits(e.Score))
+			return true
+		})
+		return res, nil
+	case *stream.Stream:
+		return dumpStream(v), nil
+	}
+	return nil, fmt.Errorf("unsupported value type %T", val.V)
+}
+
+// dumpSet 不经过编码器直接生成集合对象，编码器计算 intset 的整数宽度时只有不是新最小值的元素才会更新最大值，
+// 宽度可能偏小导致大的成员被截断。成员都是整数时与 Redis 一样使用 intset 编码
+func dumpSet(s *set.HashSet) []byte {
+	ints, ok := intMembers(s)
+	if !ok {
+		res := appendRDBLength([]byte{rdbTypeSet}, uint64(s.Size()))
+		s.ForEach(func(member string) bool {
+			res = appendRDBString(res, []byte(member))
+			return true
+		})
+		return res
+	}
+	width := 2
+	if ints[0] < math.MinInt32 || ints[len(ints)-1] > math.MaxInt32 {
+		width = 8
+	} else if ints[0] < math.MinInt16 || ints[len(ints)-1] > math.MaxInt16 {
+		width = 4
+	}
+	// intset 的格式为 4 字节的整数宽度、4 字节的成员数量以及按升序排列的成员，都是小端序
+	intSet := make([]byte, 0, 8+width*len(ints))
+	intSet = binary.LittleEndian.AppendUint32(intSet, uint32(width))
+	intSet = binary.LittleEndian.AppendUint32(intSet, uint32(len(ints)))
+	for _, n := range ints {
+		switch width {
+		case 2:
+			intSet = binary.LittleEndian.AppendUint16(intSet, uint16(n))
+		case 4:
+			intSet = binary.LittleEndian.AppendUint32(intSet, uint32(n))
+		default:
+			intSet = binary.LittleEndian.AppendUint64(intSet, uint64(n))
+		}
+	}
+	return appendRDBString([]byte{rdbTypeIntSet}, intSet)
+}
+
+// intMembers 在集合非空并且成员都是规范形式的整数时按升序返回全部成员
+func intMembers(s *set.HashSet) ([]int64, bool) {
+	ints := make([]int64, 0, s.Size())
+	s.ForEach(func(member string) bool {
+		n, err := strconv.ParseInt(member, 10, 64)
+		if err != nil || strconv.FormatInt(n, 10) != member {
+			ints = nil
+			return false
+		}
+		ints = append(ints, n)
+		return true
+	})
+	if len(ints) == 0 {
+		return nil, false
+	}
+	sort.Slice(ints, func(i, j int) bool {
+		return ints[i] < ints[j]
+	})
+	return ints, true
+}
+
+// appendRDBLength 按照 RDB 的长度编码写入 n：小于 64 时占 1 个字节，小于 16384 时占 2 个字节，否则为 5 或 9 个字节
+func appendRDBLength(buf []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(buf, byte(n))
+	case n < 1<<14:
+		return append(buf, byte(n>>8)|0x40, byte(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0x80), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, 0x81), n)
+	}
+}
+
+func appendRDBString(buf []byte, s []byte) []byte {
+	return append(appendRDBLength(buf, uint64(len(s))), s...)
+}
+
+// appendRDBStringObject 写入字符串对象，与 Redis 一样把可以用 32 位整数表示的规范整数字符串编码为整数
+func appendRDBStringObject(buf []byte, s []byte) []byte {
+	if len(s) <= 11 {
+		if n, err := strconv.ParseInt(string(s), 10, 64); err == nil && strconv.FormatInt(n, 10) == string(s) {
+			switch {
+			case n >= math.MinInt8 && n <= math.MaxInt8:
+				return append(buf, 0xc0, byte(n))
+			case n >= math.MinInt16 && n <= math.MaxInt16:
+				return binary.LittleEndian.AppendUint16(append(buf, 0xc1), uint16(n))
+			case n >= math.MinInt32 && n <= math.MaxInt32:
+				return binary.LittleEndian.AppendUint32(append(buf, 0xc2), uint32(n))
+			}
+		}
+	}
+	return appendRDBString(buf, s)
+}
+
+// RestoreValue 解析 DumpValue 或 Redis DUMP 命令生成的数据
+func RestoreValue(payload []byte) (*dbinterface.EntryValue, error) {
+	if len(payload) < 11 {
+		return nil, errors.New("DUMP payload version or checksum are wrong")
+	}
+	body, footer := payload[:len(payload)-8], payload[len(payload)-8:]
+	if binary.LittleEndian.Uint64(footer) != CRC64(body) {
+		return nil, errors.New("DUMP payload version or checksum are wrong")
+	}
+	if version := binary.LittleEndian.Uint16(body[len(body)-2:]); version > rdbMaxVersion {
+		return nil, errors.New("DUMP payload version or checksum are wrong")
+	}
+	object := body[:len(body)-2]
+	// 将对象包装成只含一个空 key 的 RDB 文件后交给 ParseRDB 处理
+	file := make([]byte, 0, len(object)+12)
+	file = append(file, "REDIS0009"...)
+	file = append(file, object[0], 0)
+	file = append(file, object[1:]...)
+	file = append(file, 0xff)
+	var res *dbinterface.EntryValue
+	err := ParseRDB(bytes.NewReader(file), func(_ int, _ string, val *dbinterface.EntryValue, _ *time.Time) error {
+		res = val
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("Bad data format: " + err.Error())
+	}
+	if res == nil {
+		return nil, errors.New("Bad data format")
+	}
+	return res, nil
+}
+
+// ObjectToValue 将 RDB 解码器得到的对象转换为数据库中存储的值
+func ObjectToValue(obj rdb.RedisObject) (*dbinterface.EntryValue, error) {
+	switch obj.GetType() {
+	case rdb.StringType:
+		strObj := obj.(*rdb.StringObject)
+		return &dbinterface.EntryValue{V: strObj.Value}, nil
+	case rdb.ListType:
+		listObj := obj.(*rdb.ListObject)
+		l := list.NewQuickList()
+		for _, v := range listObj.Values {
+			l.Add(v)
+		}
+		return &dbinterface.EntryValue{V: l}, nil
+	case rdb.SetType:
+		// intset 等编码已经由解码器展开为成员列表
+		setObj := obj.(*rdb.SetObject)
+		s := set.NewHashSet()
+		for _, member := range setObj.Members {
+			s.Add(string(member))
+		}
+		return &dbinterface.EntryValue{V: s}, nil
+	case rdb.HashType:
+		hashObj := obj.(*rdb.HashObject)
+		m := dict.NewSimpleHashMap()
+		for k, v := range hashObj.Hash {
+			m.Put(k, v)
+		}
+		return &dbinterface.EntryValue{V: m}, nil
+	case rdb.ZSetType:
+		setObj := obj.(*rdb.ZSetObject)
+		s := set.NewSortedSet()
+		for _, e := range setObj.Entries {
+			s.Add(e.Member, e.Score)
+		}
+		return &dbinterface.EntryValue{V: s}, nil
+	}
+	return nil, fmt.Errorf("unsupported rdb object type: %s", obj.GetType())
+}
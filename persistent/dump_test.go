@@ -0,0 +1,140 @@
+package persistent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"godis-learn/datastruct/dict"
+	"godis-learn/datastruct/list"
+	"godis-learn/datastruct/set"
+	"godis-learn/interface/dbinterface"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRestoreRedisPayload(t *testing.T) {
+	// Redis 7.0 中 SET mykey 10 之后 DUMP mykey 的结果
+	payload := []byte("\x00\xc0\n\n\x00n\x9fWE\x0e\xaec\xbb")
+	val, err := RestoreValue(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := val.V.([]byte); !ok || string(s) != "10" {
+		t.Errorf("expected string 10, got %v", val.V)
+	}
+	payload[1] = 0xc1
+	if _, err := RestoreValue(payload); err == nil {
+		t.Error("expected checksum error")
+	}
+	// 校验和为 0 也要校验，不能跳过
+	payload[1] = 0xc0
+	binary.LittleEndian.PutUint64(payload[len(payload)-8:], 0)
+	if _, err := RestoreValue(payload); err == nil {
+		t.Error("expected checksum error for zero checksum")
+	}
+}
+
+func TestDumpSet(t *testing.T) {
+	dumped, err := DumpValue(&dbinterface.EntryValue{V: set.NewHashSet("3", "1", "2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 与 Redis 对 SADD s 1 2 3 执行 DUMP 得到的 intset 相同
+	expected := []byte("\x0b\x0e\x02\x00\x00\x00\x03\x00\x00\x00\x01\x00\x02\x00\x03\x00")
+	if !bytes.HasPrefix(dumped, expected) || len(dumped) != len(expected)+10 {
+		t.Errorf("expected intset %q, got %q", expected, dumped)
+	}
+
+	// 只有一个成员时 intset 中也只有一个成员，整数宽度为 4 字节
+	dumped, err = DumpValue(&dbinterface.EntryValue{V: set.NewHashSet("70000")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []byte("\x0b\x0c\x04\x00\x00\x00\x01\x00\x00\x00\x70\x11\x01\x00")
+	if !bytes.HasPrefix(dumped, expected) || len(dumped) != len(expected)+10 {
+		t.Errorf("expected intset %q, got %q", expected, dumped)
+	}
+
+	for _, members := range [][]string{{"70000"}, {"-5", "1", "5000000000"}, {"a", "007", "1"}} {
+		dumped, err := DumpValue(&dbinterface.EntryValue{V: set.NewHashSet(members...)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version := binary.LittleEndian.Uint16(dumped[len(dumped)-10:]); version != dumpRDBVersion {
+			t.Errorf("expected rdb version %d, got %d", dumpRDBVersion, version)
+		}
+		val, err := RestoreValue(dumped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored := val.V.(*set.HashSet).Members()
+		sort.Strings(restored)
+		sort.Strings(members)
+		if !reflect.DeepEqual(restored, members) {
+			t.Errorf("expected members %v, got %v", members, restored)
+		}
+	}
+}
+
+func TestDumpRedisPayload(t *testing.T) {
+	// Redis 文档中 SET mykey 10 之后 DUMP mykey 的结果，RDB 版本为 9
+	expected := []byte("\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n")
+	dumped, err := DumpValue(&dbinterface.EntryValue{V: []byte("10")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dumped, expected) {
+		t.Errorf("expected %q, got %q", expected, dumped)
+	}
+	// 不能用整数表示的字符串按原样保存
+	dumped, err = DumpValue(&dbinterface.EntryValue{V: []byte("010")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if object := dumped[:len(dumped)-10]; !bytes.Equal(object, []byte("\x00\x03010")) {
+		t.Errorf("expected raw string, got %q", object)
+	}
+}
+
+func TestDumpRoundTrip(t *testing.T) {
+	l := list.NewQuickList()
+	l.Add([]byte("a"))
+	l.Add([]byte("300"))
+	h := dict.NewSimpleHashMap()
+	h.Put("field", []byte("value"))
+	h.Put("n", []byte("-70000"))
+	z := set.NewSortedSet()
+	z.Add("a", 1.5)
+	z.Add("b", -2)
+	for _, val := range []any{[]byte("value"), []byte("-129"), l, h, z} {
+		dumped, err := DumpValue(&dbinterface.EntryValue{V: val})
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored, err := RestoreValue(dumped)
+		if err != nil {
+			t.Fatalf("restore %T: %v", val, err)
+		}
+		switch v := val.(type) {
+		case []byte:
+			if !bytes.Equal(restored.V.([]byte), v) {
+				t.Errorf("expected %q, got %q", v, restored.V)
+			}
+		case list.List:
+			r := restored.V.(list.List)
+			if r.Size() != 2 || string(r.Get(0).([]byte)) != "a" || string(r.Get(1).([]byte)) != "300" {
+				t.Errorf("unexpected list %v", r)
+			}
+		case dict.HashMap:
+			r := restored.V.(dict.HashMap)
+			if value, _ := r.Get("n"); r.Size() != 2 || string(value.([]byte)) != "-70000" {
+				t.Errorf("unexpected hash %v", r)
+			}
+		case *set.SortedSet:
+			r := restored.V.(*set.SortedSet)
+			if e, ok := r.Find("a"); r.Size() != 2 || !ok || e.Score != 1.5 {
+				t.Errorf("unexpected sorted set %v", r)
+			}
+		}
+	}
+}
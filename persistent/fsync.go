@@ -0,0 +1,115 @@
+package persistent
+
+import (
+	"godis-learn/config"
+	"godis-learn/lib/logger"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// appendfsync 的三种策略
+const (
+	FsyncAlways   = "always"
+	FsyncEverySec = "everysec"
+	FsyncNo       = "no"
+)
+
+// maxFsyncBatch 限制 always 策略下一次 fsync 合并的命令数量
+const maxFsyncBatch = 1024
+
+// FsyncStatus 是 INFO persistence 展示的 fsync 状态
+type FsyncStatus struct {
+	Policy string
+	// LastFsync 为最近一次成功 fsync 的 Unix 时间戳，从未 fsync 时为 -1
+	LastFsync int64
+	// Delayed 是 everysec 策略下因为上一次 fsync 尚未完成而被推迟的次数
+	Delayed int64
+}
+
+func fsyncPolicy() string {
+	policy := strings.ToLower(config.Properties.AppendFsync)
+	switch policy {
+	case FsyncAlways, FsyncEverySec, FsyncNo:
+		return policy
+	case "":
+	default:
+		logger.Warn("unknown appendfsync policy " + policy + ", using everysec")
+	}
+	return FsyncEverySec
+}
+
+func (h *Handler) FsyncStatus() FsyncStatus {
+	return FsyncStatus{
+		Policy:    h.fsyncPolicy,
+		LastFsync: atomic.LoadInt64(&h.lastFsync),
+		Delayed:   atomic.LoadInt64(&h.delayedFsync),
+	}
+}
+
+// fsync 把 AOF 文件刷到磁盘，调用者需要持有 aofMutex 的读锁或写锁
+func (h *Handler) fsync() error {
+	if err := h.aofFile.Sync(); err != nil {
+		logger.Warn("fsync failed: " + err.Error())
+		return err
+	}
+	atomic.StoreInt64(&h.lastFsync, time.Now().Unix())
+	return nil
+}
+
+// writeError 包装写入 AOF 时的错误，使 atomic.Value 中保存的类型保持一致
+type writeError struct {
+	err error
+}
+
+// WriteError 返回 always 策略下写入或 fsync 失败的原因，失败之后不再写入 AOF，没有失败时返回 nil
+func (h *Handler) WriteError() error {
+	if e, ok := h.writeErr.Load().(writeError); ok {
+		return e.err
+	}
+	return nil
+}
+
+// collectBatch 取出队列中已经到达的命令，与 first 一起写入后只需要一次 fsync
+func (h *Handler) collectBatch(first *payload) []*payload {
+	batch := []*payload{first}
+	for len(batch) < maxFsyncBatch {
+		select {
+		case p, ok := <-h.aofChan:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, p)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// fsyncEverySec 每秒在后台 fsync 一次，上一次 fsync 还没有完成时记为一次推迟
+func (h *Handler) fsyncEverySec() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.fsyncStop:
+			return
+		case <-ticker.C:
+		}
+		if atomic.LoadInt32(&h.dirty) == 0 {
+			continue
+		}
+		if !atomic.CompareAndSwapInt32(&h.fsyncing, 0, 1) {
+			atomic.AddInt64(&h.delayedFsync, 1)
+			continue
+		}
+		go func() {
+			defer atomic.StoreInt32(&h.fsyncing, 0)
+			atomic.StoreInt32(&h.dirty, 0)
+			h.aofMutex.RLock()
+			defer h.aofMutex.RUnlock()
+			_ = h.fsync()
+		}()
+	}
+}
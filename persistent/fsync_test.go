@@ -0,0 +1,95 @@
+package persistent
+
+import (
+	"bytes"
+	"godis-learn/config"
+	"godis-learn/lib/utils"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestFsyncAlways(t *testing.T) {
+	config.Properties.AppendOnly = true
+	defer func() {
+		config.Properties.AppendOnly = false
+	}()
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	aofFile, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{
+		aofChan:       make(chan *payload, aofQueueSize),
+		aofFile:       aofFile,
+		aofFinishChan: make(chan struct{}),
+		fsyncPolicy:   FsyncAlways,
+		fsyncStop:     make(chan struct{}),
+		lastFsync:     -1,
+	}
+	go h.handleAOF()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			h.AddAOF(i%2, utils.StringsToLine("SET", "key"+strconv.Itoa(i), "value"))
+		}(i)
+	}
+	wg.Wait()
+	// AddAOF 返回时命令已经写入并 fsync
+	if status := h.FsyncStatus(); status.LastFsync < 0 || status.Policy != FsyncAlways {
+		t.Errorf("unexpected fsync status %+v", status)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if !bytes.Contains(data, []byte("key"+strconv.Itoa(i)+"\r\n")) {
+			t.Errorf("key%d is not written", i)
+		}
+	}
+	h.Close()
+}
+
+func TestFsyncAlwaysWriteError(t *testing.T) {
+	config.Properties.AppendOnly = true
+	defer func() {
+		config.Properties.AppendOnly = false
+	}()
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	if err := os.WriteFile(filename, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// 只读打开使写入失败
+	aofFile, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{
+		aofChan:       make(chan *payload, aofQueueSize),
+		aofFile:       aofFile,
+		aofFinishChan: make(chan struct{}),
+		fsyncPolicy:   FsyncAlways,
+		fsyncStop:     make(chan struct{}),
+		lastFsync:     -1,
+	}
+	go h.handleAOF()
+	if err := h.AddAOF(0, utils.StringsToLine("SET", "key", "value")); err == nil {
+		t.Fatal("expected write error")
+	}
+	if h.WriteError() == nil {
+		t.Error("expected write error to be recorded")
+	}
+	if err := h.AddAOF(0, utils.StringsToLine("SET", "key2", "value")); err == nil {
+		t.Error("expected later writes to be rejected")
+	}
+	if status := h.FsyncStatus(); status.LastFsync >= 0 {
+		t.Errorf("expected no successful fsync, got %+v", status)
+	}
+	h.Close()
+}
@@ -0,0 +1,174 @@
+package persistent
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// listpack 的格式为 4 字节的总长度、2 字节的元素数量、各个元素以及结束标识 0xFF，都是小端序。
+// 每个元素由编码、数据以及记录前两者长度的 backlen 组成
+const (
+	listPackHeaderLen = 6
+	listPackEnd       = 0xFF
+)
+
+var errBadListPack = errors.New("bad listpack")
+
+// parseListPack 返回 listpack 中的全部元素，整数元素转换为十进制字符串
+func parseListPack(buf []byte) ([][]byte, error) {
+	if len(buf) < listPackHeaderLen+1 || int(binary.LittleEndian.Uint32(buf)) != len(buf) {
+		return nil, errBadListPack
+	}
+	var res [][]byte
+	cursor := listPackHeaderLen
+	for {
+		if cursor >= len(buf) {
+			return nil, errBadListPack
+		}
+		if buf[cursor] == listPackEnd {
+			break
+		}
+		entry, size, err := readListPackEntry(buf[cursor:])
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, entry)
+		cursor += size + backLenSize(size)
+	}
+	if count := binary.LittleEndian.Uint16(buf[4:]); count != 0xFFFF && int(count) != len(res) {
+		return nil, errBadListPack
+	}
+	return res, nil
+}
+
+// readListPackEntry 解析一个元素，返回元素的值以及编码和数据的总长度
+func readListPackEntry(buf []byte) ([]byte, int, error) {
+	var val int64
+	var size int
+	first := buf[0]
+	switch {
+	case first&0x80 == 0:
+		return []byte(strconv.Itoa(int(first))), 1, nil
+	case first&0xC0 == 0x80:
+		return readListPackString(buf, 1, int(first&0x3F))
+	case first&0xE0 == 0xC0:
+		if len(buf) < 2 {
+			return nil, 0, errBadListPack
+		}
+		val, size = int64(first&0x1F)<<8|int64(buf[1]), 2
+		if val >= 1<<12 {
+			val -= 1 << 13
+		}
+	case first&0xF0 == 0xE0:
+		if len(buf) < 2 {
+			return nil, 0, errBadListPack
+		}
+		return readListPackString(buf, 2, int(first&0x0F)<<8|int(buf[1]))
+	case first == 0xF0:
+		if len(buf) < 5 {
+			return nil, 0, errBadListPack
+		}
+		return readListPackString(buf, 5, int(binary.LittleEndian.Uint32(buf[1:])))
+	case first >= 0xF1 && first <= 0xF4:
+		width := []int{2, 3, 4, 8}[first-0xF1]
+		if len(buf) < 1+width {
+			return nil, 0, errBadListPack
+		}
+		var raw [8]byte
+		copy(raw[:], buf[1:1+width])
+		// 按符号位扩展到 64 位
+		if buf[width]&0x80 != 0 {
+			for i := width; i < 8; i++ {
+				raw[i] = 0xFF
+			}
+		}
+		val, size = int64(binary.LittleEndian.Uint64(raw[:])), 1+width
+	default:
+		return nil, 0, errBadListPack
+	}
+	return []byte(strconv.FormatInt(val, 10)), size, nil
+}
+
+func readListPackString(buf []byte, headerLen, strLen int) ([]byte, int, error) {
+	if len(buf) < headerLen+strLen {
+		return nil, 0, errBadListPack
+	}
+	return buf[headerLen : headerLen+strLen], headerLen + strLen, nil
+}
+
+// backLenSize 返回记录元素长度 size 的 backlen 所占用的字节数
+func backLenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// appendListPackEntry 写入一个元素。与 Redis 一样，可以表示为整数的字符串使用整数编码
+func appendListPackEntry(buf []byte, entry []byte) []byte {
+	start := len(buf)
+	if n, err := strconv.ParseInt(string(entry), 10, 64); err == nil && strconv.FormatInt(n, 10) == string(entry) {
+		buf = appendListPackInt(buf, n)
+	} else {
+		switch l := len(entry); {
+		case l < 64:
+			buf = append(buf, 0x80|byte(l))
+		case l < 4096:
+			buf = append(buf, 0xE0|byte(l>>8), byte(l))
+		default:
+			buf = binary.LittleEndian.AppendUint32(append(buf, 0xF0), uint32(l))
+		}
+		buf = append(buf, entry...)
+	}
+	// backlen 从后向前读取，每个字节的低 7 位保存长度，除最靠前的字节外最高位为 1
+	size := len(buf) - start
+	backLen := make([]byte, backLenSize(size))
+	for i := len(backLen) - 1; i >= 0; i-- {
+		backLen[i] = byte(size & 0x7F)
+		if i != 0 {
+			backLen[i] |= 0x80
+		}
+		size >>= 7
+	}
+	return append(buf, backLen...)
+}
+
+func appendListPackInt(buf []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 127:
+		return append(buf, byte(n))
+	case n >= -4096 && n <= 4095:
+		return append(buf, 0xC0|byte(uint64(n)>>8&0x1F), byte(n))
+	case n >= -32768 && n <= 32767:
+		return binary.LittleEndian.AppendUint16(append(buf, 0xF1), uint16(n))
+	case n >= -8388608 && n <= 8388607:
+		return append(buf, 0xF2, byte(n), byte(n>>8), byte(n>>16))
+	case n >= -2147483648 && n <= 2147483647:
+		return binary.LittleEndian.AppendUint32(append(buf, 0xF3), uint32(n))
+	}
+	return binary.LittleEndian.AppendUint64(append(buf, 0xF4), uint64(n))
+}
+
+// buildListPack 把元素编码为完整的 listpack
+func buildListPack(entries [][]byte) []byte {
+	buf := make([]byte, listPackHeaderLen)
+	for _, entry := range entries {
+		buf = appendListPackEntry(buf, entry)
+	}
+	buf = append(buf, listPackEnd)
+	binary.LittleEndian.PutUint32(buf, uint32(len(buf)))
+	count := len(entries)
+	if count > 0xFFFF {
+		count = 0xFFFF
+	}
+	binary.LittleEndian.PutUint16(buf[4:], uint16(count))
+	return buf
+}
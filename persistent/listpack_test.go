@@ -0,0 +1,38 @@
+package persistent
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestListPack(t *testing.T) {
+	// 与 Redis 对 "a"、1 生成的 listpack 相同
+	expected := []byte("\x0c\x00\x00\x00\x02\x00\x81a\x02\x01\x01\xff")
+	if lp := buildListPack([][]byte{[]byte("a"), []byte("1")}); !bytes.Equal(lp, expected) {
+		t.Errorf("expected listpack %q, got %q", expected, lp)
+	}
+
+	var entries [][]byte
+	for _, n := range []int64{0, 127, 128, -1, -4096, 4095, 4096, -32768, 32767, 32768, -8388608, 8388607, 8388608, -2147483648, 2147483647, 2147483648, -9223372036854775808, 9223372036854775807} {
+		entries = append(entries, []byte(strconv.FormatInt(n, 10)))
+	}
+	for _, size := range []int{0, 63, 64, 200, 4095, 4096, 20000} {
+		entries = append(entries, []byte(strings.Repeat("x", size)))
+	}
+	entries = append(entries, []byte("007"), []byte("-0"), []byte("1.5"))
+	parsed, err := parseListPack(buildListPack(entries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, entries) {
+		t.Errorf("expected %q, got %q", entries, parsed)
+	}
+
+	lp := buildListPack(entries)
+	if _, err := parseListPack(lp[:len(lp)-1]); err == nil {
+		t.Error("expected error for truncated listpack")
+	}
+}
@@ -0,0 +1,273 @@
+package persistent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"godis-learn/config"
+	"godis-learn/lib/logger"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// AOF 由一个基础文件和若干增量文件组成，保存在 appenddirname 目录中，清单文件按加载顺序列出这些文件。
+// 清单总是先写入临时文件再重命名，因此磁盘上的清单在任何时刻都是完整的，并且它列出的文件包含全部已确认的写入
+
+const (
+	defaultAppendFilename = "appendonly.aof"
+	defaultAppendDirname  = "appendonlydir"
+	manifestSuffix        = ".manifest"
+	// tempFilePrefix 是重写过程中临时文件的前缀，启动时会删除残留的临时文件
+	tempFilePrefix = "temp-"
+)
+
+// 清单中的文件类型
+const (
+	baseFileType = "b"
+	incrFileType = "i"
+)
+
+type aofInfo struct {
+	name     string
+	seq      int
+	fileType string
+}
+
+// isRDB 判断基础文件是否为 RDB 格式
+func (info *aofInfo) isRDB() bool {
+	return strings.HasSuffix(info.name, ".rdb")
+}
+
+type manifest struct {
+	// base 为 nil 表示没有基础文件，只从增量文件加载
+	base  *aofInfo
+	incrs []*aofInfo
+}
+
+// files 按加载顺序返回清单中的全部文件
+func (m *manifest) files() []*aofInfo {
+	var res []*aofInfo
+	if m.base != nil {
+		res = append(res, m.base)
+	}
+	return append(res, m.incrs...)
+}
+
+// lastIncr 返回当前写入的增量文件
+func (m *manifest) lastIncr() *aofInfo {
+	if len(m.incrs) == 0 {
+		return nil
+	}
+	return m.incrs[len(m.incrs)-1]
+}
+
+func (m *manifest) encode() []byte {
+	var buf bytes.Buffer
+	for _, info := range m.files() {
+		buf.WriteString(fmt.Sprintf("file %s seq %d type %s\n", info.name, info.seq, info.fileType))
+	}
+	return buf.Bytes()
+}
+
+func parseManifest(data []byte) (*manifest, error) {
+	m := &manifest{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, errors.New("invalid manifest line: " + line)
+		}
+		info := &aofInfo{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				info.name = fields[i+1]
+			case "seq":
+				seq, err := strconv.Atoi(fields[i+1])
+				if err != nil {
+					return nil, errors.New("invalid manifest line: " + line)
+				}
+				info.seq = seq
+			case "type":
+				info.fileType = fields[i+1]
+			}
+		}
+		// 文件名来自清单本身，不能指向目录之外
+		if info.name == "" || info.name != filepath.Base(info.name) {
+			return nil, errors.New("invalid manifest line: " + line)
+		}
+		switch info.fileType {
+		case baseFileType:
+			if m.base != nil {
+				return nil, errors.New("manifest contains more than one base file")
+			}
+			m.base = info
+		case incrFileType:
+			m.incrs = append(m.incrs, info)
+		default:
+			return nil, errors.New("invalid manifest line: " + line)
+		}
+	}
+	return m, scanner.Err()
+}
+
+// readManifest 读取清单文件，文件不存在时返回 nil
+func readManifest(filename string) (*manifest, error) {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(data)
+}
+
+// aofDir 返回保存 AOF 文件的目录，与 appendfilename 位于同一目录下
+func aofDir(filename string) string {
+	dirname := config.Properties.AppendDirname
+	if dirname == "" {
+		dirname = defaultAppendDirname
+	}
+	return filepath.Join(filepath.Dir(filename), dirname)
+}
+
+func (h *Handler) path(name string) string {
+	return filepath.Join(h.dir, name)
+}
+
+func (h *Handler) manifestPath() string {
+	return h.path(h.baseName + manifestSuffix)
+}
+
+func (h *Handler) newBaseInfo(seq int, useRDB bool) *aofInfo {
+	ext := "aof"
+	if useRDB {
+		ext = "rdb"
+	}
+	return &aofInfo{
+		name:     fmt.Sprintf("%s.%d.base.%s", h.baseName, seq, ext),
+		seq:      seq,
+		fileType: baseFileType,
+	}
+}
+
+func (h *Handler) newIncrInfo(seq int) *aofInfo {
+	return &aofInfo{
+		name:     fmt.Sprintf("%s.%d.incr.aof", h.baseName, seq),
+		seq:      seq,
+		fileType: incrFileType,
+	}
+}
+
+// persistManifest 把清单写入临时文件并 fsync 之后再替换原有的清单，返回错误时原有的清单仍然有效
+func (h *Handler) persistManifest(m *manifest) error {
+	file, err := os.CreateTemp(h.dir, tempFilePrefix+"*"+manifestSuffix)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(m.encode())
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), h.manifestPath())
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+	// 重命名已经完成，目录 fsync 失败不影响清单本身的完整性
+	if err := syncDir(h.dir); err != nil {
+		logger.Warn("fsync aof dir failed: " + err.Error())
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	return d.Sync()
+}
+
+// openManifest 读取清单，不存在时从旧版本的单个 AOF 文件升级，并保证至少有一个可以写入的增量文件
+func (h *Handler) openManifest(legacyFilename string) error {
+	if err := os.MkdirAll(h.dir, 0755); err != nil {
+		return err
+	}
+	m, err := readManifest(h.manifestPath())
+	if err != nil {
+		return err
+	}
+	upgraded := false
+	if m == nil {
+		m = &manifest{}
+		if _, err := os.Stat(legacyFilename); err == nil {
+			// 通过硬链接把旧文件作为基础文件，清单写入之前崩溃时旧文件仍然完整
+			base := h.newBaseInfo(1, false)
+			_ = os.Remove(h.path(base.name))
+			if err := os.Link(legacyFilename, h.path(base.name)); err != nil {
+				return err
+			}
+			m.base = base
+			upgraded = true
+		}
+	}
+	if m.lastIncr() == nil {
+		incr := h.newIncrInfo(1)
+		file, err := os.OpenFile(h.path(incr.name), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			return err
+		}
+		_ = file.Close()
+		m.incrs = append(m.incrs, incr)
+		if err := h.persistManifest(m); err != nil {
+			return err
+		}
+	}
+	if upgraded {
+		logger.Info("upgraded " + legacyFilename + " to multi part aof in " + h.dir)
+		_ = os.Remove(legacyFilename)
+	}
+	h.manifest = m
+	return nil
+}
+
+// removeStaleFiles 删除重写中途退出时残留的临时文件以及不再被清单引用的旧文件
+func (h *Handler) removeStaleFiles() {
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	inUse := map[string]bool{h.baseName + manifestSuffix: true}
+	for _, info := range h.manifest.files() {
+		inUse[info.name] = true
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || inUse[name] {
+			continue
+		}
+		if strings.HasPrefix(name, tempFilePrefix) || strings.HasPrefix(name, h.baseName+".") {
+			if err := os.Remove(h.path(name)); err != nil {
+				logger.Warn(err)
+			}
+		}
+	}
+}
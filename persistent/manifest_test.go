@@ -0,0 +1,40 @@
+package persistent
+
+import (
+	"testing"
+)
+
+func TestManifestEncode(t *testing.T) {
+	m := &manifest{
+		base: &aofInfo{name: "appendonly.aof.2.base.rdb", seq: 2, fileType: baseFileType},
+		incrs: []*aofInfo{
+			{name: "appendonly.aof.3.incr.aof", seq: 3, fileType: incrFileType},
+			{name: "appendonly.aof.4.incr.aof", seq: 4, fileType: incrFileType},
+		},
+	}
+	parsed, err := parseManifest(m.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.base.isRDB() || parsed.base.seq != 2 {
+		t.Errorf("unexpected base %+v", parsed.base)
+	}
+	if len(parsed.incrs) != 2 || parsed.lastIncr().name != "appendonly.aof.4.incr.aof" {
+		t.Errorf("unexpected incr files %+v", parsed.incrs)
+	}
+}
+
+func TestParseInvalidManifest(t *testing.T) {
+	invalid := []string{
+		"file appendonly.aof.1.base.aof seq 1\n",
+		"file ../appendonly.aof seq 1 type i\n",
+		"file a seq 1 type b\nfile b seq 2 type b\n",
+		"file a seq x type i\n",
+		"file a seq 1 type i extra\n",
+	}
+	for _, data := range invalid {
+		if _, err := parseManifest([]byte(data)); err == nil {
+			t.Errorf("expected error for %q", data)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"godis-learn/datastruct/dict"
 	"godis-learn/datastruct/list"
 	"godis-learn/datastruct/set"
+	"godis-learn/datastruct/stream"
 	"godis-learn/interface/dbinterface"
 	"godis-learn/interface/redis"
 	"godis-learn/redis/protocol"
@@ -15,6 +16,10 @@ func ValueToReply(key string, val *dbinterface.EntryValue) redis.Reply {
 	if val == nil {
 		return nil
 	}
+	return protocol.ArrayReply(ValueToLine(key, val))
+}
+
+func ValueToLine(key string, val *dbinterface.EntryValue) redis.Line {
 	var data [][]byte
 	keyBytes := []byte(key)
 	switch v := val.V.(type) {
@@ -28,8 +33,14 @@ func ValueToReply(key string, val *dbinterface.EntryValue) redis.Reply {
 		data = hashToArgs(keyBytes, v)
 	case *set.SortedSet:
 		data = zsetToArgs(keyBytes, v)
+	case *stream.Stream:
+		data = streamToArgs(keyBytes, v)
 	}
-	return protocol.ArrayReply(data)
+	return data
+}
+
+func ExpireToLine(key string, expireTime time.Time) redis.Line {
+	return expireToArgs([]byte(key), expireTime)
 }
 
 func stringToArgs(key []byte, s []byte) [][]byte {
@@ -87,6 +98,12 @@ func zsetToArgs(key []byte, s *set.SortedSet) [][]byte {
 	return res
 }
 
+// streamToArgs 没有 stream 的写命令，使用 RESTORE 重建整个 stream
+func streamToArgs(key []byte, s *stream.Stream) [][]byte {
+	payload, _ := DumpValue(&dbinterface.EntryValue{V: s})
+	return [][]byte{{'R', 'E', 'S', 'T', 'O', 'R', 'E'}, key, {'0'}, payload, {'R', 'E', 'P', 'L', 'A', 'C', 'E'}}
+}
+
 func expireToArgs(key []byte, expireTime time.Time) [][]byte {
 	return [][]byte{
 		{'P', 'E', 'X', 'P', 'I', 'R', 'E', 'A', 'T'},
@@ -1,6 +1,9 @@
 package persistent
 
 import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
 	"github.com/hdt3213/rdb/core"
 	"github.com/hdt3213/rdb/encoder"
 	"github.com/hdt3213/rdb/model"
@@ -9,34 +12,97 @@ import (
 	"godis-learn/datastruct/list"
 	"godis-learn/datastruct/set"
 	"godis-learn/interface/dbinterface"
+	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"time"
 )
 
+// Rewrite2RDB 生成 RDB 文件，已经有重写或保存在进行时返回 ErrRewriteInProgress
 func (h *Handler) Rewrite2RDB() error {
-	var err error
-	if ctx, err := h.StartRewrite(); err == nil {
-		if err = h.rewrite2RDB(ctx); err == nil {
-			rdbFileName := config.Properties.RDBFilename
-			if rdbFileName == "" {
-				rdbFileName = "dump.rdb"
-			}
-			if err = ctx.tempFile.Close(); err == nil {
-				return os.Rename(ctx.tempFile.Name(), rdbFileName)
-			}
-		}
+	if !h.lockRewrite() {
+		return ErrRewriteInProgress
+	}
+	defer h.unlockRewrite()
+	return h.rewrite2RDBFile()
+}
+
+func (h *Handler) rewrite2RDBFile() error {
+	return SaveRDB(h.db, RDBFilename())
+}
+
+// RDBFilename 返回 dbfilename，未配置时为 dump.rdb
+func RDBFilename() string {
+	if config.Properties.RDBFilename == "" {
+		return "dump.rdb"
 	}
-	return err
+	return config.Properties.RDBFilename
 }
 
-func (h *Handler) rewrite2RDB(ctx *RewriteContext) error {
-	tempHandler := h.newRewriteHandler()
-	tempHandler.LoadAOF(int(ctx.fileSize))
-	encoderPtr := core.NewEncoder(ctx.tempFile).EnableCompress()
-	if err := encoderPtr.WriteHeader(); err != nil {
+// SaveRDB 把当前数据的快照写入同一目录下的临时文件，fsync 之后再重命名为 filename，
+// 保存失败时原有的文件不受影响
+func SaveRDB(db dbinterface.EmbedDB, filename string) error {
+	file, err := os.CreateTemp(filepath.Dir(filename), "temp-*.rdb")
+	if err != nil {
 		return err
 	}
+	if err = writeRDB(file, db.Snapshot(nil)); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), filename)
+}
+
+const (
+	rdbVersion = 9
+
+	rdbOpCodeExpireTimeMs = 0xFC
+	rdbOpCodeResizeDB     = 0xFB
+	rdbOpCodeAux          = 0xFA
+	rdbOpCodeSelectDB     = 0xFE
+	rdbOpCodeEOF          = 0xFF
+)
+
+// rdbWriter 写入 RDB 的各个部分，同时计算 Redis 使用的 CRC64 校验和。
+// 出错之后不再写入，错误由 flush 返回
+type rdbWriter struct {
+	writer *bufio.Writer
+	crc    uint64
+	err    error
+}
+
+func (w *rdbWriter) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = w.writer.Write(p)
+	w.crc = crc64Update(w.crc, p)
+}
+
+func (w *rdbWriter) flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.writer.Flush()
+}
+
+// WriteRDB 把快照编码为 RDB 写入 w，用于向副本发送全量同步的数据
+func WriteRDB(w io.Writer, snapshot dbinterface.Snapshot) error {
+	return writeRDB(w, snapshot)
+}
+
+// writeRDB 把快照编码为 RDB 写入文件。各个值由 encodeObject 编码，文件的其余部分在这里直接写入，
+// 不使用编码器的状态检查，因此集合等值可以不经过编码器写入
+func writeRDB(file io.Writer, snapshot dbinterface.Snapshot) error {
+	w := &rdbWriter{writer: bufio.NewWriter(file)}
+	w.write([]byte(fmt.Sprintf("REDIS%04d", rdbVersion)))
 	auxMap := map[string]string{
 		"redis-ver":    "6.0.0",
 		"redis-bits":   "64",
@@ -44,30 +110,43 @@ func (h *Handler) rewrite2RDB(ctx *RewriteContext) error {
 		"ctime":        strconv.FormatInt(time.Now().Unix(), 10),
 	}
 	for k, v := range auxMap {
-		if err := encoderPtr.WriteAux(k, v); err != nil {
-			return err
-		}
+		w.write(appendRDBString(appendRDBString([]byte{rdbOpCodeAux}, []byte(k)), []byte(v)))
 	}
 	for i := 0; i < config.Properties.DatabaseCount; i++ {
-		dataSize, ttlMapSize := tempHandler.db.GetDBSize(i)
+		dataSize, ttlMapSize := snapshot.GetDBSize(i)
 		if dataSize == 0 {
 			continue
 		}
-		if err := encoderPtr.WriteDBHeader(uint(i), uint64(dataSize), uint64(ttlMapSize)); err != nil {
-			return err
-		}
+		w.write(appendRDBLength([]byte{rdbOpCodeSelectDB}, uint64(i)))
+		w.write(appendRDBLength(appendRDBLength([]byte{rdbOpCodeResizeDB}, uint64(dataSize)), uint64(ttlMapSize)))
 		var err error
-		tempHandler.db.ForEach(i, func(key string, val *dbinterface.EntryValue, expireTime *time.Time) bool {
-			err = consumer(key, val, expireTime, encoderPtr)
-			return err == nil
+		snapshot.ForEach(i, func(key string, val *dbinterface.EntryValue, expireTime *time.Time) bool {
+			var object []byte
+			if object, err = encodeObject(val); err != nil {
+				err = fmt.Errorf("key %q in db %d: %w", key, i, err)
+				return false
+			}
+			if expireTime != nil {
+				w.write(binary.LittleEndian.AppendUint64([]byte{rdbOpCodeExpireTimeMs}, uint64(expireTime.UnixMilli())))
+			}
+			// 对象的格式为类型标识、key 以及值
+			w.write(object[:1])
+			w.write(appendRDBString(nil, []byte(key)))
+			w.write(object[1:])
+			return w.err == nil
 		})
 		if err != nil {
 			return err
 		}
 	}
-	return encoderPtr.WriteEnd()
+	w.write([]byte{rdbOpCodeEOF})
+	if w.err == nil {
+		_, w.err = w.writer.Write(binary.LittleEndian.AppendUint64(nil, w.crc))
+	}
+	return w.flush()
 }
 
+// consumer 使用编码器写入一个值，集合由 dumpSet 直接编码
 func consumer(key string, val *dbinterface.EntryValue, expireTime *time.Time, encoder *encoder.Encoder) error {
 	var opts []any
 	if expireTime != nil {
@@ -83,13 +162,6 @@ func consumer(key string, val *dbinterface.EntryValue, expireTime *time.Time, en
 			return true
 		})
 		return encoder.WriteListObject(key, res, opts...)
-	case *set.HashSet:
-		res := make([][]byte, 0, v.Size())
-		v.ForEach(func(s string) bool {
-			res = append(res, []byte(s))
-			return true
-		})
-		return encoder.WriteSetObject(key, res, opts...)
 	case dict.HashMap:
 		res := make(map[string][]byte)
 		v.ForEach(func(key string, s any) bool {
@@ -0,0 +1,442 @@
+package persistent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/hdt3213/rdb/lzf"
+	rdb "github.com/hdt3213/rdb/parser"
+	"godis-learn/datastruct/set"
+	"godis-learn/interface/dbinterface"
+	"io"
+	"strconv"
+	"time"
+)
+
+// RDB 对象的类型标识，解码器不支持的类型由 rdbFilter 解析
+const (
+	rdbTypeString         = 0
+	rdbTypeList           = 1
+	rdbTypeZSet           = 3
+	rdbTypeHash           = 4
+	rdbTypeZSet2          = 5
+	rdbTypeHashZipMap     = 9
+	rdbTypeListZipList    = 10
+	rdbTypeZSetZipList    = 12
+	rdbTypeHashZipList    = 13
+	rdbTypeListQuickList  = 14
+	rdbTypeStream         = 15
+	rdbTypeHashListPack   = 16
+	rdbTypeZSetListPack   = 17
+	rdbTypeListQuickList2 = 18
+	rdbTypeStream2        = 19
+	rdbTypeSetListPack    = 20
+	rdbTypeStream3        = 21
+
+	rdbOpCodeIdle       = 0xF8
+	rdbOpCodeFreq       = 0xF9
+	rdbOpCodeExpireTime = 0xFD
+
+	// rdbMaxVersion 是可以加载的最高 RDB 版本，即 Redis 7.2
+	rdbMaxVersion = 11
+)
+
+// rdbValueReader 读取 RDB 中的长度和字符串，并记录读过的原始数据
+type rdbValueReader struct {
+	reader *bufio.Reader
+	raw    []byte
+}
+
+func newRDBValueReader(reader io.Reader) *rdbValueReader {
+	buffered, ok := reader.(*bufio.Reader)
+	if !ok {
+		buffered = bufio.NewReader(reader)
+	}
+	return &rdbValueReader{reader: buffered}
+}
+
+func (r *rdbValueReader) readByte() (byte, error) {
+	b, err := r.reader.ReadByte()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	r.raw = append(r.raw, b)
+	return b, nil
+}
+
+func (r *rdbValueReader) readFull(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r.reader, buf); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	r.raw = append(r.raw, buf...)
+	return buf, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readLength 读取长度编码，special 表示之后是整数或者 LZF 压缩的字符串
+func (r *rdbValueReader) readLength() (length uint64, special bool, err error) {
+	first, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch first >> 6 {
+	case 0:
+		return uint64(first & 0x3F), false, nil
+	case 1:
+		next, err := r.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(first&0x3F)<<8 | uint64(next), false, nil
+	case 3:
+		return uint64(first & 0x3F), true, nil
+	}
+	switch first {
+	case 0x80:
+		buf, err := r.readFull(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf)), false, nil
+	case 0x81:
+		buf, err := r.readFull(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(buf), false, nil
+	}
+	return 0, false, fmt.Errorf("illegal length encoding 0x%x", first)
+}
+
+func (r *rdbValueReader) readUint() (uint64, error) {
+	n, special, err := r.readLength()
+	if err == nil && special {
+		err = errors.New("unexpected string encoding in length")
+	}
+	return n, err
+}
+
+func (r *rdbValueReader) readString() ([]byte, error) {
+	length, special, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if !special {
+		return r.readFull(int(length))
+	}
+	switch length {
+	case 0, 1, 2:
+		buf, err := r.readFull(1 << length)
+		if err != nil {
+			return nil, err
+		}
+		var n int64
+		switch length {
+		case 0:
+			n = int64(int8(buf[0]))
+		case 1:
+			n = int64(int16(binary.LittleEndian.Uint16(buf)))
+		default:
+			n = int64(int32(binary.LittleEndian.Uint32(buf)))
+		}
+		return []byte(strconv.FormatInt(n, 10)), nil
+	case 3:
+		compressedLen, err := r.readUint()
+		if err != nil {
+			return nil, err
+		}
+		rawLen, err := r.readUint()
+		if err != nil {
+			return nil, err
+		}
+		compressed, err := r.readFull(int(compressedLen))
+		if err != nil {
+			return nil, err
+		}
+		return lzf.Decompress(compressed, int(compressedLen), int(rawLen))
+	}
+	return nil, fmt.Errorf("unknown string encoding %d", length)
+}
+
+// readMillisecondTime 读取 8 字节小端序的毫秒时间戳
+func (r *rdbValueReader) readMillisecondTime() (int64, error) {
+	buf, err := r.readFull(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
+
+// skipValue 跳过解码器可以处理的值，只记录原始数据
+func (r *rdbValueReader) skipValue(typ byte) error {
+	var count, perItem uint64
+	switch typ {
+	case rdbTypeString, rdbTypeHashZipMap, rdbTypeListZipList, rdbTypeIntSet, rdbTypeZSetZipList,
+		rdbTypeHashZipList, rdbTypeHashListPack, rdbTypeZSetListPack:
+		_, err := r.readString()
+		return err
+	case rdbTypeList, rdbTypeSet, rdbTypeListQuickList:
+		perItem = 1
+	case rdbTypeHash:
+		perItem = 2
+	case rdbTypeZSet, rdbTypeZSet2:
+		return r.skipZSet(typ)
+	case rdbTypeListQuickList2:
+		n, err := r.readUint()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			// 每个节点是容器类型加上节点的数据
+			if _, err := r.readUint(); err != nil {
+				return err
+			}
+			if _, err := r.readString(); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported rdb object type %d", typ)
+	}
+	n, err := r.readUint()
+	if err != nil {
+		return err
+	}
+	for count = n * perItem; count > 0; count-- {
+		if _, err := r.readString(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *rdbValueReader) skipZSet(typ byte) error {
+	n, err := r.readUint()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < n; i++ {
+		if _, err := r.readString(); err != nil {
+			return err
+		}
+		if typ == rdbTypeZSet2 {
+			_, err = r.readFull(8)
+		} else {
+			// 旧格式的分数是 1 字节长度加字符串，253、254、255 分别表示 NaN、正无穷和负无穷
+			var scoreLen byte
+			if scoreLen, err = r.readByte(); err == nil && scoreLen < 253 {
+				_, err = r.readFull(int(scoreLen))
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSetListPack 读取 Redis 7.2 引入的 listpack 编码的集合
+func (r *rdbValueReader) readSetListPack() (*dbinterface.EntryValue, error) {
+	buf, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+	members, err := parseListPack(buf)
+	if err != nil {
+		return nil, err
+	}
+	s := set.NewHashSet()
+	for _, member := range members {
+		s.Add(string(member))
+	}
+	return &dbinterface.EntryValue{V: s}, nil
+}
+
+// readValue 读取解码器不支持的值，其它类型返回 nil
+func (r *rdbValueReader) readValue(typ byte) (*dbinterface.EntryValue, error) {
+	switch typ {
+	case rdbTypeStream, rdbTypeStream2, rdbTypeStream3:
+		s, err := r.readStream(typ)
+		if err != nil {
+			return nil, err
+		}
+		return &dbinterface.EntryValue{V: s}, nil
+	case rdbTypeSetListPack:
+		return r.readSetListPack()
+	}
+	return nil, nil
+}
+
+// ObjectConsumer 接收 RDB 中的一个 key，expiration 为 nil 表示没有过期时间
+type ObjectConsumer func(dbIndex int, key string, val *dbinterface.EntryValue, expiration *time.Time) error
+
+// rdbFilter 逐个读取 RDB 中的对象，自己解析解码器不支持的对象交给 consumer，其余部分原样交给解码器。
+// 读到 EOF 操作码之后不再从底层读取，不会读到 RDB 之后的内容
+type rdbFilter struct {
+	input    *rdbValueReader
+	consumer ObjectConsumer
+	pending  []byte
+	dbIndex  int
+	started  bool
+	done     bool
+	err      error
+}
+
+func (f *rdbFilter) Read(p []byte) (int, error) {
+	for len(f.pending) == 0 {
+		if f.err != nil {
+			return 0, f.err
+		}
+		if f.done {
+			return 0, io.EOF
+		}
+		f.err = f.next()
+	}
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+// next 读取文件头或者一个完整的部分放入 pending。过期时间等操作码属于之后的对象，与对象一起处理
+func (f *rdbFilter) next() error {
+	r := f.input
+	r.raw = r.raw[:0]
+	if !f.started {
+		f.started = true
+		header, err := r.readFull(9)
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(header, []byte(rdbMagic)) {
+			return errors.New("file is not a RDB file")
+		}
+		version, err := strconv.Atoi(string(header[len(rdbMagic):]))
+		if err != nil || version < 1 || version > rdbMaxVersion {
+			return fmt.Errorf("unsupported rdb version %q", header[len(rdbMagic):])
+		}
+		// 解码器只接受版本 10 以下的文件，之后的版本只增加了对象类型，由这里解析
+		f.pending = append(f.pending, fmt.Sprintf("%s%04d", rdbMagic, rdbVersion)...)
+		return nil
+	}
+	var expiration *time.Time
+	for {
+		opCode, err := r.readByte()
+		if err != nil {
+			return err
+		}
+		switch opCode {
+		case rdbOpCodeEOF:
+			f.done = true
+			f.pending = append(f.pending, r.raw...)
+			return nil
+		case rdbOpCodeSelectDB:
+			dbIndex, err := r.readUint()
+			if err != nil {
+				return err
+			}
+			f.dbIndex = int(dbIndex)
+			f.pending = append(f.pending, r.raw...)
+			return nil
+		case rdbOpCodeResizeDB:
+			if _, err := r.readUint(); err != nil {
+				return err
+			}
+			if _, err := r.readUint(); err != nil {
+				return err
+			}
+			f.pending = append(f.pending, r.raw...)
+			return nil
+		case rdbOpCodeAux:
+			if _, err := r.readString(); err != nil {
+				return err
+			}
+			if _, err := r.readString(); err != nil {
+				return err
+			}
+			f.pending = append(f.pending, r.raw...)
+			return nil
+		case rdbOpCodeExpireTime:
+			buf, err := r.readFull(4)
+			if err != nil {
+				return err
+			}
+			t := time.Unix(int64(binary.LittleEndian.Uint32(buf)), 0)
+			expiration = &t
+			continue
+		case rdbOpCodeExpireTimeMs:
+			ms, err := r.readMillisecondTime()
+			if err != nil {
+				return err
+			}
+			t := time.UnixMilli(ms)
+			expiration = &t
+			continue
+		case rdbOpCodeIdle:
+			if _, err := r.readUint(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpCodeFreq:
+			if _, err := r.readByte(); err != nil {
+				return err
+			}
+			continue
+		}
+		if opCode >= 0xF0 {
+			return fmt.Errorf("unsupported rdb opcode 0x%x", opCode)
+		}
+		key, err := r.readString()
+		if err != nil {
+			return err
+		}
+		val, err := r.readValue(opCode)
+		if err != nil {
+			return fmt.Errorf("key %q in db %d: %w", key, f.dbIndex, err)
+		}
+		if val != nil {
+			return f.consumer(f.dbIndex, string(key), val, expiration)
+		}
+		if err = r.skipValue(opCode); err != nil {
+			return fmt.Errorf("key %q in db %d: %w", key, f.dbIndex, err)
+		}
+		f.pending = append(f.pending, r.raw...)
+		return nil
+	}
+}
+
+// ParseRDB 解析 RDB 并把每个 key 交给 consumer，遇到不支持的对象或者 consumer 返回错误时停止。
+// reader 为 *bufio.Reader 时不会读取 RDB 之后的内容
+func ParseRDB(reader io.Reader, consumer ObjectConsumer) error {
+	filter := &rdbFilter{
+		input:    newRDBValueReader(reader),
+		consumer: consumer,
+	}
+	var consumeErr error
+	err := rdb.NewDecoder(filter).Parse(func(obj rdb.RedisObject) bool {
+		val, err := ObjectToValue(obj)
+		if err == nil {
+			err = consumer(obj.GetDBIndex(), obj.GetKey(), val, obj.GetExpiration())
+		} else {
+			err = fmt.Errorf("key %q in db %d: %w", obj.GetKey(), obj.GetDBIndex(), err)
+		}
+		consumeErr = err
+		return err == nil
+	})
+	switch {
+	case filter.err != nil:
+		return filter.err
+	case consumeErr != nil:
+		return consumeErr
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+package persistent
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"godis-learn/interface/redis"
+	"io"
+	"strconv"
+)
+
+// rdbMagic 是 RDB 文件的开头，以它开头的 AOF 文件带有 RDB 前导部分
+const rdbMagic = "REDIS"
+
+// errTruncated 表示文件在一条命令的中间结束，通常是断电时最后一次写入不完整
+var errTruncated = errors.New("unexpected end of file")
+
+// formatError 表示 AOF 中出现了不完整写入以外的损坏
+type formatError struct {
+	offset int64
+	msg    string
+}
+
+func (e *formatError) Error() string {
+	return fmt.Sprintf("bad file format at offset %d: %s", e.offset, e.msg)
+}
+
+// countingReader 记录从底层读取的字节数
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// aofReader 逐条读取 AOF 中的命令，并记录读取的字节数，用于定位损坏或者截断的位置
+type aofReader struct {
+	input  *countingReader
+	reader *bufio.Reader
+	offset int64
+}
+
+func newAOFReader(reader io.Reader) *aofReader {
+	input := &countingReader{reader: reader}
+	return &aofReader{
+		input:  input,
+		reader: bufio.NewReader(input),
+	}
+}
+
+// readPreamble 在文件以 RDB 开头时交给 load 解析 RDB 部分，并跳过之后的校验和，返回是否存在 RDB 部分。
+// load 直接使用 aofReader 的缓冲区，不会多读，因此之后可以继续读取命令
+func (r *aofReader) readPreamble(load func(reader io.Reader) error) (bool, error) {
+	magic, err := r.reader.Peek(len(rdbMagic))
+	if err != nil || string(magic) != rdbMagic {
+		return false, nil
+	}
+	if err := load(r.reader); err != nil {
+		return true, err
+	}
+	// 解码器读到 EOF 操作码就结束了，8 字节的校验和还没有读取
+	r.offset = r.input.n - int64(r.reader.Buffered())
+	n, err := r.reader.Discard(8)
+	r.offset += int64(n)
+	if err != nil {
+		return true, r.formatError("rdb preamble is missing its checksum")
+	}
+	// 以前使用编码器生成的 RDB 在校验和之后多写了一个换行
+	if next, err := r.reader.Peek(1); err == nil && next[0] == '\n' {
+		_, _ = r.reader.Discard(1)
+		r.offset++
+	}
+	return true, nil
+}
+
+// readCommand 读取一条完整的命令，文件在命令之间结束时返回 io.EOF，在命令中间结束时返回 errTruncated
+func (r *aofReader) readCommand() (redis.Line, error) {
+	if _, err := r.reader.Peek(1); err == io.EOF {
+		return nil, io.EOF
+	}
+	header, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != '*' {
+		return nil, r.formatError("expected '*', got %q", header)
+	}
+	count, err := strconv.Atoi(string(header[1:]))
+	if err != nil || count <= 0 {
+		return nil, r.formatError("invalid argument count %q", header)
+	}
+	line := make(redis.Line, count)
+	for i := range line {
+		header, err = r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if header[0] != '$' {
+			return nil, r.formatError("expected '$', got %q", header)
+		}
+		size, err := strconv.Atoi(string(header[1:]))
+		if err != nil || size < 0 {
+			return nil, r.formatError("invalid bulk length %q", header)
+		}
+		body := make([]byte, size+2)
+		n, err := io.ReadFull(r.reader, body)
+		r.offset += int64(n)
+		if err != nil {
+			return nil, errTruncated
+		}
+		if body[size] != '\r' || body[size+1] != '\n' {
+			return nil, r.formatError("bulk string is not terminated by CRLF")
+		}
+		line[i] = body[:size]
+	}
+	return line, nil
+}
+
+// readLine 读取一行并去掉末尾的 CRLF
+func (r *aofReader) readLine() ([]byte, error) {
+	line, err := r.reader.ReadBytes('\n')
+	r.offset += int64(len(line))
+	if err == io.EOF {
+		return nil, errTruncated
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, r.formatError("line is not terminated by CRLF")
+	}
+	return line[:len(line)-2], nil
+}
+
+func (r *aofReader) formatError(format string, args ...any) error {
+	return &formatError{
+		offset: r.offset,
+		msg:    fmt.Sprintf(format, args...),
+	}
+}
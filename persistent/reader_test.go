@@ -0,0 +1,101 @@
+package persistent
+
+import (
+	"bytes"
+	"errors"
+	"github.com/hdt3213/rdb/encoder"
+	"godis-learn/interface/dbinterface"
+	"godis-learn/lib/utils"
+	"godis-learn/redis/protocol"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestAOFReader(t *testing.T) {
+	first := protocol.ArrayReply(utils.StringsToLine("SET", "a", "1\r\n")).GetBytes()
+	second := protocol.ArrayReply(utils.StringsToLine("SET", "b", "2")).GetBytes()
+	data := append(append([]byte{}, first...), second...)
+
+	reader := newAOFReader(bytes.NewReader(data))
+	for _, expected := range []int{len(first), len(data)} {
+		if _, err := reader.readCommand(); err != nil {
+			t.Fatal(err)
+		}
+		if reader.offset != int64(expected) {
+			t.Errorf("expected offset %d, got %d", expected, reader.offset)
+		}
+	}
+	if _, err := reader.readCommand(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	// 任意位置截断都只能读出截断之前的完整命令
+	for i := len(first) + 1; i < len(data); i++ {
+		reader = newAOFReader(bytes.NewReader(data[:i]))
+		if _, err := reader.readCommand(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reader.readCommand(); err != errTruncated {
+			t.Errorf("expected truncated error when cut at %d, got %v", i, err)
+		}
+	}
+
+	corrupted := append(append([]byte{}, first...), []byte("*2\r\n$3\r\nGET\r\n+OK\r\n")...)
+	reader = newAOFReader(bytes.NewReader(corrupted))
+	_, _ = reader.readCommand()
+	_, err := reader.readCommand()
+	var formatErr *formatError
+	if !errors.As(err, &formatErr) || formatErr.offset != int64(len(first)+18) {
+		t.Errorf("expected format error at offset %d, got %v", len(first)+18, err)
+	}
+}
+
+func TestAOFReaderPreamble(t *testing.T) {
+	preamble := &bytes.Buffer{}
+	enc := encoder.NewEncoder(preamble)
+	if err := enc.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteDBHeader(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteStringObject("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteEnd(); err != nil {
+		t.Fatal(err)
+	}
+	tail := protocol.ArrayReply(utils.StringsToLine("SET", "b", "2")).GetBytes()
+	data := append(append([]byte{}, preamble.Bytes()...), tail...)
+
+	var keys []string
+	load := func(reader io.Reader) error {
+		return ParseRDB(reader, func(_ int, key string, _ *dbinterface.EntryValue, _ *time.Time) error {
+			keys = append(keys, key)
+			return nil
+		})
+	}
+	reader := newAOFReader(bytes.NewReader(data))
+	if ok, err := reader.readPreamble(load); !ok || err != nil {
+		t.Fatalf("expected rdb preamble to be loaded, got %v %v", ok, err)
+	}
+	if len(keys) != 1 || keys[0] != "a" {
+		t.Errorf("expected key a in rdb preamble, got %v", keys)
+	}
+	if reader.offset != int64(preamble.Len()) {
+		t.Errorf("expected offset %d after rdb preamble, got %d", preamble.Len(), reader.offset)
+	}
+	line, err := reader.readCommand()
+	if err != nil || string(line[1]) != "b" {
+		t.Fatalf("expected command after rdb preamble, got %q %v", line, err)
+	}
+	if reader.offset != int64(len(data)) {
+		t.Errorf("expected offset %d, got %d", len(data), reader.offset)
+	}
+
+	reader = newAOFReader(bytes.NewReader(tail))
+	if ok, err := reader.readPreamble(load); ok || err != nil || reader.offset != 0 {
+		t.Errorf("expected no rdb preamble, got %v %v at offset %d", ok, err, reader.offset)
+	}
+}
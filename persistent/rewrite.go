@@ -6,116 +6,144 @@ import (
 	"godis-learn/lib/logger"
 	"godis-learn/lib/utils"
 	"godis-learn/redis/protocol"
-	"io"
 	"os"
 	"strconv"
 	"time"
 )
 
-func (h *Handler) newRewriteHandler() *Handler {
-	return &Handler{
-		aofFilename: h.aofFilename,
-		db:          h.tempProducer(),
-	}
-}
-
 type RewriteContext struct {
 	tempFile *os.File
-	fileSize int64
-	dbIndex  int
+	// useRDB 表示新的基础文件使用 RDB 格式
+	useRDB bool
 }
 
+// Rewrite 重写 AOF，已经有重写或保存在进行时返回 ErrRewriteInProgress
 func (h *Handler) Rewrite() error {
-	var err error
-	if ctx, err := h.StartRewrite(); err == nil {
-		if err = h.DoRewrite(ctx); err == nil {
-			return h.FinishRewrite(ctx)
-		}
+	if !h.lockRewrite() {
+		return ErrRewriteInProgress
+	}
+	defer h.unlockRewrite()
+	return h.rewrite()
+}
+
+func (h *Handler) rewrite() error {
+	ctx, err := h.StartRewrite()
+	if err != nil {
+		return err
+	}
+	if err = h.DoRewrite(ctx); err == nil {
+		err = h.FinishRewrite(ctx)
+	}
+	if err != nil {
+		h.abortRewrite(ctx)
 	}
 	return err
 }
 
 func (h *Handler) StartRewrite() (*RewriteContext, error) {
-	h.aofMutex.Lock()
-	defer h.aofMutex.Unlock()
-	if err := h.aofFile.Sync(); err != nil {
-		logger.Warn("fsync failed")
-		return nil, err
-	}
-	fileInfo, _ := os.Stat(h.aofFilename)
-	fileSize := fileInfo.Size()
-	file, err := os.CreateTemp("", "*.aof")
+	// 临时文件与 AOF 放在同一目录下才能直接重命名
+	file, err := os.CreateTemp(h.dir, tempFilePrefix+"rewrite-*")
 	if err != nil {
 		logger.Warn("tmp file create failed")
 		return nil, err
 	}
 	return &RewriteContext{
 		tempFile: file,
-		fileSize: fileSize,
-		dbIndex:  h.currentIndex,
+		useRDB:   config.Properties.AOFUseRDBPreamble,
 	}, nil
 }
 
+// DoRewrite 在快照的时刻切换到新的增量文件，再把快照写入临时文件，
+// 快照之前的命令都在原有的文件中，之后的命令都在新的增量文件中
 func (h *Handler) DoRewrite(ctx *RewriteContext) error {
-	tempFile := ctx.tempFile
-	tempAOF := h.newRewriteHandler()
-	tempAOF.LoadAOF(int(ctx.fileSize))
+	marker := &payload{rewriteMark: make(chan error, 1)}
+	snapshot := h.db.Snapshot(func() {
+		h.aofChan <- marker
+	})
+	if err := <-marker.rewriteMark; err != nil {
+		return err
+	}
+	var err error
+	if ctx.useRDB {
+		err = writeRDB(ctx.tempFile, snapshot)
+	} else {
+		err = writeSnapshot(ctx.tempFile, snapshot)
+	}
+	if err != nil {
+		return err
+	}
+	return ctx.tempFile.Sync()
+}
+
+func writeSnapshot(file *os.File, snapshot dbinterface.Snapshot) error {
+	var err error
 	for i := 0; i < config.Properties.DatabaseCount; i++ {
 		data := protocol.ArrayReply(utils.StringsToLine("SELECT", strconv.Itoa(i))).GetBytes()
-		if _, err := tempFile.Write(data); err != nil {
+		if _, err = file.Write(data); err != nil {
 			return err
 		}
-		tempAOF.db.ForEach(i, func(key string, val *dbinterface.EntryValue, expiration *time.Time) bool {
+		snapshot.ForEach(i, func(key string, val *dbinterface.EntryValue, expiration *time.Time) bool {
 			if cmd := ValueToReply(key, val); cmd != nil {
-				_, _ = tempFile.Write(cmd.GetBytes())
+				if _, err = file.Write(cmd.GetBytes()); err != nil {
+					return false
+				}
 			}
 			if expiration != nil {
 				if expireArgs := expireToArgs([]byte(key), *expiration); expireArgs != nil {
-					_, _ = tempFile.Write(protocol.ArrayReply(expireArgs).GetBytes())
+					if _, err = file.Write(protocol.ArrayReply(expireArgs).GetBytes()); err != nil {
+						return false
+					}
 				}
 			}
 			return true
 		})
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// FinishRewrite 把临时文件作为新的基础文件写入清单，然后删除不再需要的旧文件，
+// 新清单写入之前崩溃时旧清单中的文件仍然完整
 func (h *Handler) FinishRewrite(ctx *RewriteContext) error {
+	if err := ctx.tempFile.Close(); err != nil {
+		return err
+	}
 	h.aofMutex.Lock()
 	defer h.aofMutex.Unlock()
-	tempFile := ctx.tempFile
-	src, err := os.Open(h.aofFilename)
-	if err != nil {
-		logger.Error("open aofFilename failed: " + err.Error())
-		return err
+	old := h.manifest
+	seq := 1
+	if old.base != nil {
+		seq = old.base.seq + 1
 	}
-	defer func(f *os.File) {
-		_ = f.Close()
-	}(src)
-	_, err = src.Seek(ctx.fileSize, 0)
-	if err != nil {
-		logger.Error("seek failed: " + err.Error())
+	base := h.newBaseInfo(seq, ctx.useRDB)
+	if err := os.Rename(ctx.tempFile.Name(), h.path(base.name)); err != nil {
+		logger.Error("rename aof base file failed: " + err.Error())
 		return err
 	}
-	data := protocol.ArrayReply(utils.StringsToLine("SELECT", strconv.Itoa(ctx.dbIndex))).GetBytes()
-	if _, err = tempFile.Write(data); err != nil {
-		logger.Error("tmp file rewrite failed: " + err.Error())
-		return err
+	// 重写不会同时进行，最后一个增量文件就是 DoRewrite 切换的文件
+	updated := &manifest{
+		base:  base,
+		incrs: []*aofInfo{old.lastIncr()},
 	}
-	if _, err = io.Copy(tempFile, src); err != nil {
-		logger.Error("copy aof file failed: " + err.Error())
+	if err := h.persistManifest(updated); err != nil {
+		// 未被引用的基础文件在下次启动时删除
+		logger.Error("persist aof manifest failed: " + err.Error())
 		return err
 	}
-	_ = h.aofFile.Close()
-	_ = os.Rename(tempFile.Name(), h.aofFilename)
-	aofFile, err := os.OpenFile(h.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
-	if err != nil {
-		panic(err)
-	}
-	data = protocol.ArrayReply(utils.StringsToLine("SELECT", strconv.Itoa(h.currentIndex))).GetBytes()
-	if _, err = aofFile.Write(data); err != nil {
-		panic(err)
+	h.manifest = updated
+	for _, info := range old.files()[:len(old.files())-1] {
+		if err := os.Remove(h.path(info.name)); err != nil {
+			logger.Warn(err)
+		}
 	}
-	h.aofFile = aofFile
+	h.resetSize()
 	return nil
 }
+
+// abortRewrite 删除临时文件，切换出的增量文件仍然保留在清单中
+func (h *Handler) abortRewrite(ctx *RewriteContext) {
+	_ = ctx.tempFile.Close()
+	_ = os.Remove(ctx.tempFile.Name())
+}
@@ -0,0 +1,360 @@
+package persistent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"godis-learn/datastruct/stream"
+	"sort"
+	"strconv"
+)
+
+// stream 在 RDB 中保存为以起始 ID 为 key 的一组 listpack 节点，之后是长度、最后的 ID 以及消费组。
+// 每个节点的 listpack 以主条目开头：有效条目数、已删除条目数、字段数、各个字段以及 0，
+// 之后的每个条目为标志、相对起始 ID 的 ms 与 seq 差值、字段和值以及条目占用的元素数
+const (
+	streamItemDeleted    = 1
+	streamItemSameFields = 2
+	// streamNodeMaxEntries 与 Redis 的 stream-node-max-entries 默认值相同
+	streamNodeMaxEntries = 100
+)
+
+var errBadStream = errors.New("bad stream")
+
+func (r *rdbValueReader) readStreamID() (stream.ID, error) {
+	ms, err := r.readUint()
+	if err != nil {
+		return stream.ID{}, err
+	}
+	seq, err := r.readUint()
+	return stream.ID{Ms: ms, Seq: seq}, err
+}
+
+// readRawStreamID 读取 16 字节大端序的 ID，用于节点的 key 和待确认条目
+func (r *rdbValueReader) readRawStreamID() (stream.ID, error) {
+	buf, err := r.readFull(16)
+	if err != nil {
+		return stream.ID{}, err
+	}
+	return decodeStreamID(buf)
+}
+
+func decodeStreamID(buf []byte) (stream.ID, error) {
+	if len(buf) != 16 {
+		return stream.ID{}, errBadStream
+	}
+	return stream.ID{Ms: binary.BigEndian.Uint64(buf), Seq: binary.BigEndian.Uint64(buf[8:])}, nil
+}
+
+func appendRawStreamID(buf []byte, id stream.ID) []byte {
+	return binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(buf, id.Ms), id.Seq)
+}
+
+// readStream 读取三种格式的 stream。之后的格式多出的首个 ID、删除的最大 ID、添加过的条目数、
+// 消费组已读的条目数以及消费者的活跃时间只在读取时跳过
+func (r *rdbValueReader) readStream(typ byte) (*stream.Stream, error) {
+	s := stream.New()
+	nodes, err := r.readUint()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < nodes; i++ {
+		nodeKey, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		master, err := decodeStreamID(nodeKey)
+		if err != nil {
+			return nil, err
+		}
+		lp, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		if err = readStreamNode(s, master, lp); err != nil {
+			return nil, err
+		}
+	}
+	length, err := r.readUint()
+	if err != nil {
+		return nil, err
+	}
+	if int(length) != s.Len() {
+		return nil, fmt.Errorf("stream length %d does not match %d entries", length, s.Len())
+	}
+	if s.LastID, err = r.readStreamID(); err != nil {
+		return nil, err
+	}
+	if typ != rdbTypeStream {
+		// first_id、max_deleted_entry_id 以及 entries_added
+		for i := 0; i < 5; i++ {
+			if _, err := r.readUint(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	groups, err := r.readUint()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < groups; i++ {
+		group, err := r.readStreamGroup(typ)
+		if err != nil {
+			return nil, err
+		}
+		s.Groups = append(s.Groups, group)
+	}
+	return s, nil
+}
+
+func readStreamNode(s *stream.Stream, master stream.ID, lp []byte) error {
+	elements, err := parseListPack(lp)
+	if err != nil {
+		return err
+	}
+	cursor := 0
+	next := func() (int64, error) {
+		if cursor >= len(elements) {
+			return 0, errBadStream
+		}
+		cursor++
+		return strconv.ParseInt(string(elements[cursor-1]), 10, 64)
+	}
+	count, err := next()
+	if err != nil {
+		return err
+	}
+	deleted, err := next()
+	if err != nil {
+		return err
+	}
+	numFields, err := next()
+	if err != nil || numFields < 0 || cursor+int(numFields) > len(elements) {
+		return errBadStream
+	}
+	masterFields := elements[cursor : cursor+int(numFields)]
+	cursor += int(numFields)
+	// 主条目以 0 结尾
+	if _, err = next(); err != nil {
+		return err
+	}
+	for i := int64(0); i < count+deleted; i++ {
+		flags, err := next()
+		if err != nil {
+			return err
+		}
+		msDiff, err := next()
+		if err != nil {
+			return err
+		}
+		seqDiff, err := next()
+		if err != nil {
+			return err
+		}
+		id := stream.ID{Ms: master.Ms + uint64(msDiff), Seq: master.Seq + uint64(seqDiff)}
+		var fields [][]byte
+		if flags&streamItemSameFields != 0 {
+			if cursor+len(masterFields) > len(elements) {
+				return errBadStream
+			}
+			for j, field := range masterFields {
+				fields = append(fields, field, elements[cursor+j])
+			}
+			cursor += len(masterFields)
+		} else {
+			n, err := next()
+			if err != nil || n < 0 || cursor+2*int(n) > len(elements) {
+				return errBadStream
+			}
+			fields = append(fields, elements[cursor:cursor+2*int(n)]...)
+			cursor += 2 * int(n)
+		}
+		// 条目占用的元素数，只用于从后向前遍历
+		if _, err = next(); err != nil {
+			return err
+		}
+		if flags&streamItemDeleted != 0 {
+			continue
+		}
+		if err = s.Append(id, fields); err != nil {
+			return err
+		}
+	}
+	if cursor != len(elements) {
+		return errBadStream
+	}
+	return nil
+}
+
+func (r *rdbValueReader) readStreamGroup(typ byte) (*stream.Group, error) {
+	name, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+	group := &stream.Group{Name: string(name)}
+	if group.LastID, err = r.readStreamID(); err != nil {
+		return nil, err
+	}
+	if typ != rdbTypeStream {
+		// entries_read
+		if _, err = r.readUint(); err != nil {
+			return nil, err
+		}
+	}
+	pendingCount, err := r.readUint()
+	if err != nil {
+		return nil, err
+	}
+	pending := make(map[stream.ID]*stream.PendingEntry, pendingCount)
+	for i := uint64(0); i < pendingCount; i++ {
+		entry := &stream.PendingEntry{}
+		if entry.ID, err = r.readRawStreamID(); err != nil {
+			return nil, err
+		}
+		if entry.DeliveryTime, err = r.readMillisecondTime(); err != nil {
+			return nil, err
+		}
+		if entry.DeliveryCount, err = r.readUint(); err != nil {
+			return nil, err
+		}
+		pending[entry.ID] = entry
+		group.Pending = append(group.Pending, entry)
+	}
+	consumers, err := r.readUint()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < consumers; i++ {
+		consumerName, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		consumer := &stream.Consumer{Name: string(consumerName)}
+		if consumer.SeenTime, err = r.readMillisecondTime(); err != nil {
+			return nil, err
+		}
+		if typ == rdbTypeStream3 {
+			// active_time
+			if _, err = r.readMillisecondTime(); err != nil {
+				return nil, err
+			}
+		}
+		// 消费者的待确认列表只有 ID，其它信息在消费组的列表中
+		count, err := r.readUint()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < count; j++ {
+			id, err := r.readRawStreamID()
+			if err != nil {
+				return nil, err
+			}
+			entry, ok := pending[id]
+			if !ok {
+				return nil, fmt.Errorf("pending entry %s of consumer %s is not in group %s", id, consumer.Name, group.Name)
+			}
+			entry.Consumer = consumer.Name
+		}
+		group.Consumers = append(group.Consumers, consumer)
+	}
+	sort.Slice(group.Pending, func(i, j int) bool {
+		return group.Pending[i].ID.Less(group.Pending[j].ID)
+	})
+	return group, nil
+}
+
+// dumpStream 使用 Redis 5 的 stream 格式编码，每个节点最多 streamNodeMaxEntries 个条目
+func dumpStream(s *stream.Stream) []byte {
+	var nodes [][]byte
+	var nodeKeys []stream.ID
+	var entries []*stream.Entry
+	s.ForEach(func(entry *stream.Entry) bool {
+		entries = append(entries, entry)
+		if len(entries) == streamNodeMaxEntries {
+			nodeKeys = append(nodeKeys, entries[0].ID)
+			nodes = append(nodes, buildStreamNode(entries))
+			entries = nil
+		}
+		return true
+	})
+	if len(entries) > 0 {
+		nodeKeys = append(nodeKeys, entries[0].ID)
+		nodes = append(nodes, buildStreamNode(entries))
+	}
+	res := appendRDBLength([]byte{rdbTypeStream}, uint64(len(nodes)))
+	for i, node := range nodes {
+		res = appendRDBString(res, appendRawStreamID(nil, nodeKeys[i]))
+		res = appendRDBString(res, node)
+	}
+	res = appendRDBLength(res, uint64(s.Len()))
+	res = appendRDBLength(appendRDBLength(res, s.LastID.Ms), s.LastID.Seq)
+	res = appendRDBLength(res, uint64(len(s.Groups)))
+	for _, group := range s.Groups {
+		res = appendRDBString(res, []byte(group.Name))
+		res = appendRDBLength(appendRDBLength(res, group.LastID.Ms), group.LastID.Seq)
+		res = appendRDBLength(res, uint64(len(group.Pending)))
+		for _, entry := range group.Pending {
+			res = appendRawStreamID(res, entry.ID)
+			res = binary.LittleEndian.AppendUint64(res, uint64(entry.DeliveryTime))
+			res = appendRDBLength(res, entry.DeliveryCount)
+		}
+		res = appendRDBLength(res, uint64(len(group.Consumers)))
+		for _, consumer := range group.Consumers {
+			res = appendRDBString(res, []byte(consumer.Name))
+			res = binary.LittleEndian.AppendUint64(res, uint64(consumer.SeenTime))
+			var ids []stream.ID
+			for _, entry := range group.Pending {
+				if entry.Consumer == consumer.Name {
+					ids = append(ids, entry.ID)
+				}
+			}
+			res = appendRDBLength(res, uint64(len(ids)))
+			for _, id := range ids {
+				res = appendRawStreamID(res, id)
+			}
+		}
+	}
+	return res
+}
+
+// buildStreamNode 以第一个条目为主条目编码一个节点，字段与主条目相同的条目只写入值
+func buildStreamNode(entries []*stream.Entry) []byte {
+	master := entries[0]
+	masterFields := make([][]byte, 0, len(master.Fields)/2)
+	for i := 0; i < len(master.Fields); i += 2 {
+		masterFields = append(masterFields, master.Fields[i])
+	}
+	itoa := func(n int) []byte {
+		return []byte(strconv.Itoa(n))
+	}
+	elements := [][]byte{itoa(len(entries)), itoa(0), itoa(len(masterFields))}
+	elements = append(elements, masterFields...)
+	elements = append(elements, itoa(0))
+	for _, entry := range entries {
+		numFields := len(entry.Fields) / 2
+		sameFields := numFields == len(masterFields)
+		for i := 0; sameFields && i < numFields; i++ {
+			sameFields = bytes.Equal(entry.Fields[2*i], masterFields[i])
+		}
+		flags := 0
+		if sameFields {
+			flags = streamItemSameFields
+		}
+		// 与 Redis 一样按 64 位整数保存差值，seq 小于主条目时依靠回绕得到原值
+		elements = append(elements, itoa(flags),
+			[]byte(strconv.FormatInt(int64(entry.ID.Ms-master.ID.Ms), 10)),
+			[]byte(strconv.FormatInt(int64(entry.ID.Seq-master.ID.Seq), 10)))
+		if sameFields {
+			for i := 0; i < numFields; i++ {
+				elements = append(elements, entry.Fields[2*i+1])
+			}
+			elements = append(elements, itoa(numFields+3))
+		} else {
+			elements = append(elements, itoa(numFields))
+			elements = append(elements, entry.Fields...)
+			elements = append(elements, itoa(2*numFields+4))
+		}
+	}
+	return buildListPack(elements)
+}
@@ -0,0 +1,150 @@
+package persistent
+
+import (
+	"encoding/binary"
+	"godis-learn/datastruct/set"
+	"godis-learn/datastruct/stream"
+	"godis-learn/interface/dbinterface"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func streamEntries(s *stream.Stream) []stream.Entry {
+	var res []stream.Entry
+	s.ForEach(func(entry *stream.Entry) bool {
+		res = append(res, *entry)
+		return true
+	})
+	return res
+}
+
+// dumpPayload 给对象加上 RDB 版本号和校验和
+func dumpPayload(object []byte, version uint16) []byte {
+	res := binary.LittleEndian.AppendUint16(append([]byte{}, object...), version)
+	return binary.LittleEndian.AppendUint64(res, CRC64(res))
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	s := stream.New()
+	for i := 0; i < 250; i++ {
+		fields := [][]byte{[]byte("name"), []byte("n" + strconv.Itoa(i)), []byte("count"), []byte(strconv.Itoa(i - 100))}
+		if i%7 == 0 {
+			fields = [][]byte{[]byte("other"), []byte("")}
+		}
+		// 毫秒时间戳增加时序号从 0 开始，节点中的 seq 差值为负数
+		id := stream.ID{Ms: 1700000000000 + uint64(i/3), Seq: uint64(i % 3)}
+		if err := s.Append(id, fields); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.LastID = stream.ID{Ms: 1800000000000, Seq: 5}
+	s.Groups = []*stream.Group{
+		{
+			Name:   "group",
+			LastID: stream.ID{Ms: 1700000000001, Seq: 1},
+			Pending: []*stream.PendingEntry{
+				{ID: stream.ID{Ms: 1700000000000, Seq: 1}, Consumer: "alice", DeliveryTime: 1700000000500, DeliveryCount: 2},
+				{ID: stream.ID{Ms: 1700000000001, Seq: 0}, Consumer: "bob", DeliveryTime: 1700000000600, DeliveryCount: 1},
+			},
+			Consumers: []*stream.Consumer{{Name: "alice", SeenTime: 1700000000500}, {Name: "bob", SeenTime: 1700000000600}},
+		},
+		{Name: "empty"},
+	}
+	dumped, err := DumpValue(&dbinterface.EntryValue{V: s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := RestoreValue(dumped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, ok := val.V.(*stream.Stream)
+	if !ok {
+		t.Fatalf("expected stream, got %T", val.V)
+	}
+	if !reflect.DeepEqual(streamEntries(restored), streamEntries(s)) {
+		t.Error("stream entries are not restored")
+	}
+	if restored.LastID != s.LastID {
+		t.Errorf("expected last id %s, got %s", s.LastID, restored.LastID)
+	}
+	if !reflect.DeepEqual(restored.Groups, s.Groups) {
+		t.Errorf("expected groups %+v, got %+v", s.Groups, restored.Groups)
+	}
+}
+
+// TestRestoreStream3 使用 Redis 7.2 的格式，包含已删除的条目、字段不同的条目以及 7.x 新增的字段
+func TestRestoreStream3(t *testing.T) {
+	master := stream.ID{Ms: 1000, Seq: 0}
+	lp := buildListPack([][]byte{
+		[]byte("2"), []byte("1"), []byte("1"), []byte("f"), []byte("0"),
+		// 1000-0 f=a
+		[]byte("2"), []byte("0"), []byte("0"), []byte("a"), []byte("4"),
+		// 1000-1 已删除
+		[]byte("3"), []byte("0"), []byte("1"), []byte("b"), []byte("4"),
+		// 1001-0 x=1 y=2
+		[]byte("0"), []byte("1"), []byte("0"), []byte("2"), []byte("x"), []byte("1"), []byte("y"), []byte("2"), []byte("8"),
+	})
+	object := appendRDBLength([]byte{rdbTypeStream3}, 1)
+	object = appendRDBString(object, appendRawStreamID(nil, master))
+	object = appendRDBString(object, lp)
+	object = appendRDBLength(object, 2)
+	// last_id、first_id、max_deleted_entry_id 与 entries_added
+	for _, n := range []uint64{1001, 0, 1000, 0, 1000, 1, 3} {
+		object = appendRDBLength(object, n)
+	}
+	object = appendRDBLength(object, 1)
+	object = appendRDBString(object, []byte("g"))
+	object = appendRDBLength(appendRDBLength(object, 1001), 0)
+	// entries_read 以及待确认条目的数量
+	object = appendRDBLength(object, 2)
+	object = appendRDBLength(object, 1)
+	object = appendRawStreamID(object, stream.ID{Ms: 1001, Seq: 0})
+	object = binary.LittleEndian.AppendUint64(object, 5000)
+	object = appendRDBLength(object, 3)
+	object = appendRDBLength(object, 1)
+	object = appendRDBString(object, []byte("c"))
+	// seen_time 与 active_time
+	object = binary.LittleEndian.AppendUint64(object, 6000)
+	object = binary.LittleEndian.AppendUint64(object, 5000)
+	object = appendRDBLength(object, 1)
+	object = appendRawStreamID(object, stream.ID{Ms: 1001, Seq: 0})
+
+	val, err := RestoreValue(dumpPayload(object, 11))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := val.V.(*stream.Stream)
+	expected := []stream.Entry{
+		{ID: stream.ID{Ms: 1000, Seq: 0}, Fields: [][]byte{[]byte("f"), []byte("a")}},
+		{ID: stream.ID{Ms: 1001, Seq: 0}, Fields: [][]byte{[]byte("x"), []byte("1"), []byte("y"), []byte("2")}},
+	}
+	if !reflect.DeepEqual(streamEntries(s), expected) {
+		t.Errorf("expected entries %v, got %v", expected, streamEntries(s))
+	}
+	group, ok := s.Group("g")
+	if !ok || len(group.Pending) != 1 || group.Pending[0].Consumer != "c" || group.Pending[0].DeliveryCount != 3 {
+		t.Errorf("unexpected group %+v", group)
+	}
+
+	// 消费者的待确认条目不在消费组中
+	object[len(object)-1] = 1
+	if _, err := RestoreValue(dumpPayload(object, 11)); err == nil {
+		t.Error("expected error for unknown pending entry")
+	}
+}
+
+func TestRestoreSetListPack(t *testing.T) {
+	object := appendRDBString([]byte{rdbTypeSetListPack}, buildListPack([][]byte{[]byte("a"), []byte("1"), []byte("b")}))
+	val, err := RestoreValue(dumpPayload(object, 11))
+	if err != nil {
+		t.Fatal(err)
+	}
+	members := val.V.(*set.HashSet).Members()
+	sort.Strings(members)
+	if !reflect.DeepEqual(members, []string{"1", "a", "b"}) {
+		t.Errorf("unexpected members %v", members)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"godis-learn/redis/protocol"
 	"net"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -16,12 +17,19 @@ import (
 )
 
 const (
-	chanSize = 256
-	timeout  = 3 * time.Second
-	running  = iota
+	chanSize       = 256
+	defaultTimeout = 3 * time.Second
+	running        = iota
 	closed
 )
 
+// 以下错误回复由客户端在连接出错时产生，而不是来自服务端
+const (
+	closedErr  = "client closed"
+	timeoutErr = "server time out"
+	failedErr  = "request failed"
+)
+
 type request struct {
 	id        uint64
 	line      redis.Line
@@ -29,8 +37,14 @@ type request struct {
 	heartbeat bool
 	waiting   *wait.Wait
 	err       error
+	// dbIndex 为请求需要的数据库，小于 0 时使用连接当前的数据库
+	dbIndex int
+	// selectFor 不为空时表示这是为 selectFor 自动发送的 SELECT
+	selectFor *request
+	selectErr redis.Reply
 }
 
+// Client 是流水线化的客户端，多个协程可以同时通过一个连接发送请求，回复按照发送顺序与请求对应
 type Client struct {
 	addr        string
 	conn        net.Conn
@@ -39,6 +53,12 @@ type Client struct {
 	ticker      *time.Ticker
 	status      int32
 	working     *sync.WaitGroup
+	// closing 保证 Close 之后不会再有请求写入 pendingChan
+	closing sync.RWMutex
+	// selected 为连接当前选中的数据库，只在写协程中修改，SELECT 失败时置为 -1
+	selected int32
+	// timeout 为等待每个请求回复的最长时间
+	timeout time.Duration
 }
 
 func NewClient(addr string) (*Client, error) {
@@ -46,13 +66,39 @@ func NewClient(addr string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
+	return newClient(addr, conn, defaultTimeout), nil
+}
+
+// NewClientWithTimeout 在 timeout 内建立连接，之后每个请求等待回复的时间也不超过 timeout
+func NewClientWithTimeout(addr string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(addr, conn, timeout), nil
+}
+
+func newClient(addr string, conn net.Conn, timeout time.Duration) *Client {
 	return &Client{
 		addr:        addr,
 		conn:        conn,
 		pendingChan: make(chan *request, chanSize),
 		waitingChan: make(chan *request, chanSize),
 		working:     &sync.WaitGroup{},
-	}, nil
+		timeout:     timeout,
+	}
+}
+
+// IsConnectionError 判断错误是否来自连接本身，而不是服务端执行命令出错
+func IsConnectionError(reply redis.Reply) bool {
+	if !protocol.CheckErrorReply(reply) {
+		return false
+	}
+	switch reply.(redis.ErrorReply).Error() {
+	case closedErr, timeoutErr, failedErr:
+		return true
+	}
+	return false
 }
 
 func (c *Client) Start() {
@@ -64,33 +110,54 @@ func (c *Client) Start() {
 }
 
 func (c *Client) Close() {
+	c.closing.Lock()
+	if atomic.LoadInt32(&c.status) == closed {
+		c.closing.Unlock()
+		return
+	}
 	atomic.StoreInt32(&c.status, closed)
 	c.ticker.Stop()
 	close(c.pendingChan)
+	c.closing.Unlock()
 	c.working.Wait()
 	_ = c.conn.Close()
 	close(c.waitingChan)
 }
 
 func (c *Client) Send(line redis.Line) redis.Reply {
-	if atomic.LoadInt32(&c.status) != running {
-		return protocol.NewErrorReply([]byte("client closed"))
-	}
+	return c.SendToDB(-1, line)
+}
+
+// SendToDB 在指定的数据库上执行命令，需要时会在命令之前自动发送 SELECT，
+// dbIndex 小于 0 时使用连接当前的数据库
+func (c *Client) SendToDB(dbIndex int, line redis.Line) redis.Reply {
+	return c.SendToDBWithTimeout(dbIndex, line, c.timeout)
+}
+
+// SendToDBWithTimeout 与 SendToDB 相同，但最多等待 timeout，用于执行时间较长的命令
+func (c *Client) SendToDBWithTimeout(dbIndex int, line redis.Line, timeout time.Duration) redis.Reply {
 	req := &request{
 		line:      line,
 		heartbeat: false,
 		waiting:   &wait.Wait{},
+		dbIndex:   dbIndex,
+	}
+	c.closing.RLock()
+	if atomic.LoadInt32(&c.status) != running {
+		c.closing.RUnlock()
+		return protocol.NewErrorReply([]byte(closedErr))
 	}
 	req.waiting.Add(1)
 	c.working.Add(1)
 	defer c.working.Done()
 	c.pendingChan <- req
+	c.closing.RUnlock()
 	checkTimeout := req.waiting.WaitWithTimeout(timeout)
 	if checkTimeout {
-		return protocol.NewErrorReply([]byte("server time out"))
+		return protocol.NewErrorReply([]byte(timeoutErr))
 	}
 	if req.err != nil {
-		return protocol.NewErrorReply([]byte("request failed"))
+		return protocol.NewErrorReply([]byte(failedErr))
 	}
 	return req.reply
 }
@@ -127,20 +194,36 @@ func (c *Client) doHeartbeat() {
 		line:      redis.Line{[]byte("PING")},
 		heartbeat: true,
 		waiting:   &wait.Wait{},
+		dbIndex:   -1,
+	}
+	c.closing.RLock()
+	if atomic.LoadInt32(&c.status) != running {
+		c.closing.RUnlock()
+		return
 	}
 	req.waiting.Add(1)
 	c.working.Add(1)
 	defer c.working.Done()
 	c.pendingChan <- req
-	req.waiting.WaitWithTimeout(timeout)
+	c.closing.RUnlock()
+	req.waiting.WaitWithTimeout(c.timeout)
 }
 
 func (c *Client) doRequest(req *request) {
 	if req == nil || len(req.line) == 0 {
 		return
 	}
-	reply := protocol.ArrayReply(req.line)
-	bytes := reply.GetBytes()
+	bytes := protocol.ArrayReply(req.line).GetBytes()
+	var selectReq *request
+	if req.dbIndex >= 0 && int32(req.dbIndex) != atomic.LoadInt32(&c.selected) {
+		// SELECT 与命令一起写入，SELECT 的回复由 finishRequest 丢弃
+		selectReq = &request{
+			line:      redis.Line{[]byte("SELECT"), []byte(strconv.Itoa(req.dbIndex))},
+			selectFor: req,
+		}
+		bytes = append(protocol.ArrayReply(selectReq.line).GetBytes(), bytes...)
+		atomic.StoreInt32(&c.selected, int32(req.dbIndex))
+	}
 	var err error
 	for i := 0; i < 3; i++ {
 		_, err = c.conn.Write(bytes)
@@ -153,9 +236,15 @@ func (c *Client) doRequest(req *request) {
 		}
 	}
 	if err != nil {
+		if selectReq != nil {
+			atomic.StoreInt32(&c.selected, -1)
+		}
 		req.err = err
 		req.waiting.Done()
 	} else {
+		if selectReq != nil {
+			c.waitingChan <- selectReq
+		}
 		c.waitingChan <- req
 	}
 }
@@ -171,6 +260,17 @@ func (c *Client) finishRequest(reply redis.Reply) {
 	if req == nil {
 		return
 	}
+	if req.selectFor != nil {
+		if protocol.CheckErrorReply(reply) {
+			atomic.StoreInt32(&c.selected, -1)
+			req.selectFor.selectErr = reply
+		}
+		return
+	}
+	if req.selectErr != nil {
+		// SELECT 失败时命令执行在了错误的数据库上，把 SELECT 的错误返回给调用方
+		reply = req.selectErr
+	}
 	req.reply = reply
 	if req.waiting != nil {
 		req.waiting.Done()
@@ -194,8 +294,13 @@ func (c *Client) reconnect() {
 		c.Close()
 		return
 	}
+	// 新连接默认使用 0 号数据库
+	atomic.StoreInt32(&c.selected, 0)
 	close(c.waitingChan)
 	for req := range c.waitingChan {
+		if req.waiting == nil {
+			continue
+		}
 		req.err = errors.New("connection closed")
 		req.waiting.Done()
 	}
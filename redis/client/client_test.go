@@ -0,0 +1,84 @@
+package client
+
+import (
+	"godis-learn/lib/utils"
+	"godis-learn/redis/parse"
+	"godis-learn/redis/protocol"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// serveFakeRedis 只支持 SELECT 和 GET，GET 返回当前数据库编号和键名，用于检查回复是否与请求对应
+func serveFakeRedis(t *testing.T) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer func() {
+					_ = conn.Close()
+				}()
+				db := "0"
+				for payload := range parse.StartParseStream(conn) {
+					if payload.Err != nil {
+						return
+					}
+					args, _ := protocol.FetchArrayArgs(payload.Data)
+					var reply []byte
+					switch strings.ToLower(string(args[0])) {
+					case "select":
+						db = string(args[1])
+						reply = protocol.OkReply().GetBytes()
+					case "get":
+						reply = protocol.BulkStringReply([]byte(db + ":" + string(args[1]))).GetBytes()
+					default:
+						reply = protocol.PongReply().GetBytes()
+					}
+					if _, err := conn.Write(reply); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String(), func() {
+		_ = listener.Close()
+	}
+}
+
+func TestSendToDBConcurrently(t *testing.T) {
+	addr, stop := serveFakeRedis(t)
+	defer stop()
+	cli, err := NewClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Start()
+	defer cli.Close()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				db := (i + j) % 4
+				key := "key" + strconv.Itoa(i) + "-" + strconv.Itoa(j)
+				value, _ := protocol.FetchBulkString(cli.SendToDB(db, utils.StringsToLine("GET", key)))
+				if expected := strconv.Itoa(db) + ":" + key; string(value) != expected {
+					t.Errorf("expected %s, got %s", expected, value)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -1,6 +1,7 @@
 package connection
 
 import (
+	"errors"
 	"godis-learn/interface/redis"
 	"godis-learn/lib/sync/wait"
 	"net"
@@ -18,6 +19,8 @@ type ClientConn struct {
 	waitingReply  wait.Wait
 	mutex         sync.Mutex
 	subsMap       map[string]bool
+	psubsMap      map[string]bool
+	ssubsMap      map[string]bool
 	password      string
 	handlingMulti bool
 	queue         []redis.Line
@@ -25,31 +28,150 @@ type ClientConn struct {
 	txErrors      []error
 	selectedIndex int
 	role          int32
+	asking        bool
+	// 回复先放入输出队列，由 writeLoop 异步写入，慢客户端不会阻塞调用 Write 的协程
+	outMutex  sync.Mutex
+	outCond   *sync.Cond
+	outQueue  [][]byte
+	outBytes  int64
+	softSince time.Time
+	closed    bool
+	writing   bool
 }
 
+var errClosed = errors.New("connection closed")
+
 func NewClientConn(conn net.Conn) *ClientConn {
-	return &ClientConn{conn: conn}
+	c := &ClientConn{conn: conn, closed: conn == nil}
+	c.outCond = sync.NewCond(&c.outMutex)
+	return c
 }
 
 func (c *ClientConn) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
+// Close 等待输出队列写完后关闭连接，最多等待 10 秒
 func (c *ClientConn) Close() error {
 	c.waitingReply.WaitWithTimeout(10 * time.Second)
+	c.outMutex.Lock()
+	if c.conn == nil {
+		c.outMutex.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.outCond.Broadcast()
+	c.outMutex.Unlock()
 	return c.conn.Close()
 }
 
+// Write 把 s 放入输出队列，缓冲区超过 client-output-buffer-limit 时断开连接并返回错误
 func (c *ClientConn) Write(s []byte) error {
 	if len(s) == 0 {
 		return nil
 	}
+	limit := outputBufferLimits()[c.limitClass()]
+	c.outMutex.Lock()
+	defer c.outMutex.Unlock()
+	if c.closed {
+		return errClosed
+	}
+	if c.overLimit(limit, c.outBytes+int64(len(s))) {
+		c.disconnect()
+		return errors.New("output buffer limit exceeded")
+	}
+	if !c.writing {
+		// 只有需要写出回复时才启动写协程
+		c.writing = true
+		go c.writeLoop()
+	}
 	c.waitingReply.Add(1)
-	defer func(c *ClientConn) {
+	c.outQueue = append(c.outQueue, s)
+	c.outBytes += int64(len(s))
+	c.outCond.Signal()
+	return nil
+}
+
+// OutputBufferSize 返回输出队列中尚未写出的字节数
+func (c *ClientConn) OutputBufferSize() int64 {
+	c.outMutex.Lock()
+	defer c.outMutex.Unlock()
+	return c.outBytes
+}
+
+// limitClass 返回连接适用的输出缓冲区限制类别
+func (c *ClientConn) limitClass() int {
+	if c.GetRole() == ReplicationClient {
+		return replicaClass
+	}
+	if c.SubscriberCount()+c.ShardSubscriberCount() > 0 {
+		return pubsubClass
+	}
+	return normalClass
+}
+
+// overLimit 判断缓冲区中有 used 字节时是否超过限制，开始超过软限制时安排一次检查，
+// writeLoop 阻塞在写入上并且没有新的回复时也能按时断开连接。调用者需要持有 outMutex
+func (c *ClientConn) overLimit(limit OutputBufferLimit, used int64) bool {
+	softStarted := !c.softSince.IsZero()
+	if limit.exceeded(used, &c.softSince, time.Now()) {
+		return true
+	}
+	if !softStarted && !c.softSince.IsZero() {
+		time.AfterFunc(time.Duration(limit.SoftSeconds)*time.Second, c.checkSoftLimit)
+	}
+	return false
+}
+
+// checkSoftLimit 在软限制持续的时间到达后检查缓冲区，缓冲区仍然超过软限制时断开连接
+func (c *ClientConn) checkSoftLimit() {
+	limit := outputBufferLimits()[c.limitClass()]
+	c.outMutex.Lock()
+	defer c.outMutex.Unlock()
+	if c.closed || c.softSince.IsZero() {
+		return
+	}
+	if c.overLimit(limit, c.outBytes) {
+		c.disconnect()
+	}
+}
+
+// disconnect 丢弃队列中的回复并立即关闭连接，调用者需要持有 outMutex
+func (c *ClientConn) disconnect() {
+	c.closed = true
+	for _, s := range c.outQueue {
+		c.outBytes -= int64(len(s))
 		c.waitingReply.Done()
-	}(c)
-	_, err := c.conn.Write(s)
-	return err
+	}
+	c.outQueue = nil
+	c.outCond.Broadcast()
+	_ = c.conn.Close()
+}
+
+func (c *ClientConn) writeLoop() {
+	for {
+		c.outMutex.Lock()
+		for len(c.outQueue) == 0 && !c.closed {
+			c.outCond.Wait()
+		}
+		if len(c.outQueue) == 0 {
+			c.outMutex.Unlock()
+			return
+		}
+		s := c.outQueue[0]
+		c.outQueue = c.outQueue[1:]
+		c.outMutex.Unlock()
+		_, err := c.conn.Write(s)
+		limit := outputBufferLimits()[c.limitClass()]
+		c.outMutex.Lock()
+		c.outBytes -= int64(len(s))
+		c.waitingReply.Done()
+		// 写出之后重新检查，缓冲区降到软限制以下时重新计时
+		if !c.closed && (err != nil || c.overLimit(limit, c.outBytes)) {
+			c.disconnect()
+		}
+		c.outMutex.Unlock()
+	}
 }
 
 func (c *ClientConn) SetPassword(password string) {
@@ -72,24 +194,73 @@ func (c *ClientConn) Subscribe(channel string) {
 func (c *ClientConn) Unsubscribe(channel string) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	if c.SubscriberCount() > 0 {
-		delete(c.subsMap, channel)
+	delete(c.subsMap, channel)
+}
+
+func (c *ClientConn) PSubscribe(pattern string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.psubsMap == nil {
+		c.psubsMap = make(map[string]bool)
+	}
+	c.psubsMap[pattern] = true
+}
+
+func (c *ClientConn) PUnsubscribe(pattern string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.psubsMap, pattern)
+}
+
+func (c *ClientConn) SSubscribe(channel string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.ssubsMap == nil {
+		c.ssubsMap = make(map[string]bool)
 	}
+	c.ssubsMap[channel] = true
+}
+
+func (c *ClientConn) SUnsubscribe(channel string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.ssubsMap, channel)
 }
 
 func (c *ClientConn) SubscriberCount() int {
-	return len(c.subsMap)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.subsMap) + len(c.psubsMap)
+}
+
+func (c *ClientConn) ShardSubscriberCount() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.ssubsMap)
 }
 
 func (c *ClientConn) GetChannels() []string {
-	if c.subsMap == nil {
-		return make([]string, 0)
-	}
-	res := make([]string, c.SubscriberCount())
-	i := 0
-	for channel := range c.subsMap {
-		res[i] = channel
-		i++
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return mapKeys(c.subsMap)
+}
+
+func (c *ClientConn) GetPatterns() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return mapKeys(c.psubsMap)
+}
+
+func (c *ClientConn) GetShardChannels() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return mapKeys(c.ssubsMap)
+}
+
+func mapKeys(m map[string]bool) []string {
+	res := make([]string, 0, len(m))
+	for key := range m {
+		res = append(res, key)
 	}
 	return res
 }
@@ -151,3 +322,11 @@ func (c *ClientConn) GetRole() int32 {
 	}
 	return c.role
 }
+
+func (c *ClientConn) SetAsking(asking bool) {
+	c.asking = asking
+}
+
+func (c *ClientConn) CheckAsking() bool {
+	return c.asking
+}
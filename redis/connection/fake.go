@@ -2,11 +2,11 @@ package connection
 
 import (
 	"bytes"
-	"godis-learn/interface/redis"
 )
 
+// FakeConn 把回复记录在内存中，其余方法使用 ClientConn 的默认实现
 type FakeConn struct {
-	redis.Connection
+	ClientConn
 	buf bytes.Buffer
 }
 
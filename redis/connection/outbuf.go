@@ -0,0 +1,112 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"godis-learn/config"
+	"godis-learn/lib/logger"
+	"godis-learn/lib/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 输出缓冲区限制的类别
+const (
+	normalClass = iota
+	replicaClass
+	pubsubClass
+	classCount
+)
+
+var classNames = map[string]int{
+	"normal":  normalClass,
+	"replica": replicaClass,
+	"slave":   replicaClass,
+	"pubsub":  pubsubClass,
+}
+
+// OutputBufferLimit 描述一类连接的输出缓冲区限制，0 表示不限制
+type OutputBufferLimit struct {
+	HardBytes int64
+	SoftBytes int64
+	// SoftSeconds 缓冲区持续超过软限制这么久之后断开连接
+	SoftSeconds int64
+}
+
+var defaultOutputBufferLimits = [classCount]OutputBufferLimit{
+	normalClass:  {},
+	replicaClass: {HardBytes: 256 << 20, SoftBytes: 64 << 20, SoftSeconds: 60},
+	pubsubClass:  {HardBytes: 32 << 20, SoftBytes: 8 << 20, SoftSeconds: 60},
+}
+
+// ParseOutputBufferLimits 解析 client-output-buffer-limit，未出现的类别保留默认值
+func ParseOutputBufferLimits(s string) ([classCount]OutputBufferLimit, error) {
+	limits := defaultOutputBufferLimits
+	fields := strings.Fields(s)
+	if len(fields)%4 != 0 {
+		return limits, errors.New("wrong number of arguments")
+	}
+	for i := 0; i < len(fields); i += 4 {
+		class, ok := classNames[strings.ToLower(fields[i])]
+		if !ok {
+			return limits, fmt.Errorf("invalid client class '%s'", fields[i])
+		}
+		hard, err := utils.ParseMemory(fields[i+1])
+		if err != nil {
+			return limits, err
+		}
+		soft, err := utils.ParseMemory(fields[i+2])
+		if err != nil {
+			return limits, err
+		}
+		seconds, err := strconv.ParseInt(fields[i+3], 10, 64)
+		if err != nil || seconds < 0 {
+			return limits, fmt.Errorf("invalid soft limit seconds '%s'", fields[i+3])
+		}
+		limits[class] = OutputBufferLimit{HardBytes: hard, SoftBytes: soft, SoftSeconds: seconds}
+	}
+	return limits, nil
+}
+
+var limitCache struct {
+	sync.Mutex
+	raw    string
+	limits [classCount]OutputBufferLimit
+	parsed bool
+}
+
+// outputBufferLimits 返回当前配置的限制，配置没有变化时不重复解析
+func outputBufferLimits() [classCount]OutputBufferLimit {
+	raw := config.Properties.ClientOutputBufferLimit
+	limitCache.Lock()
+	defer limitCache.Unlock()
+	if !limitCache.parsed || limitCache.raw != raw {
+		limits, err := ParseOutputBufferLimits(raw)
+		if err != nil {
+			logger.Warn("client-output-buffer-limit: " + err.Error())
+			limits = defaultOutputBufferLimits
+		}
+		limitCache.raw = raw
+		limitCache.limits = limits
+		limitCache.parsed = true
+	}
+	return limitCache.limits
+}
+
+// exceeded 判断缓冲区中有 used 字节时是否需要断开连接，softSince 记录开始超过软限制的时间
+func (l OutputBufferLimit) exceeded(used int64, softSince *time.Time, now time.Time) bool {
+	if l.HardBytes > 0 && used >= l.HardBytes {
+		return true
+	}
+	if l.SoftBytes == 0 || used < l.SoftBytes {
+		*softSince = time.Time{}
+		return false
+	}
+	if softSince.IsZero() {
+		*softSince = now
+		return false
+	}
+	return now.Sub(*softSince) >= time.Duration(l.SoftSeconds)*time.Second
+}
@@ -0,0 +1,86 @@
+package connection
+
+import (
+	"godis-learn/config"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseOutputBufferLimits(t *testing.T) {
+	limits, err := ParseOutputBufferLimits("normal 1kb 1k 5 pubsub 2mb 1mb 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (OutputBufferLimit{HardBytes: 1024, SoftBytes: 1000, SoftSeconds: 5}); limits[normalClass] != expected {
+		t.Errorf("unexpected normal limit %+v", limits[normalClass])
+	}
+	if expected := (OutputBufferLimit{HardBytes: 2 << 20, SoftBytes: 1 << 20, SoftSeconds: 10}); limits[pubsubClass] != expected {
+		t.Errorf("unexpected pubsub limit %+v", limits[pubsubClass])
+	}
+	if limits[replicaClass] != defaultOutputBufferLimits[replicaClass] {
+		t.Errorf("expected default replica limit, got %+v", limits[replicaClass])
+	}
+	for _, s := range []string{"pubsub 1mb 1mb", "other 0 0 0", "normal 1xb 0 0", "normal 0 0 -1"} {
+		if _, err := ParseOutputBufferLimits(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
+
+func TestSlowSubscriberDisconnected(t *testing.T) {
+	config.Properties.ClientOutputBufferLimit = "pubsub 100 0 0"
+	defer func() {
+		config.Properties.ClientOutputBufferLimit = ""
+	}()
+	server, client := net.Pipe()
+	conn := NewClientConn(server)
+	conn.Subscribe("news")
+	message := make([]byte, 60)
+	// 客户端不读取数据，Write 也不应该被阻塞
+	done := make(chan error, 2)
+	go func() {
+		done <- conn.Write(message)
+		done <- conn.Write(message)
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if i == 1 && err == nil {
+				t.Error("expected output buffer limit error")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("write blocked by slow subscriber")
+		}
+	}
+	if err := conn.Write(message); err == nil {
+		t.Error("expected write on disconnected connection to fail")
+	}
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAll(client); err != nil {
+		t.Errorf("expected connection to be closed, got %v", err)
+	}
+}
+
+func TestSoftLimitWithoutWrites(t *testing.T) {
+	config.Properties.ClientOutputBufferLimit = "pubsub 0 100 1"
+	defer func() {
+		config.Properties.ClientOutputBufferLimit = ""
+	}()
+	server, client := net.Pipe()
+	conn := NewClientConn(server)
+	conn.Subscribe("news")
+	// 超过软限制之后不再写入，writeLoop 阻塞在写入上，连接也应该在软限制的时间到达后被断开
+	if err := conn.Write(make([]byte, 150)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if conn.OutputBufferSize() != 0 {
+		t.Error("expected output buffer to be dropped")
+	}
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAll(client); err != nil {
+		t.Errorf("expected connection to be closed, got %v", err)
+	}
+}
@@ -155,7 +155,7 @@ func parseArray(header []byte, reader *bufio.Reader, ch chan<- *Payload) error {
 			protocolError(ch, header)
 			break
 		} else if strLen == -1 {
-			lines = append(lines, []byte{})
+			lines = append(lines, nil)
 		} else {
 			body := make([]byte, strLen+2)
 			_, err := io.ReadFull(reader, body)
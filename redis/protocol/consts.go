@@ -223,5 +223,8 @@ func FetchReplies(r redis.Reply) (replies []redis.Reply, ok bool) {
 }
 
 func convertArg(arg []byte) []byte {
+	if arg == nil {
+		return nullBulkBytes
+	}
 	return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg))
 }
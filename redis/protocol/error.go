@@ -20,3 +20,19 @@ func (r *argumentCountErrorReply) Error() string {
 func ArgumentCountErrorReply(cmd []byte) redis.ErrorReply {
 	return &argumentCountErrorReply{cmd: cmd}
 }
+
+type wrongTypeErrorReply struct{}
+
+var wrongTypeErrBytes = []byte("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
+
+func (r *wrongTypeErrorReply) GetBytes() []byte {
+	return wrongTypeErrBytes
+}
+
+func (r *wrongTypeErrorReply) Error() string {
+	return "WRONGTYPE Operation against a key holding the wrong kind of value"
+}
+
+func WrongTypeErrorReply() redis.ErrorReply {
+	return &wrongTypeErrorReply{}
+}